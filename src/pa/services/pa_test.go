@@ -58,6 +58,26 @@ func (c *fakePbClient) RegisterDevice(ctx context.Context, request *pbr.DeviceRe
 	return c.registerDevice.response, c.registerDevice.err
 }
 
+func (c *fakePbClient) BatchRegisterDevices(ctx context.Context, request *pbr.BatchDeviceRegistrationRequest, opts ...grpc.CallOption) (*pbr.BatchDeviceRegistrationResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "BatchRegisterDevices is not implemented")
+}
+
+func (c *fakePbClient) GetDevice(ctx context.Context, request *pbr.GetDeviceRequest, opts ...grpc.CallOption) (*pbr.GetDeviceResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "GetDevice is not implemented")
+}
+
+func (c *fakePbClient) ListDevices(ctx context.Context, request *pbr.ListDevicesRequest, opts ...grpc.CallOption) (*pbr.ListDevicesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "ListDevices is not implemented")
+}
+
+func (c *fakePbClient) DeleteDevice(ctx context.Context, request *pbr.DeleteDeviceRequest, opts ...grpc.CallOption) (*pbr.DeleteDeviceResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "DeleteDevice is not implemented")
+}
+
+func (c *fakePbClient) DeepHealthCheck(ctx context.Context, request *pbr.DeepHealthCheckRequest, opts ...grpc.CallOption) (*pbr.DeepHealthCheckResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "DeepHealthCheck is not implemented")
+}
+
 // fakeSpmClient provides a fake client interface to the SPM server. Test
 // cases can set the fake responses as part of the test setup.
 type fakeSpmClient struct {
@@ -40,6 +40,7 @@ func (s *Session) GenerateAES(keyBitLen uint, opts *KeyOptions) (SecretKey, erro
 		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, opts.Extractable),
 		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, opts.Token),
 		pkcs11.NewAttribute(pkcs11.CKA_WRAP, true),
+		pkcs11.NewAttribute(pkcs11.CKA_UNWRAP, true),
 		pkcs11.NewAttribute(pkcs11.CKA_ENCRYPT, true),
 		pkcs11.NewAttribute(pkcs11.CKA_DECRYPT, true),
 	}
@@ -198,3 +199,32 @@ func (k SecretKey) WrapAESGCM(key Key) (ciphertext, actualIV []byte, err error)
 
 	return cipher, iv, nil
 }
+
+// UnwrapAESKWP unwraps a generic secret key wrapped with AES-KWP using the
+// given wrapping key.
+//
+// This operation can be quite slow, so it is recommended to call it from another
+// goroutine.
+func (s *Session) UnwrapAESKWP(wrapped []byte, wk SecretKey, opts *KeyOptions) (SecretKey, error) {
+	if opts == nil {
+		opts = &KeyOptions{}
+	}
+
+	tpl := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_GENERIC_SECRET),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, opts.Sensitive),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, opts.Extractable),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, opts.Token),
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_DERIVE, true),
+	}
+	s.tok.m.appendAttrKeyID(&tpl)
+
+	mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_AES_KEY_WRAP_PAD, nil)}
+	k, err := s.tok.m.Raw().UnwrapKey(s.raw, mech, wk.raw, wrapped, tpl)
+	if err != nil {
+		return SecretKey{}, newError(err, "could not perform unwrapping operation")
+	}
+	return SecretKey{object{s, k}}, nil
+}
@@ -27,8 +27,8 @@ func oid(c elliptic.Curve) ([]byte, error) {
 		// ascii2der <<< "OBJECT_IDENTIFIER { 1.3.132.0.34 }" | xxd -i
 		return []byte{0x06, 0x05, 0x2b, 0x81, 0x04, 0x00, 0x22}, nil
 	case "P-521":
-		// ascii2der <<< "OBJECT_IDENTIFIER { 1.2.840.10045.4.3.4 }" | xxd -i
-		return []byte{0x06, 0x08, 0x2a, 0x86, 0x48, 0xce, 0x3d, 0x04, 0x03, 0x04}, nil
+		// ascii2der <<< "OBJECT_IDENTIFIER { 1.3.132.0.35 }" | xxd -i
+		return []byte{0x06, 0x05, 0x2b, 0x81, 0x04, 0x00, 0x23}, nil
 	default:
 		return nil, fmt.Errorf("unsupported curve: %s", c.Params().Name)
 	}
@@ -37,7 +37,7 @@ func oid(c elliptic.Curve) ([]byte, error) {
 var oid2Curve = map[string]elliptic.Curve{
 	string([]byte{0x06, 0x08, 0x2a, 0x86, 0x48, 0xce, 0x3d, 0x03, 0x01, 0x07}): elliptic.P256(),
 	string([]byte{0x06, 0x05, 0x2b, 0x81, 0x04, 0x00, 0x22}):                   elliptic.P384(),
-	string([]byte{0x06, 0x08, 0x2a, 0x86, 0x48, 0xce, 0x3d, 0x07, 0x03, 0x04}): elliptic.P521(),
+	string([]byte{0x06, 0x05, 0x2b, 0x81, 0x04, 0x00, 0x23}):                   elliptic.P521(),
 }
 
 // GenerateECDSA generates an ECDSA signing keypair on the specified curve.
@@ -64,6 +64,7 @@ func (s *Session) GenerateECDSA(curve elliptic.Curve, opts *KeyOptions) (KeyPair
 	privTpl := []*pkcs11.Attribute{
 		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_EC),
 		pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_DERIVE, opts.Derive),
 		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, opts.Sensitive),
 		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, opts.Extractable),
 		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, opts.Token),
@@ -102,6 +103,7 @@ func (s *Session) importECDSAPrivate(key *ecdsa.PrivateKey, opts *KeyOptions) (P
 		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
 		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_EC),
 		pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_DERIVE, opts.Derive),
 		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, !opts.Extractable),
 		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, opts.Extractable),
 		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, opts.Token),
@@ -203,6 +205,8 @@ func (s ECDSASigner) Public() crypto.PublicKey {
 //
 //	signature ::= SEQUENCE { r INTEGER; s INTEGER; }
 //
+// The signature is normalized to low-S form, see `LowS`.
+//
 // This is part of interface crypto.Signer.
 func (s ECDSASigner) Sign(ignored io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
 	rb, sb, err := s.PrivateKey.SignECDSAPreHashed(digest)
@@ -214,10 +218,88 @@ func (s ECDSASigner) Sign(ignored io.Reader, digest []byte, opts crypto.SignerOp
 	sig.R, sig.S = new(big.Int), new(big.Int)
 	sig.R.SetBytes(rb)
 	sig.S.SetBytes(sb)
+	LowS(s.PublicKey.Curve, sig.S)
 
 	return asn1.Marshal(sig)
 }
 
+// LowS normalizes the `s` scalar of an ECDSA signature on `curve` to its low
+// form, replacing it with N-s if it is greater than N/2, where N is the order
+// of the curve. Both forms verify, but some verifiers only accept the low one.
+func LowS(curve elliptic.Curve, s *big.Int) {
+	n := curve.Params().N
+	if s.Cmp(new(big.Int).Rsh(n, 1)) > 0 {
+		s.Sub(n, s)
+	}
+}
+
+// Curve returns the named curve of this ECDSA private key.
+func (k PrivateKey) Curve() (elliptic.Curve, error) {
+	oid, err := k.Attr(pkcs11.CKA_EC_PARAMS)
+	if err != nil {
+		return nil, newError(err, "could not retrieve curve parameters")
+	}
+	curve, ok := oid2Curve[string(oid)]
+	if !ok {
+		return nil, fmt.Errorf("unknown curve OID: %v", oid)
+	}
+	return curve, nil
+}
+
+// DeriveECDH derives an AES key from the ECDH shared secret of this private
+// key and the `peer` public key, using CKM_ECDH1_DERIVE with the CKD_NULL key
+// derivation function. The shared secret does not leave the HSM unless
+// `opts` makes the derived key extractable.
+//
+// The AES key is the x-coordinate of the shared point, so only curves whose
+// field size is a valid AES key size, such as P-256, are supported. The
+// private key must have been created with `KeyOptions.Derive` set.
+//
+// This operation can be quite slow, so it is recommended to call it from another
+// goroutine.
+func (k PrivateKey) DeriveECDH(peer *ecdsa.PublicKey, opts *KeyOptions) (SecretKey, error) {
+	if opts == nil {
+		opts = &KeyOptions{}
+	}
+
+	curve, err := k.Curve()
+	if err != nil {
+		return SecretKey{}, err
+	}
+	if peer.Curve.Params().Name != curve.Params().Name {
+		return SecretKey{}, fmt.Errorf("peer key curve %s does not match private key curve %s",
+			peer.Curve.Params().Name, curve.Params().Name)
+	}
+	keyLen := uint(curve.Params().BitSize+7) / 8
+	if keyLen != 16 && keyLen != 24 && keyLen != 32 {
+		return SecretKey{}, fmt.Errorf("unsupported curve for AES key derivation: %s", curve.Params().Name)
+	}
+
+	params := pkcs11.NewECDH1DeriveParams(pkcs11.CKD_NULL, nil, elliptic.Marshal(peer.Curve, peer.X, peer.Y))
+	mech := pkcs11.NewMechanism(pkcs11.CKM_ECDH1_DERIVE, params)
+
+	tpl := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_AES),
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE_LEN, keyLen),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, opts.Sensitive),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, opts.Extractable),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, opts.Token),
+		pkcs11.NewAttribute(pkcs11.CKA_WRAP, true),
+		pkcs11.NewAttribute(pkcs11.CKA_UNWRAP, true),
+		pkcs11.NewAttribute(pkcs11.CKA_ENCRYPT, true),
+		pkcs11.NewAttribute(pkcs11.CKA_DECRYPT, true),
+	}
+	k.sess.tok.m.appendAttrKeyID(&tpl)
+
+	d, err := k.sess.tok.m.Raw().DeriveKey(k.sess.raw, []*pkcs11.Mechanism{mech}, k.raw, tpl)
+	if err != nil {
+		return SecretKey{}, newError(err, "could not derive key")
+	}
+
+	return SecretKey{object{k.sess, d}}, nil
+}
+
 func (o object) exportECDSAPublic() (*ecdsa.PublicKey, error) {
 	attrs, err := o.Attrs(pkcs11.CKA_EC_PARAMS, pkcs11.CKA_EC_POINT)
 	if err != nil {
@@ -5,9 +5,11 @@
 package test
 
 import (
+	"bytes"
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
+	crand "crypto/rand"
 	"fmt"
 	"math/big"
 	"math/rand"
@@ -23,6 +25,8 @@ func TestECDSA(t *testing.T) {
 		hash  crypto.Hash
 	}{
 		{elliptic.P256(), crypto.SHA256},
+		{elliptic.P384(), crypto.SHA384},
+		{elliptic.P521(), crypto.SHA512},
 	}
 
 	s := ts.GetSession(t)
@@ -34,6 +38,12 @@ func TestECDSA(t *testing.T) {
 			kp, err := s.GenerateECDSA(test.curve, nil)
 			ts.Check(t, err)
 
+			curve, err := kp.PrivateKey.Curve()
+			ts.Check(t, err)
+			if curve != test.curve {
+				t.Errorf("Curve() = %s, want %s", curve.Params().Name, test.curve.Params().Name)
+			}
+
 			var r, s big.Int
 			rBytes, sBytes, err := kp.SignECDSA(test.hash, []byte(name))
 			ts.Check(t, err)
@@ -157,3 +167,62 @@ func TestECDSALookup(t *testing.T) {
 		})
 	}
 }
+
+func TestDeriveECDH(t *testing.T) {
+	s := ts.GetSession(t)
+	ts.Check(t, s.Login(pk11.NormalUser, ts.UserPin))
+
+	kp, err := s.GenerateECDSA(elliptic.P256(), &pk11.KeyOptions{Derive: true})
+	ts.Check(t, err)
+	pubIface, err := kp.PublicKey.ExportKey()
+	ts.Check(t, err)
+	pub := pubIface.(*ecdsa.PublicKey)
+
+	// This does not need to be secure randomness.
+	rand := rand.New(rand.NewSource(0))
+	peer, err := ecdsa.GenerateKey(elliptic.P256(), rand)
+	ts.Check(t, err)
+
+	k, err := kp.PrivateKey.DeriveECDH(&peer.PublicKey, &pk11.KeyOptions{Extractable: true})
+	ts.Check(t, err)
+	kIface, err := k.ExportKey()
+	ts.Check(t, err)
+
+	x, _ := elliptic.P256().ScalarMult(pub.X, pub.Y, peer.D.Bytes())
+	want := x.FillBytes(make([]byte, 32))
+	if got := kIface.(pk11.AESKey); !bytes.Equal(got, want) {
+		t.Errorf("DeriveECDH() = %x, want %x", []byte(got), want)
+	}
+
+	other, err := ecdsa.GenerateKey(elliptic.P384(), rand)
+	ts.Check(t, err)
+	if _, err := kp.PrivateKey.DeriveECDH(&other.PublicKey, nil); err == nil {
+		t.Error("DeriveECDH() succeeded with a P-384 peer key, want error")
+	}
+}
+
+func TestLowS(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	ts.Check(t, err)
+	hash := ts.MakeHash(crypto.SHA256, []byte("low-S"))
+	halfN := new(big.Int).Rsh(elliptic.P256().Params().N, 1)
+
+	// Half of the signatures are high-S, so one is expected well within the
+	// attempts.
+	for i := 0; i < 64; i++ {
+		r, s, err := ecdsa.Sign(crand.Reader, key, hash)
+		ts.Check(t, err)
+		if s.Cmp(halfN) <= 0 {
+			continue
+		}
+		pk11.LowS(elliptic.P256(), s)
+		if s.Cmp(halfN) > 0 {
+			t.Fatal("LowS() did not normalize a high-S signature")
+		}
+		if !ecdsa.Verify(&key.PublicKey, hash, r, s) {
+			t.Fatal("normalized signature does not verify")
+		}
+		return
+	}
+	t.Fatal("no high-S signature observed")
+}
@@ -0,0 +1,113 @@
+// Copyright lowRISC contributors (OpenTitan project).
+// Licensed under the Apache License, Version 2.0, see LICENSE for details.
+// SPDX-License-Identifier: Apache-2.0
+
+package pk11
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/asn1"
+	"fmt"
+
+	"github.com/miekg/pkcs11"
+)
+
+// Edwards curve key type and mechanisms. These were introduced in PKCS#11
+// v3.0 and are not defined by the pkcs11 package.
+const (
+	CKK_EC_EDWARDS              = 0x00000040
+	CKM_EC_EDWARDS_KEY_PAIR_GEN = 0x00001055
+	CKM_EDDSA                   = 0x00001057
+)
+
+// oidEd25519 is the DER encoded Ed25519 curve OID.
+//
+// ascii2der <<< "OBJECT_IDENTIFIER { 1.3.101.112 }" | xxd -i
+var oidEd25519 = []byte{0x06, 0x03, 0x2b, 0x65, 0x70}
+
+// GenerateEd25519 generates an Ed25519 signing keypair.
+//
+// This operation can be quite slow, so it is recommended to call it from another
+// goroutine.
+func (s *Session) GenerateEd25519(opts *KeyOptions) (KeyPair, error) {
+	if opts == nil {
+		opts = &KeyOptions{}
+	}
+
+	mech := pkcs11.NewMechanism(CKM_EC_EDWARDS_KEY_PAIR_GEN, nil)
+	pubTpl := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, oidEd25519),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, CKK_EC_EDWARDS),
+		pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, opts.Token),
+	}
+	privTpl := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, CKK_EC_EDWARDS),
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, opts.Sensitive),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, opts.Extractable),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, opts.Token),
+	}
+
+	s.tok.m.appendAttrKeyID(&pubTpl, &privTpl)
+
+	kpu, kpr, err := s.tok.m.Raw().GenerateKeyPair(
+		s.raw,
+		[]*pkcs11.Mechanism{mech},
+		pubTpl,
+		privTpl,
+	)
+	if err != nil {
+		return KeyPair{}, newError(err, "could not generate keys")
+	}
+
+	return KeyPair{PublicKey{object{s, kpu}}, PrivateKey{object{s, kpr}}}, nil
+}
+
+// SignEd25519 creates a new pure Ed25519 signature of `message` using this
+// object as the private key.
+//
+// Unlike ECDSA, the message is not hashed by the caller; Ed25519 hashes it
+// internally as part of the signature.
+func (k PrivateKey) SignEd25519(message []byte) ([]byte, error) {
+	mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(CKM_EDDSA, nil)}
+	if err := k.sess.tok.m.Raw().SignInit(k.sess.raw, mech, k.raw); err != nil {
+		return nil, newError(err, "could not begin signing operation")
+	}
+
+	sig, err := k.sess.tok.m.Raw().Sign(k.sess.raw, message)
+	if err != nil {
+		return nil, newError(err, "could not complete signing operation")
+	}
+	if len(sig) != ed25519.SignatureSize {
+		return nil, fmt.Errorf("unexpected Ed25519 signature size: %d", len(sig))
+	}
+	return sig, nil
+}
+
+func (o object) exportEd25519Public() (ed25519.PublicKey, error) {
+	attrs, err := o.Attrs(pkcs11.CKA_EC_PARAMS, pkcs11.CKA_EC_POINT)
+	if err != nil {
+		return nil, newError(err, "could not retrieve public key contents")
+	}
+	oid, qDer := attrs[0].Value, attrs[1].Value
+
+	if !bytes.Equal(oid, oidEd25519) {
+		return nil, fmt.Errorf("unknown Edwards curve OID: %v", oid)
+	}
+
+	// CKA_EC_POINT should be a DER encoded OCTET STRING, but some tokens
+	// return the raw point instead.
+	q := qDer
+	if len(qDer) != ed25519.PublicKeySize {
+		if _, err := asn1.Unmarshal(qDer, &q); err != nil {
+			return nil, newError(err, "could not parse curve point")
+		}
+	}
+	if len(q) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("unexpected Ed25519 public key size: %d", len(q))
+	}
+
+	return ed25519.PublicKey(q), nil
+}
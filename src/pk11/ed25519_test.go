@@ -0,0 +1,39 @@
+// Copyright lowRISC contributors (OpenTitan project).
+// Licensed under the Apache License, Version 2.0, see LICENSE for details.
+// SPDX-License-Identifier: Apache-2.0
+
+package test
+
+import (
+	"crypto/ed25519"
+	"testing"
+
+	"github.com/lowRISC/opentitan-provisioning/src/pk11"
+	ts "github.com/lowRISC/opentitan-provisioning/src/pk11/test_support"
+)
+
+func TestEd25519(t *testing.T) {
+	s := ts.GetSession(t)
+	ts.Check(t, s.Login(pk11.NormalUser, ts.UserPin))
+
+	kp, err := s.GenerateEd25519(nil)
+	ts.Check(t, err)
+
+	message := []byte("Ed25519")
+	sig, err := kp.SignEd25519(message)
+	ts.Check(t, err)
+
+	pub, err := kp.PublicKey.ExportKey()
+	ts.Check(t, err)
+
+	edPub, ok := pub.(ed25519.PublicKey)
+	if !ok {
+		t.Fatalf("expected ed25519.PublicKey, got %T", pub)
+	}
+	if !ed25519.Verify(edPub, message, sig) {
+		t.Fatal("verification failed")
+	}
+	if ed25519.Verify(edPub, []byte("tampered"), sig) {
+		t.Fatal("verification of a different message succeeded")
+	}
+}
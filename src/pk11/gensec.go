@@ -5,6 +5,7 @@
 package pk11
 
 import (
+	"crypto"
 	"fmt"
 
 	"github.com/miekg/pkcs11"
@@ -59,7 +60,37 @@ func (s *Session) Generate(keyBitLen uint, opts *KeyOptions) (SecretKey, error)
 // This operation can be quite slow, so it is recommended to call it from another
 // goroutine.
 func (k *SecretKey) SignHMAC256(raw []byte) ([]byte, error) {
-	mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_SHA256_HMAC, nil)}
+	return k.SignHMAC(crypto.SHA256, raw)
+}
+
+// hmacMechanisms maps the hashes supported by `SignHMAC` to their HMAC
+// mechanism.
+var hmacMechanisms = map[crypto.Hash]uint{
+	crypto.SHA256: pkcs11.CKM_SHA256_HMAC,
+	crypto.SHA384: pkcs11.CKM_SHA384_HMAC,
+	crypto.SHA512: pkcs11.CKM_SHA512_HMAC,
+}
+
+// HMACMechanism returns the CKM_*_HMAC mechanism using hash `h`.
+func HMACMechanism(h crypto.Hash) (uint, error) {
+	mech, ok := hmacMechanisms[h]
+	if !ok {
+		return 0, fmt.Errorf("unsupported HMAC hash: %v", h)
+	}
+	return mech, nil
+}
+
+// SignHMAC signs the given data with the key using HMAC with hash `h`, which
+// must be one of SHA-256, SHA-384 or SHA-512.
+//
+// This operation can be quite slow, so it is recommended to call it from another
+// goroutine.
+func (k *SecretKey) SignHMAC(h crypto.Hash, raw []byte) ([]byte, error) {
+	m, err := HMACMechanism(h)
+	if err != nil {
+		return nil, err
+	}
+	mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(m, nil)}
 	if err := k.sess.tok.m.Raw().SignInit(k.sess.raw, mech, k.raw); err != nil {
 		return nil, newError(err, "could not begin signing operation")
 	}
@@ -0,0 +1,87 @@
+// Copyright lowRISC contributors (OpenTitan project).
+// Licensed under the Apache License, Version 2.0, see LICENSE for details.
+// SPDX-License-Identifier: Apache-2.0
+
+package pk11
+
+import (
+	"fmt"
+
+	"github.com/miekg/pkcs11"
+)
+
+// CKM_HKDF_DERIVE was introduced in PKCS#11 v3.0 and is not defined by the
+// pkcs11 package.
+const CKM_HKDF_DERIVE = 0x0000402A
+
+// mechanismNames maps the mechanisms used by the provisioning services to their
+// PKCS#11 names.
+var mechanismNames = map[uint]string{
+	pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN:  "CKM_RSA_PKCS_KEY_PAIR_GEN",
+	pkcs11.CKM_RSA_PKCS:               "CKM_RSA_PKCS",
+	pkcs11.CKM_RSA_PKCS_OAEP:          "CKM_RSA_PKCS_OAEP",
+	pkcs11.CKM_RSA_PKCS_PSS:           "CKM_RSA_PKCS_PSS",
+	pkcs11.CKM_SHA256:                 "CKM_SHA256",
+	pkcs11.CKM_SHA384:                 "CKM_SHA384",
+	pkcs11.CKM_SHA512:                 "CKM_SHA512",
+	pkcs11.CKM_SHA256_HMAC:            "CKM_SHA256_HMAC",
+	pkcs11.CKM_SHA384_HMAC:            "CKM_SHA384_HMAC",
+	pkcs11.CKM_SHA512_HMAC:            "CKM_SHA512_HMAC",
+	pkcs11.CKM_GENERIC_SECRET_KEY_GEN: "CKM_GENERIC_SECRET_KEY_GEN",
+	pkcs11.CKM_EC_KEY_PAIR_GEN:        "CKM_EC_KEY_PAIR_GEN",
+	pkcs11.CKM_ECDSA:                  "CKM_ECDSA",
+	pkcs11.CKM_ECDH1_DERIVE:           "CKM_ECDH1_DERIVE",
+	CKM_EC_EDWARDS_KEY_PAIR_GEN:       "CKM_EC_EDWARDS_KEY_PAIR_GEN",
+	CKM_EDDSA:                         "CKM_EDDSA",
+	pkcs11.CKM_AES_KEY_GEN:            "CKM_AES_KEY_GEN",
+	pkcs11.CKM_AES_GCM:                "CKM_AES_GCM",
+	pkcs11.CKM_AES_KEY_WRAP:           "CKM_AES_KEY_WRAP",
+	pkcs11.CKM_AES_KEY_WRAP_PAD:       "CKM_AES_KEY_WRAP_PAD",
+	CKM_HKDF_DERIVE:                   "CKM_HKDF_DERIVE",
+}
+
+// MechanismName returns the PKCS#11 name of mechanism `mech`, or its hex value
+// if the name is not known.
+func MechanismName(mech uint) string {
+	if name, ok := mechanismNames[mech]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%08x", mech)
+}
+
+// MechanismInfo describes a mechanism supported by a token.
+type MechanismInfo struct {
+	// Mechanism is the CKM_* mechanism type.
+	Mechanism uint
+	// MinKeySize and MaxKeySize are the supported key size range. Units are
+	// mechanism dependent.
+	MinKeySize, MaxKeySize uint
+	// Flags is the CKF_* bitmask of supported operations.
+	Flags uint
+}
+
+// Mechanisms returns the mechanisms supported by the token the session is
+// opened on.
+func (s *Session) Mechanisms() ([]MechanismInfo, error) {
+	raw := s.tok.m.Raw()
+	mechs, err := raw.GetMechanismList(s.tok.slot)
+	if err != nil {
+		return nil, newError(err, "could not list mechanisms on slot %d", s.tok.slot)
+	}
+
+	infos := make([]MechanismInfo, 0, len(mechs))
+	for i, mech := range mechs {
+		// GetMechanismInfo ignores all but the first slice element.
+		info, err := raw.GetMechanismInfo(s.tok.slot, mechs[i:])
+		if err != nil {
+			return nil, newError(err, "could not get info for mechanism %s", MechanismName(mech.Mechanism))
+		}
+		infos = append(infos, MechanismInfo{
+			Mechanism:  mech.Mechanism,
+			MinKeySize: info.MinKeySize,
+			MaxKeySize: info.MaxKeySize,
+			Flags:      info.Flags,
+		})
+	}
+	return infos, nil
+}
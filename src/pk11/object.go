@@ -8,6 +8,8 @@ import (
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/rsa"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"reflect"
 
@@ -22,6 +24,15 @@ var (
 	ClassSecretKey  = pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY)
 )
 
+var (
+	// ErrObjectNotFound is returned, possibly wrapped, when no object
+	// matches a UID or label lookup.
+	ErrObjectNotFound = errors.New("could not find object")
+	// ErrMultipleObjects is returned, possibly wrapped, when several objects
+	// match a lookup expecting a unique object.
+	ErrMultipleObjects = errors.New("found multiple objects")
+)
+
 // UID creates a new Attribute representing a particular UID value.
 func UID(uid []byte) *pkcs11.Attribute {
 	return pkcs11.NewAttribute(pkcs11.CKA_ID, uid)
@@ -49,6 +60,8 @@ type KeyOptions struct {
 	Encryption bool
 	// Set to true to allow the key to be used for wrapping/unwrapping other keys.
 	Wrapping bool
+	// Set to true to allow the key to be used for key derivation, e.g. ECDH.
+	Derive bool
 }
 
 // KeyPair is the result of a key generation operation.
@@ -71,6 +84,11 @@ type Object interface {
 	// Int retrieves a single attribute from an object and interprets it as an
 	// integer.
 	Int(typ uint) (uint, error)
+	// Bool retrieves a single attribute from an object and interprets it as a
+	// boolean.
+	Bool(typ uint) (bool, error)
+	// IsToken returns true if the object is a token object.
+	IsToken() (bool, error)
 	// Destroy destroys an object, which will be unusable after it returns
 	// successfully.
 	Destroy() error
@@ -158,11 +176,11 @@ func (s *Session) findUnique(class *pkcs11.Attribute, uid []byte) (object, error
 
 	switch len(objs) {
 	case 0:
-		return object{}, fmt.Errorf("could not find object with UID %v", uid)
+		return object{}, fmt.Errorf("%w with UID %v", ErrObjectNotFound, uid)
 	case 1:
 		return objs[0], nil
 	default:
-		return object{}, fmt.Errorf("found multiple objects with UID %v", uid)
+		return object{}, fmt.Errorf("%w with UID %v", ErrMultipleObjects, uid)
 	}
 }
 
@@ -178,11 +196,11 @@ func (s *Session) findUniqueByLabel(class *pkcs11.Attribute, label string) (obje
 
 	switch len(objs) {
 	case 0:
-		return object{}, fmt.Errorf("could not find object with LABEL %q", label)
+		return object{}, fmt.Errorf("%w with LABEL %q", ErrObjectNotFound, label)
 	case 1:
 		return objs[0], nil
 	default:
-		return object{}, fmt.Errorf("found multiple objects with LABEL %q", label)
+		return object{}, fmt.Errorf("%w with LABEL %q", ErrMultipleObjects, label)
 	}
 }
 
@@ -204,6 +222,16 @@ func (s *Session) FindKeyByLabel(classKey ClassAttribute, label string) (object,
 	return o, err
 }
 
+// HasKeyWithLabel reports whether at least one key object of class
+// `classKey` has the given label.
+func (s *Session) HasKeyWithLabel(classKey ClassAttribute, label string) (bool, error) {
+	objs, err := s.find(classKey, Label(label))
+	if err != nil {
+		return false, err
+	}
+	return len(objs) > 0, nil
+}
+
 // FindSecretKey finds the unique symmetric key object with the given UID.
 func (s *Session) FindSecretKey(uid []byte) (SecretKey, error) {
 	o, err := s.findUnique(ClassSecretKey, uid)
@@ -301,6 +329,28 @@ func (o object) Int(typ uint) (uint, error) {
 	return bytes2uint(attr), nil
 }
 
+// Bool retrieves a single attribute from an object and interprets it as a
+// boolean.
+func (o object) Bool(typ uint) (bool, error) {
+	attr, err := o.Attr(typ)
+	if err != nil {
+		return false, err
+	}
+
+	return bytes2uint(attr) != 0, nil
+}
+
+// IsToken returns true if the object is a token object, i.e. it persists
+// across sessions.
+func (o object) IsToken() (bool, error) {
+	return o.Bool(pkcs11.CKA_TOKEN)
+}
+
+// CanWrap returns true if the key can be used to wrap other keys.
+func (k PublicKey) CanWrap() (bool, error) {
+	return k.Bool(pkcs11.CKA_WRAP)
+}
+
 // Destroy destroys an object, which will be unusable after it returns successfully.
 func (o object) Destroy() error {
 	if err := o.sess.tok.m.Raw().DestroyObject(o.sess.raw, o.raw); err != nil {
@@ -368,6 +418,7 @@ func (s *Session) ImportKey(key any, opts *KeyOptions) (Key, error) {
 //
 // The type of the returned object depends on the type of key being exported:
 // - ECDSA keys are *ecdsa.PublicKey.
+// - Ed25519 keys are ed25519.PublicKey.
 // - RSA keys are *rsa.PublicKey.
 func (k PublicKey) ExportKey() (any, error) {
 	kType, err := k.Int(pkcs11.CKA_KEY_TYPE)
@@ -382,6 +433,9 @@ func (k PublicKey) ExportKey() (any, error) {
 	case pkcs11.CKK_ECDSA:
 		// Defined in ecdsa.go
 		return k.exportECDSAPublic()
+	case CKK_EC_EDWARDS:
+		// Defined in ed25519.go
+		return k.exportEd25519Public()
 	default:
 		return nil, fmt.Errorf("cannot parse key: type %x", kType)
 	}
@@ -442,6 +496,25 @@ func (k PrivateKey) FindPublicKey() (PublicKey, error) {
 	return k.Session().FindPublicKey(uid)
 }
 
+// Algorithm returns the public key algorithm of this private key.
+func (k PrivateKey) Algorithm() (x509.PublicKeyAlgorithm, error) {
+	kType, err := k.Int(pkcs11.CKA_KEY_TYPE)
+	if err != nil {
+		return x509.UnknownPublicKeyAlgorithm, err
+	}
+
+	switch kType {
+	case pkcs11.CKK_RSA:
+		return x509.RSA, nil
+	case pkcs11.CKK_ECDSA:
+		return x509.ECDSA, nil
+	case CKK_EC_EDWARDS:
+		return x509.Ed25519, nil
+	default:
+		return x509.UnknownPublicKeyAlgorithm, fmt.Errorf("not a known private key type: %x", kType)
+	}
+}
+
 // Signer creates a crypto.Signer wrapping this private key.
 func (k PrivateKey) Signer() (crypto.Signer, error) {
 	kType, err := k.Int(pkcs11.CKA_KEY_TYPE)
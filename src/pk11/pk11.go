@@ -8,8 +8,10 @@ package pk11
 
 import (
 	"crypto"
+	"errors"
 	"fmt"
 	"math/rand"
+	"strings"
 	"sync"
 	"time"
 
@@ -38,6 +40,23 @@ func newError(raw error, fmtStr string, args ...any) error {
 	return fmt.Errorf("%s: %s", ctx, raw)
 }
 
+// IsSessionLost reports whether `err` is a PKCS#11 error indicating that the
+// session is no longer usable, e.g. because the HSM restarted or the
+// connection to a network HSM dropped. Such sessions must be replaced.
+func IsSessionLost(err error) bool {
+	var e Error
+	if !errors.As(err, &e) {
+		return false
+	}
+	switch e.Raw {
+	case pkcs11.CKR_SESSION_HANDLE_INVALID, pkcs11.CKR_SESSION_CLOSED,
+		pkcs11.CKR_DEVICE_ERROR, pkcs11.CKR_DEVICE_REMOVED,
+		pkcs11.CKR_TOKEN_NOT_PRESENT:
+		return true
+	}
+	return false
+}
+
 // Error converts this error into a user-displayable string.
 func (e Error) Error() string {
 	if e.ctx == "" {
@@ -84,6 +103,19 @@ func (m *Mod) Raw() *pkcs11.Ctx {
 	return m.ctx
 }
 
+// Close finalizes the module and unloads the plugin. The module must not be
+// used afterwards.
+//
+// Finalizing closes all sessions opened through the plugin, including those of
+// other `Mod` instances loaded from the same plugin.
+func (m *Mod) Close() error {
+	if err := m.ctx.Finalize(); err != nil && err.(pkcs11.Error) != pkcs11.CKR_CRYPTOKI_NOT_INITIALIZED {
+		return newError(err, "could not finalize module")
+	}
+	m.ctx.Destroy()
+	return nil
+}
+
 // Tokens returns a slice containing each token the PKCS#11 module can currently
 // see; PKCS#11 slots without tokens in them are inaccessible.
 func (m *Mod) Tokens() ([]Token, error) {
@@ -136,6 +168,35 @@ type Token struct {
 	slot uint
 }
 
+// Slot returns the PKCS#11 slot ID of the token.
+func (t Token) Slot() uint {
+	return t.slot
+}
+
+// Label returns the label of the token, without the padding spaces.
+func (t Token) Label() (string, error) {
+	info, err := t.m.Raw().GetTokenInfo(t.slot)
+	if err != nil {
+		return "", newError(err, "could not get info of token on slot %d", t.slot)
+	}
+	return strings.TrimRight(info.Label, " \x00"), nil
+}
+
+// MaxSessions returns the maximum number of sessions that can be opened on
+// the token at once, as reported by C_GetTokenInfo. Returns zero if the token
+// does not report a limit.
+func (t Token) MaxSessions() (uint, error) {
+	info, err := t.m.Raw().GetTokenInfo(t.slot)
+	if err != nil {
+		return 0, newError(err, "could not get info of token on slot %d", t.slot)
+	}
+	if info.MaxSessionCount == pkcs11.CK_UNAVAILABLE_INFORMATION {
+		return 0, nil
+	}
+	// CK_EFFECTIVELY_INFINITE is also zero.
+	return info.MaxSessionCount, nil
+}
+
 // OpenSession opens a read-write session on a token.
 func (t Token) OpenSession() (*Session, error) {
 	sess, err := t.m.Raw().OpenSession(t.slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
@@ -146,6 +207,17 @@ func (t Token) OpenSession() (*Session, error) {
 	return &Session{t, sess}, nil
 }
 
+// OpenReadOnlySession opens a read-only session with this token. Token objects
+// cannot be created, modified or destroyed through a read-only session.
+func (t Token) OpenReadOnlySession() (*Session, error) {
+	sess, err := t.m.Raw().OpenSession(t.slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return nil, newError(err, "could not open read-only session on slot %d", t.slot)
+	}
+
+	return &Session{t, sess}, nil
+}
+
 // UserType is a type of user that can log into a token.
 type UserType int
 
@@ -207,6 +279,36 @@ func (s *Session) Logout() {
 	}
 }
 
+// Token returns the token the session is opened on.
+func (s *Session) Token() Token {
+	return s.tok
+}
+
+// Close closes the session. The session must not be used afterwards.
+//
+// Closing a session that was already closed, e.g. by finalizing the module,
+// is not an error.
+func (s *Session) Close() error {
+	err := s.tok.m.Raw().CloseSession(s.raw)
+	if err == nil {
+		return nil
+	}
+	switch err.(pkcs11.Error) {
+	case pkcs11.CKR_SESSION_HANDLE_INVALID, pkcs11.CKR_SESSION_CLOSED, pkcs11.CKR_CRYPTOKI_NOT_INITIALIZED:
+		return nil
+	}
+	return newError(err, "could not close session on slot %d", s.tok.slot)
+}
+
+// Ping checks that the session is still valid. It does not use any key
+// material.
+func (s *Session) Ping() error {
+	if _, err := s.tok.m.Raw().GetSessionInfo(s.raw); err != nil {
+		return newError(err, "could not get info of session on slot %d", s.tok.slot)
+	}
+	return nil
+}
+
 // DestroyKeyPairObject removes object from the current session.
 func (s *Session) DestroyKeyPairObject(kp KeyPair) error {
 	privateKeyObj := kp.PrivateKey
@@ -7,6 +7,8 @@ package test
 import (
 	"testing"
 
+	"github.com/miekg/pkcs11"
+
 	"github.com/lowRISC/opentitan-provisioning/src/pk11"
 	ts "github.com/lowRISC/opentitan-provisioning/src/pk11/test_support"
 )
@@ -20,3 +22,55 @@ func TestSOLogin(t *testing.T) {
 	s := ts.GetSession(t)
 	ts.Check(t, s.Login(pk11.SecurityOfficerUser, ts.SecOffPin))
 }
+
+func TestMechanisms(t *testing.T) {
+	s := ts.GetSession(t)
+	mechs, err := s.Mechanisms()
+	ts.Check(t, err)
+
+	found := false
+	for _, m := range mechs {
+		if m.Mechanism == pkcs11.CKM_ECDSA {
+			found = true
+			if m.Flags&pkcs11.CKF_SIGN == 0 {
+				t.Errorf("CKM_ECDSA does not support signing, flags: 0x%x", m.Flags)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("CKM_ECDSA not found in %d mechanisms", len(mechs))
+	}
+
+	if got, want := pk11.MechanismName(pkcs11.CKM_AES_GCM), "CKM_AES_GCM"; got != want {
+		t.Errorf("MechanismName() = %q, want %q", got, want)
+	}
+	if got, want := pk11.MechanismName(0x80000001), "0x80000001"; got != want {
+		t.Errorf("MechanismName() = %q, want %q", got, want)
+	}
+}
+
+func TestTokenMaxSessions(t *testing.T) {
+	s := ts.GetSession(t)
+	n, err := s.Token().MaxSessions()
+	ts.Check(t, err)
+	if n == pkcs11.CK_UNAVAILABLE_INFORMATION {
+		t.Errorf("MaxSessions() = 0x%x, want a session count", n)
+	}
+}
+
+func TestSessionLost(t *testing.T) {
+	s := ts.GetSession(t)
+	ts.Check(t, s.Ping())
+	ts.Check(t, s.Close())
+
+	err := s.Ping()
+	if err == nil {
+		t.Fatal("Ping() on a closed session succeeded")
+	}
+	if !pk11.IsSessionLost(err) {
+		t.Errorf("IsSessionLost(%v) = false, want true", err)
+	}
+	if pk11.IsSessionLost(pk11.Error{Raw: pkcs11.CKR_PIN_INCORRECT}) {
+		t.Errorf("IsSessionLost(CKR_PIN_INCORRECT) = true, want false")
+	}
+}
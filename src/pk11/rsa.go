@@ -241,6 +241,74 @@ func (k PrivateKey) SignRSAPSSPreHashed(opts *rsa.PSSOptions, hashed []byte) ([]
 	return data, nil
 }
 
+// oaepMechanism returns an RSA-OAEP mechanism using `hash` for both the
+// label digest and MGF1.
+func oaepMechanism(hash crypto.Hash) ([]*pkcs11.Mechanism, error) {
+	var hashMech, mgfMech uint
+	switch hash {
+	case crypto.SHA256:
+		hashMech = pkcs11.CKM_SHA256
+		mgfMech = pkcs11.CKG_MGF1_SHA256
+	case crypto.SHA384:
+		hashMech = pkcs11.CKM_SHA384
+		mgfMech = pkcs11.CKG_MGF1_SHA384
+	case crypto.SHA512:
+		hashMech = pkcs11.CKM_SHA512
+		mgfMech = pkcs11.CKG_MGF1_SHA512
+	default:
+		return nil, fmt.Errorf("unknown hash function: %s", hash)
+	}
+	return []*pkcs11.Mechanism{
+		pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_OAEP,
+			pkcs11.NewOAEPParams(hashMech, mgfMech, pkcs11.CKZ_DATA_SPECIFIED, nil),
+		),
+	}, nil
+}
+
+// EncryptRSAOAEP encrypts `plaintext` with RSA-OAEP, using this object as the
+// public key. `hash` is used for both the label digest and MGF1; the label is
+// empty.
+//
+// This operation can be quite slow, so it is recommended to call it from another
+// goroutine.
+func (k PublicKey) EncryptRSAOAEP(hash crypto.Hash, plaintext []byte) ([]byte, error) {
+	mech, err := oaepMechanism(hash)
+	if err != nil {
+		return nil, err
+	}
+	if err := k.sess.tok.m.Raw().EncryptInit(k.sess.raw, mech, k.raw); err != nil {
+		return nil, newError(err, "could not begin encryption operation")
+	}
+
+	ciph, err := k.sess.tok.m.Raw().Encrypt(k.sess.raw, plaintext)
+	if err != nil {
+		return nil, newError(err, "could not perform encryption operation")
+	}
+	return ciph, nil
+}
+
+// DecryptRSAOAEP decrypts `ciphertext` with RSA-OAEP, using this object as the
+// private key. `hash` is used for both the label digest and MGF1; the label is
+// empty.
+//
+// This operation can be quite slow, so it is recommended to call it from another
+// goroutine.
+func (k PrivateKey) DecryptRSAOAEP(hash crypto.Hash, ciphertext []byte) ([]byte, error) {
+	mech, err := oaepMechanism(hash)
+	if err != nil {
+		return nil, err
+	}
+	if err := k.sess.tok.m.Raw().DecryptInit(k.sess.raw, mech, k.raw); err != nil {
+		return nil, newError(err, "could not begin decryption operation")
+	}
+
+	plain, err := k.sess.tok.m.Raw().Decrypt(k.sess.raw, ciphertext)
+	if err != nil {
+		return nil, newError(err, "could not perform decryption operation")
+	}
+	return plain, nil
+}
+
 // RSASigner is a crypto.Signer backed by a PrivateKey.
 type RSASigner struct {
 	// The public key, which may not actually live on the device itself.
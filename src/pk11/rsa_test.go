@@ -5,7 +5,9 @@
 package test
 
 import (
+	"bytes"
 	"crypto"
+	crand "crypto/rand"
 	"crypto/rsa"
 	"fmt"
 	"math/rand"
@@ -207,3 +209,37 @@ func TestRSALookup(t *testing.T) {
 		})
 	}
 }
+
+func TestRSAOAEP(t *testing.T) {
+	s := ts.GetSession(t)
+	ts.Check(t, s.Login(pk11.NormalUser, ts.UserPin))
+
+	kp, err := s.GenerateRSA(2048, 0x010001, &pk11.KeyOptions{Encryption: true})
+	ts.Check(t, err)
+
+	pub, err := kp.PublicKey.ExportKey()
+	ts.Check(t, err)
+	pubkey := pub.(*rsa.PublicKey)
+
+	msg := []byte("session key material")
+	for _, h := range []crypto.Hash{crypto.SHA256, crypto.SHA384, crypto.SHA512} {
+		t.Run(h.String(), func(t *testing.T) {
+			ciph, err := kp.PublicKey.EncryptRSAOAEP(h, msg)
+			ts.Check(t, err)
+			plain, err := kp.PrivateKey.DecryptRSAOAEP(h, ciph)
+			ts.Check(t, err)
+			if !bytes.Equal(plain, msg) {
+				t.Errorf("DecryptRSAOAEP() = %x, want %x", plain, msg)
+			}
+
+			// Check interoperability with the Go implementation.
+			ciph, err = rsa.EncryptOAEP(h.New(), crand.Reader, pubkey, msg, nil)
+			ts.Check(t, err)
+			plain, err = kp.PrivateKey.DecryptRSAOAEP(h, ciph)
+			ts.Check(t, err)
+			if !bytes.Equal(plain, msg) {
+				t.Errorf("DecryptRSAOAEP() = %x, want %x", plain, msg)
+			}
+		})
+	}
+}
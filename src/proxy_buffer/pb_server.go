@@ -9,12 +9,17 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"net"
+	"os"
+	"strings"
+	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/reflection"
 
 	pbp "github.com/lowRISC/opentitan-provisioning/src/proxy_buffer/proto/proxy_buffer_go_pb"
 	"github.com/lowRISC/opentitan-provisioning/src/proxy_buffer/services/proxybuffer"
@@ -26,12 +31,54 @@ import (
 var (
 	port        = flag.Int("port", 0, "the port to bind the server on; required")
 	dbPath      = flag.String("db_path", "", "the path to the database file")
+	dbCodec     = flag.String("db_codec", "proto", "the serialization format of new database records; one of: proto, json")
 	enableTLS   = flag.Bool("enable_tls", false, "Enable mTLS secure channel; optional")
 	serviceKey  = flag.String("service_key", "", "File path to the PEM encoding of the server's private key")
 	serviceCert = flag.String("service_cert", "", "File path to the PEM encoding of the server's certificate chain")
 	caRootCerts = flag.String("ca_root_certs", "", "File path to the PEM encoding of the CA root certificates")
+	verifySig   = flag.Bool("verify_device_signature", false, "Reject registration requests without a valid device signature; optional")
+	deviceRoots = flag.String("device_cert_roots", "", "File path to the PEM encoding of the trusted device certificate roots; required by `verify_device_signature`")
+	deepHealth  = flag.Bool("enable_deep_health_check", false, "Enable the DeepHealthCheck RPC, which inserts synthetic device records; optional")
+
+	dbSecretProvider = flag.String("db_secret_provider", "", "Secrets manager holding the database connection string, overriding `db_path`; one of: env, aws, gcp; optional")
+	dbSecretName     = flag.String("db_secret_name", "", "Name of the database connection string secret")
+	dbSecretRefresh  = flag.Duration("db_secret_refresh_interval", 15*time.Minute, "Interval between database credential refreshes; zero disables refreshing")
+	awsRegion        = flag.String("aws_region", "", "AWS region of the Secrets Manager; required by the aws secret provider")
+	gcpProject       = flag.String("gcp_project", "", "GCP project of the Secret Manager; required by the gcp secret provider")
+
+	forwardedMaxAge  = flag.Duration("retention_forwarded_max_age", 0, "Maximum age of forwarded records before they are pruned; zero keeps them indefinitely")
+	failedMaxAge     = flag.Duration("retention_failed_max_age", 0, "Maximum age of records that failed forwarding before they are pruned; zero keeps them indefinitely")
+	pruneInterval    = flag.Duration("retention_prune_interval", time.Hour, "Interval between record pruning passes")
+	disableRetention = flag.Bool("disable_retention_policy", false, "Disable record pruning, e.g. for audit environments requiring indefinite retention")
+
+	keepaliveTime        = flag.Duration("grpc_keepalive_time", grpconn.DefaultServerConfig().KeepaliveTime, "Idle time after which the server pings clients")
+	keepaliveTimeout     = flag.Duration("grpc_keepalive_timeout", grpconn.DefaultServerConfig().KeepaliveTimeout, "Time to wait for a keepalive ping ack before closing the connection")
+	minPingInterval      = flag.Duration("grpc_min_ping_interval", grpconn.DefaultServerConfig().MinPingInterval, "Minimum interval allowed between client keepalive pings")
+	maxConcurrentStreams = flag.Uint("grpc_max_concurrent_streams", uint(grpconn.DefaultServerConfig().MaxConcurrentStreams), "Maximum number of concurrent streams per connection; zero is unlimited")
+	maxConnectionAge     = flag.Duration("grpc_max_connection_age", grpconn.DefaultServerConfig().MaxConnectionAge, "Maximum connection lifetime; zero is unlimited")
+	maxConnectionGrace   = flag.Duration("grpc_max_connection_age_grace", grpconn.DefaultServerConfig().MaxConnectionAgeGrace, "Time given to in-flight RPCs after the maximum connection age is reached")
+
+	selfAddress  = flag.String("self_address", "", "Address of this instance as listed in `peers`; required if `peers` is set")
+	peers        = flag.String("peers", "", "Comma-separated addresses of all proxy buffer instances; enables consistent hash routing of device IDs; optional")
+	virtualNodes = flag.Int("virtual_nodes", 100, "Number of virtual nodes per peer in the consistent hash ring")
+
+	reflectionKeyFile = flag.String("reflection_key_file", "", "File path to the key authorizing gRPC server reflection calls; enables reflection; optional")
 )
 
+// secretProvider returns the secrets manager client called `name`.
+func secretProvider(name string) (db.SecretProvider, error) {
+	switch name {
+	case "env":
+		return db.EnvVarProvider{}, nil
+	case "aws":
+		return &db.AWSSecretsManagerProvider{Region: *awsRegion}, nil
+	case "gcp":
+		return &db.GCPSecretManagerProvider{Project: *gcpProject}, nil
+	default:
+		return nil, fmt.Errorf("unknown secret provider: %q", name)
+	}
+}
+
 func main() {
 	flag.Parse()
 	if *port == 0 {
@@ -39,11 +86,29 @@ func main() {
 	}
 
 	// Initialize the datastore layer.
-	conn, err := filedb.New(*dbPath)
+	codec, err := db.CodecByName(*dbCodec)
 	if err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
-	database := db.New(conn)
+	var database *db.DB
+	if *dbSecretProvider != "" {
+		secrets, err := secretProvider(*dbSecretProvider)
+		if err != nil {
+			log.Fatalf("Failed to initialize database: %v", err)
+		}
+		// The secret holds the path of the database file, which must not
+		// change while the server runs.
+		database, err = db.NewFromSecret(context.Background(), secrets, *dbSecretName, filedb.New, *dbSecretRefresh, db.WithCodec(codec), db.WithFileDSN())
+		if err != nil {
+			log.Fatalf("Failed to initialize database: %v", err)
+		}
+	} else {
+		conn, err := filedb.New(*dbPath)
+		if err != nil {
+			log.Fatalf("Failed to initialize database: %v", err)
+		}
+		database = db.New(conn, db.WithCodec(codec))
+	}
 
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", *port))
 	if err != nil {
@@ -51,19 +116,79 @@ func main() {
 	}
 	log.Printf("Server is now listening on port: %d", *port)
 
-	opts := []grpc.ServerOption{}
+	// The recovery interceptor must run first to catch panics in all other
+	// interceptors.
+	opts := []grpc.ServerOption{grpc.ChainUnaryInterceptor(proxybuffer.RecoveryInterceptor())}
 	if *enableTLS {
 		credentials, err := grpconn.LoadServerCredentials(*caRootCerts, *serviceCert, *serviceKey)
 		if err != nil {
 			log.Fatalf("Failed to load server credentials: %v", err)
 		}
 		opts = append(opts, grpc.Creds(credentials))
-		opts = append(opts, grpc.UnaryInterceptor(grpconn.CheckEndpointInterceptor))
+		opts = append(opts, grpc.ChainUnaryInterceptor(grpconn.CheckEndpointInterceptor))
+	}
+	if *peers != "" {
+		if *selfAddress == "" {
+			log.Fatalf("`self_address` parameter missing")
+		}
+		dialOpts := []grpc.DialOption{grpc.WithInsecure()}
+		if *enableTLS {
+			credentials, err := grpconn.LoadClientCredentials(*caRootCerts, *serviceCert, *serviceKey)
+			if err != nil {
+				log.Fatalf("Failed to load peer client credentials: %v", err)
+			}
+			dialOpts = []grpc.DialOption{grpc.WithTransportCredentials(credentials)}
+		}
+		routerOpt, err := proxybuffer.WithConsistentHashRouter(*selfAddress, strings.Split(*peers, ","), *virtualNodes, dialOpts...)
+		if err != nil {
+			log.Fatalf("Failed to initialize consistent hash router: %v", err)
+		}
+		opts = append(opts, routerOpt)
+	}
+	if *reflectionKeyFile != "" {
+		key, err := os.ReadFile(*reflectionKeyFile)
+		if err != nil {
+			log.Fatalf("Failed to read reflection key: %v", err)
+		}
+		opts = append(opts, grpc.ChainStreamInterceptor(proxybuffer.ReflectionAuthzInterceptor(key)))
+	}
+	server := grpconn.NewServer(grpconn.ServerConfig{
+		KeepaliveTime:         *keepaliveTime,
+		KeepaliveTimeout:      *keepaliveTimeout,
+		MinPingInterval:       *minPingInterval,
+		MaxConcurrentStreams:  uint32(*maxConcurrentStreams),
+		MaxConnectionAge:      *maxConnectionAge,
+		MaxConnectionAgeGrace: *maxConnectionGrace,
+	}, opts...)
+
+	pbOpts := []proxybuffer.Option{
+		proxybuffer.WithRetentionPolicy(proxybuffer.RetentionPolicy{
+			ForwardedRecordsMaxAge: *forwardedMaxAge,
+			FailedForwardingMaxAge: *failedMaxAge,
+			PruneInterval:          *pruneInterval,
+			DisableRetentionPolicy: *disableRetention,
+		}),
+	}
+	if *verifySig {
+		if *deviceRoots == "" {
+			log.Fatalf("`device_cert_roots` parameter missing, required by `verify_device_signature`")
+		}
+		roots, err := grpconn.LoadCertPool(*deviceRoots)
+		if err != nil {
+			log.Fatalf("Failed to load device certificate roots: %v", err)
+		}
+		pbOpts = append(pbOpts, proxybuffer.WithDeviceSignatureVerification(roots))
+	}
+	if *deepHealth {
+		pbOpts = append(pbOpts, proxybuffer.WithDeepHealthCheck())
 	}
-	server := grpc.NewServer(opts...)
 
 	// Register server
-	pbp.RegisterProxyBufferServiceServer(server, proxybuffer.NewProxyBufferServer(database))
+	pbp.RegisterProxyBufferServiceServer(server, proxybuffer.NewProxyBufferServer(database, pbOpts...))
+
+	if *reflectionKeyFile != "" {
+		reflection.Register(server)
+	}
 
 	// Block and serve RPCs
 	server.Serve(listener)
@@ -7,7 +7,11 @@
 package validators
 
 import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
 	"fmt"
+	"strings"
 
 	pb "github.com/lowRISC/opentitan-provisioning/src/proxy_buffer/proto/proxy_buffer_go_pb"
 )
@@ -15,6 +19,9 @@ import (
 // ValidateDeviceRegistrationRequest performs invariant checks for a
 // DeviceRegistrationRequest that protobuf syntax cannot capture.
 func ValidateDeviceRegistrationRequest(request *pb.DeviceRegistrationRequest) error {
+	if request.Record == nil {
+		return fmt.Errorf("Invalid DeviceRegistrationRequest; Record missing")
+	}
 	// Device IDs will be validated by the PA, only check if device ID string is empty.
 	if request.Record.DeviceId == "" {
 		return fmt.Errorf("Invalid DeviceRegistrationRequest; DeviceId empty")
@@ -30,6 +37,60 @@ func ValidateDeviceRegistrationRequest(request *pb.DeviceRegistrationRequest) er
 	return nil
 }
 
+// ValidateBatchDeviceRegistrationRequest checks that a
+// BatchDeviceRegistrationRequest holds at least one and at most `maxSize`
+// requests. The requests themselves are validated individually with
+// `ValidateDeviceRegistrationRequest`.
+func ValidateBatchDeviceRegistrationRequest(request *pb.BatchDeviceRegistrationRequest, maxSize int) error {
+	if len(request.Requests) == 0 {
+		return fmt.Errorf("Invalid BatchDeviceRegistrationRequest; Requests empty")
+	}
+	if len(request.Requests) > maxSize {
+		return fmt.Errorf("Invalid BatchDeviceRegistrationRequest; %d requests exceed the maximum of %d", len(request.Requests), maxSize)
+	}
+	return nil
+}
+
+// VerifyDeviceSignature verifies the device signature attached to a
+// DeviceRegistrationRequest. The device certificate included in the request
+// must chain to one of the `roots` and carry the device ID of the record as
+// its subject serialNumber attribute, compared case-insensitively. The
+// signature is checked against the public key of the certificate, over the
+// serialized DeviceData payload of the record.
+func VerifyDeviceSignature(request *pb.DeviceRegistrationRequest, roots *x509.CertPool) error {
+	if roots == nil {
+		return fmt.Errorf("no trusted device certificate roots configured")
+	}
+	if len(request.DeviceCert) == 0 {
+		return fmt.Errorf("Invalid DeviceRegistrationRequest; DeviceCert empty")
+	}
+	if len(request.DeviceSignature) == 0 {
+		return fmt.Errorf("Invalid DeviceRegistrationRequest; DeviceSignature empty")
+	}
+	cert, err := x509.ParseCertificate(request.DeviceCert)
+	if err != nil {
+		return fmt.Errorf("Invalid DeviceRegistrationRequest; failed to parse DeviceCert: %v", err)
+	}
+	if _, err := cert.Verify(x509.VerifyOptions{
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		return fmt.Errorf("Invalid DeviceRegistrationRequest; untrusted DeviceCert: %v", err)
+	}
+	if !strings.EqualFold(cert.Subject.SerialNumber, request.Record.DeviceId) {
+		return fmt.Errorf("Invalid DeviceRegistrationRequest; DeviceCert subject serialNumber %q does not match DeviceId %q", cert.Subject.SerialNumber, request.Record.DeviceId)
+	}
+	pub, ok := cert.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("Invalid DeviceRegistrationRequest; unsupported device key type %T", cert.PublicKey)
+	}
+	hash := sha256.Sum256(request.Record.Data)
+	if !ecdsa.VerifyASN1(pub, hash[:], request.DeviceSignature) {
+		return fmt.Errorf("Invalid DeviceRegistrationRequest; device signature verification failed")
+	}
+	return nil
+}
+
 func validateDeviceRegistrationStatus(status pb.DeviceRegistrationStatus) error {
 	switch status {
 	case
@@ -54,3 +115,14 @@ func ValidateDeviceRegistrationResponse(response *pb.DeviceRegistrationResponse)
 
 	return nil
 }
+
+// ValidateGetDeviceRequest performs invariant checks for a GetDeviceRequest
+// that protobuf syntax cannot capture.
+func ValidateGetDeviceRequest(request *pb.GetDeviceRequest) error {
+	// Device IDs are validated on registration, only check if device ID
+	// string is empty.
+	if request.DeviceId == "" {
+		return fmt.Errorf("Invalid GetDeviceRequest; DeviceId empty")
+	}
+	return nil
+}
@@ -4,10 +4,22 @@
 package validators
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
 
 	diu "github.com/lowRISC/opentitan-provisioning/src/proto/device_id_utils"
 	dtd "github.com/lowRISC/opentitan-provisioning/src/proto/device_testdata"
+	rrpb "github.com/lowRISC/opentitan-provisioning/src/proto/registry_record_go_pb"
 	pb "github.com/lowRISC/opentitan-provisioning/src/proxy_buffer/proto/proxy_buffer_go_pb"
 )
 
@@ -47,6 +59,194 @@ func TestValidateDeviceRegistrationRequest(t *testing.T) {
 	}
 }
 
+func TestValidateBatchDeviceRegistrationRequest(t *testing.T) {
+	const maxSize = 2
+	drr := &pb.DeviceRegistrationRequest{Record: &dtd.RegistryRecordOk}
+	tests := []struct {
+		name string
+		bdrr *pb.BatchDeviceRegistrationRequest
+		ok   bool
+	}{
+		{
+			name: "ok",
+			bdrr: &pb.BatchDeviceRegistrationRequest{
+				Requests: []*pb.DeviceRegistrationRequest{drr, drr},
+			},
+			ok: true,
+		},
+		{
+			name: "empty",
+			bdrr: &pb.BatchDeviceRegistrationRequest{},
+		},
+		{
+			name: "too large",
+			bdrr: &pb.BatchDeviceRegistrationRequest{
+				Requests: []*pb.DeviceRegistrationRequest{drr, drr, drr},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateBatchDeviceRegistrationRequest(tt.bdrr, maxSize); (err == nil) != tt.ok {
+				t.Errorf("expected ok=%t; got err=%q", tt.ok, err)
+			}
+		})
+	}
+}
+
+// newCA returns a self-signed CA certificate and its private key.
+func newCA(t *testing.T) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate CA key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "device CA"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create CA certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse CA certificate: %v", err)
+	}
+	return cert, key
+}
+
+// signedRequest returns a DeviceRegistrationRequest carrying a device
+// certificate for `deviceID` issued by a new CA, and a device signature over
+// the record data, along with a pool holding the CA certificate.
+func signedRequest(t *testing.T, deviceID string) (*pb.DeviceRegistrationRequest, *x509.CertPool) {
+	t.Helper()
+	ca, caKey := newCA(t)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate device key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "device", SerialNumber: deviceID},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("failed to create device certificate: %v", err)
+	}
+	record := proto.Clone(&dtd.RegistryRecordOk).(*rrpb.RegistryRecord)
+	hash := sha256.Sum256(record.Data)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, hash[:])
+	if err != nil {
+		t.Fatalf("failed to sign device data: %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	return &pb.DeviceRegistrationRequest{
+		Record:          record,
+		DeviceCert:      cert,
+		DeviceSignature: sig,
+	}, roots
+}
+
+func TestVerifyDeviceSignature(t *testing.T) {
+	otherCA, _ := newCA(t)
+	otherRoots := x509.NewCertPool()
+	otherRoots.AddCert(otherCA)
+
+	tests := []struct {
+		name     string
+		deviceID string
+		mutate   func(*pb.DeviceRegistrationRequest, **x509.CertPool)
+		ok       bool
+	}{
+		{
+			name:     "ok",
+			deviceID: dtd.RegistryRecordOk.DeviceId,
+			mutate:   func(*pb.DeviceRegistrationRequest, **x509.CertPool) {},
+			ok:       true,
+		},
+		{
+			name:     "device id case",
+			deviceID: strings.ToUpper(dtd.RegistryRecordOk.DeviceId),
+			mutate:   func(*pb.DeviceRegistrationRequest, **x509.CertPool) {},
+			ok:       true,
+		},
+		{
+			name:     "device id mismatch",
+			deviceID: "0123456789abcdef",
+			mutate:   func(*pb.DeviceRegistrationRequest, **x509.CertPool) {},
+		},
+		{
+			name:     "untrusted cert",
+			deviceID: dtd.RegistryRecordOk.DeviceId,
+			mutate: func(_ *pb.DeviceRegistrationRequest, roots **x509.CertPool) {
+				*roots = otherRoots
+			},
+		},
+		{
+			name:     "no roots",
+			deviceID: dtd.RegistryRecordOk.DeviceId,
+			mutate: func(_ *pb.DeviceRegistrationRequest, roots **x509.CertPool) {
+				*roots = nil
+			},
+		},
+		{
+			name:     "tampered data",
+			deviceID: dtd.RegistryRecordOk.DeviceId,
+			mutate: func(drr *pb.DeviceRegistrationRequest, _ **x509.CertPool) {
+				drr.Record.Data[0] ^= 0xff
+			},
+		},
+		{
+			name:     "tampered signature",
+			deviceID: dtd.RegistryRecordOk.DeviceId,
+			mutate: func(drr *pb.DeviceRegistrationRequest, _ **x509.CertPool) {
+				drr.DeviceSignature[len(drr.DeviceSignature)-1] ^= 0xff
+			},
+		},
+		{
+			name:     "missing signature",
+			deviceID: dtd.RegistryRecordOk.DeviceId,
+			mutate: func(drr *pb.DeviceRegistrationRequest, _ **x509.CertPool) {
+				drr.DeviceSignature = nil
+			},
+		},
+		{
+			name:     "missing cert",
+			deviceID: dtd.RegistryRecordOk.DeviceId,
+			mutate: func(drr *pb.DeviceRegistrationRequest, _ **x509.CertPool) {
+				drr.DeviceCert = nil
+			},
+		},
+		{
+			name:     "invalid cert",
+			deviceID: dtd.RegistryRecordOk.DeviceId,
+			mutate: func(drr *pb.DeviceRegistrationRequest, _ **x509.CertPool) {
+				drr.DeviceCert = []byte("not a certificate")
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			drr, roots := signedRequest(t, tt.deviceID)
+			tt.mutate(drr, &roots)
+			if err := VerifyDeviceSignature(drr, roots); (err == nil) != tt.ok {
+				t.Errorf("expected ok=%t; got err=%q", tt.ok, err)
+			}
+		})
+	}
+}
+
 func TestValidateDeviceRegistrationResponse(t *testing.T) {
 	tests := []struct {
 		name string
@@ -99,3 +299,31 @@ func TestValidateDeviceRegistrationResponse(t *testing.T) {
 		})
 	}
 }
+
+func TestValidateGetDeviceRequest(t *testing.T) {
+	tests := []struct {
+		name string
+		gdr  *pb.GetDeviceRequest
+		ok   bool
+	}{
+		{
+			name: "ok",
+			gdr: &pb.GetDeviceRequest{
+				DeviceId: diu.DeviceIdToHexString(&dtd.DeviceIdOk),
+			},
+			ok: true,
+		},
+		{
+			name: "empty device id",
+			gdr:  &pb.GetDeviceRequest{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateGetDeviceRequest(tt.gdr); (err == nil) != tt.ok {
+				t.Errorf("expected ok=%t; got err=%q", tt.ok, err)
+			}
+		})
+	}
+}
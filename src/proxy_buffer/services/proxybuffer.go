@@ -7,14 +7,24 @@ package proxybuffer
 
 import (
 	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"log"
+	"sync"
+	"time"
 
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 
+	rpb "github.com/lowRISC/opentitan-provisioning/src/proto/registry_record_go_pb"
 	pbp "github.com/lowRISC/opentitan-provisioning/src/proxy_buffer/proto/proxy_buffer_go_pb"
 	"github.com/lowRISC/opentitan-provisioning/src/proxy_buffer/proto/validators"
+	"github.com/lowRISC/opentitan-provisioning/src/proxy_buffer/store/connector"
 	"github.com/lowRISC/opentitan-provisioning/src/proxy_buffer/store/db"
 )
 
@@ -26,12 +36,169 @@ type Registry interface {
 // server is the server object.
 type server struct {
 	db *db.DB
+
+	// verifyDeviceSignature enables verification of the device signature
+	// attached to registration requests.
+	verifyDeviceSignature bool
+	// deviceCertRoots are the trusted roots of the device certificates.
+	deviceCertRoots *x509.CertPool
+
+	// retention is the record retention policy.
+	retention RetentionPolicy
+
+	// idempotencyTTL is the lifetime of stored idempotent responses.
+	idempotencyTTL time.Duration
+
+	// maxBatchSize is the maximum number of requests accepted by
+	// `BatchRegisterDevices`.
+	maxBatchSize int
+
+	// enableDeepHealthCheck enables `DeepHealthCheck`.
+	enableDeepHealthCheck bool
+
+	// healthCheckMu serializes deep health checks, which share the same
+	// synthetic device ID.
+	healthCheckMu sync.Mutex
+}
+
+// defaultPruneInterval is the pruning interval used when
+// `RetentionPolicy.PruneInterval` is not set.
+const defaultPruneInterval = time.Hour
+
+// RetentionPolicy configures automatic pruning of device records.
+type RetentionPolicy struct {
+	// ForwardedRecordsMaxAge is the maximum age of records forwarded to the
+	// registry. Forwarded records are kept indefinitely if set to zero.
+	ForwardedRecordsMaxAge time.Duration
+	// FailedForwardingMaxAge is the maximum age of records that failed
+	// forwarding. Failed records are kept indefinitely if set to zero.
+	FailedForwardingMaxAge time.Duration
+	// PruneInterval is the interval between pruning passes. Defaults to
+	// `defaultPruneInterval` if set to zero.
+	PruneInterval time.Duration
+	// DisableRetentionPolicy disables pruning. Used in audit environments that
+	// require indefinite retention of device records.
+	DisableRetentionPolicy bool
+}
+
+// defaultIdempotencyTTL is the lifetime of stored idempotent responses used
+// when `WithIdempotencyTTL` is not set.
+const defaultIdempotencyTTL = 24 * time.Hour
+
+// defaultMaxBatchSize is the maximum number of requests accepted by
+// `BatchRegisterDevices` used when `WithMaxBatchSize` is not set.
+const defaultMaxBatchSize = 500
+
+// Option configures optional behavior of the ProxyBufferService server.
+type Option func(*server)
+
+// WithDeviceSignatureVerification requires every registration request to
+// carry a device certificate issued for the device under one of the `roots`,
+// and a valid device signature over the device data payload. Requests failing
+// verification are rejected.
+func WithDeviceSignatureVerification(roots *x509.CertPool) Option {
+	return func(s *server) {
+		s.verifyDeviceSignature = true
+		s.deviceCertRoots = roots
+	}
+}
+
+// WithRetentionPolicy enables automatic pruning of device records according
+// to the `p` retention policy.
+func WithRetentionPolicy(p RetentionPolicy) Option {
+	return func(s *server) {
+		s.retention = p
+	}
+}
+
+// WithIdempotencyTTL sets the lifetime of responses stored for requests
+// carrying an idempotency key.
+func WithIdempotencyTTL(ttl time.Duration) Option {
+	return func(s *server) {
+		s.idempotencyTTL = ttl
+	}
+}
+
+// WithMaxBatchSize sets the maximum number of requests accepted by
+// `BatchRegisterDevices`. Larger batches are rejected.
+func WithMaxBatchSize(n int) Option {
+	return func(s *server) {
+		s.maxBatchSize = n
+	}
+}
+
+// WithDeepHealthCheck enables `DeepHealthCheck`. It is disabled by default
+// to keep synthetic records out of production audit logs.
+func WithDeepHealthCheck() Option {
+	return func(s *server) {
+		s.enableDeepHealthCheck = true
+	}
 }
 
 // NewProxyBufferServer returns an implementation of the ProxyBufferService
 // gRPC server.
-func NewProxyBufferServer(db *db.DB) pbp.ProxyBufferServiceServer {
-	return &server{db: db}
+//
+// Unless the retention policy is disabled, a background goroutine prunes
+// expired records and idempotency entries for the lifetime of the process.
+func NewProxyBufferServer(db *db.DB, opts ...Option) pbp.ProxyBufferServiceServer {
+	s := &server{
+		db:             db,
+		idempotencyTTL: defaultIdempotencyTTL,
+		maxBatchSize:   defaultMaxBatchSize,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if !s.retention.DisableRetentionPolicy {
+		go s.pruneLoop(context.Background())
+	}
+	return s
+}
+
+// pruneLoop prunes expired records at the configured interval until `ctx` is
+// canceled.
+func (s *server) pruneLoop(ctx context.Context) {
+	interval := s.retention.PruneInterval
+	if interval == 0 {
+		interval = defaultPruneInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.prune(ctx)
+		}
+	}
+}
+
+// prune runs a single pruning pass.
+func (s *server) prune(ctx context.Context) {
+	now := time.Now()
+	if maxAge := s.retention.ForwardedRecordsMaxAge; maxAge > 0 {
+		n, err := s.db.PruneForwarded(ctx, now.Add(-maxAge))
+		if err != nil {
+			log.Printf("Failed to prune forwarded records: %v", err)
+		} else if n > 0 {
+			log.Printf("Pruned %d forwarded records older than %v", n, maxAge)
+		}
+	}
+	if maxAge := s.retention.FailedForwardingMaxAge; maxAge > 0 {
+		n, err := s.db.PruneDeadLetter(ctx, now.Add(-maxAge))
+		if err != nil {
+			log.Printf("Failed to prune dead letter records: %v", err)
+		} else if n > 0 {
+			log.Printf("Pruned %d dead letter records older than %v", n, maxAge)
+		}
+	}
+	n, err := s.db.PruneIdempotencyKeys(ctx)
+	if err != nil {
+		log.Printf("Failed to prune idempotency keys: %v", err)
+	} else if n > 0 {
+		log.Printf("Pruned %d expired idempotency keys", n)
+	}
 }
 
 // RegisterDevice registers a new device record.
@@ -41,13 +208,23 @@ func (s *server) RegisterDevice(ctx context.Context, request *pbp.DeviceRegistra
 	device_id := request.Record.DeviceId
 	log.Printf("Received device-registration request with DeviceID: %s", device_id)
 
+	if key := request.IdempotencyKey; key != "" {
+		stored, err := s.idempotentResponse(ctx, key, device_id)
+		if err != nil {
+			return nil, err
+		}
+		if stored != nil {
+			return stored, nil
+		}
+	}
+
 	response := &pbp.DeviceRegistrationResponse{
 		DeviceId: device_id,
 	}
 
-	if err := validators.ValidateDeviceRegistrationRequest(request); err != nil {
+	if err := s.validateRegistration(request); err != nil {
 		response.Status = pbp.DeviceRegistrationStatus_DEVICE_REGISTRATION_STATUS_BAD_REQUEST
-		return response, status.Errorf(codes.InvalidArgument, "failed request validation: %v", err)
+		return response, status.Error(codes.InvalidArgument, err.Error())
 	}
 
 	if err := s.db.InsertDevice(ctx, request.Record); err != nil {
@@ -57,5 +234,255 @@ func (s *server) RegisterDevice(ctx context.Context, request *pbp.DeviceRegistra
 	}
 
 	response.Status = pbp.DeviceRegistrationStatus_DEVICE_REGISTRATION_STATUS_SUCCESS
+
+	if key := request.IdempotencyKey; key != "" {
+		s.storeIdempotentResponse(ctx, key, response)
+	}
+	return response, nil
+}
+
+// BatchRegisterDevices registers the devices of multiple registration
+// requests.
+//
+// Each request is validated as in `RegisterDevice`. Invalid requests are
+// reported with a `DEVICE_REGISTRATION_STATUS_BAD_REQUEST` result without
+// aborting the batch, and the valid ones are recorded in a single database
+// transaction. An error is returned if the batch itself is invalid or the
+// transaction fails, in which case no device is registered.
+func (s *server) BatchRegisterDevices(ctx context.Context, request *pbp.BatchDeviceRegistrationRequest) (*pbp.BatchDeviceRegistrationResponse, error) {
+	if err := validators.ValidateBatchDeviceRegistrationRequest(request, s.maxBatchSize); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "failed request validation: %v", err)
+	}
+	log.Printf("Received batch device-registration request with %d devices", len(request.Requests))
+
+	results := make([]*pbp.DeviceRegistrationResult, len(request.Requests))
+	// pending holds the indices of the requests to insert.
+	var pending []int
+	var records []*rpb.RegistryRecord
+	seen := make(map[string]bool)
+	for i, r := range request.Requests {
+		result := &pbp.DeviceRegistrationResult{DeviceId: r.GetRecord().GetDeviceId()}
+		results[i] = result
+
+		if key := r.IdempotencyKey; key != "" {
+			stored, err := s.idempotentResponse(ctx, key, result.DeviceId)
+			if status.Code(err) == codes.InvalidArgument {
+				result.Status = pbp.DeviceRegistrationStatus_DEVICE_REGISTRATION_STATUS_BAD_REQUEST
+				result.Error = status.Convert(err).Message()
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			if stored != nil {
+				result.Status = stored.Status
+				result.DeviceId = stored.DeviceId
+				continue
+			}
+		}
+		if err := s.validateRegistration(r); err != nil {
+			result.Status = pbp.DeviceRegistrationStatus_DEVICE_REGISTRATION_STATUS_BAD_REQUEST
+			result.Error = err.Error()
+			continue
+		}
+		// Duplicates would fail the whole transaction.
+		if seen[result.DeviceId] {
+			result.Status = pbp.DeviceRegistrationStatus_DEVICE_REGISTRATION_STATUS_BAD_REQUEST
+			result.Error = fmt.Sprintf("duplicate device ID %q in batch", result.DeviceId)
+			continue
+		}
+		seen[result.DeviceId] = true
+		pending = append(pending, i)
+		records = append(records, r.Record)
+	}
+
+	if len(records) > 0 {
+		if err := s.db.InsertDeviceBatch(ctx, records); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to insert records: %v", err)
+		}
+	}
+	for _, i := range pending {
+		results[i].Status = pbp.DeviceRegistrationStatus_DEVICE_REGISTRATION_STATUS_SUCCESS
+		if key := request.Requests[i].IdempotencyKey; key != "" {
+			s.storeIdempotentResponse(ctx, key, &pbp.DeviceRegistrationResponse{
+				Status:   results[i].Status,
+				DeviceId: results[i].DeviceId,
+			})
+		}
+	}
+	return &pbp.BatchDeviceRegistrationResponse{Results: results}, nil
+}
+
+// validateRegistration validates a registration `request` and, if enabled,
+// verifies its device signature.
+func (s *server) validateRegistration(request *pbp.DeviceRegistrationRequest) error {
+	if err := validators.ValidateDeviceRegistrationRequest(request); err != nil {
+		return fmt.Errorf("failed request validation: %v", err)
+	}
+	if s.verifyDeviceSignature {
+		if err := validators.VerifyDeviceSignature(request, s.deviceCertRoots); err != nil {
+			return fmt.Errorf("failed device signature verification: %v", err)
+		}
+	}
+	return nil
+}
+
+// idempotentResponse returns the response stored for the idempotency `key`,
+// or nil if there is none. Returns a `codes.InvalidArgument` error if the
+// stored response is for a device other than `deviceID`, i.e. the key was
+// reused for another request.
+func (s *server) idempotentResponse(ctx context.Context, key, deviceID string) (*pbp.DeviceRegistrationResponse, error) {
+	stored, err := s.db.GetIdempotentResponse(ctx, key)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to look up idempotency key: %v", err)
+	}
+	if stored == nil {
+		return nil, nil
+	}
+	response := &pbp.DeviceRegistrationResponse{}
+	if err := proto.Unmarshal(stored, response); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to unmarshal stored response: %v", err)
+	}
+	if response.DeviceId != deviceID {
+		return nil, status.Errorf(codes.InvalidArgument, "idempotency key %q was used for device %q, not %q", key, response.DeviceId, deviceID)
+	}
+	log.Printf("Returning stored response for idempotency key: %s", key)
+	return response, nil
+}
+
+// storeIdempotentResponse stores the `response` to a successful request with
+// the idempotency `key`.
+func (s *server) storeIdempotentResponse(ctx context.Context, key string, response *pbp.DeviceRegistrationResponse) {
+	// The device is already registered at this point, so failing to store
+	// the response is not fatal. A retry is then processed again.
+	stored, err := proto.Marshal(response)
+	if err != nil {
+		log.Printf("Failed to marshal response for idempotency key %s: %v", key, err)
+	} else if err := s.db.InsertIdempotentResponse(ctx, key, response.DeviceId, stored, s.idempotencyTTL); err != nil {
+		log.Printf("Failed to store response for idempotency key %s: %v", key, err)
+	}
+}
+
+// GetDevice returns the stored record of a registered device, so that callers
+// can verify that a registration was persisted. Returns `codes.NotFound` if
+// the device is not registered, with the device ID attached as
+// `errdetails.ResourceInfo`.
+func (s *server) GetDevice(ctx context.Context, request *pbp.GetDeviceRequest) (*pbp.GetDeviceResponse, error) {
+	if err := validators.ValidateGetDeviceRequest(request); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid request: %v", err)
+	}
+	record, err := s.db.GetDevice(ctx, request.DeviceId)
+	if errors.Is(err, connector.ErrNotFound) {
+		st := status.New(codes.NotFound, fmt.Sprintf("device %q not found", request.DeviceId))
+		if withDetails, detailsErr := st.WithDetails(&errdetails.ResourceInfo{
+			ResourceType: "device",
+			ResourceName: request.DeviceId,
+		}); detailsErr == nil {
+			st = withDetails
+		}
+		return nil, st.Err()
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get device %q: %v", request.DeviceId, err)
+	}
+	return &pbp.GetDeviceResponse{Record: record}, nil
+}
+
+const (
+	// defaultListPageSize is the `ListDevices` page size used when the
+	// request does not set one.
+	defaultListPageSize = 100
+	// maxListPageSize is the largest `ListDevices` page size. Larger
+	// requested sizes are reduced to it.
+	maxListPageSize = 1000
+)
+
+// ListDevices returns a page of registered device records, ordered by device
+// ID. Records are read from the database one page at a time, using the last
+// device ID of the previous page as cursor, so the order is stable while
+// devices are registered concurrently.
+func (s *server) ListDevices(ctx context.Context, request *pbp.ListDevicesRequest) (*pbp.ListDevicesResponse, error) {
+	pageSize := int(request.PageSize)
+	switch {
+	case pageSize < 0:
+		return nil, status.Errorf(codes.InvalidArgument, "negative page size: %d", pageSize)
+	case pageSize == 0:
+		pageSize = defaultListPageSize
+	case pageSize > maxListPageSize:
+		pageSize = maxListPageSize
+	}
+	after, err := base64.RawURLEncoding.DecodeString(request.PageToken)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid page token: %v", err)
+	}
+
+	// One more record than requested is read to find out whether there is a
+	// next page.
+	records, err := s.db.ListDevices(ctx, string(after), pageSize+1)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list devices: %v", err)
+	}
+	response := &pbp.ListDevicesResponse{Records: records}
+	if len(records) > pageSize {
+		response.Records = records[:pageSize]
+		last := response.Records[pageSize-1].DeviceId
+		response.NextPageToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+	}
 	return response, nil
 }
+
+// DeleteDevice deletes the record of a registered device. Returns
+// `codes.NotFound` if there is no such record, e.g. because a concurrent
+// caller deleted it first.
+func (s *server) DeleteDevice(ctx context.Context, request *pbp.DeleteDeviceRequest) (*pbp.DeleteDeviceResponse, error) {
+	if request.DeviceId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "empty device ID")
+	}
+	deleted, err := s.db.DeleteDevice(ctx, request.DeviceId)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to delete device %q: %v", request.DeviceId, err)
+	}
+	if !deleted {
+		return nil, status.Errorf(codes.NotFound, "device %q not found", request.DeviceId)
+	}
+	return &pbp.DeleteDeviceResponse{}, nil
+}
+
+// healthCheckDeviceID is the device ID of the synthetic record used by
+// `DeepHealthCheck`.
+const healthCheckDeviceID = "__health_check__"
+
+// DeepHealthCheck exercises the registration storage path end to end by
+// inserting a synthetic device record, reading it back and deleting it. The
+// record is flagged as synthetic so it is excluded from record counts and
+// pruning. Returns `codes.FailedPrecondition` unless enabled with
+// `WithDeepHealthCheck`.
+func (s *server) DeepHealthCheck(ctx context.Context, request *pbp.DeepHealthCheckRequest) (*pbp.DeepHealthCheckResponse, error) {
+	if !s.enableDeepHealthCheck {
+		return nil, status.Errorf(codes.FailedPrecondition, "deep health check is disabled")
+	}
+	s.healthCheckMu.Lock()
+	defer s.healthCheckMu.Unlock()
+
+	start := time.Now()
+	record := &rpb.RegistryRecord{
+		DeviceId: healthCheckDeviceID,
+		Sku:      healthCheckDeviceID,
+	}
+	if err := s.db.InsertSyntheticDevice(ctx, record); err != nil {
+		return nil, status.Errorf(codes.Unavailable, "failed to insert synthetic record: %v", err)
+	}
+	got, err := s.db.GetDevice(ctx, healthCheckDeviceID)
+	if err == nil && got.DeviceId != healthCheckDeviceID {
+		err = fmt.Errorf("unexpected device ID %q", got.DeviceId)
+	}
+	// The record is deleted even if the read back failed, so that the next
+	// health check can insert it again.
+	if delErr := s.db.DeleteSyntheticDevice(ctx, healthCheckDeviceID); delErr != nil && err == nil {
+		err = delErr
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "synthetic registration failed: %v", err)
+	}
+	return &pbp.DeepHealthCheckResponse{LatencyUs: uint64(time.Since(start).Microseconds())}, nil
+}
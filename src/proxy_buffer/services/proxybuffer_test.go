@@ -7,10 +7,20 @@ package proxybuffer
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
 	"net"
 	"testing"
+	"time"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/google/go-cmp/cmp"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -18,6 +28,7 @@ import (
 	"google.golang.org/protobuf/testing/protocmp"
 
 	dtd "github.com/lowRISC/opentitan-provisioning/src/proto/device_testdata"
+	rrpb "github.com/lowRISC/opentitan-provisioning/src/proto/registry_record_go_pb"
 	pbp "github.com/lowRISC/opentitan-provisioning/src/proxy_buffer/proto/proxy_buffer_go_pb"
 	"github.com/lowRISC/opentitan-provisioning/src/proxy_buffer/services/proxybuffer"
 	"github.com/lowRISC/opentitan-provisioning/src/proxy_buffer/store/db"
@@ -29,10 +40,10 @@ const (
 	bufferConnectionSize = 2048 * 1024
 )
 
-func bufferDialer(t *testing.T, database *db.DB) func(context.Context, string) (net.Conn, error) {
+func bufferDialer(t *testing.T, database *db.DB, opts ...proxybuffer.Option) func(context.Context, string) (net.Conn, error) {
 	listener := bufconn.Listen(bufferConnectionSize)
 	server := grpc.NewServer()
-	pbp.RegisterProxyBufferServiceServer(server, proxybuffer.NewProxyBufferServer(database))
+	pbp.RegisterProxyBufferServiceServer(server, proxybuffer.NewProxyBufferServer(database, opts...))
 	go func(t *testing.T) {
 		if err := server.Serve(listener); err != nil {
 			t.Fatal(err)
@@ -115,3 +126,489 @@ func TestRegisterDevice(t *testing.T) {
 		})
 	}
 }
+
+func TestRegisterDeviceSignatureVerification(t *testing.T) {
+	ctx := context.Background()
+
+	// Generate a device CA, and a device key and certificate issued for the
+	// device ID of the record.
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate CA key: %v", err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "device CA"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("failed to create CA certificate: %v", err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatalf("failed to parse CA certificate: %v", err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate device key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "device", SerialNumber: dtd.RegistryRecordOk.DeviceId},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("failed to create device certificate: %v", err)
+	}
+	// A certificate for the same key, but not issued by the CA.
+	selfSigned, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create self-signed device certificate: %v", err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	db_conn := db_fake.New()
+	database := db.New(db_conn)
+	conn, err := grpc.DialContext(ctx, "", grpc.WithInsecure(),
+		grpc.WithContextDialer(bufferDialer(t, database, proxybuffer.WithDeviceSignatureVerification(roots))))
+	if err != nil {
+		t.Fatalf("failed to connect to test server: %v", err)
+	}
+	defer conn.Close()
+
+	client := pbp.NewProxyBufferServiceClient(conn)
+	hash := sha256.Sum256(dtd.RegistryRecordOk.Data)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, hash[:])
+	if err != nil {
+		t.Fatalf("failed to sign device data: %v", err)
+	}
+
+	tampered := proto.Clone(&dtd.RegistryRecordOk).(*rrpb.RegistryRecord)
+	tampered.Data[0] ^= 0xff
+
+	tests := []struct {
+		name    string
+		drr     *pbp.DeviceRegistrationRequest
+		expCode codes.Code
+	}{
+		{
+			name: "ok",
+			drr: &pbp.DeviceRegistrationRequest{
+				Record:          &dtd.RegistryRecordOk,
+				DeviceCert:      cert,
+				DeviceSignature: sig,
+			},
+			expCode: codes.OK,
+		},
+		{
+			name: "unsigned",
+			drr: &pbp.DeviceRegistrationRequest{
+				Record: &dtd.RegistryRecordOk,
+			},
+			expCode: codes.InvalidArgument,
+		},
+		{
+			name: "untrusted cert",
+			drr: &pbp.DeviceRegistrationRequest{
+				Record:          &dtd.RegistryRecordOk,
+				DeviceCert:      selfSigned,
+				DeviceSignature: sig,
+			},
+			expCode: codes.InvalidArgument,
+		},
+		{
+			name: "tampered data",
+			drr: &pbp.DeviceRegistrationRequest{
+				Record:          tampered,
+				DeviceCert:      cert,
+				DeviceSignature: sig,
+			},
+			expCode: codes.InvalidArgument,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := client.RegisterDevice(ctx, tt.drr)
+			s, ok := status.FromError(err)
+			if !ok {
+				t.Fatal("unable to extract status code from error")
+			}
+			if s.Code() != tt.expCode {
+				t.Errorf("expected status code: %v, got %v", tt.expCode, s.Code())
+			}
+		})
+	}
+}
+
+func TestRetentionPolicy(t *testing.T) {
+	ctx := context.Background()
+	database := db.New(db_fake.New())
+	policy := proxybuffer.RetentionPolicy{
+		ForwardedRecordsMaxAge: time.Nanosecond,
+		PruneInterval:          10 * time.Millisecond,
+	}
+	conn, err := grpc.DialContext(ctx, "", grpc.WithInsecure(),
+		grpc.WithContextDialer(bufferDialer(t, database, proxybuffer.WithRetentionPolicy(policy))))
+	if err != nil {
+		t.Fatalf("failed to connect to test server: %v", err)
+	}
+	defer conn.Close()
+
+	client := pbp.NewProxyBufferServiceClient(conn)
+	if _, err := client.RegisterDevice(ctx, &pbp.DeviceRegistrationRequest{Record: &dtd.RegistryRecordOk}); err != nil {
+		t.Fatalf("failed to register device: %v", err)
+	}
+
+	// Records that have not been forwarded must not be pruned.
+	time.Sleep(5 * policy.PruneInterval)
+	if _, err := database.GetDevice(ctx, dtd.RegistryRecordOk.DeviceId); err != nil {
+		t.Fatalf("unforwarded record was pruned: %v", err)
+	}
+
+	if err := database.MarkForwarded(ctx, dtd.RegistryRecordOk.DeviceId); err != nil {
+		t.Fatalf("failed to mark record as forwarded: %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, err := database.GetDevice(ctx, dtd.RegistryRecordOk.DeviceId); err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("forwarded record was not pruned")
+		}
+		time.Sleep(policy.PruneInterval)
+	}
+}
+
+func TestRegisterDeviceIdempotency(t *testing.T) {
+	ctx := context.Background()
+	database := db.New(db_fake.New())
+
+	register := func(req *pbp.DeviceRegistrationRequest) (*pbp.DeviceRegistrationResponse, error) {
+		t.Helper()
+		// Dial a new server instance on every call to check that deduplication
+		// does not depend on in-memory server state.
+		conn, err := grpc.DialContext(ctx, "", grpc.WithInsecure(), grpc.WithContextDialer(bufferDialer(t, database)))
+		if err != nil {
+			t.Fatalf("failed to connect to test server: %v", err)
+		}
+		defer conn.Close()
+		return pbp.NewProxyBufferServiceClient(conn).RegisterDevice(ctx, req)
+	}
+
+	first, err := register(&pbp.DeviceRegistrationRequest{
+		Record:         &dtd.RegistryRecordOk,
+		IdempotencyKey: "key-0",
+	})
+	if err != nil {
+		t.Fatalf("RegisterDevice() failed: %v", err)
+	}
+
+	// Retrying the request must return the stored response.
+	second, err := register(&pbp.DeviceRegistrationRequest{
+		Record:         &dtd.RegistryRecordOk,
+		IdempotencyKey: "key-0",
+	})
+	if err != nil {
+		t.Fatalf("RegisterDevice() retry failed: %v", err)
+	}
+	if diff := cmp.Diff(first, second, protocmp.Transform()); diff != "" {
+		t.Errorf("RegisterDevice() returned unexpected diff (-want +got):\n%s", diff)
+	}
+
+	// Reusing the key for another device must be rejected rather than return
+	// the response for the first device.
+	other := proto.Clone(&dtd.RegistryRecordOk).(*rrpb.RegistryRecord)
+	other.DeviceId = "0123456789abcdef0123456789abcdef0123456789abcdef"
+	if _, err := register(&pbp.DeviceRegistrationRequest{
+		Record:         other,
+		IdempotencyKey: "key-0",
+	}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("RegisterDevice() with reused key = %v, want code %v", err, codes.InvalidArgument)
+	}
+	if _, err := database.GetDevice(ctx, other.DeviceId); err == nil {
+		t.Errorf("GetDevice(%q) succeeded, expected the request with a reused key to be skipped", other.DeviceId)
+	}
+
+	// A different key is processed as a new request.
+	third, err := register(&pbp.DeviceRegistrationRequest{
+		Record:         other,
+		IdempotencyKey: "key-1",
+	})
+	if err != nil {
+		t.Fatalf("RegisterDevice() failed: %v", err)
+	}
+	if third.DeviceId != other.DeviceId {
+		t.Errorf("RegisterDevice() returned device id %q, expected %q", third.DeviceId, other.DeviceId)
+	}
+}
+
+func TestBatchRegisterDevices(t *testing.T) {
+	ctx := context.Background()
+	database := db.New(db_fake.New())
+	conn, err := grpc.DialContext(ctx, "", grpc.WithInsecure(), grpc.WithContextDialer(bufferDialer(t, database, proxybuffer.WithMaxBatchSize(4))))
+	if err != nil {
+		t.Fatalf("failed to connect to test server: %v", err)
+	}
+	defer conn.Close()
+	client := pbp.NewProxyBufferServiceClient(conn)
+
+	var requests []*pbp.DeviceRegistrationRequest
+	for _, id := range []string{"0001", "0002", "0001"} {
+		record := proto.Clone(&dtd.RegistryRecordOk).(*rrpb.RegistryRecord)
+		record.DeviceId = id
+		requests = append(requests, &pbp.DeviceRegistrationRequest{Record: record})
+	}
+	requests = append(requests, &pbp.DeviceRegistrationRequest{Record: &dtd.RegistryRecordEmptySku})
+
+	got, err := client.BatchRegisterDevices(ctx, &pbp.BatchDeviceRegistrationRequest{Requests: requests})
+	if err != nil {
+		t.Fatalf("BatchRegisterDevices() failed: %v", err)
+	}
+	want := []pbp.DeviceRegistrationStatus{
+		pbp.DeviceRegistrationStatus_DEVICE_REGISTRATION_STATUS_SUCCESS,
+		pbp.DeviceRegistrationStatus_DEVICE_REGISTRATION_STATUS_SUCCESS,
+		pbp.DeviceRegistrationStatus_DEVICE_REGISTRATION_STATUS_BAD_REQUEST,
+		pbp.DeviceRegistrationStatus_DEVICE_REGISTRATION_STATUS_BAD_REQUEST,
+	}
+	if len(got.Results) != len(want) {
+		t.Fatalf("BatchRegisterDevices() returned %d results, want %d", len(got.Results), len(want))
+	}
+	for i, r := range got.Results {
+		if r.Status != want[i] || r.DeviceId != requests[i].Record.DeviceId {
+			t.Errorf("result %d = %v, want status %v for device %q", i, r, want[i], requests[i].Record.DeviceId)
+		}
+		if (r.Error == "") != (want[i] == pbp.DeviceRegistrationStatus_DEVICE_REGISTRATION_STATUS_SUCCESS) {
+			t.Errorf("result %d error = %q, want error only on failure", i, r.Error)
+		}
+	}
+	for _, r := range requests[:2] {
+		record, err := database.GetDevice(ctx, r.Record.DeviceId)
+		if err != nil {
+			t.Fatalf("GetDevice(%q) failed: %v", r.Record.DeviceId, err)
+		}
+		if diff := cmp.Diff(r.Record, record, protocmp.Transform()); diff != "" {
+			t.Errorf("GetDevice(%q) record mismatch (-want +got):\n%s", r.Record.DeviceId, diff)
+		}
+	}
+
+	for _, tc := range []struct {
+		name     string
+		requests []*pbp.DeviceRegistrationRequest
+	}{
+		{"empty", nil},
+		{"too_large", append(requests, requests[0])},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := client.BatchRegisterDevices(ctx, &pbp.BatchDeviceRegistrationRequest{Requests: tc.requests})
+			if status.Code(err) != codes.InvalidArgument {
+				t.Errorf("BatchRegisterDevices() = %v, want code %v", err, codes.InvalidArgument)
+			}
+		})
+	}
+}
+
+func TestGetDevice(t *testing.T) {
+	ctx := context.Background()
+	database := db.New(db_fake.New())
+	conn, err := grpc.DialContext(ctx, "", grpc.WithInsecure(), grpc.WithContextDialer(bufferDialer(t, database)))
+	if err != nil {
+		t.Fatalf("failed to connect to test server: %v", err)
+	}
+	defer conn.Close()
+	client := pbp.NewProxyBufferServiceClient(conn)
+
+	record := proto.Clone(&dtd.RegistryRecordOk).(*rrpb.RegistryRecord)
+	if _, err := client.RegisterDevice(ctx, &pbp.DeviceRegistrationRequest{Record: record}); err != nil {
+		t.Fatalf("RegisterDevice() failed: %v", err)
+	}
+
+	got, err := client.GetDevice(ctx, &pbp.GetDeviceRequest{DeviceId: record.DeviceId})
+	if err != nil {
+		t.Fatalf("GetDevice() failed: %v", err)
+	}
+	if diff := cmp.Diff(record, got.Record, protocmp.Transform()); diff != "" {
+		t.Errorf("GetDevice() record mismatch (-want +got):\n%s", diff)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		deviceID string
+		expCode  codes.Code
+	}{
+		{"not_found", "0123", codes.NotFound},
+		{"empty_device_id", "", codes.InvalidArgument},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := client.GetDevice(ctx, &pbp.GetDeviceRequest{DeviceId: tc.deviceID})
+			if status.Code(err) != tc.expCode {
+				t.Errorf("GetDevice() = %v, want code %v", err, tc.expCode)
+			}
+		})
+	}
+
+	_, err = client.GetDevice(ctx, &pbp.GetDeviceRequest{DeviceId: "0123"})
+	var info *errdetails.ResourceInfo
+	for _, d := range status.Convert(err).Details() {
+		if i, ok := d.(*errdetails.ResourceInfo); ok {
+			info = i
+		}
+	}
+	if info == nil || info.ResourceName != "0123" {
+		t.Errorf("GetDevice() error details = %v, want ResourceInfo for device %q", status.Convert(err).Details(), "0123")
+	}
+}
+
+func TestListDevices(t *testing.T) {
+	ctx := context.Background()
+	database := db.New(db_fake.New())
+	conn, err := grpc.DialContext(ctx, "", grpc.WithInsecure(), grpc.WithContextDialer(bufferDialer(t, database)))
+	if err != nil {
+		t.Fatalf("failed to connect to test server: %v", err)
+	}
+	defer conn.Close()
+	client := pbp.NewProxyBufferServiceClient(conn)
+
+	want := []string{"0001", "0002", "0003", "0004", "0005"}
+	for _, id := range []string{"0003", "0001", "0005", "0002", "0004"} {
+		record := proto.Clone(&dtd.RegistryRecordOk).(*rrpb.RegistryRecord)
+		record.DeviceId = id
+		if err := database.InsertDevice(ctx, record); err != nil {
+			t.Fatalf("InsertDevice() failed: %v", err)
+		}
+	}
+	synthetic := &rrpb.RegistryRecord{DeviceId: "0002a"}
+	if err := database.InsertSyntheticDevice(ctx, synthetic); err != nil {
+		t.Fatalf("InsertSyntheticDevice() failed: %v", err)
+	}
+
+	var got []string
+	var pages int
+	request := &pbp.ListDevicesRequest{PageSize: 2}
+	for {
+		response, err := client.ListDevices(ctx, request)
+		if err != nil {
+			t.Fatalf("ListDevices() failed: %v", err)
+		}
+		pages++
+		for _, record := range response.Records {
+			got = append(got, record.DeviceId)
+		}
+		if response.NextPageToken == "" {
+			break
+		}
+		request.PageToken = response.NextPageToken
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ListDevices() device IDs mismatch (-want +got):\n%s", diff)
+	}
+	if pages != 3 {
+		t.Errorf("ListDevices() returned %d pages, want 3", pages)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		request *pbp.ListDevicesRequest
+	}{
+		{"negative_page_size", &pbp.ListDevicesRequest{PageSize: -1}},
+		{"invalid_page_token", &pbp.ListDevicesRequest{PageToken: "not a token"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := client.ListDevices(ctx, tc.request)
+			if status.Code(err) != codes.InvalidArgument {
+				t.Errorf("ListDevices() = %v, want code %v", err, codes.InvalidArgument)
+			}
+		})
+	}
+}
+
+func TestDeleteDevice(t *testing.T) {
+	ctx := context.Background()
+	database := db.New(db_fake.New())
+	conn, err := grpc.DialContext(ctx, "", grpc.WithInsecure(), grpc.WithContextDialer(bufferDialer(t, database)))
+	if err != nil {
+		t.Fatalf("failed to connect to test server: %v", err)
+	}
+	defer conn.Close()
+	client := pbp.NewProxyBufferServiceClient(conn)
+
+	record := proto.Clone(&dtd.RegistryRecordOk).(*rrpb.RegistryRecord)
+	if err := database.InsertDevice(ctx, record); err != nil {
+		t.Fatalf("InsertDevice() failed: %v", err)
+	}
+	if _, err := client.DeleteDevice(ctx, &pbp.DeleteDeviceRequest{DeviceId: record.DeviceId}); err != nil {
+		t.Fatalf("DeleteDevice() failed: %v", err)
+	}
+	if _, err := client.GetDevice(ctx, &pbp.GetDeviceRequest{DeviceId: record.DeviceId}); status.Code(err) != codes.NotFound {
+		t.Errorf("GetDevice() after DeleteDevice() = %v, want code %v", err, codes.NotFound)
+	}
+
+	synthetic := &rrpb.RegistryRecord{DeviceId: "synthetic"}
+	if err := database.InsertSyntheticDevice(ctx, synthetic); err != nil {
+		t.Fatalf("InsertSyntheticDevice() failed: %v", err)
+	}
+	for _, tc := range []struct {
+		name     string
+		deviceID string
+		expCode  codes.Code
+	}{
+		{"already_deleted", record.DeviceId, codes.NotFound},
+		{"not_found", "0123", codes.NotFound},
+		{"synthetic", synthetic.DeviceId, codes.NotFound},
+		{"empty_device_id", "", codes.InvalidArgument},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := client.DeleteDevice(ctx, &pbp.DeleteDeviceRequest{DeviceId: tc.deviceID})
+			if status.Code(err) != tc.expCode {
+				t.Errorf("DeleteDevice() = %v, want code %v", err, tc.expCode)
+			}
+		})
+	}
+}
+
+func TestDeepHealthCheck(t *testing.T) {
+	ctx := context.Background()
+	database := db.New(db_fake.New())
+
+	dial := func(opts ...proxybuffer.Option) (pbp.ProxyBufferServiceClient, func()) {
+		conn, err := grpc.DialContext(ctx, "", grpc.WithInsecure(), grpc.WithContextDialer(bufferDialer(t, database, opts...)))
+		if err != nil {
+			t.Fatalf("failed to connect to test server: %v", err)
+		}
+		return pbp.NewProxyBufferServiceClient(conn), func() { conn.Close() }
+	}
+
+	disabled, closeDisabled := dial()
+	defer closeDisabled()
+	if _, err := disabled.DeepHealthCheck(ctx, &pbp.DeepHealthCheckRequest{}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("DeepHealthCheck() = %v, want code %v", err, codes.FailedPrecondition)
+	}
+
+	enabled, closeEnabled := dial(proxybuffer.WithDeepHealthCheck())
+	defer closeEnabled()
+	// Repeated checks must succeed, as the synthetic record is deleted.
+	for i := 0; i < 2; i++ {
+		if _, err := enabled.DeepHealthCheck(ctx, &pbp.DeepHealthCheckRequest{}); err != nil {
+			t.Fatalf("DeepHealthCheck() failed: %v", err)
+		}
+	}
+	if _, err := database.GetDevice(ctx, "__health_check__"); err == nil {
+		t.Error("synthetic record was not deleted")
+	}
+	counts, err := database.RefreshCounts(ctx)
+	if err != nil {
+		t.Fatalf("RefreshCounts() failed: %v", err)
+	}
+	if len(counts) != 0 {
+		t.Errorf("RefreshCounts() = %v, want no records", counts)
+	}
+}
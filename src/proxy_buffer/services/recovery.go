@@ -0,0 +1,55 @@
+// Copyright lowRISC contributors (OpenTitan project).
+// Licensed under the Apache License, Version 2.0, see LICENSE for details.
+// SPDX-License-Identifier: Apache-2.0
+
+package proxybuffer
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"log"
+	"runtime/debug"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// panicsTotal counts the handler panics recovered by `RecoveryInterceptor`.
+// Published through expvar: the proxy buffer does not depend on the
+// Prometheus client, which is not part of the pinned Go dependencies, but
+// the monotonic counter can be scraped with the Prometheus expvar collector.
+var panicsTotal = expvar.NewInt("proxy_buffer_panics_total")
+
+// RecoveryInterceptor returns a gRPC unary interceptor that recovers from
+// panics in downstream interceptors and handlers, so that a single bad request
+// does not crash the server. The panic is logged with its stack trace and
+// returned to the client as a `codes.Internal` error with a
+// `google.rpc.DebugInfo` detail.
+//
+// It should be installed as the first interceptor in the chain.
+func RecoveryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+		defer func() {
+			r := recover()
+			if r == nil {
+				return
+			}
+			panicsTotal.Add(1)
+			log.Printf("Recovered from panic in %s: %v\n%s", info.FullMethod, r, debug.Stack())
+
+			st := status.New(codes.Internal, fmt.Sprintf("internal error in %s", info.FullMethod))
+			// The stack trace is only logged to avoid leaking server internals
+			// to clients.
+			if withDetails, detailsErr := st.WithDetails(&errdetails.DebugInfo{
+				Detail: fmt.Sprint(r),
+			}); detailsErr == nil {
+				st = withDetails
+			}
+			resp, err = nil, st.Err()
+		}()
+		return handler(ctx, req)
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright lowRISC contributors (OpenTitan project).
+// Licensed under the Apache License, Version 2.0, see LICENSE for details.
+// SPDX-License-Identifier: Apache-2.0
+
+// Unit tests for the proxybuffer panic recovery interceptor.
+package proxybuffer
+
+import (
+	"context"
+	"expvar"
+	"net"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	dtd "github.com/lowRISC/opentitan-provisioning/src/proto/device_testdata"
+	rrpb "github.com/lowRISC/opentitan-provisioning/src/proto/registry_record_go_pb"
+	pbp "github.com/lowRISC/opentitan-provisioning/src/proxy_buffer/proto/proxy_buffer_go_pb"
+	"github.com/lowRISC/opentitan-provisioning/src/proxy_buffer/services/proxybuffer"
+	"github.com/lowRISC/opentitan-provisioning/src/proxy_buffer/store/db"
+	"github.com/lowRISC/opentitan-provisioning/src/proxy_buffer/store/db_fake"
+)
+
+// panicSku is the SKU of registration requests that trigger a panic.
+const panicSku = "panic"
+
+// panicInterceptor simulates a handler bug by panicking on requests with the
+// `panicSku` SKU.
+func panicInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if r, ok := req.(*pbp.DeviceRegistrationRequest); ok && r.GetRecord().GetSku() == panicSku {
+		panic("simulated handler bug")
+	}
+	return handler(ctx, req)
+}
+
+func TestRecoveryInterceptor(t *testing.T) {
+	ctx := context.Background()
+	listener := bufconn.Listen(2048 * 1024)
+	server := grpc.NewServer(grpc.ChainUnaryInterceptor(proxybuffer.RecoveryInterceptor(), panicInterceptor))
+	pbp.RegisterProxyBufferServiceServer(server, proxybuffer.NewProxyBufferServer(db.New(db_fake.New())))
+	go server.Serve(listener)
+	defer server.Stop()
+
+	conn, err := grpc.DialContext(ctx, "", grpc.WithInsecure(),
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+			return listener.Dial()
+		}))
+	if err != nil {
+		t.Fatalf("failed to connect to test server: %v", err)
+	}
+	defer conn.Close()
+	client := pbp.NewProxyBufferServiceClient(conn)
+
+	panicsTotal := expvar.Get("proxy_buffer_panics_total").(*expvar.Int)
+	before := panicsTotal.Value()
+
+	record := proto.Clone(&dtd.RegistryRecordOk).(*rrpb.RegistryRecord)
+	record.Sku = panicSku
+	_, err = client.RegisterDevice(ctx, &pbp.DeviceRegistrationRequest{Record: record})
+	s := status.Convert(err)
+	if s.Code() != codes.Internal {
+		t.Fatalf("expected status code: %v, got %v (err: %v)", codes.Internal, s.Code(), err)
+	}
+	found := false
+	for _, d := range s.Details() {
+		if info, ok := d.(*errdetails.DebugInfo); ok {
+			found = true
+			if info.Detail != "simulated handler bug" {
+				t.Errorf("DebugInfo.Detail = %q, want %q", info.Detail, "simulated handler bug")
+			}
+		}
+	}
+	if !found {
+		t.Errorf("DebugInfo not found in error details: %v", s.Details())
+	}
+	if got := panicsTotal.Value() - before; got != 1 {
+		t.Errorf("proxy_buffer_panics_total increased by %d, want 1", got)
+	}
+
+	// The server keeps serving requests after the panic.
+	if _, err := client.RegisterDevice(ctx, &pbp.DeviceRegistrationRequest{Record: &dtd.RegistryRecordOk}); err != nil {
+		t.Errorf("RegisterDevice() after panic failed: %v", err)
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright lowRISC contributors (OpenTitan project).
+// Licensed under the Apache License, Version 2.0, see LICENSE for details.
+// SPDX-License-Identifier: Apache-2.0
+
+package proxybuffer
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// reflectionTokenKey is the metadata key carrying the reflection access
+	// token.
+	reflectionTokenKey = "x-reflection-token"
+
+	// reflectionServicePrefix matches the methods of all versions of the gRPC
+	// server reflection service.
+	reflectionServicePrefix = "/grpc.reflection."
+
+	// reflectionTokenMessage is the message authenticated by reflection
+	// access tokens.
+	reflectionTokenMessage = "grpc-server-reflection"
+)
+
+// ReflectionToken returns the reflection access token derived from `key`. It is
+// the hex encoded HMAC-SHA256 of a fixed message, so that the key itself is
+// never sent to the server.
+func ReflectionToken(key []byte) string {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(reflectionTokenMessage))
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// ReflectionAuthzInterceptor returns a gRPC stream interceptor that only
+// allows calls to the server reflection service carrying a valid
+// `X-Reflection-Token` metadata value, as computed by `ReflectionToken` with
+// `key`. Other calls are denied with `codes.PermissionDenied`. All other
+// services are unaffected.
+//
+// The reflection service itself must be registered with
+// `reflection.Register`.
+func ReflectionAuthzInterceptor(key []byte) grpc.StreamServerInterceptor {
+	want := []byte(ReflectionToken(key))
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if !strings.HasPrefix(info.FullMethod, reflectionServicePrefix) {
+			return handler(srv, ss)
+		}
+		md, _ := metadata.FromIncomingContext(ss.Context())
+		tokens := md.Get(reflectionTokenKey)
+		if len(tokens) != 1 || !hmac.Equal([]byte(tokens[0]), want) {
+			return status.Errorf(codes.PermissionDenied, "missing or invalid reflection token")
+		}
+		return handler(srv, ss)
+	}
+}
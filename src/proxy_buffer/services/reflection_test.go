@@ -0,0 +1,111 @@
+// Copyright lowRISC contributors (OpenTitan project).
+// Licensed under the Apache License, Version 2.0, see LICENSE for details.
+// SPDX-License-Identifier: Apache-2.0
+
+// Unit tests for the proxybuffer reflection access control.
+package proxybuffer
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	dtd "github.com/lowRISC/opentitan-provisioning/src/proto/device_testdata"
+	pbp "github.com/lowRISC/opentitan-provisioning/src/proxy_buffer/proto/proxy_buffer_go_pb"
+	"github.com/lowRISC/opentitan-provisioning/src/proxy_buffer/services/proxybuffer"
+	"github.com/lowRISC/opentitan-provisioning/src/proxy_buffer/store/db"
+	"github.com/lowRISC/opentitan-provisioning/src/proxy_buffer/store/db_fake"
+)
+
+// listServices lists the services exposed by the server through reflection.
+func listServices(ctx context.Context, conn *grpc.ClientConn) ([]string, error) {
+	stream, err := rpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.Send(&rpb.ServerReflectionRequest{
+		MessageRequest: &rpb.ServerReflectionRequest_ListServices{},
+	}); err != nil {
+		return nil, err
+	}
+	resp, err := stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+	var services []string
+	for _, s := range resp.GetListServicesResponse().GetService() {
+		services = append(services, s.Name)
+	}
+	return services, nil
+}
+
+func TestReflectionAuthzInterceptor(t *testing.T) {
+	key := []byte("reflection key")
+
+	listener := bufconn.Listen(2048 * 1024)
+	server := grpc.NewServer(grpc.ChainStreamInterceptor(proxybuffer.ReflectionAuthzInterceptor(key)))
+	pbp.RegisterProxyBufferServiceServer(server, proxybuffer.NewProxyBufferServer(db.New(db_fake.New())))
+	reflection.Register(server)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	conn, err := grpc.DialContext(context.Background(), "", grpc.WithInsecure(),
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+			return listener.Dial()
+		}))
+	if err != nil {
+		t.Fatalf("failed to connect to test server: %v", err)
+	}
+	defer conn.Close()
+	client := pbp.NewProxyBufferServiceClient(conn)
+
+	tests := []struct {
+		name     string
+		token    string
+		wantCode codes.Code
+	}{
+		{
+			name:     "valid_token",
+			token:    proxybuffer.ReflectionToken(key),
+			wantCode: codes.OK,
+		},
+		{
+			name:     "invalid_token",
+			token:    proxybuffer.ReflectionToken([]byte("wrong key")),
+			wantCode: codes.PermissionDenied,
+		},
+		{
+			name:     "missing_token",
+			wantCode: codes.PermissionDenied,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.token != "" {
+				ctx = metadata.AppendToOutgoingContext(ctx, "X-Reflection-Token", tt.token)
+			}
+
+			services, err := listServices(ctx, conn)
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("listServices() = %v, want code %v", err, tt.wantCode)
+			}
+			if tt.wantCode == codes.OK && len(services) == 0 {
+				t.Error("listServices() returned no services")
+			}
+
+			// Registration is not affected by the reflection token.
+			if _, err := client.RegisterDevice(ctx, &pbp.DeviceRegistrationRequest{Record: &dtd.RegistryRecordOk}); err != nil {
+				t.Errorf("RegisterDevice() failed: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,302 @@
+// Copyright lowRISC contributors (OpenTitan project).
+// Licensed under the Apache License, Version 2.0, see LICENSE for details.
+// SPDX-License-Identifier: Apache-2.0
+
+package proxybuffer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	pbp "github.com/lowRISC/opentitan-provisioning/src/proxy_buffer/proto/proxy_buffer_go_pb"
+)
+
+// forwardedByKey is the metadata key set on requests forwarded to the owning
+// peer. Requests forwarded by an authenticated peer are always processed
+// locally to avoid routing loops when peers disagree on the ring membership.
+// See `ConsistentHashRouter.forwardedByPeer`.
+const forwardedByKey = "x-proxybuffer-forwarded-by"
+
+// ringNode is a virtual node in the consistent hash ring.
+type ringNode struct {
+	hash uint64
+	peer string
+}
+
+// ConsistentHashRouter maps device IDs to proxy buffer instances using a
+// consistent hash ring, so that each device is always processed by the same
+// instance. All instances must be configured with the same set of peers.
+type ConsistentHashRouter struct {
+	// self is the address of the local instance, as listed in the peers.
+	self string
+
+	// members contains the addresses of all instances in the ring.
+	members map[string]bool
+
+	// ring contains the virtual nodes sorted by hash.
+	ring []ringNode
+
+	// dialOpts are used to connect to peers.
+	dialOpts []grpc.DialOption
+
+	// mu guards conns.
+	mu sync.Mutex
+
+	// conns is the client connection pool, indexed by peer address.
+	conns map[string]*grpc.ClientConn
+}
+
+// hashKey returns the position of `key` in the hash ring.
+func hashKey(key string) uint64 {
+	h := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(h[:8])
+}
+
+// NewConsistentHashRouter creates a router for the `peers` proxy buffer
+// instances. `self` is the address of the local instance and is added to the
+// ring if not listed in `peers`. Each peer is placed `virtualNodes` times in
+// the ring to even out the distribution of device IDs.
+func NewConsistentHashRouter(self string, peers []string, virtualNodes int, dialOpts ...grpc.DialOption) (*ConsistentHashRouter, error) {
+	if virtualNodes <= 0 {
+		return nil, fmt.Errorf("invalid number of virtual nodes: %d", virtualNodes)
+	}
+	members := map[string]bool{self: true}
+	for _, p := range peers {
+		members[p] = true
+	}
+	r := &ConsistentHashRouter{
+		self:     self,
+		members:  members,
+		dialOpts: dialOpts,
+		conns:    make(map[string]*grpc.ClientConn),
+	}
+	for p := range members {
+		for i := 0; i < virtualNodes; i++ {
+			r.ring = append(r.ring, ringNode{hash: hashKey(fmt.Sprintf("%s#%d", p, i)), peer: p})
+		}
+	}
+	sort.Slice(r.ring, func(i, j int) bool {
+		if r.ring[i].hash == r.ring[j].hash {
+			return r.ring[i].peer < r.ring[j].peer
+		}
+		return r.ring[i].hash < r.ring[j].hash
+	})
+	return r, nil
+}
+
+// Owner returns the address of the instance owning `deviceID`.
+func (r *ConsistentHashRouter) Owner(deviceID string) string {
+	h := hashKey(deviceID)
+	i := sort.Search(len(r.ring), func(i int) bool { return r.ring[i].hash >= h })
+	if i == len(r.ring) {
+		i = 0
+	}
+	return r.ring[i].peer
+}
+
+// conn returns a pooled client connection to `peer`.
+func (r *ConsistentHashRouter) conn(peer string) (*grpc.ClientConn, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if c, ok := r.conns[peer]; ok {
+		return c, nil
+	}
+	c, err := grpc.Dial(peer, r.dialOpts...)
+	if err != nil {
+		return nil, err
+	}
+	r.conns[peer] = c
+	return c, nil
+}
+
+// Close closes all peer connections.
+func (r *ConsistentHashRouter) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var firstErr error
+	for peer, c := range r.conns {
+		if err := c.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(r.conns, peer)
+	}
+	return firstErr
+}
+
+// client returns a client of the `owner` peer, and `ctx` marked as forwarded
+// by the local instance.
+func (r *ConsistentHashRouter) client(ctx context.Context, owner string) (pbp.ProxyBufferServiceClient, context.Context, error) {
+	c, err := r.conn(owner)
+	if err != nil {
+		return nil, nil, status.Errorf(codes.Unavailable, "failed to connect to peer %q: %v", owner, err)
+	}
+	return pbp.NewProxyBufferServiceClient(c), metadata.AppendToOutgoingContext(ctx, forwardedByKey, r.self), nil
+}
+
+// forwardedByPeer reports whether the request of `ctx` was forwarded by
+// another instance of the ring. The forwarded-by metadata is only trusted
+// from clients authenticated with a verified TLS certificate issued to the
+// forwarding instance, so that other clients cannot bypass the routing.
+func (r *ConsistentHashRouter) forwardedByPeer(ctx context.Context) bool {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return false
+	}
+	forwardedBy := md.Get(forwardedByKey)
+	if len(forwardedBy) != 1 || forwardedBy[0] == r.self || !r.members[forwardedBy[0]] {
+		return false
+	}
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return false
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 || len(info.State.VerifiedChains[0]) == 0 {
+		return false
+	}
+	host, _, err := net.SplitHostPort(forwardedBy[0])
+	if err != nil {
+		host = forwardedBy[0]
+	}
+	return info.State.VerifiedChains[0][0].VerifyHostname(host) == nil
+}
+
+// UnaryServerInterceptor is a gRPC unary interceptor that forwards the device
+// registration, lookup and deletion requests to the instance owning the
+// device. Batch registration requests are split by owner, and the results
+// merged in the order of the request. Requests owned by the local instance,
+// requests forwarded by an authenticated peer and all other RPCs are passed
+// on to the next handler.
+func (r *ConsistentHashRouter) UnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	var deviceID string
+	switch request := req.(type) {
+	case *pbp.DeviceRegistrationRequest:
+		deviceID = request.GetRecord().GetDeviceId()
+	case *pbp.GetDeviceRequest:
+		deviceID = request.GetDeviceId()
+	case *pbp.DeleteDeviceRequest:
+		deviceID = request.GetDeviceId()
+	case *pbp.BatchDeviceRegistrationRequest:
+		if r.forwardedByPeer(ctx) {
+			return handler(ctx, req)
+		}
+		return r.routeBatch(ctx, request, handler)
+	default:
+		return handler(ctx, req)
+	}
+	owner := r.Owner(deviceID)
+	if owner == r.self || r.forwardedByPeer(ctx) {
+		return handler(ctx, req)
+	}
+
+	client, ctx, err := r.client(ctx, owner)
+	if err != nil {
+		return nil, err
+	}
+	switch request := req.(type) {
+	case *pbp.DeviceRegistrationRequest:
+		return client.RegisterDevice(ctx, request)
+	case *pbp.GetDeviceRequest:
+		return client.GetDevice(ctx, request)
+	default:
+		return client.DeleteDevice(ctx, req.(*pbp.DeleteDeviceRequest))
+	}
+}
+
+// routeBatch splits the batch registration `request` into one batch per
+// owning instance, and merges their results in the order of `request`. The
+// local batch is passed on to `handler`. Each instance enforces its own batch
+// size limit on its share of the batch.
+//
+// The batches are not registered atomically: the devices of a batch failing
+// on its owner are reported with an unspecified status and the error, while
+// the other batches are registered. An error is only returned if all batches
+// fail.
+func (r *ConsistentHashRouter) routeBatch(ctx context.Context, request *pbp.BatchDeviceRegistrationRequest, handler grpc.UnaryHandler) (interface{}, error) {
+	var owners []string
+	indices := make(map[string][]int)
+	for i, dr := range request.Requests {
+		owner := r.Owner(dr.GetRecord().GetDeviceId())
+		if _, ok := indices[owner]; !ok {
+			owners = append(owners, owner)
+		}
+		indices[owner] = append(indices[owner], i)
+	}
+	if len(owners) == 0 || (len(owners) == 1 && owners[0] == r.self) {
+		return handler(ctx, request)
+	}
+
+	results := make([]*pbp.DeviceRegistrationResult, len(request.Requests))
+	var firstErr error
+	failed := 0
+	for _, owner := range owners {
+		batch := &pbp.BatchDeviceRegistrationRequest{}
+		for _, i := range indices[owner] {
+			batch.Requests = append(batch.Requests, request.Requests[i])
+		}
+		response, err := r.registerBatch(ctx, owner, batch, handler)
+		if err == nil && len(response.Results) != len(batch.Requests) {
+			err = status.Errorf(codes.Internal, "peer %q returned %d results for %d devices", owner, len(response.Results), len(batch.Requests))
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			failed++
+			for _, i := range indices[owner] {
+				results[i] = &pbp.DeviceRegistrationResult{
+					DeviceId: request.Requests[i].GetRecord().GetDeviceId(),
+					Error:    err.Error(),
+				}
+			}
+			continue
+		}
+		for j, i := range indices[owner] {
+			results[i] = response.Results[j]
+		}
+	}
+	if failed == len(owners) {
+		return nil, firstErr
+	}
+	return &pbp.BatchDeviceRegistrationResponse{Results: results}, nil
+}
+
+// registerBatch registers the batch `request` on the `owner` instance,
+// passing it on to `handler` if owned by the local instance.
+func (r *ConsistentHashRouter) registerBatch(ctx context.Context, owner string, request *pbp.BatchDeviceRegistrationRequest, handler grpc.UnaryHandler) (*pbp.BatchDeviceRegistrationResponse, error) {
+	if owner == r.self {
+		response, err := handler(ctx, request)
+		if err != nil {
+			return nil, err
+		}
+		return response.(*pbp.BatchDeviceRegistrationResponse), nil
+	}
+	client, ctx, err := r.client(ctx, owner)
+	if err != nil {
+		return nil, err
+	}
+	return client.BatchRegisterDevices(ctx, request)
+}
+
+// WithConsistentHashRouter returns a gRPC server option installing a
+// `ConsistentHashRouter` interceptor. See `NewConsistentHashRouter` for a
+// description of the parameters.
+func WithConsistentHashRouter(self string, peers []string, virtualNodes int, dialOpts ...grpc.DialOption) (grpc.ServerOption, error) {
+	r, err := NewConsistentHashRouter(self, peers, virtualNodes, dialOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return grpc.ChainUnaryInterceptor(r.UnaryServerInterceptor), nil
+}
@@ -0,0 +1,320 @@
+// Copyright lowRISC contributors (OpenTitan project).
+// Licensed under the Apache License, Version 2.0, see LICENSE for details.
+// SPDX-License-Identifier: Apache-2.0
+
+// Unit tests for the proxybuffer consistent hash router.
+package proxybuffer
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/test/bufconn"
+
+	dtd "github.com/lowRISC/opentitan-provisioning/src/proto/device_testdata"
+	rrpb "github.com/lowRISC/opentitan-provisioning/src/proto/registry_record_go_pb"
+	pbp "github.com/lowRISC/opentitan-provisioning/src/proxy_buffer/proto/proxy_buffer_go_pb"
+	"github.com/lowRISC/opentitan-provisioning/src/proxy_buffer/services/proxybuffer"
+	"github.com/lowRISC/opentitan-provisioning/src/proxy_buffer/store/db"
+	"github.com/lowRISC/opentitan-provisioning/src/proxy_buffer/store/db_fake"
+)
+
+const (
+	// bufferConnectionSize is the size of the gRPC connection buffer.
+	bufferConnectionSize = 2048 * 1024
+
+	// numVirtualNodes is the number of virtual nodes per peer in the ring.
+	numVirtualNodes = 64
+)
+
+// startPeers simulates each of the `peers` with a bufconn server backed by
+// its own database, routing requests with a `ConsistentHashRouter`. Returns
+// the databases and a dialer connecting to the peers.
+func startPeers(t *testing.T, peers []string) (map[string]*db.DB, grpc.DialOption) {
+	t.Helper()
+	listeners := make(map[string]*bufconn.Listener)
+	databases := make(map[string]*db.DB)
+	for _, p := range peers {
+		listeners[p] = bufconn.Listen(bufferConnectionSize)
+		databases[p] = db.New(db_fake.New())
+	}
+	dialer := grpc.WithContextDialer(func(_ context.Context, addr string) (net.Conn, error) {
+		l, ok := listeners[addr]
+		if !ok {
+			return nil, fmt.Errorf("unknown peer %q", addr)
+		}
+		return l.Dial()
+	})
+	for _, p := range peers {
+		opt, err := proxybuffer.WithConsistentHashRouter(p, peers, numVirtualNodes, grpc.WithInsecure(), dialer)
+		if err != nil {
+			t.Fatalf("WithConsistentHashRouter() failed: %v", err)
+		}
+		server := grpc.NewServer(opt)
+		pbp.RegisterProxyBufferServiceServer(server, proxybuffer.NewProxyBufferServer(databases[p]))
+		go server.Serve(listeners[p])
+		t.Cleanup(server.Stop)
+	}
+	return databases, dialer
+}
+
+// testRecord returns a registry record with a device ID derived from `i`.
+func testRecord(i int) *rrpb.RegistryRecord {
+	record := proto.Clone(&dtd.RegistryRecordOk).(*rrpb.RegistryRecord)
+	record.DeviceId = fmt.Sprintf("%048x", i)
+	return record
+}
+
+// checkStoredOnOwner checks that `deviceID` is only stored in the database of
+// its `owner`.
+func checkStoredOnOwner(t *testing.T, databases map[string]*db.DB, deviceID, owner string) {
+	t.Helper()
+	for p, database := range databases {
+		_, err := database.GetDevice(context.Background(), deviceID)
+		if p == owner && err != nil {
+			t.Errorf("device %q not found on owner %q: %v", deviceID, owner, err)
+		}
+		if p != owner && err == nil {
+			t.Errorf("device %q found on %q, expected only on owner %q", deviceID, p, owner)
+		}
+	}
+}
+
+func TestConsistentHashRouter(t *testing.T) {
+	ctx := context.Background()
+	peers := []string{"peer-a", "peer-b", "peer-c"}
+	databases, dialer := startPeers(t, peers)
+
+	router, err := proxybuffer.NewConsistentHashRouter(peers[0], peers, numVirtualNodes)
+	if err != nil {
+		t.Fatalf("NewConsistentHashRouter() failed: %v", err)
+	}
+
+	// Send all requests to the first peer, which forwards them to the owners.
+	conn, err := grpc.DialContext(ctx, peers[0], grpc.WithInsecure(), dialer)
+	if err != nil {
+		t.Fatalf("failed to connect to test server: %v", err)
+	}
+	defer conn.Close()
+	client := pbp.NewProxyBufferServiceClient(conn)
+
+	owned := make(map[string]int)
+	for i := 0; i < 30; i++ {
+		record := testRecord(i)
+		if _, err := client.RegisterDevice(ctx, &pbp.DeviceRegistrationRequest{Record: record}); err != nil {
+			t.Fatalf("RegisterDevice(%q) failed: %v", record.DeviceId, err)
+		}
+
+		owner := router.Owner(record.DeviceId)
+		owned[owner]++
+		checkStoredOnOwner(t, databases, record.DeviceId, owner)
+	}
+	for _, p := range peers {
+		if owned[p] == 0 {
+			t.Errorf("peer %q owns none of the devices: %v", p, owned)
+		}
+	}
+}
+
+func TestConsistentHashRouterStableOwnership(t *testing.T) {
+	peers := []string{"peer-a", "peer-b", "peer-c"}
+	r1, err := proxybuffer.NewConsistentHashRouter("peer-a", peers, numVirtualNodes)
+	if err != nil {
+		t.Fatalf("NewConsistentHashRouter() failed: %v", err)
+	}
+	// Peers listed in a different order must produce the same ring.
+	r2, err := proxybuffer.NewConsistentHashRouter("peer-b", []string{"peer-c", "peer-a"}, numVirtualNodes)
+	if err != nil {
+		t.Fatalf("NewConsistentHashRouter() failed: %v", err)
+	}
+	// Removing a peer only moves the devices it owned.
+	r3, err := proxybuffer.NewConsistentHashRouter("peer-a", peers[:2], numVirtualNodes)
+	if err != nil {
+		t.Fatalf("NewConsistentHashRouter() failed: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		id := fmt.Sprintf("%048x", i)
+		owner := r1.Owner(id)
+		if got := r2.Owner(id); got != owner {
+			t.Errorf("Owner(%q) = %q, want %q", id, got, owner)
+		}
+		if owner != "peer-c" {
+			if got := r3.Owner(id); got != owner {
+				t.Errorf("Owner(%q) moved from %q to %q after removing peer-c", id, owner, got)
+			}
+		}
+	}
+
+	if _, err := proxybuffer.NewConsistentHashRouter("peer-a", peers, 0); err == nil {
+		t.Error("expected NewConsistentHashRouter to reject zero virtual nodes")
+	}
+}
+
+func TestConsistentHashRouterBatchGetDelete(t *testing.T) {
+	ctx := context.Background()
+	peers := []string{"peer-a", "peer-b", "peer-c"}
+	databases, dialer := startPeers(t, peers)
+	router, err := proxybuffer.NewConsistentHashRouter(peers[0], peers, numVirtualNodes)
+	if err != nil {
+		t.Fatalf("NewConsistentHashRouter() failed: %v", err)
+	}
+
+	conn, err := grpc.DialContext(ctx, peers[0], grpc.WithInsecure(), dialer)
+	if err != nil {
+		t.Fatalf("failed to connect to test server: %v", err)
+	}
+	defer conn.Close()
+	client := pbp.NewProxyBufferServiceClient(conn)
+
+	batch := &pbp.BatchDeviceRegistrationRequest{}
+	for i := 0; i < 30; i++ {
+		batch.Requests = append(batch.Requests, &pbp.DeviceRegistrationRequest{Record: testRecord(i)})
+	}
+	response, err := client.BatchRegisterDevices(ctx, batch)
+	if err != nil {
+		t.Fatalf("BatchRegisterDevices() failed: %v", err)
+	}
+	if len(response.Results) != len(batch.Requests) {
+		t.Fatalf("BatchRegisterDevices() returned %d results, want %d", len(response.Results), len(batch.Requests))
+	}
+	for i, result := range response.Results {
+		deviceID := batch.Requests[i].Record.DeviceId
+		if result.DeviceId != deviceID || result.Status != pbp.DeviceRegistrationStatus_DEVICE_REGISTRATION_STATUS_SUCCESS {
+			t.Errorf("BatchRegisterDevices() result %d = %v, want success for %q", i, result, deviceID)
+		}
+		checkStoredOnOwner(t, databases, deviceID, router.Owner(deviceID))
+	}
+
+	for _, r := range batch.Requests {
+		deviceID := r.Record.DeviceId
+		got, err := client.GetDevice(ctx, &pbp.GetDeviceRequest{DeviceId: deviceID})
+		if err != nil {
+			t.Errorf("GetDevice(%q) failed: %v", deviceID, err)
+		} else if got.Record.DeviceId != deviceID {
+			t.Errorf("GetDevice(%q) returned device %q", deviceID, got.Record.DeviceId)
+		}
+		if _, err := client.DeleteDevice(ctx, &pbp.DeleteDeviceRequest{DeviceId: deviceID}); err != nil {
+			t.Errorf("DeleteDevice(%q) failed: %v", deviceID, err)
+		}
+		if _, err := databases[router.Owner(deviceID)].GetDevice(ctx, deviceID); err == nil {
+			t.Errorf("device %q still found on its owner after DeleteDevice()", deviceID)
+		}
+	}
+}
+
+func TestConsistentHashRouterUntrustedForwardedBy(t *testing.T) {
+	ctx := context.Background()
+	peers := []string{"peer-a", "peer-b", "peer-c"}
+	databases, dialer := startPeers(t, peers)
+	router, err := proxybuffer.NewConsistentHashRouter(peers[0], peers, numVirtualNodes)
+	if err != nil {
+		t.Fatalf("NewConsistentHashRouter() failed: %v", err)
+	}
+
+	conn, err := grpc.DialContext(ctx, peers[0], grpc.WithInsecure(), dialer)
+	if err != nil {
+		t.Fatalf("failed to connect to test server: %v", err)
+	}
+	defer conn.Close()
+	client := pbp.NewProxyBufferServiceClient(conn)
+
+	// A client claiming to be a peer without authenticating as one is routed
+	// like any other client.
+	spoofed := metadata.AppendToOutgoingContext(ctx, "x-proxybuffer-forwarded-by", "peer-b")
+	for i := 0; i < 10; i++ {
+		record := testRecord(i)
+		if _, err := client.RegisterDevice(spoofed, &pbp.DeviceRegistrationRequest{Record: record}); err != nil {
+			t.Fatalf("RegisterDevice(%q) failed: %v", record.DeviceId, err)
+		}
+		checkStoredOnOwner(t, databases, record.DeviceId, router.Owner(record.DeviceId))
+	}
+}
+
+// peerContext returns an incoming context of a request forwarded by
+// `forwardedBy` over a TLS connection authenticated with a certificate
+// issued to `certName`.
+func peerContext(t *testing.T, forwardedBy, certName string) context.Context {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: certName},
+		DNSNames:     []string{certName},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}, &x509.Certificate{}, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-proxybuffer-forwarded-by", forwardedBy))
+	return peer.NewContext(ctx, &peer.Peer{
+		AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}},
+	})
+}
+
+func TestConsistentHashRouterAuthenticatedForwardedBy(t *testing.T) {
+	peers := []string{"peer-a", "peer-b", "peer-c"}
+	_, dialer := startPeers(t, peers)
+	router, err := proxybuffer.NewConsistentHashRouter(peers[0], peers, numVirtualNodes, grpc.WithInsecure(), dialer)
+	if err != nil {
+		t.Fatalf("NewConsistentHashRouter() failed: %v", err)
+	}
+	defer router.Close()
+
+	// Find a device owned by another peer.
+	var record *rrpb.RegistryRecord
+	for i := 0; record == nil; i++ {
+		if r := testRecord(i); router.Owner(r.DeviceId) != peers[0] {
+			record = r
+		}
+	}
+	request := &pbp.DeviceRegistrationRequest{Record: record}
+
+	for _, tc := range []struct {
+		name        string
+		forwardedBy string
+		certName    string
+		local       bool
+	}{
+		{"authenticated peer", "peer-b", "peer-b", true},
+		{"certificate of another peer", "peer-b", "peer-c", false},
+		{"unknown peer", "peer-d", "peer-d", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			local := false
+			handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+				local = true
+				return &pbp.DeviceRegistrationResponse{}, nil
+			}
+			ctx := peerContext(t, tc.forwardedBy, tc.certName)
+			if _, err := router.UnaryServerInterceptor(ctx, request, &grpc.UnaryServerInfo{}, handler); err != nil {
+				t.Fatalf("UnaryServerInterceptor() failed: %v", err)
+			}
+			if local != tc.local {
+				t.Errorf("request processed locally = %t, want %t", local, tc.local)
+			}
+		})
+	}
+}
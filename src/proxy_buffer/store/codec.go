@@ -0,0 +1,95 @@
+// Copyright lowRISC contributors (OpenTitan project).
+// Licensed under the Apache License, Version 2.0, see LICENSE for details.
+// SPDX-License-Identifier: Apache-2.0
+
+package db
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	rpb "github.com/lowRISC/opentitan-provisioning/src/proto/registry_record_go_pb"
+)
+
+// Codec serializes registry records at the storage boundary.
+type Codec interface {
+	// Name returns the name of the codec.
+	Name() string
+	// Marshal serializes the `rr` registry record.
+	Marshal(rr *rpb.RegistryRecord) ([]byte, error)
+	// Unmarshal deserializes `data` into the `rr` registry record.
+	Unmarshal(data []byte, rr *rpb.RegistryRecord) error
+	// Match returns true if `data` appears to be encoded with this codec.
+	Match(data []byte) bool
+}
+
+// ProtoCodec encodes registry records in protobuf binary format. This is the
+// default codec.
+type ProtoCodec struct{}
+
+// Name returns the name of the codec.
+func (ProtoCodec) Name() string { return "proto" }
+
+// Marshal serializes the `rr` registry record in protobuf binary format.
+func (ProtoCodec) Marshal(rr *rpb.RegistryRecord) ([]byte, error) {
+	return proto.Marshal(rr)
+}
+
+// Unmarshal deserializes protobuf binary `data` into the `rr` registry record.
+func (ProtoCodec) Unmarshal(data []byte, rr *rpb.RegistryRecord) error {
+	return proto.Unmarshal(data, rr)
+}
+
+// Match returns true for any `data` not claimed by a more specific codec.
+func (ProtoCodec) Match(data []byte) bool { return true }
+
+// JSONCodec encodes registry records in protobuf JSON format.
+type JSONCodec struct{}
+
+// Name returns the name of the codec.
+func (JSONCodec) Name() string { return "json" }
+
+// Marshal serializes the `rr` registry record in JSON format.
+func (JSONCodec) Marshal(rr *rpb.RegistryRecord) ([]byte, error) {
+	return protojson.Marshal(rr)
+}
+
+// Unmarshal deserializes JSON `data` into the `rr` registry record.
+func (JSONCodec) Unmarshal(data []byte, rr *rpb.RegistryRecord) error {
+	return protojson.Unmarshal(data, rr)
+}
+
+// Match returns true if `data` is a JSON object, as written by `Marshal`. A
+// protobuf encoded RegistryRecord never starts with '{', as it would decode
+// as a group start tag for field 15. Leading whitespace is not skipped: a
+// protobuf record may start with a '\n' tag followed by a '{' length byte.
+func (JSONCodec) Match(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("{"))
+}
+
+// codecs lists the supported codecs in detection order. The protobuf codec
+// matches any input and must be last.
+var codecs = []Codec{JSONCodec{}, ProtoCodec{}}
+
+// CodecByName returns the codec registered under `name`.
+func CodecByName(name string) (Codec, error) {
+	for _, c := range codecs {
+		if c.Name() == name {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported codec: %q", name)
+}
+
+// detectCodec returns the codec used to encode `data`.
+func detectCodec(data []byte) Codec {
+	for _, c := range codecs {
+		if c.Match(data) {
+			return c
+		}
+	}
+	return ProtoCodec{}
+}
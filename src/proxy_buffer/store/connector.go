@@ -7,15 +7,100 @@ package connector
 
 import (
 	"context"
+	"errors"
+	"time"
 )
 
+// ErrNotFound is returned, possibly wrapped, when there is no record
+// associated with a key.
+var ErrNotFound = errors.New("record not found")
+
+// Forwarding states of a record.
+const (
+	// SyncStateUnsynced indicates that the record has not been forwarded yet.
+	SyncStateUnsynced = iota
+	// SyncStateSynced indicates that the record was forwarded successfully.
+	SyncStateSynced
+	// SyncStateFailed indicates that forwarding the record failed permanently.
+	SyncStateFailed
+)
+
+// Record is a `key` `value` pair returned by `List`.
+type Record struct {
+	Key   string
+	Value []byte
+}
+
+// BatchRecord is a `key` `value` pair inserted by `InsertBatch`.
+type BatchRecord struct {
+	Key   string
+	SKU   string
+	Value []byte
+}
+
 // Connector implements a connection to the database.
 type Connector interface {
 	// Insert a `key` `value` pair to the database.
 	// It should respect context cancellation and timeout.
 	Insert(ctx context.Context, key, sku string, value []byte) error
 
-	// Get returns a value associated with a given `key`.
+	// InsertBatch adds `records` to the database in a single transaction.
+	// Either all or none of the records are inserted.
+	// It should respect context cancellation and timeout.
+	InsertBatch(ctx context.Context, records []BatchRecord) error
+
+	// Get returns a value associated with a given `key`, or an error
+	// wrapping `ErrNotFound` if there is none.
 	// It should respect context cancellation and timeout.
 	Get(ctx context.Context, key string) ([]byte, error)
+
+	// UpdateSyncState sets the forwarding `state` of the records associated
+	// with a given `key`.
+	UpdateSyncState(ctx context.Context, key string, state int) error
+
+	// Prune deletes all records in the forwarding `state` last updated before
+	// `olderThan`, and returns the number of deleted records.
+	Prune(ctx context.Context, state int, olderThan time.Time) (int64, error)
+
+	// InsertIdempotencyKey stores the serialized `response` to a request with
+	// the given idempotency `key`. The entry expires at `expiresAt`. Fails if
+	// an unexpired entry with the same key exists; expired entries are
+	// replaced.
+	InsertIdempotencyKey(ctx context.Context, key, deviceID string, response []byte, expiresAt time.Time) error
+
+	// GetIdempotencyKey returns the serialized response stored with a given
+	// idempotency `key`, or nil if there is no entry that expires after `now`.
+	GetIdempotencyKey(ctx context.Context, key string, now time.Time) ([]byte, error)
+
+	// PruneIdempotencyKeys deletes all idempotency entries expired at `now`,
+	// and returns the number of deleted entries.
+	PruneIdempotencyKeys(ctx context.Context, now time.Time) (int64, error)
+
+	// CountByStatus returns the number of records in each forwarding state.
+	// States without records may be omitted. Synthetic records are not
+	// counted.
+	CountByStatus(ctx context.Context) (map[int]int64, error)
+
+	// InsertSynthetic adds a synthetic `key` `value` pair to the database,
+	// e.g. for health checks. Synthetic records are excluded from
+	// `CountByStatus` and `Prune`.
+	InsertSynthetic(ctx context.Context, key, sku string, value []byte) error
+
+	// List returns up to `limit` records with a key greater than `after`,
+	// ordered by key. Only the latest value of each key is returned.
+	// Synthetic records are skipped.
+	List(ctx context.Context, after string, limit int) ([]Record, error)
+
+	// DeleteSynthetic deletes the synthetic records associated with a given
+	// `key`. Non-synthetic records are never deleted.
+	DeleteSynthetic(ctx context.Context, key string) error
+
+	// Delete deletes all the records associated with a given `key`, and
+	// reports whether any record was deleted. Synthetic records are never
+	// deleted.
+	Delete(ctx context.Context, key string) (bool, error)
+
+	// Close closes the connection to the database. No other method may be
+	// called afterwards.
+	Close() error
 }
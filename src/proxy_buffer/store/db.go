@@ -8,8 +8,9 @@ package db
 import (
 	"context"
 	"fmt"
-
-	"github.com/golang/protobuf/proto"
+	"log"
+	"sync"
+	"time"
 
 	rpb "github.com/lowRISC/opentitan-provisioning/src/proto/registry_record_go_pb"
 	"github.com/lowRISC/opentitan-provisioning/src/proxy_buffer/store/connector"
@@ -17,36 +18,377 @@ import (
 
 // DB implements the Proxy Buffer database abstraction layer.
 type DB struct {
+	// connMu guards conn and dsn, which are replaced when credentials are
+	// rotated.
+	connMu sync.RWMutex
 	// conn is the database connector interface.
-	conn connector.Connector
+	conn *activeConn
+	// secrets provides the `dsnSecret` connection string used to open conn
+	// with `open`. Only set by `NewFromSecret`.
+	secrets   SecretProvider
+	dsnSecret string
+	dsn       string
+	open      Opener
+	// fileDSN is set if dsn is a database file path. See `WithFileDSN`.
+	fileDSN bool
+	// codec is used to serialize registry records on insertion.
+	codec Codec
+	// countTTL is the lifetime of cached `CountByStatus` results.
+	countTTL time.Duration
+	// counts caches the result of `CountByStatus`.
+	counts *countCache
+}
+
+// activeConn is a database connector along with the calls in flight on it,
+// so that it is only closed once they complete after being replaced.
+type activeConn struct {
+	connector.Connector
+	inFlight sync.WaitGroup
+}
+
+// countCache is a concurrency safe cache of record counts.
+type countCache struct {
+	// mu guards access to all fields below. It is held while refreshing the
+	// cache, so concurrent readers wait for a single query to complete.
+	mu        sync.Mutex
+	counts    map[int]int64
+	expiresAt time.Time
+}
+
+// defaultCountCacheTTL is the lifetime of cached record counts used when
+// `WithCountCacheTTL` is not set.
+const defaultCountCacheTTL = 5 * time.Second
+
+// Option configures optional behavior of the database layer.
+type Option func(*DB)
+
+// WithCodec sets the codec used to serialize new registry records. Records
+// are always read back with the codec they were written with.
+func WithCodec(c Codec) Option {
+	return func(d *DB) {
+		d.codec = c
+	}
+}
+
+// WithCountCacheTTL sets the lifetime of cached `CountByStatus` results. A zero
+// `ttl` disables caching.
+func WithCountCacheTTL(ttl time.Duration) Option {
+	return func(d *DB) {
+		d.countTTL = ttl
+	}
+}
+
+// WithFileDSN marks the connection string of `NewFromSecret` as the path of
+// a database file, such as the ones opened by `filedb.New`, rather than
+// credentials. A rotated secret then makes `RefreshCredentials` fail instead
+// of silently reopening a different, possibly empty, database file.
+func WithFileDSN() Option {
+	return func(d *DB) {
+		d.fileDSN = true
+	}
 }
 
 // New creates a database `DB` instance with a given `c` databace connection.
-func New(c connector.Connector) *DB {
-	return &DB{conn: c}
+func New(c connector.Connector, opts ...Option) *DB {
+	d := &DB{
+		conn:     &activeConn{Connector: c},
+		codec:    ProtoCodec{},
+		countTTL: defaultCountCacheTTL,
+		counts:   &countCache{},
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// Opener opens a database connector given a `dsn` connection string.
+type Opener func(dsn string) (connector.Connector, error)
+
+// NewFromSecret creates a database `DB` instance connected with `open` using
+// the connection string stored in the `dsnSecret` secret of the `secrets`
+// provider. This avoids passing database credentials on the command line.
+//
+// If `refreshInterval` is non-zero, the secret is read again at that interval
+// until `ctx` is done, and the database is reconnected when the secret has
+// been rotated. The interval should be shorter than the lifetime of the
+// credentials. See `RefreshCredentials`.
+func NewFromSecret(ctx context.Context, secrets SecretProvider, dsnSecret string, open Opener, refreshInterval time.Duration, opts ...Option) (*DB, error) {
+	dsn, err := secrets.GetSecret(ctx, dsnSecret)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get database credentials: %v", err)
+	}
+	c, err := open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	d := New(c, opts...)
+	d.secrets = secrets
+	d.dsnSecret = dsnSecret
+	d.dsn = dsn
+	d.open = open
+
+	if refreshInterval > 0 {
+		go func() {
+			ticker := time.NewTicker(refreshInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					if err := d.RefreshCredentials(ctx); err != nil {
+						log.Printf("Failed to refresh database credentials: %v", err)
+					}
+				}
+			}
+		}()
+	}
+	return d, nil
+}
+
+// RefreshCredentials reads the connection string secret and, if it changed,
+// reconnects to the database with the new credentials. Requests in flight
+// complete on the previous connection, which is closed once they are done.
+// It is a no-op for instances not created with `NewFromSecret`, and fails for
+// instances created `WithFileDSN`.
+func (d *DB) RefreshCredentials(ctx context.Context) error {
+	if d.secrets == nil {
+		return nil
+	}
+	dsn, err := d.secrets.GetSecret(ctx, d.dsnSecret)
+	if err != nil {
+		return fmt.Errorf("failed to get database credentials: %v", err)
+	}
+
+	d.connMu.RLock()
+	unchanged := dsn == d.dsn
+	d.connMu.RUnlock()
+	if unchanged {
+		return nil
+	}
+	if d.fileDSN {
+		return fmt.Errorf("secret %q changed, but the database is a file without credentials: not reopening it", d.dsnSecret)
+	}
+
+	c, err := d.open(dsn)
+	if err != nil {
+		return fmt.Errorf("failed to reconnect with rotated credentials: %v", err)
+	}
+	d.connMu.Lock()
+	old := d.conn
+	d.conn = &activeConn{Connector: c}
+	d.dsn = dsn
+	d.connMu.Unlock()
+
+	// No call can start on the previous connector once replaced.
+	go func() {
+		old.inFlight.Wait()
+		if err := old.Close(); err != nil {
+			log.Printf("Failed to close database connection with rotated credentials: %v", err)
+		}
+	}()
+	return nil
+}
+
+// connector returns the current database connector, and a function to call
+// once done with it.
+func (d *DB) connector() (connector.Connector, func()) {
+	d.connMu.RLock()
+	defer d.connMu.RUnlock()
+	c := d.conn
+	c.inFlight.Add(1)
+	return c.Connector, c.inFlight.Done
 }
 
 // InsertDevice adds a `rr` registry record into the database in serialized
 // bytes format.
 func (d *DB) InsertDevice(ctx context.Context, rr *rpb.RegistryRecord) error {
 	key := rr.DeviceId
-	data, err := proto.Marshal(rr)
+	data, err := d.codec.Marshal(rr)
 	if err != nil {
 		return fmt.Errorf("failed to marshal registry record: %v", err)
 	}
-	return d.conn.Insert(ctx, key, rr.Sku, data)
+	c, done := d.connector()
+	defer done()
+	return c.Insert(ctx, key, rr.Sku, data)
+}
+
+// InsertDeviceBatch adds the `records` registry records into the database in
+// a single transaction. Either all or none of the records are inserted.
+func (d *DB) InsertDeviceBatch(ctx context.Context, records []*rpb.RegistryRecord) error {
+	batch := make([]connector.BatchRecord, len(records))
+	for i, rr := range records {
+		data, err := d.codec.Marshal(rr)
+		if err != nil {
+			return fmt.Errorf("failed to marshal registry record %q: %v", rr.DeviceId, err)
+		}
+		batch[i] = connector.BatchRecord{Key: rr.DeviceId, SKU: rr.Sku, Value: data}
+	}
+	c, done := d.connector()
+	defer done()
+	return c.InsertBatch(ctx, batch)
 }
 
 // GetDevice returns a device record associated with a `di` device id. The
-// result is returned in protobuf format.
+// result is returned in protobuf format. Returns an error wrapping
+// `connector.ErrNotFound` if there is no such record.
 func (d *DB) GetDevice(ctx context.Context, di string) (*rpb.RegistryRecord, error) {
-	rr_bytes, err := d.conn.Get(ctx, di)
+	c, done := d.connector()
+	defer done()
+	rr_bytes, err := c.Get(ctx, di)
 	if err != nil {
 		return nil, err
 	}
 	record := &rpb.RegistryRecord{}
-	if err := proto.Unmarshal(rr_bytes, record); err != nil {
+	if err := detectCodec(rr_bytes).Unmarshal(rr_bytes, record); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal registry record: %v", err)
 	}
 	return record, nil
 }
+
+// ListDevices returns up to `limit` device records with a device id greater
+// than `after`, ordered by device id. Synthetic records are skipped. Pass the
+// device id of the last returned record as `after` to get the next batch.
+func (d *DB) ListDevices(ctx context.Context, after string, limit int) ([]*rpb.RegistryRecord, error) {
+	c, done := d.connector()
+	defer done()
+	rows, err := c.List(ctx, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]*rpb.RegistryRecord, len(rows))
+	for i, row := range rows {
+		records[i] = &rpb.RegistryRecord{}
+		if err := detectCodec(row.Value).Unmarshal(row.Value, records[i]); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal registry record %q: %v", row.Key, err)
+		}
+	}
+	return records, nil
+}
+
+// DeleteDevice deletes the registry record associated with a `di` device id,
+// e.g. once it has been consumed downstream. Reports whether a record was
+// deleted. Synthetic records are not deleted.
+func (d *DB) DeleteDevice(ctx context.Context, di string) (bool, error) {
+	c, done := d.connector()
+	defer done()
+	return c.Delete(ctx, di)
+}
+
+// InsertSyntheticDevice adds a synthetic `rr` registry record into the
+// database. Synthetic records are excluded from record counts and pruning.
+func (d *DB) InsertSyntheticDevice(ctx context.Context, rr *rpb.RegistryRecord) error {
+	data, err := d.codec.Marshal(rr)
+	if err != nil {
+		return fmt.Errorf("failed to marshal registry record: %v", err)
+	}
+	c, done := d.connector()
+	defer done()
+	return c.InsertSynthetic(ctx, rr.DeviceId, rr.Sku, data)
+}
+
+// DeleteSyntheticDevice deletes the synthetic record associated with a `di`
+// device id.
+func (d *DB) DeleteSyntheticDevice(ctx context.Context, di string) error {
+	c, done := d.connector()
+	defer done()
+	return c.DeleteSynthetic(ctx, di)
+}
+
+// MarkForwarded records that the registry record associated with a `di`
+// device id was forwarded successfully.
+func (d *DB) MarkForwarded(ctx context.Context, di string) error {
+	c, done := d.connector()
+	defer done()
+	return c.UpdateSyncState(ctx, di, connector.SyncStateSynced)
+}
+
+// MarkFailed records that forwarding the registry record associated with a
+// `di` device id failed permanently.
+func (d *DB) MarkFailed(ctx context.Context, di string) error {
+	c, done := d.connector()
+	defer done()
+	return c.UpdateSyncState(ctx, di, connector.SyncStateFailed)
+}
+
+// PruneForwarded deletes forwarded records last updated before `olderThan`,
+// and returns the number of deleted records.
+func (d *DB) PruneForwarded(ctx context.Context, olderThan time.Time) (int64, error) {
+	c, done := d.connector()
+	defer done()
+	return c.Prune(ctx, connector.SyncStateSynced, olderThan)
+}
+
+// PruneDeadLetter deletes records that failed forwarding and were last
+// updated before `olderThan`, and returns the number of deleted records.
+func (d *DB) PruneDeadLetter(ctx context.Context, olderThan time.Time) (int64, error) {
+	c, done := d.connector()
+	defer done()
+	return c.Prune(ctx, connector.SyncStateFailed, olderThan)
+}
+
+// GetIdempotentResponse returns the serialized response stored for the given
+// idempotency `key`, or nil if there is no unexpired entry.
+func (d *DB) GetIdempotentResponse(ctx context.Context, key string) ([]byte, error) {
+	c, done := d.connector()
+	defer done()
+	return c.GetIdempotencyKey(ctx, key, time.Now())
+}
+
+// InsertIdempotentResponse stores the serialized `response` to the request
+// with the given idempotency `key` and `di` device id. The entry expires after
+// `ttl`.
+func (d *DB) InsertIdempotentResponse(ctx context.Context, key, di string, response []byte, ttl time.Duration) error {
+	c, done := d.connector()
+	defer done()
+	return c.InsertIdempotencyKey(ctx, key, di, response, time.Now().Add(ttl))
+}
+
+// PruneIdempotencyKeys deletes expired idempotency entries, and returns the
+// number of deleted entries.
+func (d *DB) PruneIdempotencyKeys(ctx context.Context) (int64, error) {
+	c, done := d.connector()
+	defer done()
+	return c.PruneIdempotencyKeys(ctx, time.Now())
+}
+
+// CountByStatus returns the number of records in each forwarding state,
+// indexed by `connector.SyncState*` values.
+//
+// Results are cached for the configured TTL so that frequent metrics scrapes
+// do not query the database every time. Use `RefreshCounts` to bypass the
+// cache.
+func (d *DB) CountByStatus(ctx context.Context) (map[int]int64, error) {
+	return d.countByStatus(ctx, false)
+}
+
+// RefreshCounts queries the number of records in each forwarding state and
+// updates the `CountByStatus` cache.
+func (d *DB) RefreshCounts(ctx context.Context) (map[int]int64, error) {
+	return d.countByStatus(ctx, true)
+}
+
+func (d *DB) countByStatus(ctx context.Context, refresh bool) (map[int]int64, error) {
+	d.counts.mu.Lock()
+	defer d.counts.mu.Unlock()
+
+	now := time.Now()
+	if refresh || d.counts.counts == nil || !now.Before(d.counts.expiresAt) {
+		c, done := d.connector()
+		counts, err := c.CountByStatus(ctx)
+		done()
+		if err != nil {
+			return nil, err
+		}
+		d.counts.counts = counts
+		d.counts.expiresAt = now.Add(d.countTTL)
+	}
+
+	// Return a copy so that callers cannot modify the cached value.
+	counts := make(map[int]int64, len(d.counts.counts))
+	for state, n := range d.counts.counts {
+		counts[state] = n
+	}
+	return counts, nil
+}
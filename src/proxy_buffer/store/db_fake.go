@@ -9,6 +9,9 @@ package db_fake
 import (
 	"context"
 	"fmt"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/lowRISC/opentitan-provisioning/src/proxy_buffer/store/connector"
 )
@@ -22,6 +25,9 @@ type versionedKey struct {
 // fakeDB is a fake database implementation. It implements the
 // `connector.Connector` interface.
 type fakeDB struct {
+	// mu guards access to all fields below.
+	mu sync.Mutex
+
 	// keyVersions is a map of plain keys to the lastest version number. The
 	// number of records associated with a key is equivalent to the latest
 	// version number.
@@ -30,6 +36,25 @@ type fakeDB struct {
 	// db is a map of versioned keys to string values. This is the main
 	// database storage container.
 	db map[versionedKey][]byte
+
+	// states is a map of plain keys to record forwarding states.
+	states map[string]keyState
+
+	// idempotency is a map of idempotency keys to stored responses.
+	idempotency map[string]idempotencyEntry
+}
+
+// idempotencyEntry is a stored response to an idempotent request.
+type idempotencyEntry struct {
+	response  []byte
+	expiresAt time.Time
+}
+
+// keyState tracks the forwarding state of a key.
+type keyState struct {
+	state     int
+	updatedAt time.Time
+	synthetic bool
 }
 
 // New creates a database connector.
@@ -37,28 +62,222 @@ func New() connector.Connector {
 	return &fakeDB{
 		keyVersions: map[string]uint32{},
 		db:          map[versionedKey][]byte{},
+		states:      map[string]keyState{},
+		idempotency: map[string]idempotencyEntry{},
 	}
 }
 
 // Insert adds a `key` `value` pair to the database. Multiple calls with the
 // same key will succeed, emulating the behavior of an real database.
 func (c *fakeDB) Insert(ctx context.Context, key, sku string, value []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.insert(key, value)
+	return nil
+}
+
+// InsertBatch adds `records` to the database. The fake database never fails,
+// so all records are inserted.
+func (c *fakeDB) InsertBatch(ctx context.Context, records []connector.BatchRecord) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, r := range records {
+		c.insert(r.Key, r.Value)
+	}
+	return nil
+}
+
+// insert adds a new version of the `key` `value` pair. The caller must hold
+// `c.mu`.
+func (c *fakeDB) insert(key string, value []byte) {
 	verK := versionedKey{key: key, version: 0}
 	if ver, found := c.keyVersions[key]; found {
 		verK.version = ver + 1
 	}
 	c.keyVersions[key] = verK.version
 	c.db[verK] = value
-	return nil
+	c.states[key] = keyState{state: connector.SyncStateUnsynced, updatedAt: time.Now()}
 }
 
 // Get gets the latest insterted value associated with a given `key`.
 func (c *fakeDB) Get(ctx context.Context, key string) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	verK := versionedKey{key: key}
 	ver, found := c.keyVersions[key]
 	if !found {
-		return nil, fmt.Errorf("record not found key: %q", key)
+		return nil, fmt.Errorf("%w key: %q", connector.ErrNotFound, key)
 	}
 	verK.version = ver
 	return c.db[verK], nil
 }
+
+// UpdateSyncState sets the forwarding `state` of the records associated with
+// a given `key`.
+func (c *fakeDB) UpdateSyncState(ctx context.Context, key string, state int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, found := c.keyVersions[key]; !found {
+		return fmt.Errorf("record not found key: %q", key)
+	}
+	c.states[key] = keyState{state: state, updatedAt: time.Now(), synthetic: c.states[key].synthetic}
+	return nil
+}
+
+// Prune deletes all records in the forwarding `state` last updated before
+// `olderThan`.
+func (c *fakeDB) Prune(ctx context.Context, state int, olderThan time.Time) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var n int64
+	for key, ks := range c.states {
+		if ks.state != state || !ks.updatedAt.Before(olderThan) || ks.synthetic {
+			continue
+		}
+		for v := uint32(0); v <= c.keyVersions[key]; v++ {
+			delete(c.db, versionedKey{key: key, version: v})
+			n++
+		}
+		delete(c.keyVersions, key)
+		delete(c.states, key)
+	}
+	return n, nil
+}
+
+// InsertIdempotencyKey stores the serialized `response` to a request with the
+// given idempotency `key`. Fails if an unexpired entry with the key already
+// exists.
+func (c *fakeDB) InsertIdempotencyKey(ctx context.Context, key, deviceID string, response []byte, expiresAt time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, found := c.idempotency[key]; found && e.expiresAt.After(time.Now()) {
+		return fmt.Errorf("idempotency key already exists: %q", key)
+	}
+	c.idempotency[key] = idempotencyEntry{response: response, expiresAt: expiresAt}
+	return nil
+}
+
+// GetIdempotencyKey returns the serialized response stored with a given
+// idempotency `key`, or nil if there is no unexpired entry.
+func (c *fakeDB) GetIdempotencyKey(ctx context.Context, key string, now time.Time) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, found := c.idempotency[key]
+	if !found || !e.expiresAt.After(now) {
+		return nil, nil
+	}
+	return e.response, nil
+}
+
+// PruneIdempotencyKeys deletes all idempotency entries expired at `now`.
+func (c *fakeDB) PruneIdempotencyKeys(ctx context.Context, now time.Time) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var n int64
+	for key, e := range c.idempotency {
+		if !e.expiresAt.After(now) {
+			delete(c.idempotency, key)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// CountByStatus returns the number of keys in each forwarding state.
+func (c *fakeDB) CountByStatus(ctx context.Context) (map[int]int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	counts := map[int]int64{}
+	for _, ks := range c.states {
+		if !ks.synthetic {
+			counts[ks.state]++
+		}
+	}
+	return counts, nil
+}
+
+// InsertSynthetic adds a synthetic `key` `value` pair to the database.
+func (c *fakeDB) InsertSynthetic(ctx context.Context, key, sku string, value []byte) error {
+	if err := c.Insert(ctx, key, sku, value); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ks := c.states[key]
+	ks.synthetic = true
+	c.states[key] = ks
+	return nil
+}
+
+// DeleteSynthetic deletes all versions of the synthetic records associated
+// with a given `key`.
+func (c *fakeDB) DeleteSynthetic(ctx context.Context, key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ver, found := c.keyVersions[key]
+	if !found || !c.states[key].synthetic {
+		return fmt.Errorf("synthetic record not found key: %q", key)
+	}
+	for v := uint32(0); v <= ver; v++ {
+		delete(c.db, versionedKey{key: key, version: v})
+	}
+	delete(c.keyVersions, key)
+	delete(c.states, key)
+	return nil
+}
+
+// Delete deletes all versions of the non-synthetic records associated with a
+// given `key`.
+func (c *fakeDB) Delete(ctx context.Context, key string) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ver, found := c.keyVersions[key]
+	if !found || c.states[key].synthetic {
+		return false, nil
+	}
+	for v := uint32(0); v <= ver; v++ {
+		delete(c.db, versionedKey{key: key, version: v})
+	}
+	delete(c.keyVersions, key)
+	delete(c.states, key)
+	return true, nil
+}
+
+// List returns up to `limit` non-synthetic records with a key greater than
+// `after`, ordered by key.
+func (c *fakeDB) List(ctx context.Context, after string, limit int) ([]connector.Record, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var keys []string
+	for key := range c.keyVersions {
+		if key > after && !c.states[key].synthetic {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	if len(keys) > limit {
+		keys = keys[:limit]
+	}
+	records := make([]connector.Record, len(keys))
+	for i, key := range keys {
+		records[i] = connector.Record{Key: key, Value: c.db[versionedKey{key: key, version: c.keyVersions[key]}]}
+	}
+	return records, nil
+}
+
+// Close is a no-op, as the fake database holds no connection.
+func (c *fakeDB) Close() error {
+	return nil
+}
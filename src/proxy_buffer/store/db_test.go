@@ -7,12 +7,17 @@ package db_test
 
 import (
 	"context"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/google/go-cmp/cmp"
 	"google.golang.org/protobuf/testing/protocmp"
 
 	dtd "github.com/lowRISC/opentitan-provisioning/src/proto/device_testdata"
+	rrpb "github.com/lowRISC/opentitan-provisioning/src/proto/registry_record_go_pb"
+	"github.com/lowRISC/opentitan-provisioning/src/proxy_buffer/store/connector"
 	"github.com/lowRISC/opentitan-provisioning/src/proxy_buffer/store/db"
 	"github.com/lowRISC/opentitan-provisioning/src/proxy_buffer/store/db_fake"
 )
@@ -34,3 +39,207 @@ func TestInsert(t *testing.T) {
 		t.Errorf("GetDevice() returned unexpected diff (-want +got):\n%s", diff)
 	}
 }
+
+func TestInsertDeviceBatch(t *testing.T) {
+	database := db.New(db_fake.New())
+	var records []*rrpb.RegistryRecord
+	for _, id := range []string{"0001", "0002", "0003"} {
+		record := proto.Clone(&dtd.RegistryRecordOk).(*rrpb.RegistryRecord)
+		record.DeviceId = id
+		records = append(records, record)
+	}
+
+	if err := database.InsertDeviceBatch(context.Background(), records); err != nil {
+		t.Fatalf("failed to insert records: %v", err)
+	}
+
+	for _, record := range records {
+		got, err := database.GetDevice(context.Background(), record.DeviceId)
+		if err != nil {
+			t.Fatalf("failed to get record %q: %v", record.DeviceId, err)
+		}
+		if diff := cmp.Diff(record, got, protocmp.Transform()); diff != "" {
+			t.Errorf("GetDevice(%q) returned unexpected diff (-want +got):\n%s", record.DeviceId, diff)
+		}
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	record := &dtd.RegistryRecordOk
+	for _, name := range []string{"proto", "json"} {
+		t.Run(name, func(t *testing.T) {
+			codec, err := db.CodecByName(name)
+			if err != nil {
+				t.Fatalf("failed to get codec: %v", err)
+			}
+			database := db.New(db_fake.New(), db.WithCodec(codec))
+			if err := database.InsertDevice(context.Background(), record); err != nil {
+				t.Fatalf("failed to insert record: %v", err)
+			}
+			got, err := database.GetDevice(context.Background(), record.DeviceId)
+			if err != nil {
+				t.Fatalf("failed to get record: %v", err)
+			}
+			if diff := cmp.Diff(record, got, protocmp.Transform()); diff != "" {
+				t.Errorf("GetDevice() returned unexpected diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCodecDetection(t *testing.T) {
+	conn := db_fake.New()
+	record := &dtd.RegistryRecordOk
+
+	// Write the record in protobuf format and read it back through a database
+	// configured to write JSON records.
+	if err := db.New(conn).InsertDevice(context.Background(), record); err != nil {
+		t.Fatalf("failed to insert record: %v", err)
+	}
+	got, err := db.New(conn, db.WithCodec(db.JSONCodec{})).GetDevice(context.Background(), record.DeviceId)
+	if err != nil {
+		t.Fatalf("failed to get record: %v", err)
+	}
+	if diff := cmp.Diff(record, got, protocmp.Transform()); diff != "" {
+		t.Errorf("GetDevice() returned unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestCodecDetectionLengthPrefix(t *testing.T) {
+	// A 123 byte device ID is encoded with a '\n' tag followed by a '{'
+	// length byte, which must not be mistaken for JSON.
+	record := proto.Clone(&dtd.RegistryRecordOk).(*rrpb.RegistryRecord)
+	record.DeviceId = strings.Repeat("a", 123)
+	data, err := db.ProtoCodec{}.Marshal(record)
+	if err != nil {
+		t.Fatalf("failed to marshal record: %v", err)
+	}
+	if !strings.HasPrefix(string(data), "\n{") {
+		t.Fatalf("protobuf record starts with %q, want %q", data[:2], "\n{")
+	}
+	if (db.JSONCodec{}).Match(data) {
+		t.Error("JSONCodec.Match() = true for a protobuf record")
+	}
+
+	conn := db_fake.New()
+	if err := db.New(conn).InsertDevice(context.Background(), record); err != nil {
+		t.Fatalf("failed to insert record: %v", err)
+	}
+	got, err := db.New(conn, db.WithCodec(db.JSONCodec{})).GetDevice(context.Background(), record.DeviceId)
+	if err != nil {
+		t.Fatalf("failed to get record: %v", err)
+	}
+	if diff := cmp.Diff(record, got, protocmp.Transform()); diff != "" {
+		t.Errorf("GetDevice() returned unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestCodecByNameUnsupported(t *testing.T) {
+	if _, err := db.CodecByName("xml"); err == nil {
+		t.Error("expected error for unsupported codec")
+	}
+}
+
+func TestPrune(t *testing.T) {
+	ctx := context.Background()
+	database := db.New(db_fake.New())
+
+	forwarded := proto.Clone(&dtd.RegistryRecordOk).(*rrpb.RegistryRecord)
+	forwarded.DeviceId = "forwarded"
+	failed := proto.Clone(&dtd.RegistryRecordOk).(*rrpb.RegistryRecord)
+	failed.DeviceId = "failed"
+	pending := proto.Clone(&dtd.RegistryRecordOk).(*rrpb.RegistryRecord)
+	pending.DeviceId = "pending"
+	for _, rr := range []*rrpb.RegistryRecord{forwarded, failed, pending} {
+		if err := database.InsertDevice(ctx, rr); err != nil {
+			t.Fatalf("failed to insert record: %v", err)
+		}
+	}
+	if err := database.MarkForwarded(ctx, forwarded.DeviceId); err != nil {
+		t.Fatalf("failed to mark record as forwarded: %v", err)
+	}
+	if err := database.MarkFailed(ctx, failed.DeviceId); err != nil {
+		t.Fatalf("failed to mark record as failed: %v", err)
+	}
+
+	// Records updated after the cutoff must be retained.
+	n, err := database.PruneForwarded(ctx, time.Now().Add(-time.Hour))
+	if err != nil || n != 0 {
+		t.Errorf("PruneForwarded() = %d, %v; want 0, nil", n, err)
+	}
+
+	cutoff := time.Now().Add(time.Second)
+	if n, err := database.PruneForwarded(ctx, cutoff); err != nil || n != 1 {
+		t.Errorf("PruneForwarded() = %d, %v; want 1, nil", n, err)
+	}
+	if _, err := database.GetDevice(ctx, forwarded.DeviceId); err == nil {
+		t.Errorf("expected forwarded record to be pruned")
+	}
+	if _, err := database.GetDevice(ctx, failed.DeviceId); err != nil {
+		t.Errorf("expected failed record to be retained: %v", err)
+	}
+
+	if n, err := database.PruneDeadLetter(ctx, cutoff); err != nil || n != 1 {
+		t.Errorf("PruneDeadLetter() = %d, %v; want 1, nil", n, err)
+	}
+	if _, err := database.GetDevice(ctx, failed.DeviceId); err == nil {
+		t.Errorf("expected failed record to be pruned")
+	}
+
+	// Records that have not been forwarded are never pruned.
+	if _, err := database.GetDevice(ctx, pending.DeviceId); err != nil {
+		t.Errorf("expected pending record to be retained: %v", err)
+	}
+}
+
+func TestCountByStatusCache(t *testing.T) {
+	ctx := context.Background()
+	const ttl = 200 * time.Millisecond
+	database := db.New(db_fake.New(), db.WithCountCacheTTL(ttl))
+
+	insert := func(di string) {
+		t.Helper()
+		rr := proto.Clone(&dtd.RegistryRecordOk).(*rrpb.RegistryRecord)
+		rr.DeviceId = di
+		if err := database.InsertDevice(ctx, rr); err != nil {
+			t.Fatalf("failed to insert record: %v", err)
+		}
+	}
+	unsynced := func() int64 {
+		t.Helper()
+		counts, err := database.CountByStatus(ctx)
+		if err != nil {
+			t.Fatalf("CountByStatus() failed: %v", err)
+		}
+		return counts[connector.SyncStateUnsynced]
+	}
+
+	insert("device-0")
+	if got := unsynced(); got != 1 {
+		t.Errorf("CountByStatus() = %d unsynced records, want 1", got)
+	}
+
+	// Inserts are not visible until the cached value expires.
+	insert("device-1")
+	if got := unsynced(); got != 1 {
+		t.Errorf("CountByStatus() within TTL = %d unsynced records, want cached 1", got)
+	}
+
+	time.Sleep(ttl)
+	if got := unsynced(); got != 2 {
+		t.Errorf("CountByStatus() after TTL = %d unsynced records, want 2", got)
+	}
+
+	// A forced refresh bypasses the cache.
+	insert("device-2")
+	counts, err := database.RefreshCounts(ctx)
+	if err != nil {
+		t.Fatalf("RefreshCounts() failed: %v", err)
+	}
+	if got := counts[connector.SyncStateUnsynced]; got != 3 {
+		t.Errorf("RefreshCounts() = %d unsynced records, want 3", got)
+	}
+	if got := unsynced(); got != 3 {
+		t.Errorf("CountByStatus() after refresh = %d unsynced records, want 3", got)
+	}
+}
@@ -7,6 +7,7 @@ package filedb
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sync"
 	"time"
@@ -18,8 +19,9 @@ import (
 )
 
 const (
-	UNSYNCED = iota
-	SYNCED
+	UNSYNCED = connector.SyncStateUnsynced
+	SYNCED   = connector.SyncStateSynced
+	FAILED   = connector.SyncStateFailed
 )
 
 type sqliteDB struct {
@@ -34,6 +36,22 @@ type deviceSchema struct {
 	CreatedAt time.Time
 	UpdatedAt time.Time
 	SyncState int
+	// Synthetic marks records inserted by health checks.
+	Synthetic bool `gorm:"not null;default:false"`
+}
+
+// idempotencySchema represents the schema of the idempotency key table.
+type idempotencySchema struct {
+	IdempotencyKey string `gorm:"primarykey;index:idx_idempotency_key_expiry,priority:1"`
+	DeviceID       string
+	ResponseProto  []byte
+	CreatedAt      time.Time
+	ExpiresAt      time.Time `gorm:"index:idx_idempotency_key_expiry,priority:2"`
+}
+
+// TableName returns the name of the idempotency key table.
+func (idempotencySchema) TableName() string {
+	return "idempotency_keys"
 }
 
 var writeMutex sync.Mutex
@@ -49,7 +67,15 @@ func New(db_path string) (connector.Connector, error) {
 	db.Exec("PRAGMA busy_timeout = 5000;")
 	db.Exec("PRAGMA synchronous=NORMAL;")
 
-	db.AutoMigrate(&deviceSchema{})
+	// Records created before the `synthetic` column was added are real
+	// records. Backfill them in case the column was added as nullable, which
+	// would exclude them from the `synthetic = false` queries.
+	if db.Migrator().HasColumn(&deviceSchema{}, "Synthetic") {
+		if r := db.Exec("UPDATE device_schemas SET synthetic = false WHERE synthetic IS NULL"); r.Error != nil {
+			return nil, fmt.Errorf("failed to backfill synthetic column: %v", r.Error)
+		}
+	}
+	db.AutoMigrate(&deviceSchema{}, &idempotencySchema{})
 	return &sqliteDB{db: db}, nil
 }
 
@@ -66,12 +92,192 @@ func (s *sqliteDB) Insert(ctx context.Context, key, sku string, value []byte) er
 	return nil
 }
 
+// InsertBatch adds `records` to the database in a single transaction. The
+// transaction is rolled back if any record fails to be inserted, e.g. because
+// its key already exists.
+func (s *sqliteDB) InsertBatch(ctx context.Context, records []connector.BatchRecord) error {
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		for _, rec := range records {
+			r := tx.Create(&deviceSchema{DeviceID: rec.Key, SKU: rec.SKU, Device: rec.Value, SyncState: UNSYNCED})
+			if r.Error != nil {
+				return fmt.Errorf("failed to insert data with key: %q, error: %v", rec.Key, r.Error)
+			}
+		}
+		return nil
+	})
+}
+
 // Get gets the latest insterted value associated with a given `key`.
 func (s *sqliteDB) Get(ctx context.Context, key string) ([]byte, error) {
 	var device deviceSchema
 	r := s.db.Last(&device, "device_id = ?", key)
+	if errors.Is(r.Error, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("%w key: %q", connector.ErrNotFound, key)
+	}
 	if r.Error != nil {
 		return nil, fmt.Errorf("failed to get data associated with key: %q, error: %v", key, r.Error)
 	}
 	return device.Device, nil
 }
+
+// UpdateSyncState sets the forwarding `state` of the record associated with a
+// given `key`.
+func (s *sqliteDB) UpdateSyncState(ctx context.Context, key string, state int) error {
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+
+	r := s.db.Model(&deviceSchema{}).Where("device_id = ?", key).Update("sync_state", state)
+	if r.Error != nil {
+		return fmt.Errorf("failed to update sync state with key: %q, error: %v", key, r.Error)
+	}
+	if r.RowsAffected == 0 {
+		return fmt.Errorf("record not found key: %q", key)
+	}
+	return nil
+}
+
+// Prune deletes all records in the forwarding `state` last updated before
+// `olderThan`.
+func (s *sqliteDB) Prune(ctx context.Context, state int, olderThan time.Time) (int64, error) {
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+
+	r := s.db.Where("sync_state = ? AND updated_at < ? AND synthetic = ?", state, olderThan, false).Delete(&deviceSchema{})
+	if r.Error != nil {
+		return 0, fmt.Errorf("failed to prune records in state %d, error: %v", state, r.Error)
+	}
+	return r.RowsAffected, nil
+}
+
+// InsertIdempotencyKey stores the serialized `response` to a request with the
+// given idempotency `key`. An expired entry with the same key that was not
+// pruned yet is replaced.
+func (s *sqliteDB) InsertIdempotencyKey(ctx context.Context, key, deviceID string, response []byte, expiresAt time.Time) error {
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if r := tx.Where("idempotency_key = ? AND expires_at <= ?", key, time.Now()).Delete(&idempotencySchema{}); r.Error != nil {
+			return r.Error
+		}
+		return tx.Create(&idempotencySchema{
+			IdempotencyKey: key,
+			DeviceID:       deviceID,
+			ResponseProto:  response,
+			ExpiresAt:      expiresAt,
+		}).Error
+	})
+	if err != nil {
+		return fmt.Errorf("failed to insert idempotency key: %q, error: %v", key, err)
+	}
+	return nil
+}
+
+// GetIdempotencyKey returns the serialized response stored with a given
+// idempotency `key`, or nil if there is no unexpired entry.
+func (s *sqliteDB) GetIdempotencyKey(ctx context.Context, key string, now time.Time) ([]byte, error) {
+	var entries []idempotencySchema
+	r := s.db.Where("idempotency_key = ? AND expires_at > ?", key, now).Limit(1).Find(&entries)
+	if r.Error != nil {
+		return nil, fmt.Errorf("failed to get idempotency key: %q, error: %v", key, r.Error)
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	return entries[0].ResponseProto, nil
+}
+
+// PruneIdempotencyKeys deletes all idempotency entries expired at `now`.
+func (s *sqliteDB) PruneIdempotencyKeys(ctx context.Context, now time.Time) (int64, error) {
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+
+	r := s.db.Where("expires_at <= ?", now).Delete(&idempotencySchema{})
+	if r.Error != nil {
+		return 0, fmt.Errorf("failed to prune idempotency keys, error: %v", r.Error)
+	}
+	return r.RowsAffected, nil
+}
+
+// CountByStatus returns the number of records in each forwarding state.
+func (s *sqliteDB) CountByStatus(ctx context.Context) (map[int]int64, error) {
+	var rows []struct {
+		SyncState int
+		Count     int64
+	}
+	r := s.db.Model(&deviceSchema{}).Where("synthetic = ?", false).Select("sync_state, count(*) as count").Group("sync_state").Scan(&rows)
+	if r.Error != nil {
+		return nil, fmt.Errorf("failed to count records by sync state, error: %v", r.Error)
+	}
+	counts := make(map[int]int64, len(rows))
+	for _, row := range rows {
+		counts[row.SyncState] = row.Count
+	}
+	return counts, nil
+}
+
+// InsertSynthetic adds a synthetic `key` `value` pair to the database.
+func (s *sqliteDB) InsertSynthetic(ctx context.Context, key, sku string, value []byte) error {
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+
+	r := s.db.Create(&deviceSchema{DeviceID: key, SKU: sku, Device: value, SyncState: UNSYNCED, Synthetic: true})
+	if r.Error != nil {
+		return fmt.Errorf("failed to insert synthetic data with key: %q, error: %v", key, r.Error)
+	}
+	return nil
+}
+
+// DeleteSynthetic deletes the synthetic record associated with a given `key`.
+func (s *sqliteDB) DeleteSynthetic(ctx context.Context, key string) error {
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+
+	r := s.db.Where("device_id = ? AND synthetic = ?", key, true).Delete(&deviceSchema{})
+	if r.Error != nil {
+		return fmt.Errorf("failed to delete synthetic data with key: %q, error: %v", key, r.Error)
+	}
+	if r.RowsAffected == 0 {
+		return fmt.Errorf("synthetic record not found key: %q", key)
+	}
+	return nil
+}
+
+// Delete deletes all the non-synthetic records associated with a given `key`.
+func (s *sqliteDB) Delete(ctx context.Context, key string) (bool, error) {
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+
+	r := s.db.Where("device_id = ? AND synthetic = ?", key, false).Delete(&deviceSchema{})
+	if r.Error != nil {
+		return false, fmt.Errorf("failed to delete data with key: %q, error: %v", key, r.Error)
+	}
+	return r.RowsAffected > 0, nil
+}
+
+// List returns up to `limit` non-synthetic records with a key greater than
+// `after`, ordered by key.
+func (s *sqliteDB) List(ctx context.Context, after string, limit int) ([]connector.Record, error) {
+	var devices []deviceSchema
+	r := s.db.Where("device_id > ? AND synthetic = ?", after, false).Order("device_id").Limit(limit).Find(&devices)
+	if r.Error != nil {
+		return nil, fmt.Errorf("failed to list records after key: %q, error: %v", after, r.Error)
+	}
+	records := make([]connector.Record, len(devices))
+	for i, d := range devices {
+		records[i] = connector.Record{Key: d.DeviceID, Value: d.Device}
+	}
+	return records, nil
+}
+
+// Close closes the underlying database connection.
+func (s *sqliteDB) Close() error {
+	sqlDB, err := s.db.DB()
+	if err != nil {
+		return fmt.Errorf("failed to get database connection: %v", err)
+	}
+	return sqlDB.Close()
+}
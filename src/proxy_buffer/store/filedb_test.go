@@ -7,7 +7,13 @@ package filedb_test
 
 import (
 	"context"
+	"errors"
+	"path/filepath"
 	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
 
 	"github.com/lowRISC/opentitan-provisioning/src/proxy_buffer/store/connector"
 	"github.com/lowRISC/opentitan-provisioning/src/proxy_buffer/store/filedb"
@@ -42,3 +48,311 @@ func TestGet(t *testing.T) {
 		t.Errorf("Get returned wrong value: got %q, want %q", value, "value")
 	}
 }
+
+func TestGetNotFound(t *testing.T) {
+	db := newDB(t)
+	if _, err := db.Get(context.Background(), "missing"); !errors.Is(err, connector.ErrNotFound) {
+		t.Errorf("Get() = %v, want %v", err, connector.ErrNotFound)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	db := newDB(t)
+	ctx := context.Background()
+	if err := db.Insert(ctx, "key3", "sku", []byte("value")); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	if err := db.UpdateSyncState(ctx, "key3", filedb.SYNCED); err != nil {
+		t.Fatalf("UpdateSyncState failed: %v", err)
+	}
+	if err := db.UpdateSyncState(ctx, "missing", filedb.SYNCED); err == nil {
+		t.Errorf("UpdateSyncState succeeded for missing key")
+	}
+
+	n, err := db.Prune(ctx, filedb.SYNCED, time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatalf("Prune failed: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("Prune returned wrong count: got %d, want 1", n)
+	}
+	if _, err := db.Get(ctx, "key3"); err == nil {
+		t.Errorf("Get succeeded for pruned key")
+	}
+}
+
+func TestIdempotencyKeys(t *testing.T) {
+	db := newDB(t)
+	ctx := context.Background()
+	now := time.Now()
+	if err := db.InsertIdempotencyKey(ctx, "idem", "key4", []byte("response"), now.Add(time.Minute)); err != nil {
+		t.Fatalf("InsertIdempotencyKey failed: %v", err)
+	}
+
+	got, err := db.GetIdempotencyKey(ctx, "idem", now)
+	if err != nil {
+		t.Fatalf("GetIdempotencyKey failed: %v", err)
+	}
+	if string(got) != "response" {
+		t.Errorf("GetIdempotencyKey returned wrong response: got %q, want %q", got, "response")
+	}
+	if got, err := db.GetIdempotencyKey(ctx, "missing", now); err != nil || got != nil {
+		t.Errorf("GetIdempotencyKey(missing) = (%q, %v), want (nil, nil)", got, err)
+	}
+
+	expired := now.Add(2 * time.Minute)
+	if got, err := db.GetIdempotencyKey(ctx, "idem", expired); err != nil || got != nil {
+		t.Errorf("GetIdempotencyKey(expired) = (%q, %v), want (nil, nil)", got, err)
+	}
+	n, err := db.PruneIdempotencyKeys(ctx, expired)
+	if err != nil {
+		t.Fatalf("PruneIdempotencyKeys failed: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("PruneIdempotencyKeys returned wrong count: got %d, want 1", n)
+	}
+}
+
+func TestInsertIdempotencyKeyReplacesExpired(t *testing.T) {
+	db := newDB(t)
+	ctx := context.Background()
+	now := time.Now()
+
+	// An expired entry that was not pruned yet does not block the key.
+	if err := db.InsertIdempotencyKey(ctx, "idem-expired", "key8", []byte("old"), now.Add(-time.Minute)); err != nil {
+		t.Fatalf("InsertIdempotencyKey failed: %v", err)
+	}
+	if err := db.InsertIdempotencyKey(ctx, "idem-expired", "key9", []byte("new"), now.Add(time.Minute)); err != nil {
+		t.Fatalf("InsertIdempotencyKey over expired entry failed: %v", err)
+	}
+	got, err := db.GetIdempotencyKey(ctx, "idem-expired", now)
+	if err != nil || string(got) != "new" {
+		t.Errorf("GetIdempotencyKey = (%q, %v), want (%q, nil)", got, err, "new")
+	}
+
+	// An unexpired entry is never replaced.
+	if err := db.InsertIdempotencyKey(ctx, "idem-expired", "key10", []byte("newer"), now.Add(time.Minute)); err == nil {
+		t.Errorf("InsertIdempotencyKey over unexpired entry succeeded, want error")
+	}
+}
+
+func TestCountByStatus(t *testing.T) {
+	db := newDB(t)
+	ctx := context.Background()
+
+	// The in-memory database is shared with other tests, so only check the
+	// change in counts.
+	before, err := db.CountByStatus(ctx)
+	if err != nil {
+		t.Fatalf("CountByStatus failed: %v", err)
+	}
+	for _, key := range []string{"key5", "key6", "key7"} {
+		if err := db.Insert(ctx, key, "sku", []byte("value")); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+	if err := db.UpdateSyncState(ctx, "key7", filedb.FAILED); err != nil {
+		t.Fatalf("UpdateSyncState failed: %v", err)
+	}
+
+	after, err := db.CountByStatus(ctx)
+	if err != nil {
+		t.Fatalf("CountByStatus failed: %v", err)
+	}
+	for state, want := range map[int]int64{filedb.UNSYNCED: 2, filedb.SYNCED: 0, filedb.FAILED: 1} {
+		if got := after[state] - before[state]; got != want {
+			t.Errorf("CountByStatus returned %d new records in state %d, want %d", got, state, want)
+		}
+	}
+}
+
+func TestSynthetic(t *testing.T) {
+	db := newDB(t)
+	ctx := context.Background()
+
+	before, err := db.CountByStatus(ctx)
+	if err != nil {
+		t.Fatalf("CountByStatus failed: %v", err)
+	}
+	if err := db.InsertSynthetic(ctx, "synthetic1", "sku", []byte("value")); err != nil {
+		t.Fatalf("InsertSynthetic failed: %v", err)
+	}
+	if _, err := db.Get(ctx, "synthetic1"); err != nil {
+		t.Errorf("Get failed: %v", err)
+	}
+	after, err := db.CountByStatus(ctx)
+	if err != nil {
+		t.Fatalf("CountByStatus failed: %v", err)
+	}
+	if got := after[filedb.UNSYNCED] - before[filedb.UNSYNCED]; got != 0 {
+		t.Errorf("CountByStatus counted %d synthetic records, want 0", got)
+	}
+	if n, err := db.Prune(ctx, filedb.UNSYNCED, time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Prune failed: %v", err)
+	} else if _, err := db.Get(ctx, "synthetic1"); err != nil {
+		t.Errorf("synthetic record was pruned along with %d records", n)
+	}
+
+	if err := db.DeleteSynthetic(ctx, "synthetic1"); err != nil {
+		t.Fatalf("DeleteSynthetic failed: %v", err)
+	}
+	if _, err := db.Get(ctx, "synthetic1"); err == nil {
+		t.Error("Get succeeded after DeleteSynthetic")
+	}
+
+	// Real records are never deleted.
+	if err := db.Insert(ctx, "key8", "sku", []byte("value")); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	if err := db.DeleteSynthetic(ctx, "key8"); err == nil {
+		t.Error("DeleteSynthetic deleted a real record")
+	}
+}
+
+func TestList(t *testing.T) {
+	db := newDB(t)
+	ctx := context.Background()
+	for _, key := range []string{"list3", "list1", "list2"} {
+		if err := db.Insert(ctx, key, "sku", []byte(key)); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+	if err := db.InsertSynthetic(ctx, "list1a", "sku", []byte("value")); err != nil {
+		t.Fatalf("InsertSynthetic failed: %v", err)
+	}
+
+	records, err := db.List(ctx, "list0", 2)
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(records) != 2 || records[0].Key != "list1" || records[1].Key != "list2" {
+		t.Fatalf("List returned %v, want records list1 and list2", records)
+	}
+	if string(records[0].Value) != "list1" {
+		t.Errorf("List returned wrong value: got %q, want %q", records[0].Value, "list1")
+	}
+	records, err = db.List(ctx, "list2", 2)
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(records) != 1 || records[0].Key != "list3" {
+		t.Errorf("List returned %v, want record list3", records)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	db := newDB(t)
+	ctx := context.Background()
+	if err := db.Insert(ctx, "delete", "sku", []byte("value")); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	if err := db.InsertSynthetic(ctx, "delete_synthetic", "sku", []byte("value")); err != nil {
+		t.Fatalf("InsertSynthetic failed: %v", err)
+	}
+
+	deleted, err := db.Delete(ctx, "delete")
+	if err != nil || !deleted {
+		t.Fatalf("Delete = %v, %v, want true", deleted, err)
+	}
+	if _, err := db.Get(ctx, "delete"); !errors.Is(err, connector.ErrNotFound) {
+		t.Errorf("Get after Delete = %v, want %v", err, connector.ErrNotFound)
+	}
+	for _, key := range []string{"delete", "delete_synthetic", "missing"} {
+		deleted, err := db.Delete(ctx, key)
+		if err != nil || deleted {
+			t.Errorf("Delete(%q) = %v, %v, want false", key, deleted, err)
+		}
+	}
+}
+
+func TestInsertBatch(t *testing.T) {
+	db := newDB(t)
+	ctx := context.Background()
+	if err := db.InsertBatch(ctx, []connector.BatchRecord{
+		{Key: "batch1", SKU: "sku", Value: []byte("value1")},
+		{Key: "batch2", SKU: "sku", Value: []byte("value2")},
+	}); err != nil {
+		t.Fatalf("InsertBatch failed: %v", err)
+	}
+	for key, want := range map[string]string{"batch1": "value1", "batch2": "value2"} {
+		value, err := db.Get(ctx, key)
+		if err != nil || string(value) != want {
+			t.Errorf("Get(%q) = %q, %v, want %q", key, value, err, want)
+		}
+	}
+
+	// The existing key fails the whole batch.
+	if err := db.InsertBatch(ctx, []connector.BatchRecord{
+		{Key: "batch3", SKU: "sku", Value: []byte("value3")},
+		{Key: "batch1", SKU: "sku", Value: []byte("value1")},
+	}); err == nil {
+		t.Fatal("InsertBatch succeeded with an existing key, want error")
+	}
+	if _, err := db.Get(ctx, "batch3"); !errors.Is(err, connector.ErrNotFound) {
+		t.Errorf("Get after failed InsertBatch = %v, want %v", err, connector.ErrNotFound)
+	}
+}
+
+func TestMigrateFromSchemaWithoutSyntheticColumn(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "old.db")
+
+	// Create a database with the device table of the previous schema,
+	// lacking the `synthetic` column.
+	old, err := gorm.Open(sqlite.Open(path), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	for _, stmt := range []string{
+		"CREATE TABLE device_schemas (device_id text PRIMARY KEY, sku text, device blob, created_at datetime, updated_at datetime, sync_state integer)",
+		"INSERT INTO device_schemas VALUES ('old1', 'sku', 'value', '2020-01-01 00:00:00', '2020-01-01 00:00:00', 0)",
+		"INSERT INTO device_schemas VALUES ('old2', 'sku', 'value', '2020-01-01 00:00:00', '2020-01-01 00:00:00', 0)",
+	} {
+		if r := old.Exec(stmt); r.Error != nil {
+			t.Fatalf("Failed to create old schema: %v", r.Error)
+		}
+	}
+	sqlDB, err := old.DB()
+	if err != nil {
+		t.Fatalf("Failed to get database handle: %v", err)
+	}
+	sqlDB.Close()
+
+	db, err := filedb.New(path)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	counts, err := db.CountByStatus(ctx)
+	if err != nil {
+		t.Fatalf("CountByStatus failed: %v", err)
+	}
+	if counts[filedb.UNSYNCED] != 2 {
+		t.Errorf("CountByStatus() = %v, want 2 unsynced records", counts)
+	}
+	records, err := db.List(ctx, "", 10)
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(records) != 2 {
+		t.Errorf("List() returned %d records, want 2", len(records))
+	}
+	if ok, err := db.Delete(ctx, "old1"); err != nil || !ok {
+		t.Errorf("Delete() = %v, %v, want true", ok, err)
+	}
+	if n, err := db.Prune(ctx, filedb.UNSYNCED, time.Now()); err != nil || n != 1 {
+		t.Errorf("Prune() = %d, %v, want 1", n, err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	db, err := filedb.New(filepath.Join(t.TempDir(), "close.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := db.Insert(context.Background(), "key9", "sku", []byte("value")); err == nil {
+		t.Error("Insert succeeded after Close")
+	}
+}
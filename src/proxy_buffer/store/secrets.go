@@ -0,0 +1,44 @@
+// Copyright lowRISC contributors (OpenTitan project).
+// Licensed under the Apache License, Version 2.0, see LICENSE for details.
+// SPDX-License-Identifier: Apache-2.0
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// defaultSecretTimeout bounds the HTTP requests of the secrets managers when
+// no client is configured, so that a hung endpoint cannot block startup or
+// credential refreshes forever.
+const defaultSecretTimeout = 30 * time.Second
+
+// defaultSecretClient is the HTTP client used by the secrets managers when no
+// client is configured.
+var defaultSecretClient = &http.Client{Timeout: defaultSecretTimeout}
+
+// SecretProvider retrieves secrets, such as database credentials, from a
+// secrets manager.
+type SecretProvider interface {
+	// GetSecret returns the current value of the secret `name`.
+	GetSecret(ctx context.Context, name string) (string, error)
+}
+
+// EnvVarProvider reads secrets from environment variables. The secret name is
+// the name of the variable. This provider is intended for development and
+// for deployments injecting secrets into the process environment.
+type EnvVarProvider struct{}
+
+// GetSecret returns the value of the environment variable `name`. It is an
+// error for the variable to be unset.
+func (EnvVarProvider) GetSecret(ctx context.Context, name string) (string, error) {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable %q is not set", name)
+	}
+	return v, nil
+}
@@ -0,0 +1,146 @@
+// Copyright lowRISC contributors (OpenTitan project).
+// Licensed under the Apache License, Version 2.0, see LICENSE for details.
+// SPDX-License-Identifier: Apache-2.0
+
+package db
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+)
+
+// AWSSecretsManagerProvider reads secrets from AWS Secrets Manager using the
+// `GetSecretValue` API. Requests are signed with AWS Signature Version 4 using
+// the `AWS_ACCESS_KEY_ID`, `AWS_SECRET_ACCESS_KEY` and, if set,
+// `AWS_SESSION_TOKEN` environment variables.
+type AWSSecretsManagerProvider struct {
+	// Region is the AWS region hosting the secrets, e.g. "us-west-2".
+	Region string
+	// Endpoint overrides the regional Secrets Manager endpoint, e.g. to use a
+	// VPC endpoint. Optional.
+	Endpoint string
+	// Client is the HTTP client used to call the API. Defaults to a client
+	// with a `defaultSecretTimeout` timeout.
+	Client *http.Client
+}
+
+// awsService is the AWS service name used in request signatures.
+const awsService = "secretsmanager"
+
+func hmacSHA256(key []byte, data string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+// signV4 adds an AWS Signature Version 4 `Authorization` header for
+// `service` to `req`, which must be a request for the root path without query
+// parameters. The signed headers must already be set on `req`, and be listed
+// in lowercase and in sorted order.
+func signV4(req *http.Request, body []byte, region, service, accessKey, secretKey string, signedHeaders []string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	var canonicalHeaders, headerList string
+	for i, h := range signedHeaders {
+		v := req.Header.Get(h)
+		if h == "host" {
+			v = req.Host
+		}
+		canonicalHeaders += h + ":" + v + "\n"
+		if i > 0 {
+			headerList += ";"
+		}
+		headerList += h
+	}
+	canonicalRequest := req.Method + "\n/\n\n" + canonicalHeaders + "\n" + headerList + "\n" + sha256Hex(body)
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, headerList, signature))
+}
+
+// GetSecret returns the current string value of the secret `name`, which may
+// be a secret name or ARN.
+func (p *AWSSecretsManagerProvider) GetSecret(ctx context.Context, name string) (string, error) {
+	accessKey, secretKey := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if accessKey == "" || secretKey == "" {
+		return "", fmt.Errorf("AWS credentials not found in environment")
+	}
+	if p.Region == "" {
+		return "", fmt.Errorf("AWS region not set")
+	}
+	endpoint := p.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://secretsmanager.%s.amazonaws.com/", p.Region)
+	}
+	client := p.Client
+	if client == nil {
+		client = defaultSecretClient
+	}
+
+	body, err := json.Marshal(map[string]string{"SecretId": name})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	signedHeaders := []string{"content-type", "host", "x-amz-date", "x-amz-target"}
+	if token := os.Getenv("AWS_SESSION_TOKEN"); token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+		signedHeaders = append(signedHeaders, "x-amz-security-token")
+		sort.Strings(signedHeaders)
+	}
+	signV4(req, body, p.Region, awsService, accessKey, secretKey, signedHeaders, time.Now())
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to get secret %q: %v", name, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret %q: %v", name, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to get secret %q: %s: %s", name, resp.Status, data)
+	}
+	var value struct {
+		SecretString *string
+	}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return "", fmt.Errorf("failed to parse secret %q: %v", name, err)
+	}
+	if value.SecretString == nil {
+		return "", fmt.Errorf("secret %q has no string value", name)
+	}
+	return *value.SecretString, nil
+}
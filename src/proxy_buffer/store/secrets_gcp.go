@@ -0,0 +1,103 @@
+// Copyright lowRISC contributors (OpenTitan project).
+// Licensed under the Apache License, Version 2.0, see LICENSE for details.
+// SPDX-License-Identifier: Apache-2.0
+
+package db
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+const (
+	// gcpSecretManagerEndpoint is the base URL of the Secret Manager API.
+	gcpSecretManagerEndpoint = "https://secretmanager.googleapis.com/v1"
+	// gcpMetadataTokenURL returns access tokens of the default service
+	// account of the GCE instance or GKE workload.
+	gcpMetadataTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+)
+
+// GCPSecretManagerProvider reads the latest version of secrets from Google
+// Cloud Secret Manager. Requests are authorized with an access token of the
+// default service account, obtained from the metadata server.
+type GCPSecretManagerProvider struct {
+	// Project is the ID of the project hosting the secrets.
+	Project string
+	// Endpoint overrides the Secret Manager API base URL. Optional.
+	Endpoint string
+	// TokenURL overrides the metadata server URL returning access tokens.
+	// Optional.
+	TokenURL string
+	// Client is the HTTP client used to call the API. Defaults to a client
+	// with a `defaultSecretTimeout` timeout.
+	Client *http.Client
+}
+
+// getJSON issues a GET request to `url` with the given `header` and decodes
+// the JSON response into `v`.
+func getJSON(ctx context.Context, client *http.Client, url string, header http.Header, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header = header
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, data)
+	}
+	return json.Unmarshal(data, v)
+}
+
+// GetSecret returns the payload of the latest version of the secret `name`.
+func (p *GCPSecretManagerProvider) GetSecret(ctx context.Context, name string) (string, error) {
+	if p.Project == "" {
+		return "", fmt.Errorf("GCP project not set")
+	}
+	endpoint := p.Endpoint
+	if endpoint == "" {
+		endpoint = gcpSecretManagerEndpoint
+	}
+	tokenURL := p.TokenURL
+	if tokenURL == "" {
+		tokenURL = gcpMetadataTokenURL
+	}
+	client := p.Client
+	if client == nil {
+		client = defaultSecretClient
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := getJSON(ctx, client, tokenURL, http.Header{"Metadata-Flavor": {"Google"}}, &token); err != nil {
+		return "", fmt.Errorf("failed to get access token: %v", err)
+	}
+
+	var version struct {
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}
+	secretURL := fmt.Sprintf("%s/projects/%s/secrets/%s/versions/latest:access", endpoint, url.PathEscape(p.Project), url.PathEscape(name))
+	if err := getJSON(ctx, client, secretURL, http.Header{"Authorization": {"Bearer " + token.AccessToken}}, &version); err != nil {
+		return "", fmt.Errorf("failed to get secret %q: %v", name, err)
+	}
+	data, err := base64.StdEncoding.DecodeString(version.Payload.Data)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode secret %q: %v", name, err)
+	}
+	return string(data), nil
+}
@@ -0,0 +1,326 @@
+// Copyright lowRISC contributors (OpenTitan project).
+// Licensed under the Apache License, Version 2.0, see LICENSE for details.
+// SPDX-License-Identifier: Apache-2.0
+
+package db_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	dtd "github.com/lowRISC/opentitan-provisioning/src/proto/device_testdata"
+	"github.com/lowRISC/opentitan-provisioning/src/proxy_buffer/store/connector"
+	"github.com/lowRISC/opentitan-provisioning/src/proxy_buffer/store/db"
+	"github.com/lowRISC/opentitan-provisioning/src/proxy_buffer/store/db_fake"
+)
+
+// rotatingProvider is a `db.SecretProvider` returning the current value of
+// its secret, which can be rotated by the test.
+type rotatingProvider struct {
+	mu    sync.Mutex
+	value string
+}
+
+func (p *rotatingProvider) GetSecret(ctx context.Context, name string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.value, nil
+}
+
+func (p *rotatingProvider) rotate(value string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.value = value
+}
+
+// fakeOpener returns a `db.Opener` creating a fake connector per DSN.
+func fakeOpener(conns map[string]connector.Connector) db.Opener {
+	return func(dsn string) (connector.Connector, error) {
+		c := db_fake.New()
+		conns[dsn] = c
+		return c, nil
+	}
+}
+
+func TestEnvVarProvider(t *testing.T) {
+	t.Setenv("PB_TEST_DSN", "file:test.db")
+
+	ctx := context.Background()
+	value, err := db.EnvVarProvider{}.GetSecret(ctx, "PB_TEST_DSN")
+	if err != nil {
+		t.Fatalf("GetSecret() failed: %v", err)
+	}
+	if value != "file:test.db" {
+		t.Errorf("GetSecret() = %q, want %q", value, "file:test.db")
+	}
+	if _, err := (db.EnvVarProvider{}).GetSecret(ctx, "PB_TEST_UNSET"); err == nil {
+		t.Error("GetSecret() of unset variable succeeded, want error")
+	}
+
+	conns := map[string]connector.Connector{}
+	if _, err := db.NewFromSecret(ctx, db.EnvVarProvider{}, "PB_TEST_DSN", fakeOpener(conns), 0); err != nil {
+		t.Fatalf("NewFromSecret() failed: %v", err)
+	}
+	if _, ok := conns["file:test.db"]; !ok {
+		t.Errorf("database not opened with DSN from environment, opened: %v", conns)
+	}
+}
+
+func TestRefreshCredentials(t *testing.T) {
+	ctx := context.Background()
+	p := &rotatingProvider{value: "dsn-v1"}
+	conns := map[string]connector.Connector{}
+	database, err := db.NewFromSecret(ctx, p, "dsn", fakeOpener(conns), 0)
+	if err != nil {
+		t.Fatalf("NewFromSecret() failed: %v", err)
+	}
+
+	// Refreshing without rotation keeps the connection.
+	if err := database.RefreshCredentials(ctx); err != nil {
+		t.Fatalf("RefreshCredentials() failed: %v", err)
+	}
+	if len(conns) != 1 {
+		t.Fatalf("got %d connections, want 1", len(conns))
+	}
+
+	p.rotate("dsn-v2")
+	if err := database.RefreshCredentials(ctx); err != nil {
+		t.Fatalf("RefreshCredentials() failed: %v", err)
+	}
+	c, ok := conns["dsn-v2"]
+	if !ok {
+		t.Fatalf("database not reconnected with rotated DSN, opened: %v", conns)
+	}
+
+	record := &dtd.RegistryRecordOk
+	if err := database.InsertDevice(ctx, record); err != nil {
+		t.Fatalf("InsertDevice() failed: %v", err)
+	}
+	if _, err := c.Get(ctx, record.DeviceId); err != nil {
+		t.Errorf("record not inserted with rotated connection: %v", err)
+	}
+	if _, err := conns["dsn-v1"].Get(ctx, record.DeviceId); err == nil {
+		t.Error("record inserted with stale connection")
+	}
+}
+
+func TestRefreshCredentialsFileDSN(t *testing.T) {
+	ctx := context.Background()
+	p := &rotatingProvider{value: "/var/lib/pb/v1.db"}
+	conns := map[string]connector.Connector{}
+	database, err := db.NewFromSecret(ctx, p, "dsn", fakeOpener(conns), 0, db.WithFileDSN())
+	if err != nil {
+		t.Fatalf("NewFromSecret() failed: %v", err)
+	}
+	record := &dtd.RegistryRecordOk
+	if err := database.InsertDevice(ctx, record); err != nil {
+		t.Fatalf("InsertDevice() failed: %v", err)
+	}
+
+	// Reopening another database file would lose the registered devices.
+	p.rotate("/var/lib/pb/v2.db")
+	if err := database.RefreshCredentials(ctx); err == nil {
+		t.Error("RefreshCredentials() reopened a different database file, want error")
+	}
+	if _, ok := conns["/var/lib/pb/v2.db"]; ok {
+		t.Error("database reopened with the rotated path")
+	}
+	if _, err := database.GetDevice(ctx, record.DeviceId); err != nil {
+		t.Errorf("GetDevice() after refresh failed: %v", err)
+	}
+}
+
+func TestNewFromSecretError(t *testing.T) {
+	opener := func(dsn string) (connector.Connector, error) {
+		return nil, fmt.Errorf("unexpected open of %q", dsn)
+	}
+	if _, err := db.NewFromSecret(context.Background(), db.EnvVarProvider{}, "PB_TEST_UNSET", opener, 0); err == nil {
+		t.Error("NewFromSecret() succeeded with missing secret, want error")
+	}
+}
+
+// trackedConn is a connector recording whether it was closed. `Get` calls
+// signal `entered` and block until `unblock` is closed.
+type trackedConn struct {
+	connector.Connector
+	entered chan struct{}
+	unblock chan struct{}
+	closed  chan struct{}
+}
+
+func (c *trackedConn) Get(ctx context.Context, key string) ([]byte, error) {
+	c.entered <- struct{}{}
+	<-c.unblock
+	return c.Connector.Get(ctx, key)
+}
+
+func (c *trackedConn) Close() error {
+	close(c.closed)
+	return c.Connector.Close()
+}
+
+func TestRefreshCredentialsClosesPreviousConnector(t *testing.T) {
+	ctx := context.Background()
+	p := &rotatingProvider{value: "dsn-v1"}
+	conns := map[string]*trackedConn{}
+	opener := func(dsn string) (connector.Connector, error) {
+		c := &trackedConn{
+			Connector: db_fake.New(),
+			entered:   make(chan struct{}, 1),
+			unblock:   make(chan struct{}),
+			closed:    make(chan struct{}),
+		}
+		conns[dsn] = c
+		return c, nil
+	}
+	database, err := db.NewFromSecret(ctx, p, "dsn", opener, 0)
+	if err != nil {
+		t.Fatalf("NewFromSecret() failed: %v", err)
+	}
+
+	// Start a call on the first connector and rotate the credentials while
+	// it is in flight.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		database.GetDevice(ctx, "device")
+	}()
+	<-conns["dsn-v1"].entered
+	p.rotate("dsn-v2")
+	if err := database.RefreshCredentials(ctx); err != nil {
+		t.Fatalf("RefreshCredentials() failed: %v", err)
+	}
+	select {
+	case <-conns["dsn-v1"].closed:
+		t.Fatal("previous connector closed with a call in flight")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	close(conns["dsn-v1"].unblock)
+	<-done
+	select {
+	case <-conns["dsn-v1"].closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("previous connector not closed after the calls in flight completed")
+	}
+	select {
+	case <-conns["dsn-v2"].closed:
+		t.Error("current connector closed")
+	default:
+	}
+}
+
+func TestAWSSecretsManagerProvider(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY")
+	t.Setenv("AWS_SESSION_TOKEN", "session-token")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "unexpected method", http.StatusMethodNotAllowed)
+			return
+		}
+		if got := r.Header.Get("X-Amz-Target"); got != "secretsmanager.GetSecretValue" {
+			http.Error(w, fmt.Sprintf("unexpected target %q", got), http.StatusBadRequest)
+			return
+		}
+		if got := r.Header.Get("X-Amz-Security-Token"); got != "session-token" {
+			http.Error(w, fmt.Sprintf("unexpected session token %q", got), http.StatusForbidden)
+			return
+		}
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") ||
+			!strings.Contains(auth, "/us-west-2/secretsmanager/aws4_request, SignedHeaders=content-type;host;x-amz-date;x-amz-security-token;x-amz-target, Signature=") {
+			http.Error(w, fmt.Sprintf("unexpected authorization %q", auth), http.StatusForbidden)
+			return
+		}
+		var req struct{ SecretId string }
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.SecretId != "pb-dsn" {
+			http.Error(w, `{"__type":"ResourceNotFoundException"}`, http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `{"Name":"pb-dsn","SecretString":"file:aws.db"}`)
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	p := &db.AWSSecretsManagerProvider{Region: "us-west-2", Endpoint: server.URL, Client: server.Client()}
+	value, err := p.GetSecret(ctx, "pb-dsn")
+	if err != nil {
+		t.Fatalf("GetSecret() failed: %v", err)
+	}
+	if value != "file:aws.db" {
+		t.Errorf("GetSecret() = %q, want %q", value, "file:aws.db")
+	}
+	if _, err := p.GetSecret(ctx, "missing"); err == nil {
+		t.Error("GetSecret() of missing secret succeeded, want error")
+	}
+}
+
+func TestGCPSecretManagerProvider(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			http.Error(w, "missing Metadata-Flavor header", http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, `{"access_token":"access-token","expires_in":3599,"token_type":"Bearer"}`)
+	})
+	mux.HandleFunc("/v1/projects/pb-project/secrets/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer access-token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var value string
+		switch r.URL.EscapedPath() {
+		case "/v1/projects/pb-project/secrets/pb-dsn/versions/latest:access":
+			value = "file:gcp.db"
+		case "/v1/projects/pb-project/secrets/pb%2Fdsn/versions/latest:access":
+			value = "file:escaped.db"
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, `{"payload":{"data":%q}}`, base64.StdEncoding.EncodeToString([]byte(value)))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	ctx := context.Background()
+	p := &db.GCPSecretManagerProvider{
+		Project:  "pb-project",
+		Endpoint: server.URL + "/v1",
+		TokenURL: server.URL + "/token",
+		Client:   server.Client(),
+	}
+	value, err := p.GetSecret(ctx, "pb-dsn")
+	if err != nil {
+		t.Fatalf("GetSecret() failed: %v", err)
+	}
+	if value != "file:gcp.db" {
+		t.Errorf("GetSecret() = %q, want %q", value, "file:gcp.db")
+	}
+	// Secret names are escaped in the URL path.
+	value, err = p.GetSecret(ctx, "pb/dsn")
+	if err != nil {
+		t.Fatalf("GetSecret() of escaped name failed: %v", err)
+	}
+	if value != "file:escaped.db" {
+		t.Errorf("GetSecret() = %q, want %q", value, "file:escaped.db")
+	}
+	if _, err := p.GetSecret(ctx, "missing"); err == nil {
+		t.Error("GetSecret() of missing secret succeeded, want error")
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright lowRISC contributors (OpenTitan project).
+// Licensed under the Apache License, Version 2.0, see LICENSE for details.
+// SPDX-License-Identifier: Apache-2.0
+
+package se
+
+import (
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// AuditRecord describes an HSM operation for the audit log. It identifies the
+// keys used by their labels, and never holds key material.
+type AuditRecord struct {
+	// Time is the time the operation completed.
+	Time time.Time
+	// Op is the HSM operation, e.g. "EndorseCert".
+	Op string
+	// KeyLabels are the labels of the HSM keys used by the operation.
+	KeyLabels []string
+	// KeyID is the CKA_ID of the signing key, if selected by ID. Only set by
+	// certificate operations.
+	KeyID []byte
+	// SKU is the SKU the operation was requested for. Empty if unknown.
+	SKU string
+	// SerialNumber and Subject identify the endorsed certificate, or hold
+	// the CRL number and issuer of a signed CRL. Only set by certificate and
+	// CRL operations, and nil or empty if the TBS structure could not be
+	// parsed.
+	SerialNumber *big.Int
+	Subject      string
+	// Fingerprint is the SHA-256 digest of the DER encoded certificate or
+	// CRL issued by the operation, to correlate the audit log with external
+	// certificate inventories. Nil if the operation failed or issued neither.
+	Fingerprint []byte
+	// Err is the error the operation failed with. Nil on success.
+	Err error
+}
+
+// AuditLogger records HSM operations, e.g. by forwarding them to a SIEM.
+// Implementations must be safe for concurrent use. See `HSMConfig.Audit`.
+type AuditLogger interface {
+	// LogOperation records the completed operation `r`.
+	LogOperation(r AuditRecord)
+}
+
+// LogAuditLogger is an `AuditLogger` writing each record as a JSON object to
+// a `log.Logger`.
+type LogAuditLogger struct {
+	l *log.Logger
+}
+
+// NewLogAuditLogger returns a `LogAuditLogger` writing to `l`, or to the
+// standard logger if nil.
+func NewLogAuditLogger(l *log.Logger) *LogAuditLogger {
+	if l == nil {
+		l = log.Default()
+	}
+	return &LogAuditLogger{l: l}
+}
+
+// auditEntry is the JSON encoding of an `AuditRecord`.
+type auditEntry struct {
+	Time         time.Time `json:"time"`
+	Op           string    `json:"op"`
+	KeyLabels    []string  `json:"key_labels,omitempty"`
+	KeyID        string    `json:"key_id,omitempty"`
+	SKU          string    `json:"sku,omitempty"`
+	SerialNumber string    `json:"serial_number,omitempty"`
+	Subject      string    `json:"subject,omitempty"`
+	Fingerprint  string    `json:"fingerprint,omitempty"`
+	Result       string    `json:"result"`
+	Error        string    `json:"error,omitempty"`
+}
+
+// LogOperation writes `r` as a JSON object prefixed with "AUDIT".
+func (a *LogAuditLogger) LogOperation(r AuditRecord) {
+	e := auditEntry{
+		Time:        r.Time.UTC(),
+		Op:          r.Op,
+		KeyLabels:   r.KeyLabels,
+		KeyID:       hex.EncodeToString(r.KeyID),
+		SKU:         r.SKU,
+		Subject:     r.Subject,
+		Fingerprint: hex.EncodeToString(r.Fingerprint),
+		Result:      "success",
+	}
+	if r.SerialNumber != nil {
+		e.SerialNumber = r.SerialNumber.Text(16)
+	}
+	if r.Err != nil {
+		e.Result = "failure"
+		e.Error = r.Err.Error()
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		a.l.Printf("failed to encode audit record for %s: %v", r.Op, err)
+		return
+	}
+	a.l.Printf("AUDIT %s", b)
+}
+
+// audit records `r` with the `HSMConfig.Audit` logger, if set.
+func (h *HSM) audit(r AuditRecord) {
+	if h.auditLogger == nil {
+		return
+	}
+	r.Time = time.Now()
+	h.auditLogger.LogOperation(r)
+}
+
+// tokenAuditInfo returns the labels of the seeds and wrapping keys used to
+// generate the tokens of `params`, and their SKUs separated by commas, for
+// the audit log.
+func tokenAuditInfo(params []*TokenParams) ([]string, string) {
+	var labels, skus []string
+	seen := map[string]bool{}
+	for _, p := range params {
+		for _, l := range []string{tokenSeedLabel(p), p.WrapKeyLabel} {
+			if l != "" && !seen["label:"+l] {
+				seen["label:"+l] = true
+				labels = append(labels, l)
+			}
+		}
+		if p.Sku != "" && !seen["sku:"+p.Sku] {
+			seen["sku:"+p.Sku] = true
+			skus = append(skus, p.Sku)
+		}
+	}
+	return labels, strings.Join(skus, ",")
+}
+
+// tbsCertificateSubject is the prefix of an X.509 TBSCertificate structure up
+// to and including the subject. Trailing fields are ignored.
+type tbsCertificateSubject struct {
+	Version            int `asn1:"optional,explicit,default:0,tag:0"`
+	SerialNumber       *big.Int
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Issuer             asn1.RawValue
+	Validity           asn1.RawValue
+	Subject            pkix.RDNSequence
+}
+
+// auditCertInfo returns the serial number and subject of the DER encoded
+// `tbs` certificate for the audit log, or zero values if it cannot be parsed.
+func auditCertInfo(tbs []byte) (*big.Int, string) {
+	var cert tbsCertificateSubject
+	if _, err := asn1.Unmarshal(tbs, &cert); err != nil {
+		return nil, ""
+	}
+	var subject pkix.Name
+	subject.FillFromRDNSequence(&cert.Subject)
+	return cert.SerialNumber, subject.String()
+}
+
+// auditCRLInfo returns the CRL number and issuer of the DER encoded `tbs`
+// certificate list for the audit log, or zero values if it cannot be parsed.
+func auditCRLInfo(tbs []byte) (*big.Int, string) {
+	var list tbsCertList
+	if _, err := asn1.Unmarshal(tbs, &list); err != nil {
+		return nil, ""
+	}
+	var issuer string
+	var rdns pkix.RDNSequence
+	if _, err := asn1.Unmarshal(list.Issuer.FullBytes, &rdns); err == nil {
+		var name pkix.Name
+		name.FillFromRDNSequence(&rdns)
+		issuer = name.String()
+	}
+	for _, ext := range list.Extensions {
+		if ext.Id.Equal(oidExtensionCRLNumber) {
+			number := new(big.Int)
+			if _, err := asn1.Unmarshal(ext.Value, &number); err == nil {
+				return number, issuer
+			}
+		}
+	}
+	return nil, issuer
+}
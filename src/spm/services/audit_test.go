@@ -0,0 +1,227 @@
+// Copyright lowRISC contributors (OpenTitan project).
+// Licensed under the Apache License, Version 2.0, see LICENSE for details.
+// SPDX-License-Identifier: Apache-2.0
+
+package se
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/big"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// recordingAuditLogger is an `AuditLogger` keeping the records in memory.
+type recordingAuditLogger struct {
+	mu      sync.Mutex
+	records []AuditRecord
+}
+
+func (a *recordingAuditLogger) LogOperation(r AuditRecord) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.records = append(a.records, r)
+}
+
+func TestLogAuditLogger(t *testing.T) {
+	var buf bytes.Buffer
+	a := NewLogAuditLogger(log.New(&buf, "", 0))
+	a.LogOperation(AuditRecord{
+		Time:         time.Unix(0, 0),
+		Op:           "EndorseCert",
+		KeyLabels:    []string{"KCAPriv"},
+		KeyID:        []byte{0xab, 0xcd},
+		SKU:          "sival",
+		SerialNumber: big.NewInt(0x1234),
+		Subject:      "CN=device",
+		Fingerprint:  []byte{0x12, 0x34},
+		Err:          errors.New("HSM is down"),
+	})
+
+	line := strings.TrimSpace(buf.String())
+	if !strings.HasPrefix(line, "AUDIT ") {
+		t.Fatalf("audit log line = %q, want prefix %q", line, "AUDIT ")
+	}
+	var got map[string]any
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "AUDIT ")), &got); err != nil {
+		t.Fatalf("failed to parse audit log line %q: %v", line, err)
+	}
+	for k, want := range map[string]any{
+		"op":            "EndorseCert",
+		"key_id":        "abcd",
+		"sku":           "sival",
+		"serial_number": "1234",
+		"subject":       "CN=device",
+		"fingerprint":   "1234",
+		"result":        "failure",
+		"error":         "HSM is down",
+	} {
+		if got[k] != want {
+			t.Errorf("audit record %s = %v, want %v", k, got[k], want)
+		}
+	}
+}
+
+func TestAuditCertInfo(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() failed: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "device", Organization: []string{"lowRISC"}},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate() failed: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate() failed: %v", err)
+	}
+
+	serial, subject := auditCertInfo(cert.RawTBSCertificate)
+	if serial == nil || serial.Cmp(tmpl.SerialNumber) != 0 {
+		t.Errorf("auditCertInfo() serial = %v, want %v", serial, tmpl.SerialNumber)
+	}
+	if want := cert.Subject.String(); subject != want {
+		t.Errorf("auditCertInfo() subject = %q, want %q", subject, want)
+	}
+
+	if serial, subject := auditCertInfo([]byte("garbage")); serial != nil || subject != "" {
+		t.Errorf("auditCertInfo() = %v, %q for garbage, want zero values", serial, subject)
+	}
+
+	// Issued certificates are recorded with their fingerprint.
+	a := &recordingAuditLogger{}
+	h := &HSM{auditLogger: a}
+	params := EndorseCertParams{KeyLabel: "KCAPriv", SKU: "sival"}
+	h.auditEndorseCert("EndorseCert", cert.RawTBSCertificate, der, params, nil)
+	h.auditEndorseCert("EndorseCert", cert.RawTBSCertificate, nil, params, errors.New("HSM is down"))
+	want := sha256.Sum256(der)
+	if got := a.records[0].Fingerprint; !bytes.Equal(got, want[:]) {
+		t.Errorf("audit record fingerprint = %x, want %x", got, want)
+	}
+	if got := a.records[1].Fingerprint; got != nil {
+		t.Errorf("audit record fingerprint of failed endorsement = %x, want nil", got)
+	}
+}
+
+func TestAuditCRLInfo(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() failed: %v", err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "CA"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageCRLSign,
+		SubjectKeyId: []byte{1, 2, 3, 4},
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate() failed: %v", err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatalf("ParseCertificate() failed: %v", err)
+	}
+	crlDER, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:     big.NewInt(7),
+		ThisUpdate: time.Now(),
+		NextUpdate: time.Now().Add(time.Hour),
+	}, caCert, key)
+	if err != nil {
+		t.Fatalf("CreateRevocationList() failed: %v", err)
+	}
+	crl, err := x509.ParseRevocationList(crlDER)
+	if err != nil {
+		t.Fatalf("ParseRevocationList() failed: %v", err)
+	}
+
+	number, issuer := auditCRLInfo(crl.RawTBSRevocationList)
+	if number == nil || number.Int64() != 7 {
+		t.Errorf("auditCRLInfo() number = %v, want 7", number)
+	}
+	if want := caCert.Subject.String(); issuer != want {
+		t.Errorf("auditCRLInfo() issuer = %q, want %q", issuer, want)
+	}
+
+	if number, issuer := auditCRLInfo([]byte("garbage")); number != nil || issuer != "" {
+		t.Errorf("auditCRLInfo() = %v, %q for garbage, want zero values", number, issuer)
+	}
+}
+
+func TestHSMAudit(t *testing.T) {
+	a := &recordingAuditLogger{}
+	h := &HSM{readOnly: true, auditLogger: a}
+	ctx := context.Background()
+
+	_, err := h.EndorseCert(ctx, []byte("garbage"), EndorseCertParams{KeyLabel: "KCAPriv", SKU: "sival"})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("EndorseCert() = %v in read-only mode, want code %v", err, codes.PermissionDenied)
+	}
+	_, err = h.GenerateTokens(ctx, []*TokenParams{
+		{SeedLabel: "HighSecKdfSeed", Sku: "sival"},
+		{SeedLabel: "HighSecKdfSeed", WrapKeyLabel: "WrapKey", Sku: "sival"},
+	})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("GenerateTokens() = %v in read-only mode, want code %v", err, codes.PermissionDenied)
+	}
+
+	_, err = h.BatchEndorseCert(ctx, [][]byte{[]byte("garbage"), []byte("garbage")}, EndorseCertParams{KeyLabel: "KCAPriv", SKU: "sival"})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("BatchEndorseCert() = %v in read-only mode, want code %v", err, codes.PermissionDenied)
+	}
+	_, err = h.EndorseCSR(ctx, []byte("garbage"), EndorseCSRParams{EndorseCertParams: EndorseCertParams{KeyLabel: "KCAPriv", SKU: "sival"}})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("EndorseCSR() = %v in read-only mode, want code %v", err, codes.PermissionDenied)
+	}
+
+	_, err = h.SignCRL(ctx, []byte("garbage"), EndorseCertParams{KeyLabel: "KCAPriv", SKU: "sival"})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("SignCRL() = %v in read-only mode, want code %v", err, codes.PermissionDenied)
+	}
+
+	if len(a.records) != 6 {
+		t.Fatalf("got %d audit records, want 6", len(a.records))
+	}
+	for i, want := range []AuditRecord{
+		{Op: "EndorseCert", KeyLabels: []string{"KCAPriv"}, SKU: "sival"},
+		{Op: "GenerateTokens", KeyLabels: []string{"HighSecKdfSeed", "WrapKey"}, SKU: "sival"},
+		{Op: "BatchEndorseCert", KeyLabels: []string{"KCAPriv"}, SKU: "sival"},
+		{Op: "BatchEndorseCert", KeyLabels: []string{"KCAPriv"}, SKU: "sival"},
+		{Op: "EndorseCSR", KeyLabels: []string{"KCAPriv"}, SKU: "sival"},
+		{Op: "SignCRL", KeyLabels: []string{"KCAPriv"}, SKU: "sival"},
+	} {
+		got := a.records[i]
+		if got.Op != want.Op || strings.Join(got.KeyLabels, ",") != strings.Join(want.KeyLabels, ",") || got.SKU != want.SKU {
+			t.Errorf("audit record %d = %+v, want %+v", i, got, want)
+		}
+		if status.Code(got.Err) != codes.PermissionDenied {
+			t.Errorf("audit record %d error = %v, want code %v", i, got.Err, codes.PermissionDenied)
+		}
+		if got.Time.IsZero() {
+			t.Errorf("audit record %d has no timestamp", i)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright lowRISC contributors (OpenTitan project).
+// Licensed under the Apache License, Version 2.0, see LICENSE for details.
+// SPDX-License-Identifier: Apache-2.0
+
+package spm
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/lowRISC/opentitan-provisioning/src/spm/services/se"
+	"github.com/lowRISC/opentitan-provisioning/src/spm/services/skucfg"
+)
+
+// budgetUsage is the usage of a client within the current budget window.
+type budgetUsage struct {
+	windowStart time.Time
+	requests    int64
+	hsmTime     time.Duration
+}
+
+// clientBudgets tracks the HSM usage of each client against the configured
+// `skucfg.ClientBudget`. Requests are counted when admitted, while HSM time
+// is charged once the operation completes, so a client may overrun its time
+// budget by the duration of one request. Clients are only tracked while a
+// limit is configured, and their usage is evicted once its window expires.
+type clientBudgets struct {
+	// mu guards access to all fields below.
+	mu     sync.Mutex
+	limits skucfg.ClientBudget
+	usage  map[string]*budgetUsage
+	// lastSweep is the last time expired usage was evicted.
+	lastSweep time.Time
+	// now returns the current time. Overridden by tests.
+	now func() time.Time
+}
+
+func newClientBudgets(limits skucfg.ClientBudget) *clientBudgets {
+	return &clientBudgets{
+		limits: limits,
+		usage:  make(map[string]*budgetUsage),
+		now:    time.Now,
+	}
+}
+
+// setLimits replaces the budget limits. The current usage of each client is
+// preserved and checked against the new limits, unless the new limits
+// disable the budgets.
+func (b *clientBudgets) setLimits(limits skucfg.ClientBudget) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.limits = limits
+	if !b.limited() {
+		b.usage = make(map[string]*budgetUsage)
+	}
+}
+
+// limited reports whether any limit is configured. Must be called with `mu`
+// held.
+func (b *clientBudgets) limited() bool {
+	return b.limits.MaxRequests > 0 || b.limits.MaxHSMTime > 0
+}
+
+// enabled reports whether any limit is configured.
+func (b *clientBudgets) enabled() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.limited()
+}
+
+// current returns the usage of `client` in the current window. Must be called
+// with `mu` held.
+func (b *clientBudgets) current(client string) *budgetUsage {
+	now := b.now()
+	b.evict(now)
+	u, ok := b.usage[client]
+	if !ok || (b.limits.Window > 0 && now.Sub(u.windowStart) >= b.limits.Window) {
+		u = &budgetUsage{windowStart: now}
+		b.usage[client] = u
+	}
+	return u
+}
+
+// evict drops the usage of the clients whose window expired, at most once
+// per window. Usage is kept forever without a window. Must be called with
+// `mu` held.
+func (b *clientBudgets) evict(now time.Time) {
+	if b.limits.Window <= 0 || now.Sub(b.lastSweep) < b.limits.Window {
+		return
+	}
+	for client, u := range b.usage {
+		if now.Sub(u.windowStart) >= b.limits.Window {
+			delete(b.usage, client)
+		}
+	}
+	b.lastSweep = now
+}
+
+// acquire admits a request from `client`, or returns a
+// `codes.ResourceExhausted` error if the client's budget is exhausted.
+func (b *clientBudgets) acquire(client string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	u := b.current(client)
+	if b.limits.MaxRequests > 0 && u.requests >= b.limits.MaxRequests {
+		return status.Errorf(codes.ResourceExhausted,
+			"client %q exceeded its budget of %d requests", client, b.limits.MaxRequests)
+	}
+	if b.limits.MaxHSMTime > 0 && u.hsmTime >= b.limits.MaxHSMTime {
+		return status.Errorf(codes.ResourceExhausted,
+			"client %q exceeded its budget of %v HSM time", client, b.limits.MaxHSMTime)
+	}
+	u.requests++
+	return nil
+}
+
+// charge adds `d` of HSM time to the usage of `client`.
+func (b *clientBudgets) charge(client string, d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.current(client).hsmTime += d
+}
+
+// run executes the HSM operation `op` on behalf of the client issuing the
+// request in `ctx` if its budget allows it, and charges the HSM time spent by
+// `op` to the client's budget. `op` must issue its HSM calls with the context
+// it is passed, which measures the time spent running on HSM sessions,
+// excluding the wait for a session and the retry backoff. Clients are not
+// identified when no limit is configured.
+func (b *clientBudgets) run(ctx context.Context, op func(context.Context) error) error {
+	if !b.enabled() {
+		return op(ctx)
+	}
+	client, err := clientID(ctx)
+	if err != nil {
+		return err
+	}
+	if err := b.acquire(client); err != nil {
+		return err
+	}
+	timer := &se.HSMTimer{}
+	err = op(se.WithHSMTimer(ctx, timer))
+	b.charge(client, timer.Elapsed())
+	return err
+}
+
+// clientID returns the identifier used to track the budget of the client
+// issuing the request in `ctx`: the subject of its verified TLS client
+// certificate, so that clients sharing a host or NAT address have their own
+// budget. Returns a `codes.Unauthenticated` error if the client is not
+// authenticated, rather than sharing a budget among all such clients.
+func clientID(ctx context.Context) (string, error) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return "", status.Errorf(codes.Unauthenticated, "unable to identify client: no peer information")
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 || len(info.State.VerifiedChains[0]) == 0 {
+		return "", status.Errorf(codes.Unauthenticated, "unable to identify client: client budgets require a verified TLS client certificate")
+	}
+	return info.State.VerifiedChains[0][0].Subject.String(), nil
+}
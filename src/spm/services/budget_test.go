@@ -0,0 +1,216 @@
+// Copyright lowRISC contributors (OpenTitan project).
+// Licensed under the Apache License, Version 2.0, see LICENSE for details.
+// SPDX-License-Identifier: Apache-2.0
+
+package spm
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/lowRISC/opentitan-provisioning/src/spm/services/se"
+	"github.com/lowRISC/opentitan-provisioning/src/spm/services/skucfg"
+)
+
+// fakeClock is a manually advanced clock.
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+// op returns an HSM operation taking `d` to complete, all of it spent on an
+// HSM session.
+func (c *fakeClock) op(d time.Duration) func(context.Context) error {
+	return func(ctx context.Context) error {
+		c.t = c.t.Add(d)
+		se.HSMTimerFromContext(ctx).Add(d)
+		return nil
+	}
+}
+
+// clientContext returns a context for a request issued from `addr` by the
+// client authenticated with a certificate for `name`.
+func clientContext(addr, name string) context.Context {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		panic(err)
+	}
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: name}}
+	return peer.NewContext(context.Background(), &peer.Peer{
+		Addr:     tcpAddr,
+		AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}},
+	})
+}
+
+func newTestBudgets(limits skucfg.ClientBudget) (*clientBudgets, *fakeClock) {
+	clock := &fakeClock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	b := newClientBudgets(limits)
+	b.now = clock.now
+	return b, clock
+}
+
+func TestClientBudgetsTimeWeighted(t *testing.T) {
+	b, clock := newTestBudgets(skucfg.ClientBudget{
+		MaxHSMTime: 100 * time.Millisecond,
+		Window:     time.Minute,
+	})
+	client0 := clientContext("10.0.0.1:1234", "client0")
+	// Clients behind the same address have their own budget.
+	client1 := clientContext("10.0.0.1:5678", "client1")
+	const (
+		ecdsaP256 = 2 * time.Millisecond
+		rsa4096   = 40 * time.Millisecond
+	)
+
+	// Two RSA-4096 signatures and a few ECDSA-P256 ones fit in the budget.
+	for _, d := range []time.Duration{rsa4096, ecdsaP256, rsa4096, ecdsaP256, ecdsaP256} {
+		if err := b.run(client0, clock.op(d)); err != nil {
+			t.Fatalf("run(%v) failed: %v", d, err)
+		}
+	}
+	if got, want := b.usage["CN=client0"].hsmTime, 2*rsa4096+3*ecdsaP256; got != want {
+		t.Errorf("hsmTime = %v, want %v", got, want)
+	}
+
+	// The third RSA-4096 signature is admitted with 14ms left and overruns
+	// the budget, after which all operations are rejected.
+	if err := b.run(client0, clock.op(rsa4096)); err != nil {
+		t.Fatalf("run() failed: %v", err)
+	}
+	if err := b.run(client0, clock.op(ecdsaP256)); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("run() = %v, want code %v", err, codes.ResourceExhausted)
+	}
+
+	// Other clients have their own budget.
+	if err := b.run(client1, clock.op(rsa4096)); err != nil {
+		t.Errorf("run() for other client failed: %v", err)
+	}
+
+	// The budget is replenished in the next window.
+	clock.t = clock.t.Add(time.Minute)
+	if err := b.run(client0, clock.op(ecdsaP256)); err != nil {
+		t.Errorf("run() in new window failed: %v", err)
+	}
+}
+
+func TestClientBudgetsRequests(t *testing.T) {
+	b, clock := newTestBudgets(skucfg.ClientBudget{MaxRequests: 2})
+	client0 := clientContext("10.0.0.1:1234", "client0")
+
+	// Failed operations count against the budget.
+	opErr := errors.New("hsm error")
+	if err := b.run(client0, func(context.Context) error { return opErr }); err != opErr {
+		t.Fatalf("run() = %v, want %v", err, opErr)
+	}
+	if err := b.run(client0, clock.op(time.Millisecond)); err != nil {
+		t.Fatalf("run() failed: %v", err)
+	}
+	if err := b.run(client0, clock.op(time.Millisecond)); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("run() = %v, want code %v", err, codes.ResourceExhausted)
+	}
+
+	// Budgets are never replenished without a window, but reloading the
+	// limits applies to the current usage.
+	clock.t = clock.t.Add(24 * time.Hour)
+	b.setLimits(skucfg.ClientBudget{MaxRequests: 3})
+	if err := b.run(client0, clock.op(time.Millisecond)); err != nil {
+		t.Errorf("run() after reload failed: %v", err)
+	}
+	if err := b.run(client0, clock.op(time.Millisecond)); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("run() = %v, want code %v", err, codes.ResourceExhausted)
+	}
+}
+
+func TestClientBudgetsUnlimited(t *testing.T) {
+	b, clock := newTestBudgets(skucfg.ClientBudget{})
+	// Clients need not be authenticated without a budget.
+	for i := 0; i < 1000; i++ {
+		if err := b.run(context.Background(), clock.op(time.Second)); err != nil {
+			t.Fatalf("run() failed: %v", err)
+		}
+	}
+	if len(b.usage) != 0 {
+		t.Errorf("usage tracked for %d clients, want none", len(b.usage))
+	}
+
+	// Unauthenticated clients are rejected once a budget is configured.
+	b.setLimits(skucfg.ClientBudget{MaxRequests: 1})
+	if err := b.run(context.Background(), clock.op(time.Second)); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("run() = %v, want code %v", err, codes.Unauthenticated)
+	}
+}
+
+func TestClientBudgetsHSMTime(t *testing.T) {
+	b, clock := newTestBudgets(skucfg.ClientBudget{MaxHSMTime: time.Second})
+	client0 := clientContext("10.0.0.1:1234", "client0")
+
+	// Only the time spent on HSM sessions is charged, not the time waiting
+	// for a session.
+	err := b.run(client0, func(ctx context.Context) error {
+		clock.t = clock.t.Add(time.Minute)
+		return clock.op(10 * time.Millisecond)(ctx)
+	})
+	if err != nil {
+		t.Fatalf("run() failed: %v", err)
+	}
+	if got, want := b.usage["CN=client0"].hsmTime, 10*time.Millisecond; got != want {
+		t.Errorf("hsmTime = %v, want %v", got, want)
+	}
+}
+
+func TestClientBudgetsEviction(t *testing.T) {
+	b, clock := newTestBudgets(skucfg.ClientBudget{
+		MaxRequests: 10,
+		Window:      time.Minute,
+	})
+	for _, name := range []string{"client0", "client1", "client2"} {
+		if err := b.run(clientContext("10.0.0.1:1234", name), clock.op(time.Millisecond)); err != nil {
+			t.Fatalf("run() failed: %v", err)
+		}
+	}
+	if len(b.usage) != 3 {
+		t.Fatalf("usage tracked for %d clients, want 3", len(b.usage))
+	}
+
+	// The usage of idle clients is evicted once their window expires.
+	clock.t = clock.t.Add(time.Minute)
+	if err := b.run(clientContext("10.0.0.1:1234", "client3"), clock.op(time.Millisecond)); err != nil {
+		t.Fatalf("run() failed: %v", err)
+	}
+	if _, ok := b.usage["CN=client3"]; len(b.usage) != 1 || !ok {
+		t.Errorf("usage tracked for %v, want only CN=client3", b.usage)
+	}
+}
+
+func TestClientID(t *testing.T) {
+	got, err := clientID(clientContext("10.0.0.1:1234", "pa0"))
+	if err != nil || got != "CN=pa0" {
+		t.Errorf("clientID() = %q, %v; want %q", got, err, "CN=pa0")
+	}
+
+	// Clients without a verified certificate must not share a budget.
+	tcpAddr, err := net.ResolveTCPAddr("tcp", "10.0.0.1:1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ctx := range []context.Context{
+		context.Background(),
+		peer.NewContext(context.Background(), &peer.Peer{Addr: tcpAddr}),
+	} {
+		if _, err := clientID(ctx); status.Code(err) != codes.Unauthenticated {
+			t.Errorf("clientID() without certificate = %v, want code %v", err, codes.Unauthenticated)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+// Copyright lowRISC contributors (OpenTitan project).
+// Licensed under the Apache License, Version 2.0, see LICENSE for details.
+// SPDX-License-Identifier: Apache-2.0
+
+package se
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/lowRISC/opentitan-provisioning/src/pk11"
+)
+
+// defaultFailoverCodes are the gRPC codes failed over by a `GroupConfig`
+// that does not list its own.
+var defaultFailoverCodes = []codes.Code{codes.Unavailable}
+
+// defaultFailoverErrors are the CKR_* codes failed over by a `GroupConfig`
+// that does not list its own: CKR_DEVICE_ERROR, CKR_DEVICE_REMOVED,
+// CKR_SESSION_CLOSED, CKR_SESSION_HANDLE_INVALID and CKR_TOKEN_NOT_PRESENT.
+var defaultFailoverErrors = []uint{0x30, 0x32, 0xB0, 0xB3, 0xE0}
+
+// GroupConfig configures an `HSMGroup`.
+type GroupConfig struct {
+	// FailoverCodes are the gRPC codes of the errors retried on the next
+	// HSM. Defaults to `defaultFailoverCodes` if nil.
+	FailoverCodes []codes.Code
+
+	// FailoverErrors are the CKR_* codes of the PKCS#11 errors retried on
+	// the next HSM. Defaults to `defaultFailoverErrors` if nil.
+	FailoverErrors []uint
+
+	// HealthCheckInterval is the interval at which `VerifySession` is called
+	// on every HSM to update its health. Disabled if zero, in which case
+	// HSMs are only marked healthy again by a successful operation.
+	HealthCheckInterval time.Duration
+}
+
+// failover reports whether the operation that failed with `err` is retried
+// on the next HSM.
+func (c GroupConfig) failover(err error) bool {
+	var e pk11.Error
+	if errors.As(err, &e) {
+		failover := c.FailoverErrors
+		if failover == nil {
+			failover = defaultFailoverErrors
+		}
+		for _, code := range failover {
+			if uint(e.Raw) == code {
+				return true
+			}
+		}
+		return false
+	}
+	var se interface{ GRPCStatus() *status.Status }
+	if !errors.As(err, &se) {
+		return false
+	}
+	failover := c.FailoverCodes
+	if failover == nil {
+		failover = defaultFailoverCodes
+	}
+	for _, code := range failover {
+		if se.GRPCStatus().Code() == code {
+			return true
+		}
+	}
+	return false
+}
+
+// groupHSM is an HSM of an `HSMGroup`. It is implemented by `*HSM`.
+type groupHSM interface {
+	SE
+	ExecuteCmd(ctx context.Context, cmd CmdFunc) error
+}
+
+// groupMember tracks the health of an HSM of an `HSMGroup`.
+type groupMember struct {
+	// id is the index of the HSM in the group.
+	id int
+
+	hsm groupHSM
+
+	// down is set while the HSM is unhealthy.
+	down atomic.Bool
+}
+
+// markDown records that the HSM became unhealthy because of `err`.
+func (m *groupMember) markDown(err error) {
+	if !m.down.Swap(true) {
+		log.Printf("HSM %d of group is unhealthy: %v", m.id, err)
+	}
+}
+
+// markUp records that the HSM is healthy.
+func (m *groupMember) markUp() {
+	if m.down.Swap(false) {
+		log.Printf("HSM %d of group is healthy again", m.id)
+	}
+}
+
+// HSMGroup spreads operations over several HSMs holding the same keys, in a
+// round-robin fashion. An operation failing with one of the errors listed in
+// `GroupConfig` is retried on the next HSM, so that provisioning continues
+// while an HSM is unavailable. HSMs that failed are only used once all the
+// others failed, until they are healthy again.
+//
+// HSMGroup implements the `SE` interface.
+type HSMGroup struct {
+	members []*groupMember
+
+	config GroupConfig
+
+	// next is the index of the HSM the next operation starts on.
+	next atomic.Uint32
+
+	// done is closed by `Close` to stop the health check goroutine.
+	done      chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// NewHSMGroup creates a group of the `hsms` HSMs. A health check goroutine is
+// started if `config.HealthCheckInterval` is set. Call `Close` to stop it
+// and close the HSMs.
+func NewHSMGroup(hsms []*HSM, config GroupConfig) (*HSMGroup, error) {
+	members := make([]groupHSM, len(hsms))
+	for i, h := range hsms {
+		members[i] = h
+	}
+	return newHSMGroup(members, config)
+}
+
+// newHSMGroup creates a group of the `hsms` HSMs. See `NewHSMGroup`.
+func newHSMGroup(hsms []groupHSM, config GroupConfig) (*HSMGroup, error) {
+	if len(hsms) == 0 {
+		return nil, fmt.Errorf("HSM group has no HSM")
+	}
+	g := &HSMGroup{config: config, done: make(chan struct{})}
+	for i, h := range hsms {
+		g.members = append(g.members, &groupMember{id: i, hsm: h})
+	}
+	if config.HealthCheckInterval > 0 {
+		go g.healthCheckLoop()
+	}
+	return g, nil
+}
+
+// healthCheckLoop checks the health of the HSMs periodically until the group
+// is closed.
+func (g *HSMGroup) healthCheckLoop() {
+	t := time.NewTicker(g.config.HealthCheckInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-g.done:
+			return
+		case <-t.C:
+			g.healthCheck()
+		}
+	}
+}
+
+// healthCheck calls `VerifySession` on every HSM and updates its health.
+func (g *HSMGroup) healthCheck() {
+	for _, m := range g.members {
+		ctx, cancel := context.WithTimeout(context.Background(), g.config.HealthCheckInterval)
+		err := m.hsm.VerifySession(ctx)
+		cancel()
+		if err != nil {
+			m.markDown(err)
+			continue
+		}
+		m.markUp()
+	}
+}
+
+// inGroup runs `fn` on the next HSM of `g`, failing over to the following
+// HSMs as configured. Healthy HSMs are tried first. See `HSMGroup`.
+func inGroup[T any](ctx context.Context, g *HSMGroup, op string, fn func(groupHSM) (T, error)) (res T, err error) {
+	n := len(g.members)
+	start := int(g.next.Add(1)-1) % n
+	var errs []string
+	for _, down := range []bool{false, true} {
+		for i := 0; i < n; i++ {
+			m := g.members[(start+i)%n]
+			if m.down.Load() != down {
+				continue
+			}
+			res, err = fn(m.hsm)
+			if err == nil {
+				m.markUp()
+				return res, nil
+			}
+			if !g.config.failover(err) || ctx.Err() != nil {
+				return res, err
+			}
+			m.markDown(err)
+			errs = append(errs, fmt.Sprintf("HSM %d: %v", m.id, err))
+			if n > 1 {
+				log.Printf("HSM operation %s failed on HSM %d, failing over: %v", op, m.id, err)
+			}
+		}
+	}
+	if n == 1 {
+		return res, err
+	}
+	return res, status.Errorf(codes.Unavailable, "%s failed on all HSMs of the group: %s", op, strings.Join(errs, "; "))
+}
+
+// GenerateTokens generates tokens on the next available HSM. See
+// `SE.GenerateTokens`.
+func (g *HSMGroup) GenerateTokens(ctx context.Context, params []*TokenParams) ([]TokenResult, error) {
+	return inGroup(ctx, g, "GenerateTokens", func(h groupHSM) ([]TokenResult, error) {
+		return h.GenerateTokens(ctx, params)
+	})
+}
+
+// EndorseCert endorses a certificate on the next available HSM. See
+// `SE.EndorseCert`.
+func (g *HSMGroup) EndorseCert(ctx context.Context, tbs []byte, params EndorseCertParams) ([]byte, error) {
+	return inGroup(ctx, g, "EndorseCert", func(h groupHSM) ([]byte, error) {
+		return h.EndorseCert(ctx, tbs, params)
+	})
+}
+
+// EndorseCerts endorses a batch of certificates on the next available HSM. See
+// `SE.EndorseCerts`.
+func (g *HSMGroup) EndorseCerts(ctx context.Context, reqs []EndorseCertParamsWithTBS, failFast bool) ([]EndorseCertResult, error) {
+	return inGroup(ctx, g, "EndorseCerts", func(h groupHSM) ([]EndorseCertResult, error) {
+		return h.EndorseCerts(ctx, reqs, failFast)
+	})
+}
+
+// SignCRL signs a certificate revocation list on the next available HSM. See
+// `SE.SignCRL`.
+func (g *HSMGroup) SignCRL(ctx context.Context, tbsCertList []byte, params EndorseCertParams) ([]byte, error) {
+	return inGroup(ctx, g, "SignCRL", func(h groupHSM) ([]byte, error) {
+		return h.SignCRL(ctx, tbsCertList, params)
+	})
+}
+
+// EndorseData signs a data payload on the next available HSM. See
+// `SE.EndorseData`.
+func (g *HSMGroup) EndorseData(ctx context.Context, data []byte, params EndorseCertParams) ([]byte, []byte, error) {
+	type endorsement struct{ key, sig []byte }
+	e, err := inGroup(ctx, g, "EndorseData", func(h groupHSM) (endorsement, error) {
+		key, sig, err := h.EndorseData(ctx, data, params)
+		return endorsement{key, sig}, err
+	})
+	return e.key, e.sig, err
+}
+
+// ExecuteCmd runs `cmd` with a session of the next available HSM. See
+// `HSM.ExecuteCmd`.
+func (g *HSMGroup) ExecuteCmd(ctx context.Context, cmd CmdFunc) error {
+	_, err := inGroup(ctx, g, "ExecuteCmd", func(h groupHSM) (struct{}, error) {
+		return struct{}{}, h.ExecuteCmd(ctx, cmd)
+	})
+	return err
+}
+
+// VerifySession verifies that a session to at least one HSM of the group is
+// active.
+func (g *HSMGroup) VerifySession(ctx context.Context) error {
+	_, err := inGroup(ctx, g, "VerifySession", func(h groupHSM) (struct{}, error) {
+		return struct{}{}, h.VerifySession(ctx)
+	})
+	return err
+}
+
+// Close stops the health check goroutine and closes all the HSMs of the
+// group. Calling Close again returns the result of the first call.
+func (g *HSMGroup) Close() error {
+	g.closeOnce.Do(func() {
+		close(g.done)
+		var errs []string
+		for _, m := range g.members {
+			if err := m.hsm.Close(); err != nil {
+				errs = append(errs, fmt.Sprintf("HSM %d: %v", m.id, err))
+			}
+		}
+		if len(errs) > 0 {
+			g.closeErr = fmt.Errorf("failed to close HSM group: %s", strings.Join(errs, "; "))
+		}
+	})
+	return g.closeErr
+}
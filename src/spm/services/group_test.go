@@ -0,0 +1,152 @@
+// Copyright lowRISC contributors (OpenTitan project).
+// Licensed under the Apache License, Version 2.0, see LICENSE for details.
+// SPDX-License-Identifier: Apache-2.0
+
+package se
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeGroupHSM is a `groupHSM` endorsing certificates with a fixed result.
+type fakeGroupHSM struct {
+	SE
+
+	// cert is the result of `EndorseCert`.
+	cert []byte
+
+	// mu guards the fields below.
+	mu sync.Mutex
+	// err fails all operations if set.
+	err error
+	// calls counts the `EndorseCert` calls.
+	calls int
+}
+
+func (f *fakeGroupHSM) setErr(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.err = err
+}
+
+func (f *fakeGroupHSM) EndorseCert(ctx context.Context, tbs []byte, params EndorseCertParams) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.cert, nil
+}
+
+func (f *fakeGroupHSM) VerifySession(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.err
+}
+
+func (f *fakeGroupHSM) ExecuteCmd(ctx context.Context, cmd CmdFunc) error {
+	return status.Errorf(codes.Unimplemented, "ExecuteCmd is not implemented")
+}
+
+func (f *fakeGroupHSM) Close() error {
+	return nil
+}
+
+func TestHSMGroupFailover(t *testing.T) {
+	primary := &fakeGroupHSM{cert: []byte("primary")}
+	secondary := &fakeGroupHSM{cert: []byte("secondary")}
+	g, err := newHSMGroup([]groupHSM{primary, secondary}, GroupConfig{})
+	if err != nil {
+		t.Fatalf("newHSMGroup() failed: %v", err)
+	}
+	defer g.Close()
+
+	primary.setErr(status.Errorf(codes.Unavailable, "HSM is down"))
+	cert, err := g.EndorseCert(context.Background(), nil, EndorseCertParams{})
+	if err != nil {
+		t.Fatalf("EndorseCert() failed: %v", err)
+	}
+	if !bytes.Equal(cert, secondary.cert) {
+		t.Errorf("EndorseCert() = %q, want %q", cert, secondary.cert)
+	}
+	if !g.members[0].down.Load() {
+		t.Error("primary HSM is not marked unhealthy")
+	}
+
+	// The unhealthy primary is skipped while the secondary serves requests,
+	// even when the round-robin starts on the primary.
+	for i := 0; i < 2; i++ {
+		if _, err := g.EndorseCert(context.Background(), nil, EndorseCertParams{}); err != nil {
+			t.Fatalf("EndorseCert() failed: %v", err)
+		}
+	}
+	if primary.calls != 1 {
+		t.Errorf("primary HSM called %d times, want 1", primary.calls)
+	}
+
+	secondary.setErr(status.Errorf(codes.Unavailable, "HSM is down"))
+	if _, err := g.EndorseCert(context.Background(), nil, EndorseCertParams{}); status.Code(err) != codes.Unavailable {
+		t.Errorf("EndorseCert() = %v with all HSMs down, want code %v", err, codes.Unavailable)
+	}
+}
+
+func TestHSMGroupNoFailover(t *testing.T) {
+	primary := &fakeGroupHSM{cert: []byte("primary")}
+	secondary := &fakeGroupHSM{cert: []byte("secondary")}
+	g, err := newHSMGroup([]groupHSM{primary, secondary}, GroupConfig{})
+	if err != nil {
+		t.Fatalf("newHSMGroup() failed: %v", err)
+	}
+	defer g.Close()
+
+	primary.setErr(status.Errorf(codes.InvalidArgument, "bad TBS"))
+	if _, err := g.EndorseCert(context.Background(), nil, EndorseCertParams{}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("EndorseCert() = %v, want code %v", err, codes.InvalidArgument)
+	}
+	if secondary.calls != 0 {
+		t.Errorf("secondary HSM called %d times, want 0", secondary.calls)
+	}
+	if g.members[0].down.Load() {
+		t.Error("primary HSM marked unhealthy after a request error")
+	}
+}
+
+func TestHSMGroupHealthCheck(t *testing.T) {
+	primary := &fakeGroupHSM{cert: []byte("primary")}
+	secondary := &fakeGroupHSM{cert: []byte("secondary")}
+	g, err := newHSMGroup([]groupHSM{primary, secondary}, GroupConfig{HealthCheckInterval: time.Millisecond})
+	if err != nil {
+		t.Fatalf("newHSMGroup() failed: %v", err)
+	}
+	defer g.Close()
+
+	// waitHealth waits until the health check marks the primary `down`.
+	waitHealth := func(down bool) {
+		t.Helper()
+		deadline := time.Now().Add(10 * time.Second)
+		for g.members[0].down.Load() != down {
+			if time.Now().After(deadline) {
+				t.Fatalf("primary HSM down = %v, want %v", !down, down)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	primary.setErr(status.Errorf(codes.Unavailable, "HSM is down"))
+	waitHealth(true)
+	primary.setErr(nil)
+	waitHealth(false)
+}
+
+func TestNewHSMGroupEmpty(t *testing.T) {
+	if _, err := NewHSMGroup(nil, GroupConfig{}); err == nil {
+		t.Error("NewHSMGroup() succeeded without HSMs, want error")
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright lowRISC contributors (OpenTitan project).
+// Licensed under the Apache License, Version 2.0, see LICENSE for details.
+// SPDX-License-Identifier: Apache-2.0
+
+package se
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/lowRISC/opentitan-provisioning/src/pk11"
+)
+
+// keyIDLookup returns the UID of the key object of class `class` labeled
+// `label`. See `getKeyIDByLabel`.
+type keyIDLookup func(session *pk11.Session, class pk11.ClassAttribute, label string) ([]byte, error)
+
+// keyIDCacheKey identifies a cached key UID.
+type keyIDCacheKey struct {
+	class pk11.ClassAttribute
+	label string
+}
+
+// keyIDCache caches the UIDs of key objects by class and label, which saves
+// the label lookup round trips to the HSM on the hot path. Key UIDs are
+// valid in all sessions of a token, so the cache is shared by all sessions.
+//
+// The zero value is an empty cache using `getKeyIDByLabel`. It is safe for
+// concurrent use.
+type keyIDCache struct {
+	// mu guards ids.
+	mu  sync.RWMutex
+	ids map[keyIDCacheKey][]byte
+
+	// lookup is the label lookup used on cache misses. Defaults to
+	// `getKeyIDByLabel` if nil.
+	lookup keyIDLookup
+
+	// lookups counts the label lookups, i.e. the cache misses.
+	lookups atomic.Int64
+}
+
+// get returns the UID of the key object of class `class` labeled `label`,
+// looking it up on `session` on a cache miss. Reports whether the UID was
+// cached, in which case it may be stale and should be invalidated if it no
+// longer resolves.
+func (c *keyIDCache) get(session *pk11.Session, class pk11.ClassAttribute, label string) ([]byte, bool, error) {
+	k := keyIDCacheKey{class: class, label: label}
+	c.mu.RLock()
+	id, ok := c.ids[k]
+	c.mu.RUnlock()
+	if ok {
+		return id, true, nil
+	}
+
+	lookup := c.lookup
+	if lookup == nil {
+		lookup = getKeyIDByLabel
+	}
+	c.lookups.Add(1)
+	id, err := lookup(session, class, label)
+	if err != nil {
+		return nil, false, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ids == nil {
+		c.ids = make(map[keyIDCacheKey][]byte)
+	}
+	c.ids[k] = id
+	return id, false, nil
+}
+
+// has reports whether the UID of the key object of class `class` labeled
+// `label` is cached.
+func (c *keyIDCache) has(class pk11.ClassAttribute, label string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	_, ok := c.ids[keyIDCacheKey{class: class, label: label}]
+	return ok
+}
+
+// invalidate drops the cached UID of the key object of class `class` labeled
+// `label`, e.g. once the key has been destroyed.
+func (c *keyIDCache) invalidate(class pk11.ClassAttribute, label string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.ids, keyIDCacheKey{class: class, label: label})
+}
+
+// clear drops all cached UIDs.
+func (c *keyIDCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ids = nil
+}
@@ -0,0 +1,126 @@
+// Copyright lowRISC contributors (OpenTitan project).
+// Licensed under the Apache License, Version 2.0, see LICENSE for details.
+// SPDX-License-Identifier: Apache-2.0
+
+package se
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/lowRISC/opentitan-provisioning/src/pk11"
+)
+
+// countingLookup returns a `keyIDLookup` returning the label as UID, or
+// `pk11.ErrObjectNotFound` for labels in `missing`, and counting its calls.
+func countingLookup(calls *atomic.Int64, missing ...string) keyIDLookup {
+	return func(session *pk11.Session, class pk11.ClassAttribute, label string) ([]byte, error) {
+		calls.Add(1)
+		for _, m := range missing {
+			if label == m {
+				return nil, pk11.ErrObjectNotFound
+			}
+		}
+		return []byte(label), nil
+	}
+}
+
+func TestKeyIDCache(t *testing.T) {
+	var calls atomic.Int64
+	c := &keyIDCache{lookup: countingLookup(&calls, "missing")}
+
+	for i, want := range []struct {
+		class  pk11.ClassAttribute
+		label  string
+		cached bool
+	}{
+		{pk11.ClassPrivateKey, "KCAPriv", false},
+		{pk11.ClassPrivateKey, "KCAPriv", true},
+		// Keys of different classes may share a label.
+		{pk11.ClassPublicKey, "KCAPriv", false},
+		{pk11.ClassPublicKey, "KCAPriv", true},
+	} {
+		id, cached, err := c.get(nil, want.class, want.label)
+		if err != nil {
+			t.Fatalf("get() %d failed: %v", i, err)
+		}
+		if !bytes.Equal(id, []byte(want.label)) || cached != want.cached {
+			t.Errorf("get() %d = %q, %t, want %q, %t", i, id, cached, want.label, want.cached)
+		}
+	}
+	if got := calls.Load(); got != 2 {
+		t.Errorf("got %d label lookups, want 2", got)
+	}
+
+	c.invalidate(pk11.ClassPrivateKey, "KCAPriv")
+	if c.has(pk11.ClassPrivateKey, "KCAPriv") || !c.has(pk11.ClassPublicKey, "KCAPriv") {
+		t.Error("invalidate() did not drop only the private key entry")
+	}
+	c.clear()
+	if c.has(pk11.ClassPublicKey, "KCAPriv") {
+		t.Error("clear() did not drop the public key entry")
+	}
+
+	// Failed lookups are not cached.
+	for i := 0; i < 2; i++ {
+		if _, _, err := c.get(nil, pk11.ClassPrivateKey, "missing"); !errors.Is(err, pk11.ErrObjectNotFound) {
+			t.Errorf("get() = %v for a missing key, want %v", err, pk11.ErrObjectNotFound)
+		}
+	}
+	if got := c.lookups.Load(); got != 4 {
+		t.Errorf("lookups = %d, want 4", got)
+	}
+}
+
+func TestKeyIDCacheConcurrent(t *testing.T) {
+	var calls atomic.Int64
+	c := &keyIDCache{lookup: countingLookup(&calls)}
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if _, _, err := c.get(nil, pk11.ClassPrivateKey, "KCAPriv"); err != nil {
+					t.Errorf("get() failed: %v", err)
+					return
+				}
+				if i == 0 && j%10 == 0 {
+					c.invalidate(pk11.ClassPrivateKey, "KCAPriv")
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// BenchmarkKeyIDCache compares the PKCS#11 calls made to find the signing key
+// of an endorsement with and without the key UID cache. A label lookup costs
+// two calls: `FindKeyByLabel` and `UID`.
+func BenchmarkKeyIDCache(b *testing.B) {
+	const callsPerLookup = 2
+	for _, tc := range []struct {
+		name   string
+		cached bool
+	}{
+		{"uncached", false},
+		{"cached", true},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			var calls atomic.Int64
+			c := &keyIDCache{lookup: countingLookup(&calls)}
+			for i := 0; i < b.N; i++ {
+				if !tc.cached {
+					c.clear()
+				}
+				if _, _, err := c.get(nil, pk11.ClassPrivateKey, "KCAPriv"); err != nil {
+					b.Fatalf("get() failed: %v", err)
+				}
+			}
+			b.ReportMetric(float64(calls.Load()*callsPerLookup)/float64(b.N), "pk11_calls/op")
+		})
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright lowRISC contributors (OpenTitan project).
+// Licensed under the Apache License, Version 2.0, see LICENSE for details.
+// SPDX-License-Identifier: Apache-2.0
+
+package se
+
+import (
+	"context"
+	"expvar"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics receives HSM usage measurements. Implementations must be safe for
+// concurrent use. See `HSMConfig.Metrics`.
+type Metrics interface {
+	// SetQueueDepth records the number of idle sessions in the pool.
+	SetQueueDepth(n int)
+	// ObserveWait records the time an operation waited for a session.
+	ObserveWait(d time.Duration)
+	// ObserveOperation records the latency and result of HSM operation `op`,
+	// e.g. "EndorseCert". The latency includes the session wait.
+	ObserveOperation(op string, d time.Duration, err error)
+}
+
+// waitBuckets are the upper bounds of the session wait latency histogram
+// buckets published by `ExpvarMetrics`.
+var waitBuckets = []time.Duration{
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+	10 * time.Second,
+}
+
+// ExpvarMetrics is a `Metrics` implementation publishing the measurements as
+// expvar variables in a caller-supplied map:
+//
+//	queue_depth: number of idle sessions.
+//	wait_count, wait_ns: number and total duration of session waits.
+//	wait_le_<bound>: number of waits shorter than <bound>, e.g. wait_le_10ms.
+//	op_<op>_count, op_<op>_errors, op_<op>_ns: number, failures and total
+//	    duration of operation <op>.
+//
+// Prometheus collectors are not provided because the Prometheus client is not
+// among the Go dependencies pinned by go.mod and third_party/go/deps.bzl, and
+// the SE library must build with those alone. The variables follow the
+// counter and cumulative histogram bucket conventions of Prometheus, so they
+// can be scraped through the expvar collector of the Prometheus client, and
+// deployments linking the client can implement `Metrics` with their own
+// collectors instead.
+type ExpvarMetrics struct {
+	vars *expvar.Map
+
+	queueDepth expvar.Int
+	waitCount  expvar.Int
+	waitNs     expvar.Int
+	waitLe     []*expvar.Int
+}
+
+// NewExpvarMetrics returns an `ExpvarMetrics` publishing to `vars`. Pass a map
+// created with `expvar.NewMap` to export the metrics through the expvar HTTP
+// handler, or an unpublished map to keep them private, e.g. in tests.
+func NewExpvarMetrics(vars *expvar.Map) *ExpvarMetrics {
+	m := &ExpvarMetrics{vars: vars}
+	vars.Set("queue_depth", &m.queueDepth)
+	vars.Set("wait_count", &m.waitCount)
+	vars.Set("wait_ns", &m.waitNs)
+	for _, b := range waitBuckets {
+		v := new(expvar.Int)
+		vars.Set("wait_le_"+b.String(), v)
+		m.waitLe = append(m.waitLe, v)
+	}
+	return m
+}
+
+func (m *ExpvarMetrics) SetQueueDepth(n int) {
+	m.queueDepth.Set(int64(n))
+}
+
+func (m *ExpvarMetrics) ObserveWait(d time.Duration) {
+	m.waitCount.Add(1)
+	m.waitNs.Add(int64(d))
+	for i, b := range waitBuckets {
+		if d <= b {
+			m.waitLe[i].Add(1)
+		}
+	}
+}
+
+func (m *ExpvarMetrics) ObserveOperation(op string, d time.Duration, err error) {
+	prefix := "op_" + op
+	m.vars.Add(prefix+"_count", 1)
+	m.vars.Add(prefix+"_ns", int64(d))
+	if err != nil {
+		m.vars.Add(prefix+"_errors", 1)
+	}
+}
+
+// HSMTimer accumulates the time HSM operations spend running on a session,
+// excluding the wait for a session and the backoff between retries. Attach
+// it to the context of the operations with `WithHSMTimer`. The zero value is
+// ready to use.
+type HSMTimer struct {
+	elapsed atomic.Int64
+}
+
+// Add adds `d` to the time accumulated by `t`. A nil timer discards `d`.
+func (t *HSMTimer) Add(d time.Duration) {
+	if t != nil {
+		t.elapsed.Add(int64(d))
+	}
+}
+
+// Elapsed returns the time accumulated by `t`.
+func (t *HSMTimer) Elapsed() time.Duration {
+	return time.Duration(t.elapsed.Load())
+}
+
+type hsmTimerKey struct{}
+
+// WithHSMTimer returns a copy of `ctx` whose HSM operations are timed by `t`.
+func WithHSMTimer(ctx context.Context, t *HSMTimer) context.Context {
+	return context.WithValue(ctx, hsmTimerKey{}, t)
+}
+
+// HSMTimerFromContext returns the timer attached to `ctx` by `WithHSMTimer`,
+// or nil.
+func HSMTimerFromContext(ctx context.Context) *HSMTimer {
+	t, _ := ctx.Value(hsmTimerKey{}).(*HSMTimer)
+	return t
+}
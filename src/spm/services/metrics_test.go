@@ -0,0 +1,122 @@
+// Copyright lowRISC contributors (OpenTitan project).
+// Licensed under the Apache License, Version 2.0, see LICENSE for details.
+// SPDX-License-Identifier: Apache-2.0
+
+package se
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lowRISC/opentitan-provisioning/src/pk11"
+)
+
+// recordingMetrics is a `Metrics` implementation recording the measurements.
+type recordingMetrics struct {
+	mu    sync.Mutex
+	depth int
+	waits []time.Duration
+}
+
+func (m *recordingMetrics) SetQueueDepth(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.depth = n
+}
+
+func (m *recordingMetrics) ObserveWait(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.waits = append(m.waits, d)
+}
+
+func (m *recordingMetrics) ObserveOperation(op string, d time.Duration, err error) {}
+
+func TestSessionQueueMetrics(t *testing.T) {
+	m := &recordingMetrics{}
+	q := newSessionQueue(2)
+	q.metrics = m
+	for i := 0; i < 2; i++ {
+		if err := q.insert(nil); err != nil {
+			t.Fatalf("insert() failed: %v", err)
+		}
+	}
+	if m.depth != 2 {
+		t.Errorf("queue depth = %d, want 2", m.depth)
+	}
+
+	_, release1 := q.getHandle()
+	_, release2 := q.getHandle()
+	if m.depth != 0 {
+		t.Errorf("queue depth = %d, want 0", m.depth)
+	}
+
+	// Wait on the exhausted pool until a session is released.
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		release1()
+	}()
+	_, release3 := q.getHandle()
+	release2()
+	release3()
+
+	if m.depth != 2 {
+		t.Errorf("queue depth = %d, want 2", m.depth)
+	}
+	if len(m.waits) != 3 {
+		t.Fatalf("recorded %d waits, want 3", len(m.waits))
+	}
+	if m.waits[2] < 20*time.Millisecond {
+		t.Errorf("recorded wait %v, want at least 20ms", m.waits[2])
+	}
+}
+
+func TestExpvarMetrics(t *testing.T) {
+	vars := new(expvar.Map).Init()
+	m := NewExpvarMetrics(vars)
+
+	m.SetQueueDepth(3)
+	m.ObserveWait(5 * time.Millisecond)
+	m.ObserveWait(2 * time.Second)
+	m.ObserveOperation("EndorseCert", time.Millisecond, nil)
+	m.ObserveOperation("EndorseCert", time.Millisecond, errors.New("failed"))
+
+	for name, want := range map[string]int64{
+		"queue_depth":           3,
+		"wait_count":            2,
+		"wait_ns":               int64(5*time.Millisecond + 2*time.Second),
+		"wait_le_1ms":           0,
+		"wait_le_10ms":          1,
+		"wait_le_10s":           2,
+		"op_EndorseCert_count":  2,
+		"op_EndorseCert_errors": 1,
+		"op_EndorseCert_ns":     int64(2 * time.Millisecond),
+	} {
+		v, ok := vars.Get(name).(*expvar.Int)
+		if !ok {
+			t.Errorf("missing variable %q", name)
+			continue
+		}
+		if got := v.Value(); got != want {
+			t.Errorf("%s = %d, want %d", name, got, want)
+		}
+	}
+}
+
+func TestOperationMetrics(t *testing.T) {
+	vars := new(expvar.Map).Init()
+	q := newSessionQueue(1)
+	q.insert(nil)
+	hsm := &HSM{sessions: q, metrics: NewExpvarMetrics(vars)}
+
+	if err := hsm.ExecuteCmd(context.Background(), func(*pk11.Session) error { return nil }); err != nil {
+		t.Fatalf("ExecuteCmd() failed: %v", err)
+	}
+	if got := vars.Get("op_ExecuteCmd_count").String(); got != "1" {
+		t.Errorf("op_ExecuteCmd_count = %s, want 1", got)
+	}
+}
@@ -7,10 +7,15 @@
 package se
 
 import (
+	"context"
+	"crypto"
 	"crypto/x509"
+	"math/big"
+	"time"
 )
 
-// WrappingMechanism specifies the wrapping mechanism for the key.
+// WrappingMechanism specifies the wrapping mechanism for the key. Token
+// seeds can only be wrapped with the RSA mechanisms.
 type WrappingMechanism int
 
 const (
@@ -34,8 +39,55 @@ const (
 type EndorseCertParams struct {
 	// Key label. Used to identify the key in the HSM.
 	KeyLabel string
+	// SKU selects the CA key configured for the SKU in `HSMConfig.CAKeys`
+	// instead of `KeyLabel`. Ignored if empty.
+	SKU string
+	// KeyID selects the key by its CKA_ID instead of its label, e.g. when
+	// several generations of a key share a label. Ignored if empty. If a
+	// label is selected as well, the key must carry it.
+	KeyID []byte
 	// Signature algorithm to use.
 	SignatureAlgorithm x509.SignatureAlgorithm
+	// AllowHighS keeps ECDSA signatures as returned by the HSM. By default,
+	// they are normalized to low-S form, as some verifiers, such as the
+	// device ROM, reject high-S signatures. See `pk11.LowS`.
+	AllowHighS bool
+	// SkipVerify skips the checks of the certificates endorsed by
+	// `EndorseCert` and `BatchEndorseCert`, which parse them and verify their
+	// signature, for throughput-critical SKUs.
+	SkipVerify bool
+}
+
+// EndorseCertParamsWithTBS is a certificate to endorse with `EndorseCerts()`.
+type EndorseCertParamsWithTBS struct {
+	EndorseCertParams
+	// TBS is the DER encoded TBS certificate.
+	TBS []byte
+}
+
+// EndorseCertResult is the result of endorsing one of the certificates of
+// `EndorseCerts()`.
+type EndorseCertResult struct {
+	// Cert is the DER encoded certificate. Nil if the endorsement failed.
+	Cert []byte
+	// Err is the error the endorsement failed with. Nil on success.
+	Err error
+}
+
+// Parameters for EndorseCSR().
+type EndorseCSRParams struct {
+	EndorseCertParams
+	// Issuer is the CA certificate of the signing key.
+	Issuer *x509.Certificate
+	// SerialNumber is the serial number of the certificate. If nil, it is
+	// allocated with `NextSerial`, or generated with the HSM RNG if that is
+	// not set either.
+	SerialNumber *big.Int
+	// NextSerial allocates the serial number of the certificate when
+	// `SerialNumber` is nil, e.g. `SerialPool.Next`. Optional.
+	NextSerial func(ctx context.Context) (*big.Int, error)
+	// NotBefore and NotAfter are the validity window of the certificate.
+	NotBefore, NotAfter time.Time
 }
 
 // TokenOp specifies the operation to perform on the token.
@@ -47,6 +99,10 @@ const (
 	// TokenOpHashedOtLcToken indicates that the token should be generated
 	// as a hashed OT/LC token.
 	TokenOpHashedOtLcToken
+	// TokenOpHashedOtLcToken256 is like `TokenOpHashedOtLcToken`, but hashes
+	// the token with cSHAKE256 instead of cSHAKE128, as required by some
+	// OpenTitan silicon variants.
+	TokenOpHashedOtLcToken256
 )
 
 // TokenType specifies the type of the token to generate.
@@ -64,22 +120,60 @@ const (
 	TokenTypeKeyGen
 )
 
+// Labels of the seeds deriving the `TokenTypeSecurityHi` and
+// `TokenTypeSecurityLo` tokens when `TokenParams.SeedLabel` is empty.
+const (
+	HighSecSeedLabel = "HighSecKdfSeed"
+	LowSecSeedLabel  = "LowSecKdfSeed"
+)
+
 // Parameters for GenerateTokens().
 type TokenParams struct {
-	Diversifier  string
-	Op           TokenOp
-	Type         TokenType
+	Diversifier string
+	Op          TokenOp
+	Type        TokenType
+	// SeedLabel is the label of the seed deriving the token, which must be
+	// one of the `HSMConfig.SymmetricKeys`, e.g. the seed of a product
+	// family. Defaults to `HighSecSeedLabel` or `LowSecSeedLabel` according
+	// to `Type` if empty. Ignored for `TokenTypeKeyGen`.
 	SeedLabel    string
 	SizeInBits   uint
 	Sku          string
 	Wrap         WrappingMechanism
 	WrapKeyLabel string
+	// HashAlgorithm is the HMAC hash deriving the token from its seed, one
+	// of SHA-256, SHA-384 or SHA-512. The HMAC output is truncated to
+	// `SizeInBits`. Defaults to SHA-256 if zero.
+	HashAlgorithm crypto.Hash
+	// DiversifierComponents is a structured diversifier, e.g. the hardware
+	// revision, production lot and date. Takes precedence over `Diversifier`
+	// if not empty. See `BuildDiversifier`.
+	DiversifierComponents [][]byte
 }
 
 type TokenResult struct {
-	Token       []byte
-	WrappedKey  []byte
-	Diversifier string
+	Token      []byte
+	WrappedKey []byte
+	// WrapKeyFingerprint is the SHA-256 hash of the SubjectPublicKeyInfo of
+	// the key used to wrap `WrappedKey`. Empty if the token was not wrapped.
+	WrapKeyFingerprint []byte
+	Diversifier        string
+}
+
+// EncryptedPayload is the result of an ECIES encryption.
+//
+// The content encryption key is derived with HKDF-SHA256 from the ECDH shared
+// secret between the ephemeral key and the recipient key, using the encoded
+// ephemeral public key as HKDF info. The payload is encrypted with
+// AES-256-GCM.
+type EncryptedPayload struct {
+	// EphemeralPublicKey is the uncompressed SEC 1 encoding of the ephemeral
+	// public key.
+	EphemeralPublicKey []byte
+	// Nonce is the AES-GCM nonce.
+	Nonce []byte
+	// Ciphertext is the AES-GCM ciphertext, including the authentication tag.
+	Ciphertext []byte
 }
 
 // SE is an interface representing a secure element, which may be implemented
@@ -87,6 +181,10 @@ type TokenResult struct {
 //
 // An SE provides privileged access to cryptographic operations using high-value
 // assets, such as long-lived root secrets.
+//
+// Operations give up with a `codes.DeadlineExceeded` or `codes.Canceled` error
+// if `ctx` is done before a connection to the SE becomes available. Operations
+// already in progress are not interrupted.
 type SE interface {
 	// Generates tokens.
 	//
@@ -95,7 +193,7 @@ type SE interface {
 	//   - Lifecycle tokens.
 	//
 	// Returns: slice of `TokenResult` objects.
-	GenerateTokens(params []*TokenParams) ([]TokenResult, error)
+	GenerateTokens(ctx context.Context, params []*TokenParams) ([]TokenResult, error)
 
 	// Endorses a certificate.
 	//
@@ -103,10 +201,29 @@ type SE interface {
 	// The certificate is provided in raw form, and the SE will return the
 	// signed certificate in DER format.
 	//
-	// Note: only ECDSA signature algorithms are currently supported.
+	// Note: only ECDSA, RSA (PKCS #1 v1.5 and PSS) and Ed25519 signature
+	// algorithms are currently supported.
 	//
 	// Returns: Raw signature in bytes.
-	EndorseCert(tbs []byte, params EndorseCertParams) ([]byte, error)
+	EndorseCert(ctx context.Context, tbs []byte, params EndorseCertParams) ([]byte, error)
+
+	// Endorses a batch of certificates, each with its own parameters, e.g.
+	// the certificates of a device.
+	//
+	// Results are returned in the order of `reqs`. If `failFast` is set,
+	// endorsement stops at the first failure, returned as a
+	// `*BatchEndorseError` along with the results so far. Otherwise, the
+	// failures are reported in `EndorseCertResult.Err`.
+	EndorseCerts(ctx context.Context, reqs []EndorseCertParamsWithTBS, failFast bool) ([]EndorseCertResult, error)
+
+	// Signs a certificate revocation list.
+	//
+	// The TBSCertList is provided in DER form, and the SE will return the
+	// signed CRL in DER format.
+	//
+	// Note: only ECDSA, RSA (PKCS #1 v1.5 and PSS) and Ed25519 signature
+	// algorithms are currently supported.
+	SignCRL(ctx context.Context, tbsCertList []byte, params EndorseCertParams) ([]byte, error)
 
 	// EndorseData hashes and signs an arbitrary data payload.
 	//
@@ -117,8 +234,12 @@ type SE interface {
 	// Note: only ECDSA signature algorithms are currently supported.
 	//
 	// Returns: ECDSA signature (ASN.1 DER encoded).
-	EndorseData(data []byte, params EndorseCertParams) ([]byte, []byte, error)
+	EndorseData(ctx context.Context, data []byte, params EndorseCertParams) ([]byte, []byte, error)
 
 	// VerifySession verifies that a session to the HSM for a given SKU is active
-	VerifySession() error
+	VerifySession(ctx context.Context) error
+
+	// Close releases the connections to the SE. The SE must not be used
+	// afterwards.
+	Close() error
 }
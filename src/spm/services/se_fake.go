@@ -0,0 +1,361 @@
+// Copyright lowRISC contributors (OpenTitan project).
+// Licensed under the Apache License, Version 2.0, see LICENSE for details.
+// SPDX-License-Identifier: Apache-2.0
+
+package se
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/lowRISC/opentitan-provisioning/src/pk11"
+)
+
+// FakeHSM is an in-memory `SE` for tests running without an HSM, e.g. in CI
+// where SoftHSM is not installed. Its keys are ephemeral and generated in
+// software when it is created.
+//
+// Only ECDSA keys and signature algorithms are supported, and tokens cannot be
+// wrapped. Endorsed certificates go through the same TBS checks as with `HSM`.
+type FakeHSM struct {
+	// config is the configuration the fake was created with.
+	config HSMConfig
+
+	// mu guards the fields below.
+	mu sync.Mutex
+
+	// symmetricKeys maps the labels of the symmetric keys to their value.
+	symmetricKeys map[string][]byte
+
+	// privateKeys maps the labels of the private keys to their value.
+	privateKeys map[string]*ecdsa.PrivateKey
+
+	// closed is set by `Close`, after which all operations fail.
+	closed bool
+}
+
+// fakeSeedBytes is the size of the symmetric seeds of `FakeHSM`.
+const fakeSeedBytes = 32
+
+// NewFakeHSM returns a `FakeHSM` holding a random 256-bit seed for each of
+// the `cfg.SymmetricKeys` labels, and a P-256 key pair for each of the
+// `cfg.PrivateKeys` labels. The other connection and session settings of
+// `cfg` are ignored.
+func NewFakeHSM(cfg HSMConfig) (*FakeHSM, error) {
+	f := &FakeHSM{
+		config:        cfg,
+		symmetricKeys: make(map[string][]byte),
+		privateKeys:   make(map[string]*ecdsa.PrivateKey),
+	}
+	for _, label := range cfg.SymmetricKeys {
+		seed := make([]byte, fakeSeedBytes)
+		if _, err := rand.Read(seed); err != nil {
+			return nil, fmt.Errorf("failed to generate seed %q: %w", label, err)
+		}
+		f.symmetricKeys[label] = seed
+	}
+	for _, label := range cfg.PrivateKeys {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate key %q: %w", label, err)
+		}
+		f.privateKeys[label] = key
+	}
+	for sku, label := range cfg.CAKeys {
+		if _, ok := f.privateKeys[label]; !ok {
+			return nil, fmt.Errorf("CA key %q of SKU %q is not listed as a private key", label, sku)
+		}
+	}
+	return f, nil
+}
+
+// checkOpen returns a `codes.FailedPrecondition` error once the fake is
+// closed.
+func (f *FakeHSM) checkOpen() error {
+	if f.closed {
+		return status.Errorf(codes.FailedPrecondition, "fake HSM is closed")
+	}
+	return nil
+}
+
+// privateKey returns the private key labeled `label`.
+func (f *FakeHSM) privateKey(label string) (*ecdsa.PrivateKey, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.checkOpen(); err != nil {
+		return nil, err
+	}
+	key, ok := f.privateKeys[label]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "fail to find key with label: %q", label)
+	}
+	return key, nil
+}
+
+// keyLabel returns the label of the key signing with `params`, like
+// `HSM.keyLabel`.
+func (f *FakeHSM) keyLabel(params EndorseCertParams) (string, error) {
+	if len(params.KeyID) != 0 {
+		return "", status.Errorf(codes.Unimplemented, "fake HSM does not support key selection by ID")
+	}
+	if params.SKU == "" {
+		return params.KeyLabel, nil
+	}
+	label, ok := f.config.CAKeys[params.SKU]
+	if !ok {
+		return "", status.Errorf(codes.NotFound, "no CA key configured for SKU %q", params.SKU)
+	}
+	return label, nil
+}
+
+func (f *FakeHSM) GenerateTokens(ctx context.Context, params []*TokenParams) ([]TokenResult, error) {
+	for _, p := range params {
+		if err := validateTokenParams(p); err != nil {
+			return nil, err
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.checkOpen(); err != nil {
+		return nil, err
+	}
+	tokens := []TokenResult{}
+	for _, p := range params {
+		if p.Wrap != WrappingMechanismNone {
+			return nil, status.Errorf(codes.Unimplemented, "fake HSM does not support wrap %v", p.Wrap)
+		}
+
+		var seed []byte
+		switch p.Type {
+		case TokenTypeSecurityHi, TokenTypeSecurityLo:
+			label := tokenSeedLabel(p)
+			var ok bool
+			if seed, ok = f.symmetricKeys[label]; !ok {
+				return nil, status.Errorf(codes.InvalidArgument, "seed %q is not a configured symmetric key", label)
+			}
+		case TokenTypeKeyGen:
+			seed = make([]byte, fakeSeedBytes)
+			if _, err := rand.Read(seed); err != nil {
+				return nil, fmt.Errorf("failed to generate random key: %w", err)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported key type: %v", p.Type)
+		}
+
+		mac := hmac.New(tokenHash(p).New, seed)
+		mac.Write([]byte(p.Sku))
+		mac.Write(tokenDiversifier(p))
+		token := mac.Sum(nil)[:p.SizeInBits/8]
+		if p.Op == TokenOpHashedOtLcToken || p.Op == TokenOpHashedOtLcToken256 {
+			hashLcToken(p.Op, token)
+		}
+		tokens = append(tokens, TokenResult{
+			Token:       token,
+			WrappedKey:  []byte{},
+			Diversifier: p.Diversifier,
+		})
+	}
+	return tokens, nil
+}
+
+// signECDSA signs the `data` hashed as required by the ECDSA signature
+// algorithm `alg` with `key`, and returns the ASN.1 DER encoded signature.
+func signECDSA(key *ecdsa.PrivateKey, data []byte, alg x509.SignatureAlgorithm, lowS bool) ([]byte, error) {
+	if want := signatureKeyAlgorithm(alg); want != x509.ECDSA {
+		return nil, status.Errorf(codes.InvalidArgument, "fake HSM does not support signature algorithm %v", alg)
+	}
+	hash, err := hashFromSignatureAlgorithm(alg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get hash from signature algorithm: %w", err)
+	}
+	if !ecdsaHashMatchesCurve(key.Curve, hash) {
+		return nil, status.Errorf(codes.InvalidArgument, "signature algorithm %v does not match the %s curve of the signing key", alg, key.Curve.Params().Name)
+	}
+	h := hash.New()
+	h.Write(data)
+
+	var sig struct{ R, S *big.Int }
+	sig.R, sig.S, err = ecdsa.Sign(rand.Reader, key, h.Sum(nil))
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign: %w", err)
+	}
+	if lowS {
+		pk11.LowS(key.Curve, sig.S)
+	}
+	s, err := asn1.Marshal(sig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal signature: %w", err)
+	}
+	return s, nil
+}
+
+func (f *FakeHSM) EndorseCert(ctx context.Context, tbs []byte, params EndorseCertParams) ([]byte, error) {
+	label, err := f.keyLabel(params)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkTBS(tbs, params.SignatureAlgorithm, f.config.Issuers[label], f.config.TBSChecks); err != nil {
+		return nil, err
+	}
+	if f.config.MaxClockSkew > 0 {
+		if err := checkValidity(tbs, time.Now(), f.config.MaxClockSkew); err != nil {
+			return nil, err
+		}
+	}
+	key, err := f.privateKey(label)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := signECDSA(key, tbs, params.SignatureAlgorithm, !params.AllowHighS)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := marshalSigned(tbs, params.SignatureAlgorithm, sig)
+	if err != nil || params.SkipVerify {
+		return cert, err
+	}
+	if err := verifyEndorsedCert(&key.PublicKey, cert, params.SignatureAlgorithm); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+func (f *FakeHSM) EndorseCerts(ctx context.Context, reqs []EndorseCertParamsWithTBS, failFast bool) ([]EndorseCertResult, error) {
+	results := make([]EndorseCertResult, 0, len(reqs))
+	for i, r := range reqs {
+		cert, err := f.EndorseCert(ctx, r.TBS, r.EndorseCertParams)
+		if err != nil && failFast {
+			return results, &BatchEndorseError{Index: i, Err: err}
+		}
+		results = append(results, EndorseCertResult{Cert: cert, Err: err})
+	}
+	return results, nil
+}
+
+func (f *FakeHSM) SignCRL(ctx context.Context, tbsCertList []byte, params EndorseCertParams) ([]byte, error) {
+	label, err := f.keyLabel(params)
+	if err != nil {
+		return nil, err
+	}
+	key, err := f.privateKey(label)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := signECDSA(key, tbsCertList, params.SignatureAlgorithm, !params.AllowHighS)
+	if err != nil {
+		return nil, err
+	}
+	return marshalSigned(tbsCertList, params.SignatureAlgorithm, sig)
+}
+
+func (f *FakeHSM) EndorseData(ctx context.Context, data []byte, params EndorseCertParams) ([]byte, []byte, error) {
+	if len(params.KeyID) != 0 {
+		return nil, nil, status.Errorf(codes.Unimplemented, "fake HSM does not support key selection by ID")
+	}
+	key, err := f.privateKey(params.KeyLabel)
+	if err != nil {
+		return nil, nil, err
+	}
+	pub, err := asn1.Marshal(struct{ X, Y *big.Int }{key.X, key.Y})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal public key: %w", err)
+	}
+	sig, err := signECDSA(key, data, params.SignatureAlgorithm, !params.AllowHighS)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pub, sig, nil
+}
+
+func (f *FakeHSM) VerifySession(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.checkOpen()
+}
+
+func (f *FakeHSM) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	return nil
+}
+
+// Ready always reports the fake as ready. See `HSM.Ready`.
+func (f *FakeHSM) Ready() bool {
+	return true
+}
+
+// SlotHealth returns no slots, since the fake has none. See `HSM.SlotHealth`.
+func (f *FakeHSM) SlotHealth() []SlotHealth {
+	return nil
+}
+
+// GetRandomInt returns a random integer in the range [min, max), like
+// `HSM.GetRandomInt`, using `crypto/rand`.
+func (f *FakeHSM) GetRandomInt(ctx context.Context, min, max *big.Int) (*big.Int, error) {
+	rangeSize := new(big.Int).Sub(max, min)
+	if rangeSize.Sign() <= 0 {
+		return nil, fmt.Errorf("invalid range: min %v must be less than max %v", min, max)
+	}
+	n, err := rand.Int(rand.Reader, rangeSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate random number: %w", err)
+	}
+	return n.Add(n, min), nil
+}
+
+// GenerateAndStoreKeyPair generates an ECDSA key pair on curve `keyType`,
+// which must be an `elliptic.Curve`, and stores it under `label`, like
+// `HSM.GenerateAndStoreKeyPair`. Returns the DER encoded PKIX public key.
+// `opts` is ignored.
+func (f *FakeHSM) GenerateAndStoreKeyPair(ctx context.Context, keyType any, label string, opts *pk11.KeyOptions) ([]byte, error) {
+	if label == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "key label is empty")
+	}
+	curve, ok := keyType.(elliptic.Curve)
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "unsupported key type: %T", keyType)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.checkOpen(); err != nil {
+		return nil, err
+	}
+	if _, ok := f.privateKeys[label]; ok {
+		return nil, fmt.Errorf("%w: %q", ErrKeyAlreadyExists, label)
+	}
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key pair %q: %w", label, err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal public key %q: %w", label, err)
+	}
+	f.privateKeys[label] = key
+	return der, nil
+}
+
+// ExportPublicKey returns the public key of the key pair labeled `keyLabel`,
+// like `HSM.ExportPublicKey`.
+func (f *FakeHSM) ExportPublicKey(ctx context.Context, keyLabel string) (any, error) {
+	key, err := f.privateKey(keyLabel)
+	if err != nil {
+		return nil, err
+	}
+	return &key.PublicKey, nil
+}
@@ -0,0 +1,253 @@
+// Copyright lowRISC contributors (OpenTitan project).
+// Licensed under the Apache License, Version 2.0, see LICENSE for details.
+// SPDX-License-Identifier: Apache-2.0
+
+package se
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newTestFakeHSM(t *testing.T) *FakeHSM {
+	t.Helper()
+	f, err := NewFakeHSM(HSMConfig{
+		SymmetricKeys: []string{"HighSecKdfSeed", "LowSecKdfSeed"},
+		PrivateKeys:   []string{"KCAPriv"},
+		CAKeys:        map[string]string{"sival": "KCAPriv"},
+	})
+	if err != nil {
+		t.Fatalf("NewFakeHSM() failed: %v", err)
+	}
+	return f
+}
+
+func TestFakeHSMEndorseCert(t *testing.T) {
+	f := newTestFakeHSM(t)
+	ctx := context.Background()
+	pub, err := f.ExportPublicKey(ctx, "KCAPriv")
+	if err != nil {
+		t.Fatalf("ExportPublicKey() failed: %v", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() failed: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:       big.NewInt(1),
+		Subject:            pkix.Name{CommonName: "device"},
+		NotBefore:          time.Now(),
+		NotAfter:           time.Now().Add(time.Hour),
+		SignatureAlgorithm: x509.ECDSAWithSHA256,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate() failed: %v", err)
+	}
+	swCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate() failed: %v", err)
+	}
+
+	certDER, err := f.EndorseCert(ctx, swCert.RawTBSCertificate, EndorseCertParams{
+		SKU:                "sival",
+		SignatureAlgorithm: x509.ECDSAWithSHA256,
+	})
+	if err != nil {
+		t.Fatalf("EndorseCert() failed: %v", err)
+	}
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		t.Fatalf("ParseCertificate() failed: %v", err)
+	}
+	if err := (&x509.Certificate{PublicKey: pub}).CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature); err != nil {
+		t.Errorf("endorsed certificate does not verify: %v", err)
+	}
+
+	if _, err := f.EndorseCert(ctx, []byte("arbitrary data"), EndorseCertParams{KeyLabel: "KCAPriv", SignatureAlgorithm: x509.ECDSAWithSHA256}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("EndorseCert() = %v for arbitrary data, want code %v", err, codes.InvalidArgument)
+	}
+	if _, err := f.EndorseCert(ctx, swCert.RawTBSCertificate, EndorseCertParams{KeyLabel: "missing", SignatureAlgorithm: x509.ECDSAWithSHA256}); status.Code(err) != codes.NotFound {
+		t.Errorf("EndorseCert() = %v with a missing key, want code %v", err, codes.NotFound)
+	}
+	if _, err := f.EndorseCert(ctx, swCert.RawTBSCertificate, EndorseCertParams{KeyID: []byte{1}, SignatureAlgorithm: x509.ECDSAWithSHA256}); status.Code(err) != codes.Unimplemented {
+		t.Errorf("EndorseCert() = %v with a key ID, want code %v", err, codes.Unimplemented)
+	}
+}
+
+func TestFakeHSMEndorseCerts(t *testing.T) {
+	f := newTestFakeHSM(t)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() failed: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:       big.NewInt(1),
+		Subject:            pkix.Name{CommonName: "device"},
+		NotBefore:          time.Now(),
+		NotAfter:           time.Now().Add(time.Hour),
+		SignatureAlgorithm: x509.ECDSAWithSHA256,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate() failed: %v", err)
+	}
+	swCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate() failed: %v", err)
+	}
+	params := EndorseCertParams{KeyLabel: "KCAPriv", SignatureAlgorithm: x509.ECDSAWithSHA256}
+	reqs := []EndorseCertParamsWithTBS{
+		{EndorseCertParams: params, TBS: swCert.RawTBSCertificate},
+		{EndorseCertParams: params, TBS: []byte("arbitrary data")},
+		{EndorseCertParams: params, TBS: swCert.RawTBSCertificate},
+	}
+
+	results, err := f.EndorseCerts(context.Background(), reqs, false)
+	if err != nil {
+		t.Fatalf("EndorseCerts() failed: %v", err)
+	}
+	if len(results) != len(reqs) {
+		t.Fatalf("EndorseCerts() returned %d results, want %d", len(results), len(reqs))
+	}
+	for i, r := range results {
+		if wantErr := i == 1; (r.Err != nil) != wantErr {
+			t.Errorf("EndorseCerts() result %d error = %v, want error %v", i, r.Err, wantErr)
+		}
+	}
+
+	results, err = f.EndorseCerts(context.Background(), reqs, true)
+	var batchErr *BatchEndorseError
+	if !errors.As(err, &batchErr) || batchErr.Index != 1 || len(results) != 1 {
+		t.Errorf("EndorseCerts() = %d results, %v, want 1 result and a *BatchEndorseError for certificate 1", len(results), err)
+	}
+}
+
+func TestFakeHSMEndorseData(t *testing.T) {
+	f := newTestFakeHSM(t)
+	data := []byte("data")
+	pubDER, sig, err := f.EndorseData(context.Background(), data, EndorseCertParams{
+		KeyLabel:           "KCAPriv",
+		SignatureAlgorithm: x509.ECDSAWithSHA256,
+	})
+	if err != nil {
+		t.Fatalf("EndorseData() failed: %v", err)
+	}
+	var point struct{ X, Y *big.Int }
+	if _, err := asn1.Unmarshal(pubDER, &point); err != nil {
+		t.Fatalf("failed to parse public key: %v", err)
+	}
+	pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: point.X, Y: point.Y}
+	digest := sha256.Sum256(data)
+	if !ecdsa.VerifyASN1(pub, digest[:], sig) {
+		t.Error("EndorseData() signature does not verify")
+	}
+}
+
+func TestFakeHSMGenerateTokens(t *testing.T) {
+	f := newTestFakeHSM(t)
+	ctx := context.Background()
+	params := []*TokenParams{
+		{Type: TokenTypeSecurityHi, SeedLabel: "HighSecKdfSeed", SizeInBits: 256, Sku: "sival", Diversifier: "a"},
+		{Type: TokenTypeSecurityHi, SeedLabel: "HighSecKdfSeed", SizeInBits: 256, Sku: "sival", Diversifier: "a"},
+		{Type: TokenTypeSecurityLo, SeedLabel: "LowSecKdfSeed", SizeInBits: 128, Sku: "sival", Diversifier: "a"},
+		{Type: TokenTypeKeyGen, SizeInBits: 128, Op: TokenOpHashedOtLcToken},
+	}
+	tokens, err := f.GenerateTokens(ctx, params)
+	if err != nil {
+		t.Fatalf("GenerateTokens() failed: %v", err)
+	}
+	for i, p := range params {
+		if got, want := len(tokens[i].Token), int(p.SizeInBits/8); got != want {
+			t.Errorf("token %d is %d bytes, want %d", i, got, want)
+		}
+	}
+	if !bytes.Equal(tokens[0].Token, tokens[1].Token) {
+		t.Error("tokens derived from the same seed and diversifier differ")
+	}
+	if bytes.Equal(tokens[0].Token[:16], tokens[2].Token) {
+		t.Error("tokens derived from different seeds match")
+	}
+
+	// The seed defaults to the one of the token type.
+	defaults, err := f.GenerateTokens(ctx, []*TokenParams{
+		{Type: TokenTypeSecurityHi, SizeInBits: 256, Sku: "sival", Diversifier: "a"},
+	})
+	if err != nil {
+		t.Fatalf("GenerateTokens() failed: %v", err)
+	}
+	if !bytes.Equal(defaults[0].Token, tokens[0].Token) {
+		t.Errorf("token derived from the default seed differs from the %q one", HighSecSeedLabel)
+	}
+
+	_, err = f.GenerateTokens(ctx, []*TokenParams{{Type: TokenTypeSecurityHi, SeedLabel: "missing", SizeInBits: 128}})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("GenerateTokens() = %v with a missing seed, want code %v", err, codes.InvalidArgument)
+	}
+	_, err = f.GenerateTokens(ctx, []*TokenParams{{Type: TokenTypeKeyGen, SizeInBits: 128, Wrap: WrappingMechanismRSAOAEP}})
+	if status.Code(err) != codes.Unimplemented {
+		t.Errorf("GenerateTokens() = %v with wrapping, want code %v", err, codes.Unimplemented)
+	}
+}
+
+func TestFakeHSMGenerateAndStoreKeyPair(t *testing.T) {
+	f := newTestFakeHSM(t)
+	ctx := context.Background()
+	pubDER, err := f.GenerateAndStoreKeyPair(ctx, elliptic.P384(), "new_key", nil)
+	if err != nil {
+		t.Fatalf("GenerateAndStoreKeyPair() failed: %v", err)
+	}
+	pub, err := x509.ParsePKIXPublicKey(pubDER)
+	if err != nil {
+		t.Fatalf("ParsePKIXPublicKey() failed: %v", err)
+	}
+	if got := pub.(*ecdsa.PublicKey).Curve; got != elliptic.P384() {
+		t.Errorf("generated key curve = %s, want P-384", got.Params().Name)
+	}
+	if _, err := f.GenerateAndStoreKeyPair(ctx, elliptic.P256(), "new_key", nil); err == nil {
+		t.Error("GenerateAndStoreKeyPair() succeeded with an existing label, want error")
+	}
+}
+
+func TestFakeHSMClose(t *testing.T) {
+	f := newTestFakeHSM(t)
+	ctx := context.Background()
+	if err := f.VerifySession(ctx); err != nil {
+		t.Fatalf("VerifySession() failed: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	if err := f.VerifySession(ctx); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("VerifySession() = %v after Close, want code %v", err, codes.FailedPrecondition)
+	}
+}
+
+func TestFakeHSMGetRandomInt(t *testing.T) {
+	f := newTestFakeHSM(t)
+	min, max := big.NewInt(10), big.NewInt(20)
+	for i := 0; i < 100; i++ {
+		n, err := f.GetRandomInt(context.Background(), min, max)
+		if err != nil {
+			t.Fatalf("GetRandomInt() failed: %v", err)
+		}
+		if n.Cmp(min) < 0 || n.Cmp(max) >= 0 {
+			t.Fatalf("GetRandomInt() = %v, want in [%v, %v)", n, min, max)
+		}
+	}
+}
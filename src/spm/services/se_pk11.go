@@ -6,16 +6,37 @@
 package se
 
 import (
+	"context"
 	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/asn1"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
+	"log"
 	"math/big"
+	mrand "math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/ocsp"
 	"golang.org/x/crypto/sha3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"github.com/lowRISC/opentitan-provisioning/src/pk11"
 )
@@ -23,33 +44,459 @@ import (
 // sessionQueue implements a thread-safe HSM session queue. See `insert` and
 // `getHandle` functions for more details.
 type sessionQueue struct {
-	// numSessions is the number of sessions managed by the queue.
-	numSessions int
+	// numSessions is the number of sessions managed by the queue. Changed by
+	// `resize`.
+	numSessions atomic.Int32
 
-	// s is an HSM session channel.
+	// s is an HSM session channel. Its capacity bounds `numSessions`.
 	s chan *pk11.Session
+
+	// resizeMu serializes `resize` calls.
+	resizeMu sync.Mutex
+
+	// retiring is the number of sessions in use to close instead of
+	// returning them to the queue, after the queue was shrunk. Retiring
+	// sessions are not counted in `numSessions`.
+	retiring atomic.Int32
+
+	// pending is the number of sessions not opened yet. Non-zero while a
+	// degraded pool is being backfilled. See `openSessions`.
+	pending atomic.Int32
+
+	// waitTimeout bounds the time `getHandleContext` waits for a session.
+	// Disabled if zero.
+	waitTimeout time.Duration
+
+	// highWater is the highest number of sessions checked out at once.
+	highWater atomic.Int32
+
+	// waits counts the session requests that found the queue empty.
+	waits atomic.Int64
+
+	// waiters is the number of session requests currently waiting.
+	waiters atomic.Int32
+
+	// checkouts counts the sessions taken from the queue.
+	checkouts atomic.Int64
+
+	// waitNanos and holdNanos are the cumulative time spent waiting for a
+	// session and holding a session, in nanoseconds.
+	waitNanos, holdNanos atomic.Int64
+
+	// open opens replacements for lost sessions. See `replace`.
+	open sessionOpener
+
+	// sweeping is set while `replaceLost` is running.
+	sweeping atomic.Bool
+
+	// metrics receives the queue depth and session wait latency. Optional.
+	metrics Metrics
+
+	// closing is set and closed is closed by `close`, after which no more
+	// sessions are handed out.
+	closing atomic.Bool
+	closed  chan struct{}
+
+	// drained is set once `HSM.Close` stopped waiting for sessions in use.
+	// Sessions returned afterwards are closed by their release function.
+	drained atomic.Bool
+
+	// slots are the HSM slots sessions are opened on. Lost sessions mark
+	// their slot down. Optional.
+	slots *slotSet
+
+	// watchdog tracks the sessions in use. Nil unless enabled with
+	// `HSMConfig.SessionHoldWarning` or `HSMConfig.SessionHoldLimit`.
+	watchdog *sessionWatchdog
+
+	// reserved is the number of sessions `sessionClassBulk` checkouts leave
+	// for `sessionClassShort` ones. See `HSMConfig.ReservedSessions`.
+	reserved int32
+
+	// bulkInUse is the number of sessions checked out by bulk operations.
+	bulkInUse atomic.Int32
+
+	// bulkFreed is signaled when the number of sessions bulk operations may
+	// check out increases.
+	bulkFreed chan struct{}
+}
+
+// sessionClass is the priority class of a session checkout.
+type sessionClass int
+
+const (
+	// sessionClassShort is used by short, latency-sensitive operations, e.g.
+	// the endorsements a tester is blocking on. They may use any session.
+	sessionClassShort sessionClass = iota
+	// sessionClassBulk is used by all other operations. They never use the
+	// sessions reserved for `sessionClassShort`.
+	sessionClassBulk
+)
+
+// shortOps are the operations checking out `sessionClassShort` sessions.
+var shortOps = map[string]bool{
+	"EndorseCert":   true,
+	"EndorseCerts":  true,
+	"VerifySession": true,
+	"GetRandomInt":  true,
 }
 
+// rwOps are the operations creating or destroying token objects, which use
+// the read-write sessions of `HSM.rwSessions`. `ExecuteCmd` runs arbitrary
+// commands, so it is assumed to need a read-write session.
+var rwOps = map[string]bool{
+	"ExecuteCmd":              true,
+	"GenerateAndStoreKeyPair": true,
+	"DeleteKeyPair":           true,
+	"ECDHDerive":              true,
+	"DeleteKeyByLabel":        true,
+}
+
+// opClass returns the session class of operation `op`.
+func opClass(op string) sessionClass {
+	if shortOps[op] {
+		return sessionClassShort
+	}
+	return sessionClassBulk
+}
+
+// errSessionPoolClosed is returned when requesting a session after
+// `HSM.Close`.
+var errSessionPoolClosed = status.Error(codes.Unavailable, "HSM session pool is closed")
+
 // newSessionQueue creates a session queue with a channel of depth `num`.
 func newSessionQueue(num int) *sessionQueue {
-	return &sessionQueue{
-		numSessions: num,
-		s:           make(chan *pk11.Session, num),
+	return newResizableSessionQueue(num, num)
+}
+
+// newResizableSessionQueue creates a session queue of `num` sessions that can
+// be grown up to `max` sessions.
+func newResizableSessionQueue(num, max int) *sessionQueue {
+	if max < num {
+		max = num
 	}
+	q := &sessionQueue{
+		s:         make(chan *pk11.Session, max),
+		closed:    make(chan struct{}),
+		bulkFreed: make(chan struct{}, 1),
+	}
+	q.numSessions.Store(int32(num))
+	return q
 }
 
-// insert adds a new session `s` to the session queue.
+// insert adds a new session `s` to the session queue. Fails without blocking
+// if the queue is full.
 func (q *sessionQueue) insert(s *pk11.Session) error {
-	// TODO: Consider adding a timeout context to avoid deadlocks if the caller
-	// forgets to call the release function returned by the `getHandle`
-	// function.
-	if len(q.s) >= q.numSessions {
+	select {
+	case q.s <- s:
+		if q.metrics != nil {
+			q.metrics.SetQueueDepth(len(q.s))
+		}
+		return nil
+	default:
 		return errors.New("Reached maximum session queue capacity.")
 	}
-	q.s <- s
+}
+
+// size returns the number of sessions owned by the queue, including sessions
+// currently in use.
+func (q *sessionQueue) size() int {
+	return int(q.numSessions.Load() - q.pending.Load())
+}
+
+// inUse returns the number of sessions currently checked out, including
+// retiring sessions.
+func (q *sessionQueue) inUse() int {
+	n := q.size() + int(q.retiring.Load()) - len(q.s)
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+// close stops handing out sessions. Callers waiting for a session fail with
+// `errSessionPoolClosed`. Returns false if the queue was already closed.
+func (q *sessionQueue) close() bool {
+	if !q.closing.CompareAndSwap(false, true) {
+		return false
+	}
+	close(q.closed)
+	return true
+}
+
+// retireOne claims one of the sessions to retire, if any. The caller must
+// then close the session it holds instead of returning it to the queue.
+func (q *sessionQueue) retireOne() bool {
+	for {
+		n := q.retiring.Load()
+		if n <= 0 {
+			return false
+		}
+		if q.retiring.CompareAndSwap(n, n-1) {
+			return true
+		}
+	}
+}
+
+// resize grows or shrinks the queue to `n` sessions. New sessions are opened
+// with `open` before returning. Idle sessions are closed immediately when
+// shrinking, and sessions in use are closed when they are returned.
+func (q *sessionQueue) resize(n int) error {
+	q.resizeMu.Lock()
+	defer q.resizeMu.Unlock()
+
+	if n <= 0 {
+		return fmt.Errorf("invalid number of sessions: %d", n)
+	}
+	if n > cap(q.s) {
+		return fmt.Errorf("cannot resize session pool to %d sessions, maximum is %d", n, cap(q.s))
+	}
+	if q.closing.Load() {
+		return errSessionPoolClosed
+	}
+	// The backfill of a degraded pool counts on the number of sessions not
+	// changing.
+	if pending := q.pending.Load(); pending > 0 {
+		return fmt.Errorf("cannot resize degraded session pool, %d sessions pending", pending)
+	}
+
+	cur := int(q.numSessions.Load())
+	if n > cur {
+		// Keep sessions due to be retired first.
+		for ; cur < n && q.retireOne(); cur++ {
+			q.numSessions.Add(1)
+		}
+		for ; cur < n; cur++ {
+			if q.open == nil {
+				return fmt.Errorf("no session opener configured")
+			}
+			s, err := q.open()
+			if err != nil {
+				return fmt.Errorf("opened %d of %d sessions: %w", cur, n, err)
+			}
+			q.numSessions.Add(1)
+			if err := q.insert(s); err != nil {
+				q.numSessions.Add(-1)
+				if cerr := s.Close(); cerr != nil {
+					log.Printf("Failed to close HSM session: %v", cerr)
+				}
+				return err
+			}
+		}
+		q.signalBulk()
+		return nil
+	}
+
+	for ; cur > n; cur-- {
+		q.numSessions.Add(-1)
+		select {
+		case s := <-q.s:
+			if err := s.Close(); err != nil {
+				log.Printf("Failed to close HSM session: %v", err)
+			}
+		default:
+			q.retiring.Add(1)
+		}
+	}
+	if q.metrics != nil {
+		q.metrics.SetQueueDepth(len(q.s))
+	}
 	return nil
 }
 
+// backfill opens the pending sessions with `open`, retrying every `interval`
+// until the queue is complete.
+func (q *sessionQueue) backfill(open sessionOpener, interval time.Duration) {
+	for q.pending.Load() > 0 {
+		time.Sleep(interval)
+		if q.closing.Load() {
+			return
+		}
+		for q.pending.Load() > 0 {
+			s, err := open()
+			if err != nil {
+				log.Printf("Failed to backfill HSM session pool, %d sessions pending: %v", q.pending.Load(), err)
+				break
+			}
+			if err := q.insert(s); err != nil {
+				log.Printf("Failed to enqueue backfilled HSM session: %v", err)
+				return
+			}
+			q.pending.Add(-1)
+			q.signalBulk()
+		}
+	}
+	log.Printf("HSM session pool recovered: %d sessions open", q.numSessions.Load())
+}
+
+// warmUp opens the pending sessions of a lazily opened queue with `open`. If
+// a session fails to open, the remaining ones are backfilled. See
+// `openSessionsLazy`.
+func (q *sessionQueue) warmUp(open sessionOpener) {
+	for q.pending.Load() > 0 {
+		if q.closing.Load() {
+			return
+		}
+		s, err := open()
+		if err != nil {
+			log.Printf("Failed to warm up HSM session pool, %d sessions pending: %v", q.pending.Load(), err)
+			q.backfill(open, sessionBackfillInterval)
+			return
+		}
+		if err := q.insert(s); err != nil {
+			log.Printf("Failed to enqueue warm-up HSM session: %v", err)
+			return
+		}
+		q.pending.Add(-1)
+		q.signalBulk()
+	}
+	log.Printf("HSM session pool warmed up: %d sessions open", q.numSessions.Load())
+}
+
+// replace closes the lost `stale` session, which must be checked out of the
+// queue, and inserts a newly opened session in its place. If the replacement
+// cannot be opened, the pool is degraded and backfilled in the background.
+func (q *sessionQueue) replace(stale *pk11.Session) {
+	if q.watchdog != nil {
+		q.watchdog.untrackSession(stale)
+	}
+	if err := stale.Close(); err != nil {
+		log.Printf("Failed to close lost HSM session: %v", err)
+	}
+	if q.retireOne() {
+		return
+	}
+	if q.closing.Load() {
+		q.numSessions.Add(-1)
+		return
+	}
+
+	if q.slots != nil {
+		q.slots.markLost(stale)
+	}
+	if q.open == nil {
+		q.pending.Add(1)
+		log.Printf("Dropped lost HSM session, no session opener configured")
+		return
+	}
+	s, err := q.open()
+	if err != nil {
+		log.Printf("Failed to replace lost HSM session: %v", err)
+		// Start a backfill unless one is already running.
+		if q.pending.Add(1) == 1 {
+			go q.backfill(q.open, sessionBackfillInterval)
+		}
+		return
+	}
+	if err := q.insert(s); err != nil {
+		log.Printf("Failed to enqueue replacement HSM session: %v", err)
+		s.Close()
+		return
+	}
+	log.Printf("Replaced lost HSM session")
+}
+
+// replaceLost checks the idle sessions in the queue and replaces the lost
+// ones. Sessions in use are not checked. Returns immediately if a check is
+// already in progress.
+func (q *sessionQueue) replaceLost() {
+	if !q.sweeping.CompareAndSwap(false, true) {
+		return
+	}
+	defer q.sweeping.Store(false)
+
+	n := len(q.s)
+	idle := make([]*pk11.Session, 0, n)
+	for i := 0; i < n; i++ {
+		select {
+		case s := <-q.s:
+			idle = append(idle, s)
+		default:
+		}
+	}
+	for _, s := range idle {
+		if err := s.Ping(); pk11.IsSessionLost(err) {
+			q.replace(s)
+			continue
+		}
+		if err := q.insert(s); err != nil {
+			log.Printf("Failed to return HSM session to the pool, the pool is corrupted: %v", err)
+		}
+	}
+}
+
+// healthCheck replaces the lost idle sessions every `interval` until the
+// queue is closed, so that a dropped HSM connection is repaired before
+// operations fail on it, and checks whether the slots marked down recovered.
+// See `replaceLost`.
+func (q *sessionQueue) healthCheck(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-q.closed:
+			return
+		case <-t.C:
+			q.replaceLost()
+			if q.slots != nil {
+				q.slots.probe()
+			}
+		}
+	}
+}
+
+// keepaliveProbe is the operation run by `sessionQueue.keepalive`. Reading
+// the session info may be answered by the PKCS#11 library without reaching
+// the HSM, so a random byte is generated instead.
+func keepaliveProbe(s *pk11.Session) error {
+	_, err := s.GenerateRandom(1)
+	return err
+}
+
+// keepalive runs `probe` on the idle sessions every `interval` until the
+// queue is closed. See `keepaliveRound`.
+func (q *sessionQueue) keepalive(interval time.Duration, probe func(*pk11.Session) error) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-q.closed:
+			return
+		case <-t.C:
+			q.keepaliveRound(probe)
+		}
+	}
+}
+
+// keepaliveRound runs `probe` on the idle sessions one at a time, replacing
+// the sessions lost. Sessions in use are not probed. The round stops as soon
+// as a request waits for a session, so that keepalives do not delay
+// operations when the pool is under pressure.
+func (q *sessionQueue) keepaliveRound(probe func(*pk11.Session) error) {
+	n := len(q.s)
+	for i := 0; i < n; i++ {
+		if q.waiters.Load() > 0 || q.closing.Load() {
+			return
+		}
+		var s *pk11.Session
+		select {
+		case s = <-q.s:
+		default:
+			return
+		}
+		if err := probe(s); err != nil {
+			if sessionLost(s, err) {
+				q.replace(s)
+				continue
+			}
+			log.Printf("HSM session keepalive failed: %v", err)
+		}
+		if err := q.insert(s); err != nil {
+			log.Printf("Failed to return HSM session to the pool, the pool is corrupted: %v", err)
+		}
+	}
+}
+
 // getHandle returns a session from the queue and a release function to
 // get the session back into the queue. Recommended use:
 //
@@ -58,12 +505,300 @@ func (q *sessionQueue) insert(s *pk11.Session) error {
 //
 // Note: failing to call the release function can result into deadlocks
 // if the queue remains empty after calling the `insert` function.
+//
+// Panics if the queue is closed; use `getHandleContext` where that can
+// happen.
 func (q *sessionQueue) getHandle() (*pk11.Session, func()) {
-	s := <-q.s
+	// A nil channel is never ready, so this waits indefinitely.
+	s, ok := q.acquire(nil)
+	if !ok {
+		panic("se: session acquired from a closed HSM session pool")
+	}
+	return s, q.releaser(s, sessionClassShort)
+}
+
+// getHandleContext is like `getHandle`, but gives up waiting for a session
+// when `ctx` is done or after `waitTimeout`, returning a `*sessionWaitError`.
+// Fails with `errSessionPoolClosed` once the queue is closed.
+// The release function may safely be called more than once, and is a no-op
+// when no session was acquired, so callers may always `defer release()`.
+//
+// `sessionClassBulk` checkouts also wait while the sessions not reserved for
+// `sessionClassShort` checkouts are all in use.
+func (q *sessionQueue) getHandleContext(ctx context.Context, class sessionClass) (*pk11.Session, func(), error) {
+	if q.waitTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, q.waitTimeout)
+		defer cancel()
+	}
+	ok := class != sessionClassBulk || q.acquireBulk(ctx.Done())
+	var s *pk11.Session
+	if ok {
+		if s, ok = q.acquire(ctx.Done()); !ok {
+			q.endCheckout(class)
+		}
+	}
+	if !ok {
+		if q.closing.Load() {
+			return nil, func() {}, errSessionPoolClosed
+		}
+		return nil, func() {}, &sessionWaitError{err: ctx.Err()}
+	}
+	return s, q.releaser(s, class), nil
+}
+
+// bulkLimit returns the number of sessions bulk operations may check out.
+func (q *sessionQueue) bulkLimit() int32 {
+	return int32(q.size()) - q.reserved
+}
+
+// acquireBulk waits until a bulk operation may check out a session, or
+// `done` is closed. Returns false in the latter case, or if the queue is
+// closed. See `endCheckout`.
+func (q *sessionQueue) acquireBulk(done <-chan struct{}) bool {
+	for {
+		n := q.bulkInUse.Load()
+		if n < q.bulkLimit() {
+			if q.bulkInUse.CompareAndSwap(n, n+1) {
+				// Pass the wakeup on to the next waiter if there is room
+				// left, as signals are coalesced.
+				if n+1 < q.bulkLimit() {
+					q.signalBulk()
+				}
+				return true
+			}
+			continue
+		}
+		select {
+		case <-q.bulkFreed:
+		case <-done:
+			return false
+		case <-q.closed:
+			return false
+		}
+	}
+}
+
+// signalBulk wakes up a bulk operation waiting in `acquireBulk`.
+func (q *sessionQueue) signalBulk() {
+	select {
+	case q.bulkFreed <- struct{}{}:
+	default:
+	}
+}
+
+// endCheckout ends a checkout of class `class`, allowing another bulk
+// operation to check out a session. Called by the release function, or
+// directly when the session is not returned to the queue.
+func (q *sessionQueue) endCheckout(class sessionClass) {
+	if class != sessionClassBulk {
+		return
+	}
+	q.bulkInUse.Add(-1)
+	q.signalBulk()
+}
+
+// acquire takes a session from the queue, waiting until one is available or
+// `done` is closed. Returns false in the latter case, or if the queue is
+// closed.
+func (q *sessionQueue) acquire(done <-chan struct{}) (*pk11.Session, bool) {
+	if q.closing.Load() {
+		return nil, false
+	}
+	select {
+	case s := <-q.s:
+		q.recordAcquire(0)
+		return s, true
+	default:
+	}
+
+	q.waits.Add(1)
+	q.waiters.Add(1)
+	defer q.waiters.Add(-1)
+	start := time.Now()
+	select {
+	case s := <-q.s:
+		q.recordAcquire(time.Since(start))
+		return s, true
+	case <-done:
+	case <-q.closed:
+	}
+	wait := time.Since(start)
+	q.waitNanos.Add(int64(wait))
+	if q.metrics != nil {
+		q.metrics.ObserveWait(wait)
+	}
+	return nil, false
+}
+
+// recordAcquire updates the checkout counters and the high-water mark of
+// sessions in use, and reports the session `wait` to the queue metrics.
+func (q *sessionQueue) recordAcquire(wait time.Duration) {
+	q.checkouts.Add(1)
+	q.waitNanos.Add(int64(wait))
+	if q.metrics != nil {
+		q.metrics.ObserveWait(wait)
+		q.metrics.SetQueueDepth(len(q.s))
+	}
+	inUse := int32(q.inUse())
+	for {
+		hw := q.highWater.Load()
+		if inUse <= hw || q.highWater.CompareAndSwap(hw, inUse) {
+			return
+		}
+	}
+}
+
+// releaser returns an idempotent function returning `s`, checked out with
+// class `class`, to the queue, or closing it if the queue was shrunk. The
+// time until the first call is accounted as session hold time.
+func (q *sessionQueue) releaser(s *pk11.Session, class sessionClass) func() {
+	var once sync.Once
+	acquired := time.Now()
+	var c *checkout
+	if q.watchdog != nil {
+		c = &checkout{session: s, acquired: acquired, caller: callSite()}
+	}
 	release := func() {
-		q.insert(s)
+		once.Do(func() {
+			if c != nil {
+				q.watchdog.untrack(c)
+			}
+			q.holdNanos.Add(int64(time.Since(acquired)))
+			defer q.endCheckout(class)
+			if q.retireOne() {
+				if err := s.Close(); err != nil {
+					log.Printf("Failed to close retired HSM session: %v", err)
+				}
+				return
+			}
+			if q.drained.Load() {
+				q.numSessions.Add(-1)
+				if err := s.Close(); err != nil {
+					log.Printf("Failed to close HSM session returned after Close: %v", err)
+				}
+				return
+			}
+			// The queue can only be full if a session was inserted twice or
+			// from outside the pool.
+			if err := q.insert(s); err != nil {
+				log.Printf("Failed to return HSM session to the pool, the pool is corrupted: %v", err)
+			}
+		})
+	}
+	if c != nil {
+		c.release = release
+		q.watchdog.track(c)
+	}
+	return release
+}
+
+// sessionWaitError is returned when no session becomes available before the
+// context passed to `getHandleContext` is done. It wraps the context error,
+// so that `errors.Is(err, context.DeadlineExceeded)` holds, and converts to a
+// `codes.DeadlineExceeded` or `codes.Canceled` gRPC status.
+type sessionWaitError struct {
+	err error
+}
+
+func (e *sessionWaitError) Error() string {
+	return fmt.Sprintf("no HSM session available: %v", e.err)
+}
+
+func (e *sessionWaitError) Unwrap() error {
+	return e.err
+}
+
+// GRPCStatus implements the interface used by `status.FromError`.
+func (e *sessionWaitError) GRPCStatus() *status.Status {
+	code := codes.Canceled
+	if errors.Is(e.err, context.DeadlineExceeded) {
+		code = codes.DeadlineExceeded
+	}
+	return status.New(code, e.Error())
+}
+
+// defaultRetryableErrors are the CKR_* codes retried by a `RetryPolicy` that
+// does not list its own: CKR_FUNCTION_FAILED and CKR_DEVICE_MEMORY.
+var defaultRetryableErrors = []uint{0x06, 0x31}
+
+// Default `RetryPolicy` backoff bounds.
+const (
+	defaultRetryInitialBackoff = 50 * time.Millisecond
+	defaultRetryMaxBackoff     = 2 * time.Second
+)
+
+// RetryPolicy configures the retries of HSM operations failing with a
+// transient PKCS#11 error, e.g. a busy network HSM. Retries are delayed with
+// an exponential backoff and jitter. Errors not listed in `RetryableErrors`,
+// such as CKR_PIN_INCORRECT, fail immediately.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts of an operation,
+	// including the first one. Retries are disabled if lower than two.
+	MaxAttempts int
+
+	// InitialBackoff is the delay before the first retry, doubled on every
+	// retry. Defaults to `defaultRetryInitialBackoff` if zero.
+	InitialBackoff time.Duration
+
+	// MaxBackoff caps the delay between retries. Defaults to
+	// `defaultRetryMaxBackoff` if zero.
+	MaxBackoff time.Duration
+
+	// MaxElapsed bounds the total time spent on an operation, retries
+	// included. No retry is attempted past this time. Unbounded if zero,
+	// though the context deadline of the operation still applies.
+	MaxElapsed time.Duration
+
+	// RetryableErrors are the CKR_* codes retried. Vendor defined codes,
+	// such as the CKR_DEVICE_BUSY code of some network HSMs, must be listed
+	// explicitly. Defaults to `defaultRetryableErrors` if nil.
+	RetryableErrors []uint
+}
+
+// retryable reports whether `err` wraps one of the retryable PKCS#11 errors.
+func (p RetryPolicy) retryable(err error) bool {
+	var e pk11.Error
+	if !errors.As(err, &e) {
+		return false
+	}
+	retryable := p.RetryableErrors
+	if retryable == nil {
+		retryable = defaultRetryableErrors
+	}
+	for _, c := range retryable {
+		if uint(e.Raw) == c {
+			return true
+		}
 	}
-	return s, release
+	return false
+}
+
+// backoff returns the delay before retrying an operation that failed with
+// `err` on its `attempt`-th attempt, after `elapsed` time. Returns false if
+// the operation must not be retried.
+func (p RetryPolicy) backoff(attempt int, elapsed time.Duration, err error) (time.Duration, bool) {
+	if err == nil || attempt >= p.MaxAttempts || !p.retryable(err) {
+		return 0, false
+	}
+	initial, max := p.InitialBackoff, p.MaxBackoff
+	if initial <= 0 {
+		initial = defaultRetryInitialBackoff
+	}
+	if max <= 0 {
+		max = defaultRetryMaxBackoff
+	}
+	d := max
+	if shift := attempt - 1; shift < 32 && initial<<shift < max {
+		d = initial << shift
+	}
+	// Jitter the delay within [d/2, d] so that operations failing together
+	// do not retry in lockstep.
+	d = d/2 + time.Duration(mrand.Int63n(int64(d/2)+1))
+	if p.MaxElapsed > 0 && elapsed+d > p.MaxElapsed {
+		return 0, false
+	}
+	return d, true
 }
 
 // HSMConfig contains parameters used to configure a new HSM instance with the
@@ -75,12 +810,36 @@ type HSMConfig struct {
 	// slotID is the HSM slot ID.
 	SlotID int
 
+	// TokenLabel selects the token by label instead of `SlotID`, which is
+	// ignored if set. Slot numbering may change when partitions are added
+	// or the PKCS#11 module is reinitialized, while labels are stable.
+	TokenLabel string
+
+	// FailoverSlotIDs are additional slots holding replicas of the `SlotID`
+	// partition, e.g. on redundant network HSMs. Sessions are distributed
+	// over all the reachable slots, and lost sessions are replaced on
+	// another slot. Keys are looked up by label on `SlotID` at startup, so
+	// the replicas must hold the same keys with the same IDs. Slots marked
+	// down are checked for recovery by the session health check, see
+	// `SessionHealthCheckInterval`. See `HSM.SlotHealth`.
+	FailoverSlotIDs []int
+
 	// HSMPassword is the Crypto User HSM password.
 	HSMPassword string
 
 	// NumSessions configures the number of sessions to open in `SlotID`.
 	NumSessions int
 
+	// MinSessions is the minimum number of sessions that must be opened for
+	// the HSM to start. Sessions that fail to open at startup are opened in
+	// the background. Defaults to `NumSessions` if zero.
+	MinSessions int
+
+	// MaxSessions is the largest number of sessions `HSM.ResizeSessions`
+	// can grow the pool to. Defaults to `NumSessions`, in which case the
+	// pool can only be shrunk and grown back.
+	MaxSessions int
+
 	// SymmetricKeys contains the list of symmetric key labels to use for
 	// retrieving long-lived symmetric keys on the HSM.
 	SymmetricKeys []string
@@ -92,10 +851,129 @@ type HSMConfig struct {
 	// PublicKeys contains the list of public key labels to use for
 	// retrieving long-lived public keys on the HSM.
 	PublicKeys []string
+
+	// CAKeys maps SKU names to the label of the CA private key signing their
+	// certificates, when several SKUs share the HSM. The labels must be
+	// listed in `PrivateKeys`. See `EndorseCertParams.SKU`.
+	CAKeys map[string]string
+
+	// WrappingKeys contains the subset of `PublicKeys` labels designated as
+	// wrapping keys. Each key is validated against the wrapping key policy
+	// at startup and before every wrap operation.
+	WrappingKeys []string
+
+	// MinWrappingKeyBits is the minimum RSA modulus size in bits accepted for
+	// wrapping keys. Defaults to `defaultMinWrappingKeyBits` if set to zero.
+	MinWrappingKeyBits int
+
+	// MaxClockSkew is the tolerance applied to the NotBefore field of
+	// certificates submitted to `EndorseCert`. NotBefore must be within
+	// MaxClockSkew of the HSM host time. The check is disabled if set to zero.
+	MaxClockSkew time.Duration
+
+	// TBSChecks disables individual sanity checks applied to the TBS
+	// certificates submitted to `EndorseCert` and `BatchEndorseCert`. All
+	// checks are enabled by default. See `TBSChecks`.
+	TBSChecks TBSChecks
+
+	// Issuers maps private key labels to the issuer distinguished name, in
+	// the RFC 2253 format of `pkix.RDNSequence.String`, that the TBS
+	// certificates endorsed by the key must carry. Keys without an entry
+	// endorse certificates of any issuer.
+	Issuers map[string]string
+
+	// RequiredMechanisms contains the CKM_* mechanisms that must be supported
+	// by the HSM slot. See `HSM.VerifyRequiredMechanisms`.
+	RequiredMechanisms []uint
+
+	// SessionWaitTimeout bounds the time an operation waits for a free
+	// session, in addition to the deadline of its context. Operations waiting
+	// longer fail with `context.DeadlineExceeded`. Disabled if zero.
+	SessionWaitTimeout time.Duration
+
+	// Metrics receives the session pool and operation measurements. See
+	// `NewExpvarMetrics`. Disabled if nil.
+	Metrics Metrics
+
+	// Audit records the certificate endorsement and key generation
+	// operations, e.g. for compliance. See `NewLogAuditLogger`. Disabled if
+	// nil.
+	Audit AuditLogger
+
+	// CloseTimeout is the time `HSM.Close` waits for sessions in use.
+	// Defaults to `defaultCloseTimeout` if zero.
+	CloseTimeout time.Duration
+
+	// SessionHoldWarning is the time after which a session still checked out
+	// is logged as possibly leaked, along with the call site that checked it
+	// out. Such sessions are counted in `PoolStats.Abandoned`. Disabled if
+	// zero.
+	SessionHoldWarning time.Duration
+
+	// SessionHoldLimit is the time after which a session still checked out
+	// is forcibly returned to the pool, even though its holder may still be
+	// using it. Only meant for development environments, where leaked
+	// sessions would otherwise exhaust the pool. Disabled if zero.
+	SessionHoldLimit time.Duration
+
+	// SessionHealthCheckInterval is the period at which idle sessions are
+	// probed. Lost sessions, e.g. after the connection to a network HSM
+	// dropped, are replaced by sessions opened on the same slot with the same
+	// credentials. Lost sessions are otherwise only replaced after an
+	// operation failed on them. Disabled if zero.
+	SessionHealthCheckInterval time.Duration
+
+	// SessionKeepaliveInterval is the period at which a cheap operation is
+	// run on every idle session, so that network HSMs dropping idle sessions
+	// keep them open. Sessions failing the keepalive are replaced. A round
+	// is cut short while requests wait for a session. Disabled if zero.
+	SessionKeepaliveInterval time.Duration
+
+	// Retry configures the retries of operations failing with a transient
+	// PKCS#11 error. Disabled by default.
+	Retry RetryPolicy
+
+	// OpenRetry configures the retries of the sessions failing to open or
+	// log in with a transient PKCS#11 error when the HSM is created, e.g.
+	// while a network HSM is busy. Errors such as CKR_PIN_INCORRECT fail
+	// immediately. Disabled by default.
+	OpenRetry RetryPolicy
+
+	// LazySessions makes `NewHSM` open a single session, enough to resolve
+	// the key IDs, and open the remaining sessions in the background,
+	// retrying until the pool is complete. This speeds up the startup with
+	// remote HSMs. `MinSessions` is ignored if set. See `HSM.Ready`.
+	LazySessions bool
+
+	// ReadWriteSessions is the number of read-write sessions opened for the
+	// operations creating or destroying token objects. If set, the
+	// `NumSessions` sessions used by all other operations are read-only,
+	// since some HSMs limit the number of read-write sessions per partition.
+	// Otherwise, all sessions are read-write.
+	ReadWriteSessions int
+
+	// ReservedSessions is the number of sessions reserved for short,
+	// latency-sensitive operations such as `EndorseCert`, so that they don't
+	// queue behind large `GenerateTokens` or `BatchEndorseCert` requests.
+	// Other operations never hold more than the remaining sessions at once.
+	// Must be lower than `NumSessions`. Disabled if zero.
+	ReservedSessions int
 }
 
+// defaultCloseTimeout is the time `HSM.Close` waits for sessions in use when
+// `HSMConfig.CloseTimeout` is not set.
+const defaultCloseTimeout = 10 * time.Second
+
+// defaultMinWrappingKeyBits is the minimum wrapping key strength used when
+// `HSMConfig.MinWrappingKeyBits` is not set.
+const defaultMinWrappingKeyBits = 3072
+
 // HSM is a wrapper over a pk11 session that conforms to the SPM interface.
 type HSM struct {
+	// mu guards the key UID maps, the session pools and the module, which
+	// are replaced by `Reconnect`.
+	mu sync.RWMutex
+
 	// UIDs of key objects to use for retrieving long-lived symmetric keys on
 	// the HSM.
 	SymmetricKeys map[string][]byte
@@ -108,396 +986,3309 @@ type HSM struct {
 	// the HSM.
 	PublicKeys map[string][]byte
 
+	// minWrappingKeyBits is the minimum RSA modulus size in bits accepted for
+	// wrapping keys.
+	minWrappingKeyBits int
+
+	// maxClockSkew is the NotBefore tolerance used by `EndorseCert`. Validity
+	// checks are disabled if zero.
+	maxClockSkew time.Duration
+
 	// The PKCS#11 session we're working with.
 	sessions *sessionQueue
+
+	// rwSessions are the read-write sessions used by the `rwOps` operations,
+	// when `sessions` are read-only. Nil unless enabled with
+	// `HSMConfig.ReadWriteSessions`, in which case all sessions are
+	// read-write.
+	rwSessions *sessionQueue
+
+	// healthProbe is the operation used by `DeepHealthCheck` to probe each
+	// session. Defaults to `defaultHealthProbe` if nil.
+	healthProbe func(*pk11.Session) error
+
+	// readOnly is set when the HSM sessions are not logged in as Crypto User.
+	// See `NewHSMReadOnly`.
+	readOnly bool
+
+	// config is the configuration the HSM was created with. Lost sessions
+	// are reopened on the same slot with the same credentials, and
+	// `Reconnect` opens new session pools with it.
+	config HSMConfig
+
+	// metrics receives the operation measurements. Optional.
+	metrics Metrics
+
+	// auditLogger records the operations for the audit log. Optional.
+	auditLogger AuditLogger
+
+	// mod is the PKCS#11 module the sessions are opened with. Finalized by
+	// `Close`.
+	mod *pk11.Mod
+
+	// closed is set by `Close`, after which `Reconnect` fails.
+	closed bool
+
+	// keyLabelMu serializes `GenerateAndStoreKeyPair` and `DeleteKeyPair`,
+	// which check whether a key label exists before changing the keys.
+	keyLabelMu sync.Mutex
+
+	// keyIDs caches the UIDs of the keys used to sign, by class and label.
+	// Entries are dropped when the keys are destroyed through the HSM, and
+	// when a cached UID no longer resolves.
+	keyIDs keyIDCache
+
+	// closeOnce guards `close`, and closeErr is its result returned by
+	// every `Close` call.
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// sessionOpener opens a single HSM session ready for use.
+type sessionOpener func() (*pk11.Session, error)
+
+// sessionBackfillInterval is the time between attempts to open the missing
+// sessions of a degraded session pool.
+var sessionBackfillInterval = 10 * time.Second
+
+// newSessionOpener returns a `sessionOpener` for the HSM `tokSlot` slot
+// number. Sessions are logged in as crypto user with `hsmPW` password, unless
+// `readOnly` is set, in which case read-only public sessions are opened
+// instead. Connects via PKCS#11 shared library in `soPath`, which is returned
+// so that it can be closed.
+func newSessionOpener(soPath, hsmPW string, tokSlot int, readOnly bool) (sessionOpener, *pk11.Mod, error) {
+	slots, mod, err := newSlotSet(soPath, hsmPW, "", []int{tokSlot}, readOnly)
+	if err != nil {
+		return nil, nil, err
+	}
+	return slots.openSession, mod, nil
+}
+
+// openWithRetry opens a session with `open`, retrying transient errors
+// according to `retry`. Other errors, such as CKR_PIN_INCORRECT, fail
+// immediately.
+func openWithRetry(open sessionOpener, retry RetryPolicy) (*pk11.Session, error) {
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		s, err := open()
+		delay, ok := retry.backoff(attempt, time.Since(start), err)
+		if !ok {
+			return s, err
+		}
+		log.Printf("Failed to open HSM session, retrying in %v: %v", delay, err)
+		time.Sleep(delay)
+	}
+}
+
+// openSessions opens `numSessions` sessions with `open`, retrying transient
+// errors according to `retry`. The session queue can be resized up to
+// `maxSessions`.
+//
+// Fails if fewer than `minSessions` sessions can be opened. Otherwise, if only
+// some of the sessions can be opened, returns a degraded session queue and
+// keeps opening the missing sessions in the background.
+func openSessions(open sessionOpener, retry RetryPolicy, numSessions, minSessions, maxSessions int) (*sessionQueue, error) {
+	sessions := newResizableSessionQueue(numSessions, maxSessions)
+	var openErr error
+	for i := 0; i < numSessions; i++ {
+		s, err := openWithRetry(open, retry)
+		if err != nil {
+			openErr = err
+			break
+		}
+		if err := sessions.insert(s); err != nil {
+			s.Close()
+			closeIdle(sessions)
+			return nil, fmt.Errorf("failed to enqueue session: %w", err)
+		}
+	}
+
+	sessions.open = open
+
+	opened := len(sessions.s)
+	if opened < minSessions {
+		closeIdle(sessions)
+		return nil, fmt.Errorf("opened %d sessions, minimum is %d: %v", opened, minSessions, openErr)
+	}
+	if opened < numSessions {
+		log.Printf("HSM session pool degraded: opened %d of %d sessions: %v", opened, numSessions, openErr)
+		sessions.pending.Store(int32(numSessions - opened))
+		go sessions.backfill(open, sessionBackfillInterval)
+	}
+	return sessions, nil
+}
+
+// closeIdle closes the idle sessions of the `q` queue, which is being
+// discarded before any session was handed out.
+func closeIdle(q *sessionQueue) {
+	for len(q.s) > 0 {
+		if err := (<-q.s).Close(); err != nil {
+			log.Printf("Failed to close HSM session: %v", err)
+		}
+	}
+}
+
+// openSessionsLazy opens a single session with `open`, retrying transient
+// errors according to `retry`, and the remaining of the `numSessions`
+// sessions in the background. The session queue can be resized up to
+// `maxSessions` once complete. See `HSMConfig.LazySessions`.
+func openSessionsLazy(open sessionOpener, retry RetryPolicy, numSessions, maxSessions int) (*sessionQueue, error) {
+	sessions := newResizableSessionQueue(numSessions, maxSessions)
+	s, err := openWithRetry(open, retry)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open initial session: %w", err)
+	}
+	if err := sessions.insert(s); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("failed to enqueue session: %w", err)
+	}
+	sessions.open = open
+	if numSessions > 1 {
+		sessions.pending.Store(int32(numSessions - 1))
+		go sessions.warmUp(open)
+	}
+	return sessions, nil
+}
+
+// ErrAmbiguousKeyLabel is returned, possibly wrapped, when several keys of the
+// same class share a label. Such keys must be selected by ID, e.g. with
+// `EndorseCertParams.KeyID`.
+var ErrAmbiguousKeyLabel = errors.New("key label is ambiguous")
+
+// getKeyIDByLabel returns the object ID from a given label. Fails with
+// `ErrAmbiguousKeyLabel` if several keys of the class carry the label.
+func getKeyIDByLabel(session *pk11.Session, classKeyType pk11.ClassAttribute, label string) ([]byte, error) {
+	keyObj, err := session.FindKeyByLabel(classKeyType, label)
+	if errors.Is(err, pk11.ErrMultipleObjects) {
+		return nil, fmt.Errorf("%w: multiple keys labeled %q", ErrAmbiguousKeyLabel, label)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := keyObj.UID()
+	if err != nil {
+		return nil, err
+	}
+	if id == nil {
+		return nil, fmt.Errorf("fail to find ID attribute")
+	}
+	return id, nil
+}
+
+// NewHSM creates a new instance of HSM, with dedicated session and keys.
+func NewHSM(cfg HSMConfig) (*HSM, error) {
+	return newHSM(cfg, false)
+}
+
+// NewHSMReadOnly creates a new instance of HSM without logging in as Crypto
+// User. `cfg.HSMPassword` is ignored.
+//
+// Only public objects are visible in this mode, so `cfg` must not reference
+// any symmetric or private keys. Operations requiring secret key material,
+// such as signing, derivation or wrapping, return `codes.PermissionDenied`.
+func NewHSMReadOnly(cfg HSMConfig) (*HSM, error) {
+	if len(cfg.SymmetricKeys) > 0 || len(cfg.PrivateKeys) > 0 {
+		return nil, fmt.Errorf("symmetric and private keys are not accessible in read-only mode")
+	}
+	return newHSM(cfg, true)
+}
+
+// newHSM creates a new instance of HSM. See `NewHSM` and `NewHSMReadOnly`.
+//
+// On failure, the session pools opened so far are closed, which also stops
+// their background loops. The PKCS#11 module is not finalized, as it may be
+// shared with the pools of another HSM instance, e.g. on `Reconnect`.
+func newHSM(cfg HSMConfig, readOnly bool) (_ *HSM, err error) {
+	if cfg.ReservedSessions < 0 || (cfg.ReservedSessions > 0 && cfg.ReservedSessions >= cfg.NumSessions) {
+		return nil, fmt.Errorf("invalid number of reserved sessions: %d, must be lower than the %d sessions", cfg.ReservedSessions, cfg.NumSessions)
+	}
+
+	slotIDs := append([]int{cfg.SlotID}, cfg.FailoverSlotIDs...)
+	slots, mod, err := newSlotSet(cfg.SOPath, cfg.HSMPassword, cfg.TokenLabel, slotIDs, readOnly)
+	if err != nil {
+		return nil, fmt.Errorf("fail to get session: %w", err)
+	}
+	open := slots.openSession
+	var rwq, sq *sessionQueue
+	defer func() {
+		if err == nil {
+			return
+		}
+		var queues []*sessionQueue
+		for _, q := range []*sessionQueue{sq, rwq} {
+			if q != nil {
+				queues = append(queues, q)
+			}
+		}
+		timeout := cfg.CloseTimeout
+		if timeout <= 0 {
+			timeout = defaultCloseTimeout
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		for _, e := range closeQueues(ctx, queues) {
+			log.Printf("Failed to close HSM session: %s", e)
+		}
+	}()
+	if cfg.ReadWriteSessions > 0 && !readOnly {
+		rwq, err = openSessions(open, cfg.OpenRetry, cfg.ReadWriteSessions, cfg.ReadWriteSessions, cfg.ReadWriteSessions)
+		if err != nil {
+			return nil, fmt.Errorf("fail to get read-write session: %w", err)
+		}
+		open = slots.openReadOnlySession
+	}
+	minSessions := cfg.MinSessions
+	if minSessions <= 0 || minSessions > cfg.NumSessions {
+		minSessions = cfg.NumSessions
+	}
+	if cfg.LazySessions {
+		sq, err = openSessionsLazy(open, cfg.OpenRetry, cfg.NumSessions, cfg.MaxSessions)
+	} else {
+		sq, err = openSessions(open, cfg.OpenRetry, cfg.NumSessions, minSessions, cfg.MaxSessions)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("fail to get session: %w", err)
+	}
+	sq.slots = slots
+	sq.reserved = int32(cfg.ReservedSessions)
+	sq.waitTimeout = cfg.SessionWaitTimeout
+	sq.metrics = cfg.Metrics
+	if cfg.SessionHoldWarning > 0 || cfg.SessionHoldLimit > 0 {
+		sq.watchdog = newSessionWatchdog(cfg.SessionHoldWarning, cfg.SessionHoldLimit)
+	}
+	if rwq != nil {
+		rwq.slots = slots
+		rwq.waitTimeout = cfg.SessionWaitTimeout
+		rwq.watchdog = sq.watchdog
+	}
+
+	hsm := &HSM{
+		sessions:           sq,
+		rwSessions:         rwq,
+		minWrappingKeyBits: cfg.MinWrappingKeyBits,
+		maxClockSkew:       cfg.MaxClockSkew,
+		readOnly:           readOnly,
+		config:             cfg,
+		metrics:            cfg.Metrics,
+		auditLogger:        cfg.Audit,
+		mod:                mod,
+	}
+	if hsm.minWrappingKeyBits == 0 {
+		hsm.minWrappingKeyBits = defaultMinWrappingKeyBits
+	}
+
+	if err := hsm.VerifyRequiredMechanisms(context.Background(), cfg.RequiredMechanisms); err != nil {
+		return nil, err
+	}
+
+	session, release := hsm.sessions.getHandle()
+	defer release()
+
+	// Resolve all key labels before failing, so that every missing key is
+	// reported at once.
+	var missing []string
+	resolve := func(class pk11.ClassAttribute, kind string, labels []string) map[string][]byte {
+		ids := make(map[string][]byte)
+		for _, key := range labels {
+			id, err := getKeyIDByLabel(session, class, key)
+			if err != nil {
+				missing = append(missing, fmt.Sprintf("%s key %q (%v)", kind, key, err))
+				continue
+			}
+			ids[key] = id
+		}
+		return ids
+	}
+	hsm.SymmetricKeys = resolve(pk11.ClassSecretKey, "symmetric", cfg.SymmetricKeys)
+	hsm.PrivateKeys = resolve(pk11.ClassPrivateKey, "private", cfg.PrivateKeys)
+	hsm.PublicKeys = resolve(pk11.ClassPublicKey, "public", cfg.PublicKeys)
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("fail to find %d key(s): %s", len(missing), strings.Join(missing, "; "))
+	}
+
+	for sku, label := range cfg.CAKeys {
+		if _, ok := hsm.PrivateKeys[label]; !ok {
+			return nil, fmt.Errorf("CA key %q of SKU %q is not listed as a private key", label, sku)
+		}
+	}
+
+	for _, key := range cfg.WrappingKeys {
+		id, ok := hsm.PublicKeys[key]
+		if !ok {
+			return nil, fmt.Errorf("wrapping key %q is not listed as a public key", key)
+		}
+		wk, err := session.FindPublicKey(id)
+		if err != nil {
+			return nil, fmt.Errorf("fail to find wrapping key object: %q, error: %w", key, err)
+		}
+		if err := validateWrappingKey(wk, hsm.minWrappingKeyBits); err != nil {
+			return nil, fmt.Errorf("invalid wrapping key %q: %w", key, err)
+		}
+	}
+
+	if sq.watchdog != nil {
+		go sq.watchdog.run(sq.closed)
+	}
+	if cfg.SessionHealthCheckInterval > 0 {
+		go sq.healthCheck(cfg.SessionHealthCheckInterval)
+		if rwq != nil {
+			go rwq.healthCheck(cfg.SessionHealthCheckInterval)
+		}
+	}
+	if cfg.SessionKeepaliveInterval > 0 {
+		go sq.keepalive(cfg.SessionKeepaliveInterval, keepaliveProbe)
+		if rwq != nil {
+			go rwq.keepalive(cfg.SessionKeepaliveInterval, keepaliveProbe)
+		}
+	}
+	return hsm, nil
+}
+
+// validateWrappingKey checks that the `wk` key meets the wrapping key policy:
+// it must be an RSA token object allowed to wrap other keys, with a modulus
+// of at least `minBits` bits.
+func validateWrappingKey(wk pk11.PublicKey, minBits int) error {
+	isToken, err := wk.IsToken()
+	if err != nil {
+		return fmt.Errorf("failed to read token attribute: %w", err)
+	}
+	if !isToken {
+		return fmt.Errorf("wrapping key must be a token object")
+	}
+
+	canWrap, err := wk.CanWrap()
+	if err != nil {
+		return fmt.Errorf("failed to read wrap attribute: %w", err)
+	}
+	if !canWrap {
+		return fmt.Errorf("wrapping key does not have the wrap attribute set")
+	}
+
+	pub, err := wk.ExportKey()
+	if err != nil {
+		return fmt.Errorf("failed to export wrapping key: %w", err)
+	}
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("unsupported wrapping key type %T", pub)
+	}
+	if bits := rsaPub.N.BitLen(); bits < minBits {
+		return fmt.Errorf("wrapping key is too weak: %d bits, expected at least %d", bits, minBits)
+	}
+	return nil
+}
+
+// wrappingKeyFingerprint returns the SHA-256 hash of the DER encoded
+// SubjectPublicKeyInfo of the `pub` wrapping key.
+func wrappingKeyFingerprint(pub any) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal wrapping key: %w", err)
+	}
+	fp := sha256.Sum256(der)
+	return fp[:], nil
+}
+
+// checkWritable returns a `codes.PermissionDenied` error if the HSM is in
+// read-only mode. `op` is the name of the rejected operation.
+func (h *HSM) checkWritable(op string) error {
+	if h.readOnly {
+		return status.Errorf(codes.PermissionDenied,
+			"%s is not available in read-only mode: HSM sessions are not logged in as Crypto User", op)
+	}
+	return nil
+}
+
+// Close closes all sessions and finalizes the PKCS#11 module.
+//
+// The session pool is closed first: operations waiting for a session fail
+// with `codes.Unavailable`, and so do operations started afterwards. Sessions
+// in use are waited for up to `HSMConfig.CloseTimeout`, so that operations in
+// flight can complete. Sessions still in use afterwards are closed when they
+// are returned, or by the module finalization. Finalizing the module also
+// closes the sessions of other HSM instances loaded from the same library, so
+// Close is meant to be called on process shutdown.
+//
+// Callers must wait for the operations in flight, e.g. `ExecuteCmd` calls,
+// before calling Close: operations still running may fail once their session
+// is closed or the module finalized.
+//
+// Only the first call closes the HSM. Subsequent calls return the same
+// result.
+func (h *HSM) Close() error {
+	h.closeOnce.Do(func() {
+		h.closeErr = h.close()
+	})
+	return h.closeErr
+}
+
+// close implements `Close`.
+func (h *HSM) close() error {
+	timeout := h.config.CloseTimeout
+	if timeout <= 0 {
+		timeout = defaultCloseTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	h.mu.Lock()
+	h.closed = true
+	queues := h.queues()
+	mod := h.mod
+	h.mu.Unlock()
+	errs := closeQueues(ctx, queues)
+
+	if mod != nil {
+		if err := mod.Close(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to close HSM: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// queues returns the session pools of `h`. The caller must hold `h.mu`.
+func (h *HSM) queues() []*sessionQueue {
+	queues := []*sessionQueue{h.sessions}
+	if h.rwSessions != nil {
+		queues = append(queues, h.rwSessions)
+	}
+	return queues
+}
+
+// closeQueues closes the `queues` session pools and drains them until `ctx`
+// is done. Returns the session close errors.
+func closeQueues(ctx context.Context, queues []*sessionQueue) []string {
+	for _, q := range queues {
+		q.close()
+	}
+	var errs []string
+	for _, q := range queues {
+		errs = append(errs, q.drain(ctx)...)
+	}
+	return errs
+}
+
+// Reconnect replaces the session pools of the HSM with new ones opened with
+// the configuration the HSM was created with, and resolves the key labels
+// again. It is used to recover from a failure affecting all the sessions,
+// e.g. an HSM restart. The current pools are left untouched if the new ones
+// cannot be opened, so Reconnect can be retried.
+//
+// Operations in flight complete on their current session, and operations
+// waiting for a session of a replaced pool are served by the new pool. The
+// sessions of the replaced pools are closed as they are returned, or after
+// `HSMConfig.CloseTimeout`.
+//
+// The PKCS#11 module of the replaced pools is not finalized, as that would
+// also close the sessions of the new pools. Fails once the HSM is closed.
+func (h *HSM) Reconnect() error {
+	h.mu.RLock()
+	cfg, closed := h.config, h.closed
+	h.mu.RUnlock()
+	if closed {
+		return errSessionPoolClosed
+	}
+	fresh, err := newHSM(cfg, h.readOnly)
+	if err != nil {
+		return fmt.Errorf("failed to reconnect HSM: %w", err)
+	}
+	old, err := h.swap(fresh)
+	if err != nil {
+		closeQueues(context.Background(), fresh.queues())
+		return fmt.Errorf("failed to reconnect HSM: %w", err)
+	}
+
+	timeout := cfg.CloseTimeout
+	if timeout <= 0 {
+		timeout = defaultCloseTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if errs := closeQueues(ctx, old); len(errs) > 0 {
+		log.Printf("Failed to close replaced HSM sessions: %s", strings.Join(errs, "; "))
+	}
+	log.Printf("HSM reconnected")
+	return nil
+}
+
+// swap replaces the key UIDs and session pools of `h` with those of `fresh`.
+// Returns the replaced session pools, which the caller must close. Fails if
+// `h` is closed.
+func (h *HSM) swap(fresh *HSM) ([]*sessionQueue, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil, errSessionPoolClosed
+	}
+	old := h.queues()
+	h.SymmetricKeys = fresh.SymmetricKeys
+	h.PrivateKeys = fresh.PrivateKeys
+	h.PublicKeys = fresh.PublicKeys
+	h.sessions = fresh.sessions
+	h.rwSessions = fresh.rwSessions
+	h.mod = fresh.mod
+	h.keyIDs.clear()
+	return old, nil
+}
+
+// drain closes the sessions of the closed queue as they are returned, until
+// all are closed or `ctx` is done. Sessions returned afterwards are closed by
+// their release function. Returns the session close errors.
+func (q *sessionQueue) drain(ctx context.Context) []string {
+	var errs []string
+	closeSession := func(s *pk11.Session) {
+		q.numSessions.Add(-1)
+		// Closing the last session logs the user out of the token.
+		if err := s.Close(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	numSessions := q.size()
+drain:
+	for closed := 0; closed < numSessions; closed++ {
+		select {
+		case s := <-q.s:
+			closeSession(s)
+		case <-ctx.Done():
+			log.Printf("Timed out waiting for %d HSM sessions in use", numSessions-closed)
+			break drain
+		}
+	}
+	q.drained.Store(true)
+	// Close the sessions returned while the drain was ending.
+	for {
+		select {
+		case s := <-q.s:
+			closeSession(s)
+			continue
+		default:
+		}
+		break
+	}
+	return errs
+}
+
+type CmdFunc func(*pk11.Session) error
+
+// ExecuteCmd executes a command with a session handle in a thread safe way.
+//
+// If the command fails because the session was lost, e.g. after an HSM
+// restart, the session is replaced and the command is retried once. See
+// `withSession`.
+func (h *HSM) ExecuteCmd(ctx context.Context, cmd CmdFunc) error {
+	return h.execute(ctx, "ExecuteCmd", cmd)
+}
+
+// execute runs `cmd` as HSM operation `op`. See `withSession`.
+func (h *HSM) execute(ctx context.Context, op string, cmd CmdFunc) error {
+	_, err := withSession(ctx, h, op, func(session *pk11.Session) (struct{}, error) {
+		return struct{}{}, cmd(session)
+	})
+	return err
+}
+
+// withSession runs `fn` as HSM operation `op` with a session checked out of
+// the pool of `h`. The operation is reported to `HSMConfig.Metrics`.
+//
+// If `fn` fails because the session was lost, e.g. after an HSM restart, the
+// session is replaced and `fn` is retried once with another session. Failures
+// with a transient PKCS#11 error are retried according to `HSMConfig.Retry`.
+func withSession[T any](ctx context.Context, h *HSM, op string, fn func(*pk11.Session) (T, error)) (res T, err error) {
+	if h.metrics != nil {
+		start := time.Now()
+		defer func() {
+			h.metrics.ObserveOperation(op, time.Since(start), err)
+		}()
+	}
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		var lost bool
+		q := h.queue(op)
+		res, lost, err = trySession(ctx, h, q, opClass(op), fn)
+		if err == errSessionPoolClosed && h.queue(op) != q {
+			// The pool was replaced by `Reconnect` while waiting for a
+			// session.
+			res, lost, err = trySession(ctx, h, h.queue(op), opClass(op), fn)
+		}
+		if lost {
+			res, _, err = trySession(ctx, h, h.queue(op), opClass(op), fn)
+		}
+		delay, retry := h.config.Retry.backoff(attempt, time.Since(start), err)
+		if !retry {
+			return res, err
+		}
+		log.Printf("HSM operation %s failed with a transient error, retrying in %v: %v", op, delay, err)
+		select {
+		case <-ctx.Done():
+			return res, err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// pool returns the main session pool of `h`.
+func (h *HSM) pool() *sessionQueue {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.sessions
+}
+
+// symmetricKeyID, privateKeyID and publicKeyID return the UID of the key
+// labeled `label`, and whether the key is known.
+func (h *HSM) symmetricKeyID(label string) ([]byte, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	id, ok := h.SymmetricKeys[label]
+	return id, ok
+}
+
+func (h *HSM) privateKeyID(label string) ([]byte, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	id, ok := h.PrivateKeys[label]
+	return id, ok
+}
+
+func (h *HSM) publicKeyID(label string) ([]byte, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	id, ok := h.PublicKeys[label]
+	return id, ok
+}
+
+// queue returns the session pool used by operation `op`.
+func (h *HSM) queue(op string) *sessionQueue {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.rwSessions != nil && rwOps[op] {
+		return h.rwSessions
+	}
+	return h.sessions
+}
+
+// trySession runs `fn` with a session of class `class` checked out of `q`,
+// one of the pools of `h`. Lost sessions are replaced instead of being
+// returned to the pool. The time spent in `fn` is added to the `HSMTimer` of
+// `ctx`, if any.
+func trySession[T any](ctx context.Context, h *HSM, q *sessionQueue, class sessionClass, fn func(*pk11.Session) (T, error)) (res T, lost bool, err error) {
+	session, release, err := q.getHandleContext(ctx, class)
+	if err != nil {
+		return res, false, err
+	}
+	defer func() {
+		if lost {
+			h.recoverSession(q, session, err)
+			q.endCheckout(class)
+			return
+		}
+		release()
+	}()
+	start := time.Now()
+	res, err = fn(session)
+	HSMTimerFromContext(ctx).Add(time.Since(start))
+	lost = err != nil && sessionLost(session, err)
+	return res, lost, err
+}
+
+// sessionLost reports whether the operation that failed with `err` on
+// `session` failed because the session was lost. Errors wrapped without `%w`
+// are attributed by pinging the session.
+func sessionLost(session *pk11.Session, err error) bool {
+	if pk11.IsSessionLost(err) {
+		return true
+	}
+	return pk11.IsSessionLost(session.Ping())
+}
+
+// recoverSession replaces the lost `session`, which must be checked out of
+// `q` and is not released. Sessions are usually lost all at once, so the
+// idle sessions are checked and replaced in the background as well, limiting
+// the failures to the operations in flight.
+func (h *HSM) recoverSession(q *sessionQueue, session *pk11.Session, err error) {
+	log.Printf("HSM session on slot %d lost, reconnecting: %v", h.config.SlotID, err)
+	q.replace(session)
+	go q.replaceLost()
+}
+
+// GetRandomInt returns a uniformly distributed random integer in the range
+// [min, max), using random bytes generated by the HSM.
+//
+// Rejection sampling is used to avoid the modulo bias of reducing a random
+// value into the target range.
+func (h *HSM) GetRandomInt(ctx context.Context, min, max *big.Int) (*big.Int, error) {
+	rangeSize := new(big.Int).Sub(max, min)
+	if rangeSize.Sign() <= 0 {
+		return nil, fmt.Errorf("invalid range: min %v must be less than max %v", min, max)
+	}
+
+	// Number of bits required to represent the largest value in the range.
+	bitLen := new(big.Int).Sub(rangeSize, big.NewInt(1)).BitLen()
+	if bitLen == 0 {
+		return new(big.Int).Set(min), nil
+	}
+	numBytes := (bitLen + 7) / 8
+	// Mask off the excess bits in the most significant byte to keep the
+	// rejection probability below 1/2.
+	topMask := byte(0xff >> (numBytes*8 - bitLen))
+
+	return withSession(ctx, h, "GetRandomInt", func(session *pk11.Session) (*big.Int, error) {
+		n := new(big.Int)
+		for {
+			b, err := session.GenerateRandom(numBytes)
+			if err != nil {
+				return nil, fmt.Errorf("failed to generate random bytes: %w", err)
+			}
+			b[0] &= topMask
+			n.SetBytes(b)
+			if n.Cmp(rangeSize) < 0 {
+				return n.Add(n, min), nil
+			}
+		}
+	})
+}
+
+// certSerialSize is the size in bytes of the serial numbers generated by
+// `BulkGenerateCertSerials`, the maximum allowed by RFC 5280.
+const certSerialSize = 20
+
+// BulkGenerateCertSerials generates `n` random certificate serial numbers
+// with a single HSM session checkout.
+//
+// Serial numbers are positive and encode to exactly `certSerialSize` bytes in
+// DER, leaving 158 random bits.
+func (h *HSM) BulkGenerateCertSerials(ctx context.Context, n int) ([]*big.Int, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("invalid number of serial numbers: %d", n)
+	}
+
+	return withSession(ctx, h, "BulkGenerateCertSerials", func(session *pk11.Session) ([]*big.Int, error) {
+		b, err := session.GenerateRandom(certSerialSize * n)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate random bytes: %w", err)
+		}
+		serials := make([]*big.Int, n)
+		seen := make(map[string]bool, n)
+		for i := range serials {
+			sn := certSerial(b[i*certSerialSize : (i+1)*certSerialSize])
+			// With 158 random bits, a duplicate means the HSM RNG is broken.
+			if seen[string(sn.Bytes())] {
+				return nil, status.Errorf(codes.Internal, "duplicate certificate serial number generated: %x", sn)
+			}
+			seen[string(sn.Bytes())] = true
+			serials[i] = sn
+		}
+		return serials, nil
+	})
+}
+
+// certSerial returns the certificate serial number encoded by the
+// `certSerialSize` random bytes `b`, which are modified. The sign bit is
+// cleared and the next one set, so that the DER encoding is positive and has
+// no leading zero byte.
+func certSerial(b []byte) *big.Int {
+	b[0] = b[0]&0x7f | 0x40
+	return new(big.Int).SetBytes(b)
+}
+
+// validateCertSerial checks that `sn` is a positive serial number of at most
+// `certSerialSize` bytes once DER encoded, as required by RFC 5280.
+func validateCertSerial(sn *big.Int) error {
+	if sn.Sign() <= 0 {
+		return status.Errorf(codes.InvalidArgument, "invalid serial number: %v", sn)
+	}
+	// The DER encoding needs a leading zero byte if the top bit is set.
+	if sn.BitLen() > 8*certSerialSize-1 {
+		return status.Errorf(codes.InvalidArgument, "serial number %x is longer than %d bytes", sn, certSerialSize)
+	}
+	return nil
+}
+
+// VerifySession verifies that a session to the HSM for a given SKU is active
+func (h *HSM) VerifySession(ctx context.Context) error {
+	return h.execute(ctx, "VerifySession", func(session *pk11.Session) error {
+		kca, ok := h.privateKeyID("KCAPriv")
+		if !ok {
+			return fmt.Errorf("failed to find KCAPriv key UID")
+		}
+
+		_, err := session.FindPrivateKey(kca)
+		if err != nil {
+			return fmt.Errorf("failed to verify session: %w", err)
+		}
+		return nil
+	})
+}
+
+// MechanismInfo describes a mechanism supported by the HSM slot.
+type MechanismInfo struct {
+	// MechanismID is the CKM_* mechanism type.
+	MechanismID uint
+	// Name is the PKCS#11 name of the mechanism, or its hex value if unknown.
+	Name string
+	// MinKeySize and MaxKeySize are the supported key size range. Units are
+	// mechanism dependent.
+	MinKeySize uint
+	MaxKeySize uint
+	// Flags is the CKF_* bitmask of supported operations.
+	Flags uint
+}
+
+// GetSlotMechanisms returns all mechanisms supported by the HSM slot.
+func (h *HSM) GetSlotMechanisms(ctx context.Context) ([]MechanismInfo, error) {
+	return withSession(ctx, h, "GetSlotMechanisms", func(session *pk11.Session) ([]MechanismInfo, error) {
+		mechs, err := session.Mechanisms()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get slot mechanisms: %w", err)
+		}
+		infos := make([]MechanismInfo, 0, len(mechs))
+		for _, m := range mechs {
+			infos = append(infos, MechanismInfo{
+				MechanismID: m.Mechanism,
+				Name:        pk11.MechanismName(m.Mechanism),
+				MinKeySize:  m.MinKeySize,
+				MaxKeySize:  m.MaxKeySize,
+				Flags:       m.Flags,
+			})
+		}
+		return infos, nil
+	})
+}
+
+// VerifyRequiredMechanisms returns an error listing all mechanisms in
+// `required` not supported by the HSM slot.
+func (h *HSM) VerifyRequiredMechanisms(ctx context.Context, required []uint) error {
+	if len(required) == 0 {
+		return nil
+	}
+	mechs, err := h.GetSlotMechanisms(ctx)
+	if err != nil {
+		return err
+	}
+	supported := make(map[uint]bool, len(mechs))
+	for _, m := range mechs {
+		supported[m.MechanismID] = true
+	}
+	var missing []string
+	for _, m := range required {
+		if !supported[m] {
+			missing = append(missing, pk11.MechanismName(m))
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("HSM slot does not support required mechanisms: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// SessionHealth is the health probe result of a single HSM session.
+type SessionHealth struct {
+	// Index is the position of the session in the probe order.
+	Index int
+	// Healthy is false if the probe failed, in which case the session should
+	// be replaced.
+	Healthy bool
+	// Latency is the time taken by the probe.
+	Latency time.Duration
+	// Err is the probe error of unhealthy sessions.
+	Err error
+}
+
+// PoolStats reports the utilization of the HSM session pool.
+type PoolStats struct {
+	// Total is the number of open sessions. It is lower than the configured
+	// number of sessions while a degraded pool is being backfilled.
+	Total int
+	// InUse is the number of sessions currently checked out.
+	InUse int
+	// Available is the number of idle sessions.
+	Available int
+	// Retiring is the number of sessions in use that are closed when
+	// returned, after the pool was shrunk with `ResizeSessions`. They are not
+	// counted in `Total`.
+	Retiring int
+	// HighWaterMark is the highest number of sessions checked out at once.
+	HighWaterMark int
+	// Waits is the number of operations that had to wait for a session.
+	Waits int64
+	// Waiters is the number of operations currently waiting for a session.
+	Waiters int
+	// Checkouts is the number of sessions checked out of the pool.
+	Checkouts int64
+	// WaitTime is the cumulative time operations spent waiting for a
+	// session, including waits that timed out.
+	WaitTime time.Duration
+	// HoldTime is the cumulative time sessions were checked out. Divided by
+	// `Checkouts`, it approximates the average HSM operation latency.
+	HoldTime time.Duration
+	// Abandoned is the number of sessions held longer than
+	// `HSMConfig.SessionHoldWarning`.
+	Abandoned int64
+	// Reclaimed is the number of sessions forcibly returned to the pool after
+	// `HSMConfig.SessionHoldLimit`.
+	Reclaimed int64
+}
+
+// ResizeSessions grows or shrinks the session pool to `n` sessions, so that
+// throughput can be adjusted without restarting the service. The pool holds
+// at least one session, and at most `HSMConfig.MaxSessions` sessions and the
+// session limit reported by the HSM tokens through C_GetTokenInfo. New
+// sessions are opened and logged in before returning. When shrinking, idle
+// sessions are closed immediately and sessions in use are closed as they are
+// returned, so operations in flight are not affected. Concurrent calls are
+// serialized. The pool cannot be resized while it is degraded.
+//
+// `PoolStats().Total` reports the resulting pool size.
+func (h *HSM) ResizeSessions(n int) error {
+	q := h.pool()
+	if q.slots != nil {
+		max, err := q.slots.maxSessions()
+		if err != nil {
+			return fmt.Errorf("failed to resize HSM session pool: %w", err)
+		}
+		if max > 0 && n > max {
+			return fmt.Errorf("failed to resize HSM session pool: %d sessions exceed the HSM limit of %d", n, max)
+		}
+	}
+	if err := q.resize(n); err != nil {
+		return fmt.Errorf("failed to resize HSM session pool: %w", err)
+	}
+	log.Printf("HSM session pool resized to %d sessions", n)
+	return nil
+}
+
+// PoolStats returns a snapshot of the session pool utilization. Operators can
+// use it to size `HSMConfig.NumSessions`, and to tell time spent waiting for a
+// session apart from time spent in the HSM. Safe to call concurrently with HSM
+// operations; the counts are not read atomically with each other and may be
+// briefly inconsistent.
+func (h *HSM) PoolStats() PoolStats {
+	q := h.pool()
+	stats := PoolStats{
+		Total:         q.size(),
+		InUse:         q.inUse(),
+		Available:     len(q.s),
+		Retiring:      int(q.retiring.Load()),
+		HighWaterMark: int(q.highWater.Load()),
+		Waits:         q.waits.Load(),
+		Waiters:       int(q.waiters.Load()),
+		Checkouts:     q.checkouts.Load(),
+		WaitTime:      time.Duration(q.waitNanos.Load()),
+		HoldTime:      time.Duration(q.holdNanos.Load()),
+	}
+	if q.watchdog != nil {
+		stats.Abandoned = q.watchdog.abandoned.Load()
+		stats.Reclaimed = q.watchdog.reclaimed.Load()
+	}
+	return stats
+}
+
+// Ready reports whether all the sessions of the pool are open. Operations
+// are served as soon as one session is open, but may wait for a session until
+// the pool is ready, e.g. while sessions are opened in the background with
+// `HSMConfig.LazySessions` or a degraded pool is backfilled.
+func (h *HSM) Ready() bool {
+	q := h.pool()
+	return q.pending.Load() == 0 && !q.closing.Load()
+}
+
+// SlotHealth returns the state of the slots sessions are opened on: the
+// `HSMConfig.SlotID` slot followed by the `HSMConfig.FailoverSlotIDs` slots.
+func (h *HSM) SlotHealth() []SlotHealth {
+	q := h.pool()
+	if q.slots == nil {
+		return nil
+	}
+	return q.slots.health()
+}
+
+// HealthReport is the result of a `DeepHealthCheck`.
+type HealthReport struct {
+	// Sessions contains the per-session probe results.
+	Sessions []SessionHealth
+	// NumHealthy is the number of sessions that passed the probe.
+	NumHealthy int
+	// Latency is the total time taken to probe the whole session pool,
+	// including the time spent waiting for sessions in use.
+	Latency time.Duration
+	// Degraded is set if the session pool has fewer sessions than configured
+	// because some failed to open at startup.
+	Degraded bool
+}
+
+// defaultHealthProbe probes a session by requesting a single random byte from
+// the HSM, which does not depend on any key material.
+func defaultHealthProbe(s *pk11.Session) error {
+	_, err := s.GenerateRandom(1)
+	return err
+}
+
+// DeepHealthCheck probes every session in the pool concurrently and reports
+// the health of each one.
+//
+// All sessions are checked out of the pool for the duration of the check, so
+// the call waits for in-flight operations to complete. Sessions failing the
+// probe are replaced. Returns an error if `ctx` expires before all sessions
+// are available or probed; the sessions still being probed are then returned
+// to the pool in the background.
+func (h *HSM) DeepHealthCheck(ctx context.Context) (*HealthReport, error) {
+	probe := h.healthProbe
+	if probe == nil {
+		probe = defaultHealthProbe
+	}
+
+	start := time.Now()
+	q := h.pool()
+	numSessions := q.size()
+	sessions := make([]*pk11.Session, 0, numSessions)
+	releases := make([]func(), 0, numSessions)
+	for len(sessions) < numSessions {
+		s, release, err := q.getHandleContext(ctx, sessionClassShort)
+		if err != nil {
+			for _, release := range releases {
+				release()
+			}
+			return nil, fmt.Errorf("failed to acquire sessions for health check: %w", err)
+		}
+		sessions = append(sessions, s)
+		releases = append(releases, release)
+	}
+
+	report := &HealthReport{
+		Sessions: make([]SessionHealth, len(sessions)),
+		Degraded: q.pending.Load() > 0,
+	}
+	var wg sync.WaitGroup
+	for i, s := range sessions {
+		wg.Add(1)
+		go func(i int, s *pk11.Session, release func()) {
+			defer wg.Done()
+			probeStart := time.Now()
+			err := probe(s)
+			report.Sessions[i] = SessionHealth{
+				Index:   i,
+				Healthy: err == nil,
+				Latency: time.Since(probeStart),
+				Err:     err,
+			}
+			if err != nil {
+				log.Printf("HSM session %d failed the health check, replacing it: %v", i, err)
+				q.replace(s)
+				q.endCheckout(sessionClassShort)
+				return
+			}
+			release()
+		}(i, s, releases[i])
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return nil, status.Errorf(codes.DeadlineExceeded, "health check did not complete: %v", ctx.Err())
+	}
+
+	for _, sh := range report.Sessions {
+		if sh.Healthy {
+			report.NumHealthy++
+		}
+	}
+	report.Latency = time.Since(start)
+	return report, nil
+}
+
+func (h *HSM) GenerateTokens(ctx context.Context, params []*TokenParams) (tokens []TokenResult, err error) {
+	defer func() {
+		labels, sku := tokenAuditInfo(params)
+		h.audit(AuditRecord{Op: "GenerateTokens", KeyLabels: labels, SKU: sku, Err: err})
+	}()
+	if err := h.checkWritable("GenerateTokens"); err != nil {
+		return nil, err
+	}
+	for _, p := range params {
+		if err := validateTokenParams(p); err != nil {
+			return nil, err
+		}
+		if label := tokenSeedLabel(p); label != "" {
+			if _, ok := h.symmetricKeyID(label); !ok {
+				return nil, status.Errorf(codes.InvalidArgument, "seed %q is not a configured symmetric key", label)
+			}
+		}
+	}
+
+	return withSession(ctx, h, "GenerateTokens", func(session *pk11.Session) ([]TokenResult, error) {
+		if err := checkTokenHashes(session, params); err != nil {
+			return nil, err
+		}
+
+		Tokens := []TokenResult{}
+		for _, p := range params {
+			// Only support extracting random seeds using a wrapping key.
+			if p.Type != TokenTypeKeyGen && p.Wrap != WrappingMechanismNone {
+				return nil, fmt.Errorf("unsupported key type %v and wrap %v", p.Type, p.Wrap)
+			}
+
+			// Select the seed asset to use (High or Low security seed).
+			var seed pk11.SecretKey
+			var err error
+			switch p.Type {
+			case TokenTypeSecurityHi, TokenTypeSecurityLo:
+				label := tokenSeedLabel(p)
+				ks, ok := h.symmetricKeyID(label)
+				if !ok {
+					return nil, fmt.Errorf("failed to find %q key UID", label)
+				}
+				seed, err = session.FindSecretKey(ks)
+				if err != nil {
+					return nil, fmt.Errorf("failed to get %q key object: %w", label, err)
+				}
+			case TokenTypeKeyGen:
+				seed, err = session.Generate(
+					256,
+					&pk11.KeyOptions{
+						Extractable: true,
+						Sensitive:   true,
+						Token:       false,
+					})
+				if err != nil {
+					return nil, fmt.Errorf("failed to generate random key: %w", err)
+				}
+			default:
+				return nil, fmt.Errorf("unsupported key type: %v", p.Type)
+			}
+
+			// Generate token from seed and extract.
+			rawData := append([]byte(p.Sku), tokenDiversifier(p)...)
+			tBytes, err := seed.SignHMAC(tokenHash(p), rawData)
+			if err != nil {
+				return nil, fmt.Errorf("failed to hash seed: %w", err)
+			}
+
+			// Truncate token to the requested size.
+			tBytes = tBytes[:p.SizeInBits/8]
+
+			if p.Op == TokenOpHashedOtLcToken || p.Op == TokenOpHashedOtLcToken256 {
+				hashLcToken(p.Op, tBytes)
+			}
+
+			wkey := []byte{}
+			var wkFingerprint []byte
+			if p.Wrap != WrappingMechanismNone {
+				wk, ok := h.publicKeyID(p.WrapKeyLabel)
+				if !ok {
+					return nil, fmt.Errorf("failed to find %q key UID", p.WrapKeyLabel)
+				}
+				wkObj, err := session.FindPublicKey(wk)
+				if err != nil {
+					return nil, fmt.Errorf("failed to find %q key object: %w", p.WrapKeyLabel, err)
+				}
+				if err := validateWrappingKey(wkObj, h.minWrappingKeyBits); err != nil {
+					return nil, fmt.Errorf("invalid wrapping key %q: %w", p.WrapKeyLabel, err)
+				}
+
+				var m pk11.GenSecretWrapMechanism
+				switch p.Wrap {
+				case WrappingMechanismRSAPCKS:
+					m = pk11.GenSecretWrapMechanismRsaPcks
+				case WrappingMechanismRSAOAEP:
+					m = pk11.GenSecretWrapMechanismRsaOaep
+				default:
+					return nil, fmt.Errorf("unsupported wrap mechanism: %v", p.Wrap)
+				}
+				wkey, err = seed.Wrap(wkObj, m)
+				if err != nil {
+					return nil, fmt.Errorf("failed to wrap seed: %w", err)
+				}
+
+				wkPub, err := wkObj.ExportKey()
+				if err != nil {
+					return nil, fmt.Errorf("failed to export %q key: %w", p.WrapKeyLabel, err)
+				}
+				if err := checkWrappedKeyLen(wkey, p.Wrap, wkPub); err != nil {
+					return nil, err
+				}
+				wkFingerprint, err = wrappingKeyFingerprint(wkPub)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			Tokens = append(Tokens, TokenResult{
+				Token:              tBytes,
+				WrappedKey:         wkey,
+				WrapKeyFingerprint: wkFingerprint,
+				Diversifier:        p.Diversifier,
+			})
+		}
+
+		return Tokens, nil
+	})
+}
+
+// checkWrappedKeyLen verifies that the length of a `wrapped` key blob is
+// consistent with the wrapping mechanism `m` and the wrapping key `wk`. This
+// guards against silent HSM or mechanism misbehavior producing a blob that
+// cannot be unwrapped by the receiving party.
+func checkWrappedKeyLen(wrapped []byte, m WrappingMechanism, wk any) error {
+	var expected int
+	switch m {
+	case WrappingMechanismRSAPCKS, WrappingMechanismRSAOAEP:
+		// RSA encryption always produces a ciphertext of the same length as
+		// the public modulus.
+		pub, ok := wk.(*rsa.PublicKey)
+		if !ok {
+			return status.Errorf(codes.Internal, "unexpected wrapping key type %T for mechanism %v", wk, m)
+		}
+		expected = pub.Size()
+	default:
+		return status.Errorf(codes.Internal, "unsupported wrap mechanism: %v", m)
+	}
+	if len(wrapped) != expected {
+		return status.Errorf(codes.Internal, "implausible wrapped key length: got %d bytes, expected %d", len(wrapped), expected)
+	}
+	return nil
+}
+
+// macKeyLabelSuffix is appended to a wrapping key label to obtain the label of
+// the HMAC key used to authenticate keys wrapped by `WrapAndTimestamp`.
+const macKeyLabelSuffix = "-mac"
+
+// wrapNonceSize is the size in bytes of the nonce bound to a wrapped key.
+const wrapNonceSize = 16
+
+// WrappedKeyWithTimestamp is a key wrapped by `HSM.WrapAndTimestamp`, bound to
+// the time it was wrapped.
+type WrappedKeyWithTimestamp struct {
+	// WrapKeyLabel is the label of the AES key used to wrap the key.
+	WrapKeyLabel string
+	// Ciphertext is the AES-KWP wrapped key.
+	Ciphertext []byte
+	// Nonce is a random value generated by the HSM, making each wrapped key
+	// unique.
+	Nonce []byte
+	// Timestamp is the wrapping time in seconds since the Unix epoch.
+	Timestamp int64
+	// MAC is the HMAC-SHA256 of `Ciphertext || Nonce || Timestamp`, with the
+	// timestamp encoded as a 64-bit big endian integer.
+	MAC []byte
+}
+
+// macInput returns the data authenticated by `w.MAC`.
+func (w *WrappedKeyWithTimestamp) macInput() []byte {
+	data := make([]byte, 0, len(w.Ciphertext)+len(w.Nonce)+8)
+	data = append(data, w.Ciphertext...)
+	data = append(data, w.Nonce...)
+	return binary.BigEndian.AppendUint64(data, uint64(w.Timestamp))
+}
+
+// findWrapKeys returns the AES wrapping key `wrapKeyLabel` and its associated
+// HMAC key, labeled `wrapKeyLabel` followed by `macKeyLabelSuffix`. Both must
+// be configured as symmetric keys.
+func (h *HSM) findWrapKeys(session *pk11.Session, wrapKeyLabel string) (pk11.SecretKey, pk11.SecretKey, error) {
+	wkID, ok := h.symmetricKeyID(wrapKeyLabel)
+	if !ok {
+		return pk11.SecretKey{}, pk11.SecretKey{}, fmt.Errorf("failed to find %q key UID", wrapKeyLabel)
+	}
+	macLabel := wrapKeyLabel + macKeyLabelSuffix
+	macID, ok := h.symmetricKeyID(macLabel)
+	if !ok {
+		return pk11.SecretKey{}, pk11.SecretKey{}, fmt.Errorf("failed to find %q key UID", macLabel)
+	}
+	wk, err := session.FindSecretKey(wkID)
+	if err != nil {
+		return pk11.SecretKey{}, pk11.SecretKey{}, fmt.Errorf("failed to find %q key object: %w", wrapKeyLabel, err)
+	}
+	mk, err := session.FindSecretKey(macID)
+	if err != nil {
+		return pk11.SecretKey{}, pk11.SecretKey{}, fmt.Errorf("failed to find %q key object: %w", macLabel, err)
+	}
+	return wk, mk, nil
+}
+
+// WrapAndTimestamp wraps `key` with AES-KWP using the AES key `wrapKeyLabel`,
+// and authenticates the result together with a random nonce and the current
+// time using the HMAC key associated with `wrapKeyLabel` (see `findWrapKeys`).
+// This allows the receiving party to reject replayed wrapped keys with
+// `UnwrapWithTimestampVerification`.
+func (h *HSM) WrapAndTimestamp(ctx context.Context, key pk11.SecretKey, wrapKeyLabel string) (WrappedKeyWithTimestamp, error) {
+	if err := h.checkWritable("WrapAndTimestamp"); err != nil {
+		return WrappedKeyWithTimestamp{}, err
+	}
+
+	return withSession(ctx, h, "WrapAndTimestamp", func(session *pk11.Session) (WrappedKeyWithTimestamp, error) {
+		wk, mk, err := h.findWrapKeys(session, wrapKeyLabel)
+		if err != nil {
+			return WrappedKeyWithTimestamp{}, err
+		}
+		ciphertext, err := wk.WrapAESKWP(key)
+		if err != nil {
+			return WrappedKeyWithTimestamp{}, fmt.Errorf("failed to wrap key: %w", err)
+		}
+		nonce, err := session.GenerateRandom(wrapNonceSize)
+		if err != nil {
+			return WrappedKeyWithTimestamp{}, fmt.Errorf("failed to generate nonce: %w", err)
+		}
+
+		wrapped := WrappedKeyWithTimestamp{
+			WrapKeyLabel: wrapKeyLabel,
+			Ciphertext:   ciphertext,
+			Nonce:        nonce,
+			Timestamp:    time.Now().Unix(),
+		}
+		wrapped.MAC, err = mk.SignHMAC256(wrapped.macInput())
+		if err != nil {
+			return WrappedKeyWithTimestamp{}, fmt.Errorf("failed to compute MAC: %w", err)
+		}
+		return wrapped, nil
+	})
+}
+
+// UnwrapWithTimestampVerification verifies the MAC of a key wrapped by
+// `WrapAndTimestamp`, unwraps it as a generic secret session key and calls
+// `use` with it. Keys wrapped more than `maxAge` ago, or with a timestamp in
+// the future, are rejected with a `codes.InvalidArgument` error.
+//
+// The unwrapped key is bound to a pool session, so it is only valid during
+// `use`. It is destroyed once `use` returns.
+func (h *HSM) UnwrapWithTimestampVerification(ctx context.Context, wrapped WrappedKeyWithTimestamp, maxAge time.Duration, use func(pk11.SecretKey) error) error {
+	if err := h.checkWritable("UnwrapWithTimestampVerification"); err != nil {
+		return err
+	}
+
+	return h.execute(ctx, "UnwrapWithTimestampVerification", func(session *pk11.Session) error {
+		wk, mk, err := h.findWrapKeys(session, wrapped.WrapKeyLabel)
+		if err != nil {
+			return err
+		}
+		mac, err := mk.SignHMAC256(wrapped.macInput())
+		if err != nil {
+			return fmt.Errorf("failed to compute MAC: %w", err)
+		}
+		if !hmac.Equal(mac, wrapped.MAC) {
+			return status.Errorf(codes.InvalidArgument, "wrapped key MAC mismatch")
+		}
+
+		age := time.Since(time.Unix(wrapped.Timestamp, 0))
+		if age > maxAge {
+			return status.Errorf(codes.InvalidArgument,
+				"wrapped key expired: wrapped %v ago, max age %v", age.Truncate(time.Second), maxAge)
+		}
+		if age < -h.maxClockSkew {
+			return status.Errorf(codes.InvalidArgument,
+				"wrapped key timestamp is %v in the future", (-age).Truncate(time.Second))
+		}
+
+		key, err := session.UnwrapAESKWP(wrapped.Ciphertext, wk, &pk11.KeyOptions{Sensitive: true})
+		if err != nil {
+			return fmt.Errorf("failed to unwrap key: %w", err)
+		}
+		defer func() {
+			if err := key.Destroy(); err != nil {
+				log.Printf("Failed to destroy unwrapped key: %v", err)
+			}
+		}()
+		return use(key)
+	})
+}
+
+// OIDs for ECDSA signature algorithms corresponding to SHA-256, SHA-384 and
+// SHA-512.
+//
+// See https://datatracker.ietf.org/doc/html/rfc5758#section-3.1. The following
+// text is copied from the spec for reference:
+//
+// ecdsa-with-SHA256 OBJECT IDENTIFIER ::= { iso(1) member-body(2)
+//   us(840) ansi-X9-62(10045) signatures(4) ecdsa-with-SHA2(3) 2 }
+
+// ecdsa-with-SHA384 OBJECT IDENTIFIER ::= { iso(1) member-body(2)
+//   us(840) ansi-X9-62(10045) signatures(4) ecdsa-with-SHA2(3) 3 }
+
+// ecdsa-with-SHA512 OBJECT IDENTIFIER ::= { iso(1) member-body(2)
+//
+//	us(840) ansi-X9-62(10045) signatures(4) ecdsa-with-SHA2(3) 4 }
+var (
+	oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidECDSAWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}
+	oidECDSAWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 4}
+)
+
+// SHA-3 ECDSA signature algorithms. They are not defined by `crypto/x509`, so
+// values past its range are used.
+const (
+	ECDSAWithSHA3_256 x509.SignatureAlgorithm = iota + 1000
+	ECDSAWithSHA3_384
+	ECDSAWithSHA3_512
+)
+
+// OIDs for ECDSA signature algorithms corresponding to SHA3-256, SHA3-384 and
+// SHA3-512, see
+// https://csrc.nist.gov/projects/computer-security-objects-register/algorithm-registration:
+//
+// id-ecdsa-with-sha3-256 OBJECT IDENTIFIER ::= { sigAlgs 10 }
+// id-ecdsa-with-sha3-384 OBJECT IDENTIFIER ::= { sigAlgs 11 }
+// id-ecdsa-with-sha3-512 OBJECT IDENTIFIER ::= { sigAlgs 12 }
+//
+// with sigAlgs ::= { 2 16 840 1 101 3 4 3 }. The AlgorithmIdentifier
+// parameters must be absent.
+var (
+	oidECDSAWithSHA3_256 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 3, 10}
+	oidECDSAWithSHA3_384 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 3, 11}
+	oidECDSAWithSHA3_512 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 3, 12}
+)
+
+// Ed25519 object identifier, see
+// https://datatracker.ietf.org/doc/html/rfc8410#section-3:
+//
+// id-Ed25519 OBJECT IDENTIFIER ::= { 1 3 101 112 }
+//
+// The AlgorithmIdentifier parameters must be absent.
+var oidEd25519 = asn1.ObjectIdentifier{1, 3, 101, 112}
+
+// oidFromSignatureAlgorithm returns the ASN.1 object identifier for the given
+// signature algorithm.
+func oidFromSignatureAlgorithm(alg x509.SignatureAlgorithm) (asn1.ObjectIdentifier, error) {
+	switch alg {
+	case x509.ECDSAWithSHA256:
+		return oidECDSAWithSHA256, nil
+	case x509.ECDSAWithSHA384:
+		return oidECDSAWithSHA384, nil
+	case x509.ECDSAWithSHA512:
+		return oidECDSAWithSHA512, nil
+	case ECDSAWithSHA3_256:
+		return oidECDSAWithSHA3_256, nil
+	case ECDSAWithSHA3_384:
+		return oidECDSAWithSHA3_384, nil
+	case ECDSAWithSHA3_512:
+		return oidECDSAWithSHA3_512, nil
+	case x509.SHA256WithRSA:
+		return oidSHA256WithRSA, nil
+	case x509.SHA384WithRSA:
+		return oidSHA384WithRSA, nil
+	case x509.SHA512WithRSA:
+		return oidSHA512WithRSA, nil
+	case x509.PureEd25519:
+		return oidEd25519, nil
+	default:
+		return nil, fmt.Errorf("unsupported signature algorithm: %v", alg)
+	}
+}
+
+// RSASSA-PSS object identifiers, see
+// https://datatracker.ietf.org/doc/html/rfc4055#section-3.1:
+//
+// id-RSASSA-PSS OBJECT IDENTIFIER ::= { pkcs-1 10 }
+// id-mgf1 OBJECT IDENTIFIER ::= { pkcs-1 8 }
+var (
+	oidRSASSAPSS = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 10}
+	oidMGF1      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 8}
+
+	oidSHA256 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+)
+
+// RSASSA-PKCS1-v1_5 object identifiers, see
+// https://datatracker.ietf.org/doc/html/rfc4055#section-5. The
+// AlgorithmIdentifier parameters must be NULL.
+var (
+	oidSHA256WithRSA = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	oidSHA384WithRSA = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 12}
+	oidSHA512WithRSA = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 13}
+)
+
+// pkcs1v15HashFromSignatureAlgorithm returns the hash used by the
+// RSASSA-PKCS1-v1_5 `alg` signature algorithm. Returns false if `alg` is not
+// an RSASSA-PKCS1-v1_5 algorithm.
+func pkcs1v15HashFromSignatureAlgorithm(alg x509.SignatureAlgorithm) (crypto.Hash, bool) {
+	switch alg {
+	case x509.SHA256WithRSA:
+		return crypto.SHA256, true
+	case x509.SHA384WithRSA:
+		return crypto.SHA384, true
+	case x509.SHA512WithRSA:
+		return crypto.SHA512, true
+	default:
+		return 0, false
+	}
+}
+
+// pssParameters is the RSASSA-PSS-params structure of RFC 4055. The trailer
+// field is omitted, as only its default value is used.
+type pssParameters struct {
+	Hash       pkix.AlgorithmIdentifier `asn1:"explicit,tag:0"`
+	MGF        pkix.AlgorithmIdentifier `asn1:"explicit,tag:1"`
+	SaltLength int                      `asn1:"explicit,tag:2"`
+}
+
+// pssHashFromSignatureAlgorithm returns the hash used by the RSA-PSS `alg`
+// signature algorithm. Returns false if `alg` is not an RSA-PSS algorithm.
+func pssHashFromSignatureAlgorithm(alg x509.SignatureAlgorithm) (crypto.Hash, bool) {
+	switch alg {
+	case x509.SHA256WithRSAPSS:
+		return crypto.SHA256, true
+	case x509.SHA384WithRSAPSS:
+		return crypto.SHA384, true
+	case x509.SHA512WithRSAPSS:
+		return crypto.SHA512, true
+	default:
+		return 0, false
+	}
+}
+
+// signatureAlgorithmIdentifier returns the X.509 AlgorithmIdentifier of the
+// `alg` signature algorithm.
+//
+// RSA-PSS parameters follow RFC 4055 as expected by `crypto/x509`: the message
+// and MGF1 hashes are the same, and the salt length is the hash size.
+// RSASSA-PKCS1-v1_5 parameters are NULL.
+func signatureAlgorithmIdentifier(alg x509.SignatureAlgorithm) (pkix.AlgorithmIdentifier, error) {
+	hash, ok := pssHashFromSignatureAlgorithm(alg)
+	if !ok {
+		oid, err := oidFromSignatureAlgorithm(alg)
+		if err != nil {
+			return pkix.AlgorithmIdentifier{}, err
+		}
+		id := pkix.AlgorithmIdentifier{Algorithm: oid}
+		if _, ok := pkcs1v15HashFromSignatureAlgorithm(alg); ok {
+			id.Parameters = asn1.NullRawValue
+		}
+		return id, nil
+	}
+
+	hashID := pkix.AlgorithmIdentifier{Parameters: asn1.NullRawValue}
+	switch hash {
+	case crypto.SHA256:
+		hashID.Algorithm = oidSHA256
+	case crypto.SHA384:
+		hashID.Algorithm = oidSHA384
+	case crypto.SHA512:
+		hashID.Algorithm = oidSHA512
+	}
+	mgfParams, err := asn1.Marshal(hashID)
+	if err != nil {
+		return pkix.AlgorithmIdentifier{}, err
+	}
+	params, err := asn1.Marshal(pssParameters{
+		Hash:       hashID,
+		MGF:        pkix.AlgorithmIdentifier{Algorithm: oidMGF1, Parameters: asn1.RawValue{FullBytes: mgfParams}},
+		SaltLength: hash.Size(),
+	})
+	if err != nil {
+		return pkix.AlgorithmIdentifier{}, err
+	}
+	return pkix.AlgorithmIdentifier{
+		Algorithm:  oidRSASSAPSS,
+		Parameters: asn1.RawValue{FullBytes: params},
+	}, nil
+}
+
+// signatureKeyAlgorithm returns the type of key signing with the `alg`
+// signature algorithm, or `x509.UnknownPublicKeyAlgorithm` if `alg` is not
+// supported.
+func signatureKeyAlgorithm(alg x509.SignatureAlgorithm) x509.PublicKeyAlgorithm {
+	if _, ok := pssHashFromSignatureAlgorithm(alg); ok {
+		return x509.RSA
+	}
+	if _, ok := pkcs1v15HashFromSignatureAlgorithm(alg); ok {
+		return x509.RSA
+	}
+	if alg == x509.PureEd25519 {
+		return x509.Ed25519
+	}
+	if _, err := hashFromSignatureAlgorithm(alg); err == nil {
+		return x509.ECDSA
+	}
+	return x509.UnknownPublicKeyAlgorithm
+}
+
+// hashFromSignatureAlgorithm returns the crypto.Hash for the given signature
+// algorithm.
+func hashFromSignatureAlgorithm(alg x509.SignatureAlgorithm) (crypto.Hash, error) {
+	switch alg {
+	case x509.ECDSAWithSHA256:
+		return crypto.SHA256, nil
+	case x509.ECDSAWithSHA384:
+		return crypto.SHA384, nil
+	case x509.ECDSAWithSHA512:
+		return crypto.SHA512, nil
+	case ECDSAWithSHA3_256:
+		return crypto.SHA3_256, nil
+	case ECDSAWithSHA3_384:
+		return crypto.SHA3_384, nil
+	case ECDSAWithSHA3_512:
+		return crypto.SHA3_512, nil
+	default:
+		return 0, fmt.Errorf("unsupported signature algorithm: %v", alg)
+	}
+}
+
+// tbsCertificatePrefix is the prefix of an X.509 TBSCertificate structure up
+// to and including the validity period. Trailing fields are ignored.
+type tbsCertificatePrefix struct {
+	Version            int `asn1:"optional,explicit,default:0,tag:0"`
+	SerialNumber       *big.Int
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Issuer             asn1.RawValue
+	Validity           struct{ NotBefore, NotAfter time.Time }
+}
+
+// checkValidity verifies the validity period of the DER encoded `tbs`
+// certificate against `now`. NotBefore is accepted up to `maxSkew` before or
+// after `now`, which tolerates devices with skewed clocks while rejecting
+// backdated or future dated certificates. NotAfter must not be in the past.
+func checkValidity(tbs []byte, now time.Time, maxSkew time.Duration) error {
+	var cert tbsCertificatePrefix
+	if _, err := asn1.Unmarshal(tbs, &cert); err != nil {
+		return status.Errorf(codes.InvalidArgument, "failed to parse TBS certificate: %v", err)
+	}
+	notBefore, notAfter := cert.Validity.NotBefore, cert.Validity.NotAfter
+	if notBefore.After(now.Add(maxSkew)) {
+		return status.Errorf(codes.InvalidArgument, "certificate NotBefore %v is more than %v ahead of %v", notBefore, maxSkew, now)
+	}
+	if notBefore.Before(now.Add(-maxSkew)) {
+		return status.Errorf(codes.InvalidArgument, "certificate NotBefore %v is more than %v behind %v", notBefore, maxSkew, now)
+	}
+	if !notAfter.After(now) {
+		return status.Errorf(codes.InvalidArgument, "certificate NotAfter %v is not after %v", notAfter, now)
+	}
+	return nil
+}
+
+// TBSChecks selects the sanity checks of the TBS certificates submitted for
+// endorsement, which keep the endorsement keys from signing arbitrary data.
+// Failing TBS certificates are rejected with `codes.InvalidArgument`. Some
+// SKUs intentionally deviate from RFC 5280, and disable the checks they fail.
+type TBSChecks struct {
+	// SkipStructure accepts TBS certificates that do not parse as a complete
+	// RFC 5280 TBSCertificate past the validity period, or that are followed
+	// by trailing data. The fields up to the validity period must still
+	// parse, unless all the other checks are skipped as well.
+	SkipStructure bool
+	// SkipSignatureAlgorithm accepts TBS certificates declaring a signature
+	// algorithm other than `EndorseCertParams.SignatureAlgorithm`.
+	SkipSignatureAlgorithm bool
+	// SkipValidity accepts TBS certificates whose NotAfter is not after their
+	// NotBefore.
+	SkipValidity bool
+	// SkipIssuer accepts TBS certificates whose issuer does not match
+	// `HSMConfig.Issuers`.
+	SkipIssuer bool
+}
+
+// tbsCertificate is an X.509 TBSCertificate structure, see RFC 5280 section
+// 4.1. Extensions are parsed as opaque values.
+type tbsCertificate struct {
+	Version            int `asn1:"optional,explicit,default:0,tag:0"`
+	SerialNumber       *big.Int
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Issuer             asn1.RawValue
+	Validity           struct{ NotBefore, NotAfter time.Time }
+	Subject            asn1.RawValue
+	PublicKey          struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	IssuerUniqueID  asn1.BitString   `asn1:"optional,tag:1"`
+	SubjectUniqueID asn1.BitString   `asn1:"optional,tag:2"`
+	Extensions      []pkix.Extension `asn1:"omitempty,optional,explicit,tag:3"`
+}
+
+// checkTBS applies the `checks` sanity checks to the DER encoded `tbs`
+// certificate to be signed with signature algorithm `alg`. The issuer must be
+// `issuer` unless empty.
+func checkTBS(tbs []byte, alg x509.SignatureAlgorithm, issuer string, checks TBSChecks) error {
+	checkIssuer := issuer != "" && !checks.SkipIssuer
+	if checks.SkipStructure && checks.SkipSignatureAlgorithm && checks.SkipValidity && !checkIssuer {
+		return nil
+	}
+	var cert tbsCertificatePrefix
+	if _, err := asn1.Unmarshal(tbs, &cert); err != nil {
+		return status.Errorf(codes.InvalidArgument, "failed to parse TBS certificate: %v", err)
+	}
+	if !checks.SkipStructure {
+		var full tbsCertificate
+		rest, err := asn1.Unmarshal(tbs, &full)
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "malformed TBS certificate: %v", err)
+		}
+		if len(rest) != 0 {
+			return status.Errorf(codes.InvalidArgument, "TBS certificate is followed by %d bytes of trailing data", len(rest))
+		}
+		if full.Version < 0 || full.Version > 2 {
+			return status.Errorf(codes.InvalidArgument, "unsupported TBS certificate version %d", full.Version)
+		}
+	}
+	if !checks.SkipSignatureAlgorithm {
+		want, err := signatureAlgorithmIdentifier(alg)
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "%v", err)
+		}
+		if !cert.SignatureAlgorithm.Algorithm.Equal(want.Algorithm) {
+			return status.Errorf(codes.InvalidArgument, "TBS certificate signature algorithm %v does not match the requested %v (%v)", cert.SignatureAlgorithm.Algorithm, alg, want.Algorithm)
+		}
+	}
+	if !checks.SkipValidity && !cert.Validity.NotAfter.After(cert.Validity.NotBefore) {
+		return status.Errorf(codes.InvalidArgument, "certificate NotAfter %v is not after NotBefore %v", cert.Validity.NotAfter, cert.Validity.NotBefore)
+	}
+	if checkIssuer {
+		var rdns pkix.RDNSequence
+		if _, err := asn1.Unmarshal(cert.Issuer.FullBytes, &rdns); err != nil {
+			return status.Errorf(codes.InvalidArgument, "failed to parse TBS certificate issuer: %v", err)
+		}
+		if got := rdns.String(); got != issuer {
+			return status.Errorf(codes.InvalidArgument, "TBS certificate issuer %q does not match %q", got, issuer)
+		}
+	}
+	return nil
+}
+
+// checkEndorseTBS applies the `HSMConfig.TBSChecks` and the validity check of
+// `HSMConfig.MaxClockSkew` against `now` to the `tbs` certificate to be
+// endorsed by key `label` with signature algorithm `alg`.
+func (h *HSM) checkEndorseTBS(tbs []byte, alg x509.SignatureAlgorithm, label string, now time.Time) error {
+	if err := checkTBS(tbs, alg, h.config.Issuers[label], h.config.TBSChecks); err != nil {
+		return err
+	}
+	if h.maxClockSkew > 0 {
+		return checkValidity(tbs, now, h.maxClockSkew)
+	}
+	return nil
+}
+
+// auditEndorseCert records the endorsement of the `tbs` certificate with
+// `params` into the DER encoded `cert` for the audit log, which failed with
+// `err` unless nil.
+func (h *HSM) auditEndorseCert(op string, tbs, cert []byte, params EndorseCertParams, err error) {
+	serial, subject := auditCertInfo(tbs)
+	h.auditCert(op, serial, subject, cert, params, err)
+}
+
+// auditCert records the issuance of the DER encoded `der` certificate with
+// serial number `serial` and subject `subject` with `params` for the audit
+// log, which failed with `err` unless nil.
+func (h *HSM) auditCert(op string, serial *big.Int, subject string, der []byte, params EndorseCertParams, err error) {
+	label, lerr := h.keyLabel(params)
+	if lerr != nil {
+		label = params.KeyLabel
+	}
+	r := AuditRecord{
+		Op:           op,
+		KeyLabels:    []string{label},
+		KeyID:        params.KeyID,
+		SKU:          params.SKU,
+		SerialNumber: serial,
+		Subject:      subject,
+		Err:          err,
+	}
+	if err == nil && der != nil {
+		fp := sha256.Sum256(der)
+		r.Fingerprint = fp[:]
+	}
+	h.audit(r)
+}
+
+func (h *HSM) EndorseCert(ctx context.Context, tbs []byte, params EndorseCertParams) (cert []byte, err error) {
+	defer func() {
+		h.auditEndorseCert("EndorseCert", tbs, cert, params, err)
+	}()
+	if err := h.checkWritable("EndorseCert"); err != nil {
+		return nil, err
+	}
+	label, err := h.keyLabel(params)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.checkEndorseTBS(tbs, params.SignatureAlgorithm, label, time.Now()); err != nil {
+		return nil, err
+	}
+
+	return withSession(ctx, h, "EndorseCert", func(session *pk11.Session) ([]byte, error) {
+		key, err := h.findSigningKey(session, label, params.KeyID)
+		if err != nil {
+			return nil, err
+		}
+		cert, err := signTBSWithKey(key, tbs, params.SignatureAlgorithm, !params.AllowHighS)
+		if err != nil || params.SkipVerify {
+			return cert, err
+		}
+		pub, err := h.findVerificationKey(session, label, params.KeyID)
+		if err != nil {
+			return nil, err
+		}
+		if err := verifyEndorsedCert(pub, cert, params.SignatureAlgorithm); err != nil {
+			return nil, err
+		}
+		return cert, nil
+	})
+}
+
+// findVerificationKey returns the public key with ID `keyID`, or labeled
+// `label` if `keyID` is empty, used to verify the certificates endorsed by the
+// private key with the same ID or label. Returns nil if the HSM does not hold
+// the public key, e.g. for an imported private key.
+func (h *HSM) findVerificationKey(session *pk11.Session, label string, keyID []byte) (crypto.PublicKey, error) {
+	var key pk11.PublicKey
+	if len(keyID) != 0 {
+		var err error
+		key, err = session.FindPublicKey(keyID)
+		if errors.Is(err, pk11.ErrObjectNotFound) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to find key object %q: %w", keyID, err)
+		}
+	} else {
+		if !h.keyIDs.has(pk11.ClassPublicKey, label) {
+			exists, err := session.HasKeyWithLabel(pk11.ClassPublicKey, label)
+			if err != nil {
+				return nil, fmt.Errorf("failed to look up public key %q: %w", label, err)
+			}
+			if !exists {
+				return nil, nil
+			}
+		}
+		var err error
+		key, err = findCachedKey(h, session, pk11.ClassPublicKey, label, session.FindPublicKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+	pub, err := key.ExportKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to export public key %q: %w", label, err)
+	}
+	return pub, nil
+}
+
+// verifyEndorsedCert checks that the DER encoded certificate `der` parses and
+// that its TBS certificate declares signature algorithm `alg`, which catches
+// TBS certificates truncated or mislabeled by the caller. The signature is
+// verified against `pub` unless nil. Returns `codes.InvalidArgument` on any
+// mismatch.
+func verifyEndorsedCert(pub crypto.PublicKey, der []byte, alg x509.SignatureAlgorithm) error {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "endorsed certificate does not parse, the TBS certificate may be malformed or truncated: %v", err)
+	}
+	var tbs tbsCertificatePrefix
+	if _, err := asn1.Unmarshal(cert.RawTBSCertificate, &tbs); err != nil {
+		return status.Errorf(codes.InvalidArgument, "failed to parse TBS certificate: %v", err)
+	}
+	want, err := signatureAlgorithmIdentifier(alg)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	if !tbs.SignatureAlgorithm.Algorithm.Equal(want.Algorithm) {
+		return status.Errorf(codes.InvalidArgument, "TBS certificate signature algorithm %v does not match the requested %v (%v)", tbs.SignatureAlgorithm.Algorithm, alg, want.Algorithm)
+	}
+	if pub == nil {
+		return nil
+	}
+
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		// Also covers the SHA-3 algorithms, which `crypto/x509` does not
+		// support.
+		hash, herr := hashFromSignatureAlgorithm(alg)
+		if herr != nil {
+			return status.Errorf(codes.InvalidArgument, "%v", herr)
+		}
+		h := hash.New()
+		h.Write(cert.RawTBSCertificate)
+		if !ecdsa.VerifyASN1(pub, h.Sum(nil), cert.Signature) {
+			err = fmt.Errorf("ECDSA verification failure")
+		}
+	default:
+		err = (&x509.Certificate{PublicKey: pub}).CheckSignature(alg, cert.RawTBSCertificate, cert.Signature)
+	}
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "endorsed certificate signature does not verify against the endorsement key: %v", err)
+	}
+	return nil
+}
+
+// BatchEndorseError is returned by `BatchEndorseCert` when endorsing one of
+// the certificates failed.
+type BatchEndorseError struct {
+	// Index is the index of the certificate that failed.
+	Index int
+	// Err is the endorsement error.
+	Err error
+}
+
+func (e *BatchEndorseError) Error() string {
+	return fmt.Sprintf("failed to endorse certificate %d: %v", e.Index, e.Err)
+}
+
+func (e *BatchEndorseError) Unwrap() error {
+	return e.Err
+}
+
+// GRPCStatus implements the interface used by `status.FromError`, keeping the
+// code of `Err`.
+func (e *BatchEndorseError) GRPCStatus() *status.Status {
+	return status.New(status.Code(e.Err), e.Error())
+}
+
+// BatchEndorseCert endorses each of the DER encoded `tbsList` certificates
+// like `EndorseCert`, and returns the DER encoded certificates in the same
+// order.
+//
+// All certificates are endorsed within a single session checkout, and the
+// signing key is only looked up once. The difference with calling
+// `EndorseCert` in a loop can be measured on the target HSM with
+// `TestBatchEndorseCertThroughput`, which endorses 100 certificates both ways:
+//
+//	bazel test //src/spm/services:se_pk11_test --define gotags=loadtest \
+//	  --test_filter=TestBatchEndorseCertThroughput --test_output=all
+//
+// Endorsement stops at the first failure: the certificates endorsed so far
+// are returned along with a `*BatchEndorseError` holding the index of the
+// failed certificate. Each endorsed certificate and the failed one are
+// recorded for the audit log like with `EndorseCerts`.
+func (h *HSM) BatchEndorseCert(ctx context.Context, tbsList [][]byte, params EndorseCertParams) (certs [][]byte, err error) {
+	defer func() {
+		var batchErr *BatchEndorseError
+		switch {
+		case errors.As(err, &batchErr):
+			for i, cert := range certs {
+				h.auditEndorseCert("BatchEndorseCert", tbsList[i], cert, params, nil)
+			}
+			h.auditEndorseCert("BatchEndorseCert", tbsList[batchErr.Index], nil, params, batchErr.Err)
+		default:
+			for i, tbs := range tbsList {
+				var cert []byte
+				if i < len(certs) {
+					cert = certs[i]
+				}
+				h.auditEndorseCert("BatchEndorseCert", tbs, cert, params, err)
+			}
+		}
+	}()
+	if err := h.checkWritable("BatchEndorseCert"); err != nil {
+		return nil, err
+	}
+	label, err := h.keyLabel(params)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for i, tbs := range tbsList {
+		if err := h.checkEndorseTBS(tbs, params.SignatureAlgorithm, label, now); err != nil {
+			return nil, &BatchEndorseError{Index: i, Err: err}
+		}
+	}
+
+	return withSession(ctx, h, "BatchEndorseCert", func(session *pk11.Session) ([][]byte, error) {
+		key, err := h.findSigningKey(session, label, params.KeyID)
+		if err != nil {
+			return nil, err
+		}
+		var pub crypto.PublicKey
+		if !params.SkipVerify {
+			if pub, err = h.findVerificationKey(session, label, params.KeyID); err != nil {
+				return nil, err
+			}
+		}
+		certs := make([][]byte, 0, len(tbsList))
+		for i, tbs := range tbsList {
+			cert, err := signTBSWithKey(key, tbs, params.SignatureAlgorithm, !params.AllowHighS)
+			if err == nil && !params.SkipVerify {
+				err = verifyEndorsedCert(pub, cert, params.SignatureAlgorithm)
+			}
+			if err != nil {
+				return certs, &BatchEndorseError{Index: i, Err: err}
+			}
+			certs = append(certs, cert)
+		}
+		return certs, nil
+	})
+}
+
+// endorsementKeyRef identifies the signing key of an `EndorseCerts` request by
+// its label and ID.
+type endorsementKeyRef struct {
+	label string
+	id    string
+}
+
+// endorsementKey is a signing key looked up by `EndorseCerts`, along with the
+// public key verifying its certificates.
+type endorsementKey struct {
+	key pk11.PrivateKey
+	// pub is the verification key, or nil if the HSM does not hold it. Only
+	// looked up once a certificate to verify is endorsed with the key.
+	pub crypto.PublicKey
+	// pubFound is set once `pub` was looked up.
+	pubFound bool
+}
+
+// EndorseCerts endorses each of the `reqs` certificates like `EndorseCert`,
+// with their own parameters, and returns the results in the same order.
+//
+// All certificates are endorsed within a single session checkout, and each
+// distinct signing key is only looked up once, which saves most of the
+// per-certificate overhead of calling `EndorseCert` for the few certificates
+// of a device. The difference can be measured on the target HSM with
+// `TestEndorseCertsThroughput`.
+//
+// If `failFast` is set, endorsement stops at the first failure: the results
+// so far are returned along with a `*BatchEndorseError` holding the index of
+// the failed certificate. Otherwise, every certificate is endorsed, and the
+// failures are reported in `EndorseCertResult.Err`. The returned error is then
+// only set if no certificate could be endorsed, e.g. when no session is
+// available.
+func (h *HSM) EndorseCerts(ctx context.Context, reqs []EndorseCertParamsWithTBS, failFast bool) (results []EndorseCertResult, err error) {
+	defer func() {
+		var batchErr *BatchEndorseError
+		switch {
+		case errors.As(err, &batchErr):
+			for i, r := range results {
+				h.auditEndorseCert("EndorseCerts", reqs[i].TBS, r.Cert, reqs[i].EndorseCertParams, r.Err)
+			}
+			h.auditEndorseCert("EndorseCerts", reqs[batchErr.Index].TBS, nil, reqs[batchErr.Index].EndorseCertParams, batchErr.Err)
+		case err != nil:
+			for _, r := range reqs {
+				h.auditEndorseCert("EndorseCerts", r.TBS, nil, r.EndorseCertParams, err)
+			}
+		default:
+			for i, r := range results {
+				h.auditEndorseCert("EndorseCerts", reqs[i].TBS, r.Cert, reqs[i].EndorseCertParams, r.Err)
+			}
+		}
+	}()
+	if err := h.checkWritable("EndorseCerts"); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	return withSession(ctx, h, "EndorseCerts", func(session *pk11.Session) ([]EndorseCertResult, error) {
+		keys := make(map[endorsementKeyRef]*endorsementKey)
+		// endorse endorses the certificate of `r`, looking up its signing and
+		// verification keys unless already known.
+		endorse := func(r EndorseCertParamsWithTBS) ([]byte, error) {
+			label, err := h.keyLabel(r.EndorseCertParams)
+			if err != nil {
+				return nil, err
+			}
+			if err := h.checkEndorseTBS(r.TBS, r.SignatureAlgorithm, label, now); err != nil {
+				return nil, err
+			}
+			ref := endorsementKeyRef{label: label, id: string(r.KeyID)}
+			k, ok := keys[ref]
+			if !ok {
+				key, err := h.findSigningKey(session, label, r.KeyID)
+				if err != nil {
+					return nil, err
+				}
+				k = &endorsementKey{key: key}
+				keys[ref] = k
+			}
+			cert, err := signTBSWithKey(k.key, r.TBS, r.SignatureAlgorithm, !r.AllowHighS)
+			if err != nil || r.SkipVerify {
+				return cert, err
+			}
+			if !k.pubFound {
+				if k.pub, err = h.findVerificationKey(session, label, r.KeyID); err != nil {
+					return nil, err
+				}
+				k.pubFound = true
+			}
+			if err := verifyEndorsedCert(k.pub, cert, r.SignatureAlgorithm); err != nil {
+				return nil, err
+			}
+			return cert, nil
+		}
+
+		results := make([]EndorseCertResult, 0, len(reqs))
+		for i, r := range reqs {
+			cert, err := endorse(r)
+			if err != nil && failFast {
+				return results, &BatchEndorseError{Index: i, Err: err}
+			}
+			results = append(results, EndorseCertResult{Cert: cert, Err: err})
+		}
+		return results, nil
+	})
+}
+
+// EndorseCSR issues a certificate for the subject and public key of the DER
+// encoded PKCS#10 `csrDER`, signed by the `params` key of the `params.Issuer`
+// CA, and returns it DER encoded.
+//
+// The CSR self-signature must verify. The certificate carries the serial
+// number and validity window of `params`, and the subject alternative names
+// requested in the CSR; other requested extensions are ignored. The subject
+// and public key fingerprint of the certificate are logged, and the issuance
+// is recorded for the audit log.
+//
+// If `params.SerialNumber` is nil, the serial number is allocated with
+// `params.NextSerial`, or generated with the HSM RNG like the serial numbers
+// of `BulkGenerateCertSerials`.
+func (h *HSM) EndorseCSR(ctx context.Context, csrDER []byte, params EndorseCSRParams) (cert []byte, err error) {
+	var (
+		csr    *x509.CertificateRequest
+		serial *big.Int
+	)
+	defer func() {
+		var subject string
+		if csr != nil {
+			subject = csr.Subject.String()
+		}
+		h.auditCert("EndorseCSR", serial, subject, cert, params.EndorseCertParams, err)
+	}()
+	if err := h.checkWritable("EndorseCSR"); err != nil {
+		return nil, err
+	}
+	csr, err = x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "failed to parse CSR: %v", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid CSR signature: %v", err)
+	}
+	if params.Issuer == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "missing issuer certificate")
+	}
+	serial = params.SerialNumber
+	if serial == nil && params.NextSerial != nil {
+		if serial, err = params.NextSerial(ctx); err != nil {
+			return nil, status.Errorf(codes.Unavailable, "failed to allocate serial number: %v", err)
+		}
+	}
+	if serial != nil {
+		if err := validateCertSerial(serial); err != nil {
+			return nil, err
+		}
+	}
+	if !params.NotAfter.After(params.NotBefore) {
+		return nil, status.Errorf(codes.InvalidArgument, "NotAfter %v is not after NotBefore %v", params.NotAfter, params.NotBefore)
+	}
+	label, err := h.keyLabel(params.EndorseCertParams)
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:       serial,
+		Subject:            csr.Subject,
+		NotBefore:          params.NotBefore,
+		NotAfter:           params.NotAfter,
+		SignatureAlgorithm: params.SignatureAlgorithm,
+		DNSNames:           csr.DNSNames,
+		EmailAddresses:     csr.EmailAddresses,
+		IPAddresses:        csr.IPAddresses,
+		URIs:               csr.URIs,
+	}
+	cert, err = withSession(ctx, h, "EndorseCSR", func(session *pk11.Session) ([]byte, error) {
+		key, err := h.findSigningKey(session, label, params.KeyID)
+		if err != nil {
+			return nil, err
+		}
+		if template.SerialNumber == nil {
+			b, err := session.GenerateRandom(certSerialSize)
+			if err != nil {
+				return nil, fmt.Errorf("failed to generate serial number: %w", err)
+			}
+			template.SerialNumber = certSerial(b)
+			serial = template.SerialNumber
+		}
+		cert, err := x509.CreateCertificate(rand.Reader, template, params.Issuer, csr.PublicKey, hsmSigner{key: key, pub: params.Issuer.PublicKey})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create certificate: %w", err)
+		}
+		return cert, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Endorsed CSR for subject %q, public key sha256:%x", csr.Subject, sha256.Sum256(csr.RawSubjectPublicKeyInfo))
+	return cert, nil
+}
+
+// SignCRL signs a DER encoded `tbsCertList` and returns the DER encoded
+// CertificateList. Returns `codes.InvalidArgument` if `tbsCertList` is not a
+// TBSCertList, or if its signature algorithm does not match
+// `params.SignatureAlgorithm`.
+func (h *HSM) SignCRL(ctx context.Context, tbsCertList []byte, params EndorseCertParams) (crl []byte, err error) {
+	defer func() {
+		h.auditCRL("SignCRL", tbsCertList, crl, params, err)
+	}()
+	if err := h.checkWritable("SignCRL"); err != nil {
+		return nil, err
+	}
+	if err := checkTBSCertList(tbsCertList, params.SignatureAlgorithm); err != nil {
+		return nil, err
+	}
+	return h.signTBS(ctx, "SignCRL", tbsCertList, params)
+}
+
+// checkTBSCertList checks that `tbs` is a DER encoded TBSCertList with
+// signature algorithm `alg`, so that the signed CRL parses and verifies.
+// Returns `codes.InvalidArgument` on any mismatch.
+func checkTBSCertList(tbs []byte, alg x509.SignatureAlgorithm) error {
+	var list tbsCertList
+	rest, err := asn1.Unmarshal(tbs, &list)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "malformed TBSCertList: %v", err)
+	}
+	if len(rest) != 0 {
+		return status.Errorf(codes.InvalidArgument, "TBSCertList is followed by %d bytes of trailing data", len(rest))
+	}
+	if list.Version < 0 || list.Version > 1 {
+		return status.Errorf(codes.InvalidArgument, "unsupported TBSCertList version %d", list.Version)
+	}
+	want, err := signatureAlgorithmIdentifier(alg)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	if !list.Signature.Algorithm.Equal(want.Algorithm) {
+		return status.Errorf(codes.InvalidArgument, "TBSCertList signature algorithm %v does not match the requested %v (%v)", list.Signature.Algorithm, alg, want.Algorithm)
+	}
+	return nil
+}
+
+// auditCRL records the signature of the `tbs` certificate list with `params`
+// into the DER encoded `crl` for the audit log, which failed with `err` unless
+// nil.
+func (h *HSM) auditCRL(op string, tbs, crl []byte, params EndorseCertParams, err error) {
+	number, issuer := auditCRLInfo(tbs)
+	h.auditCert(op, number, issuer, crl, params, err)
+}
+
+// CRL extension object identifiers, see
+// https://datatracker.ietf.org/doc/html/rfc5280#section-5.2.
+var (
+	oidExtensionAuthorityKeyID = asn1.ObjectIdentifier{2, 5, 29, 35}
+	oidExtensionCRLNumber      = asn1.ObjectIdentifier{2, 5, 29, 20}
+)
+
+// tbsCertList is the TBSCertList structure of RFC 5280. The issuer is kept in
+// its raw encoding so that it matches the subject of the CA certificate. The
+// version is absent from v1 lists.
+type tbsCertList struct {
+	Version             int `asn1:"optional"`
+	Signature           pkix.AlgorithmIdentifier
+	Issuer              asn1.RawValue
+	ThisUpdate          time.Time
+	NextUpdate          time.Time                 `asn1:"optional"`
+	RevokedCertificates []pkix.RevokedCertificate `asn1:"optional"`
+	Extensions          []pkix.Extension          `asn1:"tag:0,optional,explicit"`
+}
+
+// authorityKeyID is the AuthorityKeyIdentifier extension value, restricted to
+// the key identifier.
+type authorityKeyID struct {
+	ID []byte `asn1:"optional,tag:0"`
+}
+
+// crlSignatureAlgorithm returns the signature algorithm used to sign CRLs
+// with the key of `caCert`.
+func crlSignatureAlgorithm(caCert *x509.Certificate) (x509.SignatureAlgorithm, error) {
+	switch pub := caCert.PublicKey.(type) {
+	case *ecdsa.PublicKey:
+		switch pub.Curve {
+		case elliptic.P256():
+			return x509.ECDSAWithSHA256, nil
+		case elliptic.P384():
+			return x509.ECDSAWithSHA384, nil
+		case elliptic.P521():
+			return x509.ECDSAWithSHA512, nil
+		}
+	case *rsa.PublicKey:
+		return x509.SHA256WithRSAPSS, nil
+	case ed25519.PublicKey:
+		return x509.PureEd25519, nil
+	}
+	return x509.UnknownSignatureAlgorithm, fmt.Errorf("unsupported CA public key algorithm: %v", caCert.PublicKeyAlgorithm)
+}
+
+// newTBSCertList returns the DER encoded v2 TBSCertList issued by `caCert`
+// with signature algorithm `alg`.
+func newTBSCertList(caCert *x509.Certificate, alg x509.SignatureAlgorithm, revoked []pkix.RevokedCertificate, thisUpdate, nextUpdate time.Time) ([]byte, error) {
+	if caCert.KeyUsage&x509.KeyUsageCRLSign == 0 {
+		return nil, fmt.Errorf("CA certificate must have the cRLSign key usage")
+	}
+	if len(caCert.SubjectKeyId) == 0 {
+		return nil, fmt.Errorf("CA certificate has no subject key identifier")
+	}
+	if !nextUpdate.After(thisUpdate) {
+		return nil, fmt.Errorf("nextUpdate %v is not after thisUpdate %v", nextUpdate, thisUpdate)
+	}
+	sigAlg, err := signatureAlgorithmIdentifier(alg)
+	if err != nil {
+		return nil, err
+	}
+	aki, err := asn1.Marshal(authorityKeyID{ID: caCert.SubjectKeyId})
+	if err != nil {
+		return nil, err
+	}
+	// CRL numbers must increase monotonically, which is guaranteed by using
+	// the issuance time.
+	crlNumber, err := asn1.Marshal(big.NewInt(thisUpdate.Unix()))
+	if err != nil {
+		return nil, err
+	}
+	// Revocation times must be encoded in UTC.
+	entries := make([]pkix.RevokedCertificate, len(revoked))
+	for i, rc := range revoked {
+		rc.RevocationTime = rc.RevocationTime.UTC()
+		entries[i] = rc
+	}
+	return asn1.Marshal(tbsCertList{
+		Version:             1, // v2
+		Signature:           sigAlg,
+		Issuer:              asn1.RawValue{FullBytes: caCert.RawSubject},
+		ThisUpdate:          thisUpdate.UTC(),
+		NextUpdate:          nextUpdate.UTC(),
+		RevokedCertificates: entries,
+		Extensions: []pkix.Extension{
+			{Id: oidExtensionAuthorityKeyID, Value: aki},
+			{Id: oidExtensionCRLNumber, Value: crlNumber},
+		},
+	})
+}
+
+// GenerateCRL issues a DER encoded CRL revoking the `revoked` certificates,
+// signed by the `KCAPriv` private key of the `caCert` CA.
+//
+// The signature algorithm is derived from the CA public key: ECDSA with the
+// hash matching the curve, RSA-PSS with SHA-256, or Ed25519. The CRL carries
+// the authority key identifier of `caCert`, and a CRL number derived from
+// `thisUpdate`.
+func (h *HSM) GenerateCRL(ctx context.Context, caCert *x509.Certificate, revoked []pkix.RevokedCertificate, thisUpdate, nextUpdate time.Time) (crl []byte, err error) {
+	params := EndorseCertParams{KeyLabel: "KCAPriv"}
+	var tbs []byte
+	defer func() {
+		h.auditCRL("GenerateCRL", tbs, crl, params, err)
+	}()
+	if err := h.checkWritable("GenerateCRL"); err != nil {
+		return nil, err
+	}
+	params.SignatureAlgorithm, err = crlSignatureAlgorithm(caCert)
+	if err != nil {
+		return nil, err
+	}
+	tbs, err = newTBSCertList(caCert, params.SignatureAlgorithm, revoked, thisUpdate, nextUpdate)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build CRL: %w", err)
+	}
+	return h.signTBS(ctx, "GenerateCRL", tbs, params)
+}
+
+// hsmSigner is a `crypto.Signer` backed by an HSM private key, as required by
+// `ocsp.CreateResponse` and `x509.CreateCertificate`. Only valid while the
+// session of `key` is checked out. ECDSA signatures are normalized to low-S
+// form.
+type hsmSigner struct {
+	key pk11.PrivateKey
+	pub crypto.PublicKey
+}
+
+func (s hsmSigner) Public() crypto.PublicKey {
+	return s.pub
+}
+
+func (s hsmSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	switch pub := s.pub.(type) {
+	case *ecdsa.PublicKey:
+		rb, sb, err := s.key.SignECDSAPreHashed(digest)
+		if err != nil {
+			return nil, err
+		}
+		var sig struct{ R, S *big.Int }
+		sig.R, sig.S = new(big.Int).SetBytes(rb), new(big.Int).SetBytes(sb)
+		pk11.LowS(pub.Curve, sig.S)
+		return asn1.Marshal(sig)
+	case *rsa.PublicKey:
+		if pss, ok := opts.(*rsa.PSSOptions); ok {
+			return s.key.SignRSAPSSPreHashed(pss, digest)
+		}
+		return s.key.SignRSAPKCS1v15PreHashed(opts.HashFunc(), digest)
+	case ed25519.PublicKey:
+		// Ed25519 signs the message itself, passed in place of the digest.
+		return s.key.SignEd25519(digest)
+	default:
+		return nil, fmt.Errorf("unsupported signing key type: %T", s.pub)
+	}
+}
+
+// SignOCSPResponse issues a DER encoded OCSP response for the certificate
+// status described by `template`, signed by the `keyLabel` private key. The
+// `KCAPriv` key is used if `keyLabel` is empty.
+//
+// The response is signed by the `issuer` CA itself, unless
+// `template.Certificate` is set to a delegated OCSP responder certificate
+// issued by `issuer`, in which case `keyLabel` must be the responder key and
+// the certificate is included in the response. ECDSA responder keys sign with
+// the hash matching their curve, and RSA keys with SHA-256, unless
+// `template.SignatureAlgorithm` is set.
+func (h *HSM) SignOCSPResponse(ctx context.Context, template *ocsp.Response, issuer *x509.Certificate, keyLabel string) ([]byte, error) {
+	if err := h.checkWritable("SignOCSPResponse"); err != nil {
+		return nil, err
+	}
+	if keyLabel == "" {
+		keyLabel = "KCAPriv"
+	}
+	responder := issuer
+	if template.Certificate != nil {
+		responder = template.Certificate
+	}
+	return withSession(ctx, h, "SignOCSPResponse", func(session *pk11.Session) ([]byte, error) {
+		key, err := h.findPrivateKey(session, keyLabel)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := ocsp.CreateResponse(issuer, responder, *template, hsmSigner{key: key, pub: responder.PublicKey})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create OCSP response: %w", err)
+		}
+		return resp, nil
+	})
+}
+
+// keyLabel returns the label of the signing key selected by `params`: the CA
+// key of `params.SKU` if set, or `params.KeyLabel`. Fails with
+// `codes.NotFound` if no CA key is configured for the SKU.
+func (h *HSM) keyLabel(params EndorseCertParams) (string, error) {
+	if params.SKU == "" {
+		return params.KeyLabel, nil
+	}
+	label, ok := h.config.CAKeys[params.SKU]
+	if !ok {
+		return "", status.Errorf(codes.NotFound, "no CA key configured for SKU %q", params.SKU)
+	}
+	return label, nil
+}
+
+// signTBS signs a DER encoded `tbs` structure and returns the DER encoding of
+// the signed structure. Certificates and CRLs share the same layout:
+//
+//	SEQUENCE {
+//	  tbs                 ANY,
+//	  signatureAlgorithm  AlgorithmIdentifier,
+//	  signatureValue      BIT STRING
+//	}
+func (h *HSM) signTBS(ctx context.Context, op string, tbs []byte, params EndorseCertParams) ([]byte, error) {
+	label, err := h.keyLabel(params)
+	if err != nil {
+		return nil, err
+	}
+	return withSession(ctx, h, op, func(session *pk11.Session) ([]byte, error) {
+		key, err := h.findSigningKey(session, label, params.KeyID)
+		if err != nil {
+			return nil, err
+		}
+		return signTBSWithKey(key, tbs, params.SignatureAlgorithm, !params.AllowHighS)
+	})
+}
+
+// findPrivateKey returns the private key object labeled `keyLabel`.
+func (h *HSM) findPrivateKey(session *pk11.Session, keyLabel string) (pk11.PrivateKey, error) {
+	return findCachedKey(h, session, pk11.ClassPrivateKey, keyLabel, session.FindPrivateKey)
+}
+
+// findSigningKey returns the private key with ID `keyID`, or labeled `label`
+// if `keyID` is empty. If both are set, the key must carry the label, so that
+// a key ID cannot select a key outside of those allowed by the label.
+func (h *HSM) findSigningKey(session *pk11.Session, label string, keyID []byte) (pk11.PrivateKey, error) {
+	if len(keyID) == 0 {
+		return h.findPrivateKey(session, label)
+	}
+	key, err := session.FindPrivateKey(keyID)
+	if errors.Is(err, pk11.ErrObjectNotFound) {
+		return pk11.PrivateKey{}, status.Errorf(codes.NotFound, "no private key with ID %x", keyID)
+	}
+	if err != nil {
+		return pk11.PrivateKey{}, fmt.Errorf("failed to find key object %q: %w", keyID, err)
+	}
+	if label != "" {
+		keyLabel, err := key.Label()
+		if err != nil {
+			return pk11.PrivateKey{}, fmt.Errorf("failed to read label of key %x: %w", keyID, err)
+		}
+		if keyLabel != label {
+			return pk11.PrivateKey{}, status.Errorf(codes.InvalidArgument, "key with ID %x is labeled %q, not %q", keyID, keyLabel, label)
+		}
+	}
+	return key, nil
+}
+
+// findCachedKey returns the key object of class `class` labeled `label`,
+// found with `find` by its UID in the `h.keyIDs` cache. If a cached UID no
+// longer resolves, e.g. because the key was destroyed and created again by
+// another client, the entry is dropped and the label is looked up once more.
+func findCachedKey[T any](h *HSM, session *pk11.Session, class pk11.ClassAttribute, label string, find func(uid []byte) (T, error)) (T, error) {
+	for retry := true; ; retry = false {
+		keyID, cached, err := h.keyIDs.get(session, class, label)
+		if err != nil {
+			var zero T
+			return zero, fmt.Errorf("fail to find key with label: %q, error: %w", label, err)
+		}
+		key, err := find(keyID)
+		if retry && cached && errors.Is(err, pk11.ErrObjectNotFound) {
+			h.keyIDs.invalidate(class, label)
+			continue
+		}
+		if err != nil {
+			return key, fmt.Errorf("failed to find key object %q: %w", keyID, err)
+		}
+		return key, nil
+	}
+}
+
+// ecdsaCurveHashSizes are the digest sizes in bytes of the hashes matching
+// the strength of the supported ECDSA curves.
+var ecdsaCurveHashSizes = map[string]int{
+	"P-256": 32,
+	"P-384": 48,
+	"P-521": 64,
+}
+
+// ecdsaHashMatchesCurve reports whether `hash` matches the strength of
+// `curve`. SHA-2 and SHA-3 hashes of the same size are both accepted.
+func ecdsaHashMatchesCurve(curve elliptic.Curve, hash crypto.Hash) bool {
+	size, ok := ecdsaCurveHashSizes[curve.Params().Name]
+	return ok && hash.Size() == size
+}
+
+// checkECDSACurve returns the curve of the ECDSA `key` and the hash of the
+// ECDSA signature algorithm `alg`. Returns a `codes.InvalidArgument` error if
+// the hash does not match the curve, e.g. SHA-256 with a P-384 key, which
+// verifiers may reject.
+func checkECDSACurve(key pk11.PrivateKey, alg x509.SignatureAlgorithm) (elliptic.Curve, crypto.Hash, error) {
+	hash, err := hashFromSignatureAlgorithm(alg)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get hash from signature algorithm: %w", err)
+	}
+	curve, err := key.Curve()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get signing key curve: %w", err)
+	}
+	if !ecdsaHashMatchesCurve(curve, hash) {
+		return nil, 0, status.Errorf(codes.InvalidArgument, "signature algorithm %v does not match the %s curve of the signing key", alg, curve.Params().Name)
+	}
+	return curve, hash, nil
 }
 
-// openSessions opens `numSessions` sessions on the HSM `tokSlot` slot number.
-// Logs in as crypto user with `hsmPW` password. Connects via PKCS#11 shared
-// library in `soPath`.
-func openSessions(soPath, hsmPW string, tokSlot, numSessions int) (*sessionQueue, error) {
-	mod, err := pk11.Load(soPath)
+// signECDSAWithKey signs `data` hashed with `hash` with the ECDSA `key` on
+// `curve`, and returns the ASN.1 DER encoded signature. The signature is
+// normalized to low-S form if `lowS` is set. See `checkECDSACurve`.
+func signECDSAWithKey(key pk11.PrivateKey, curve elliptic.Curve, hash crypto.Hash, data []byte, lowS bool) ([]byte, error) {
+	rb, sb, err := key.SignECDSA(hash, data)
 	if err != nil {
-		return nil, fmt.Errorf("fail to load pk11: %v", err)
+		return nil, fmt.Errorf("failed to sign: %w", err)
 	}
-	toks, err := mod.Tokens()
-	if err != nil {
-		return nil, fmt.Errorf("failed to open tokens: %v", err)
+
+	var sig struct{ R, S *big.Int }
+	sig.R, sig.S = new(big.Int).SetBytes(rb), new(big.Int).SetBytes(sb)
+	if lowS {
+		pk11.LowS(curve, sig.S)
 	}
-	if tokSlot >= len(toks) {
-		return nil, fmt.Errorf("fail to find slot number: %v", err)
+	s, err := asn1.Marshal(sig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal signature: %w", err)
 	}
+	return s, nil
+}
 
-	sessions := newSessionQueue(numSessions)
-	for i := 0; i < numSessions; i++ {
-		s, err := toks[tokSlot].OpenSession()
+// signTBSWithKey signs `tbs` with `key` using signature algorithm `alg`.
+// ECDSA signatures are normalized to low-S form if `lowS` is set. See
+// `signTBS`.
+func signTBSWithKey(key pk11.PrivateKey, tbs []byte, alg x509.SignatureAlgorithm, lowS bool) ([]byte, error) {
+	// Unsupported algorithms fail below.
+	if want := signatureKeyAlgorithm(alg); want != x509.UnknownPublicKeyAlgorithm {
+		keyAlg, err := key.Algorithm()
 		if err != nil {
-			return nil, fmt.Errorf("fail to open session to HSM: %v", err)
+			return nil, fmt.Errorf("failed to get signing key type: %w", err)
+		}
+		if keyAlg != want {
+			return nil, status.Errorf(codes.InvalidArgument, "signature algorithm %v requires a %v key, the signing key is %v", alg, want, keyAlg)
 		}
+	}
 
-		err = s.Login(pk11.NormalUser, hsmPW)
+	var s []byte
+	var err error
+	pssHash, isPSS := pssHashFromSignatureAlgorithm(alg)
+	pkcs1Hash, isPKCS1 := pkcs1v15HashFromSignatureAlgorithm(alg)
+	switch {
+	case alg == x509.PureEd25519:
+		// Ed25519 signs the message directly and its signature is stored as
+		// is in the signature value.
+		s, err = key.SignEd25519(tbs)
 		if err != nil {
-			return nil, fmt.Errorf("fail to login into the HSM: %v", err)
+			return nil, fmt.Errorf("failed to sign: %w", err)
 		}
-
-		err = sessions.insert(s)
+	case isPSS:
+		s, err = key.SignRSAPSS(&rsa.PSSOptions{
+			SaltLength: rsa.PSSSaltLengthEqualsHash,
+			Hash:       pssHash,
+		}, tbs)
+		if err != nil {
+			return nil, fmt.Errorf("failed to sign: %w", err)
+		}
+	case isPKCS1:
+		s, err = key.SignRSAPKCS1v15(pkcs1Hash, tbs)
+		if err != nil {
+			return nil, fmt.Errorf("failed to sign: %w", err)
+		}
+	default:
+		curve, hash, err := checkECDSACurve(key, alg)
+		if err != nil {
+			return nil, err
+		}
+		s, err = signECDSAWithKey(key, curve, hash, tbs, lowS)
 		if err != nil {
-			return nil, fmt.Errorf("failed to enqueue session: %v", err)
+			return nil, err
 		}
 	}
-	return sessions, nil
+
+	return marshalSigned(tbs, alg, s)
 }
 
-// getKeyIDByLabel returns the object ID from a given label
-func getKeyIDByLabel(session *pk11.Session, classKeyType pk11.ClassAttribute, label string) ([]byte, error) {
-	keyObj, err := session.FindKeyByLabel(classKeyType, label)
+// marshalSigned returns the DER encoding of the `tbs` structure signed with
+// signature `sig` of algorithm `alg`. See `signTBS` for the layout.
+func marshalSigned(tbs []byte, alg x509.SignatureAlgorithm, sig []byte) ([]byte, error) {
+	sigAlg, err := signatureAlgorithmIdentifier(alg)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to get signature algorithm identifier: %w", err)
 	}
 
-	id, err := keyObj.UID()
-	if err != nil {
-		return nil, err
+	signedRaw := struct {
+		TBS                asn1.RawValue
+		SignatureAlgorithm pkix.AlgorithmIdentifier
+		SignatureValue     asn1.BitString
+	}{
+		TBS:                asn1.RawValue{FullBytes: tbs},
+		SignatureAlgorithm: sigAlg,
+		SignatureValue:     asn1.BitString{Bytes: sig, BitLength: len(sig) * 8},
 	}
-	if id == nil {
-		return nil, fmt.Errorf("fail to find ID attribute")
+	signed, err := asn1.Marshal(signedRaw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal signed structure: %w", err)
 	}
-	return id, nil
+	return signed, nil
 }
 
-// NewHSM creates a new instance of HSM, with dedicated session and keys.
-func NewHSM(cfg HSMConfig) (*HSM, error) {
-	sq, err := openSessions(cfg.SOPath, cfg.HSMPassword, cfg.SlotID, cfg.NumSessions)
-	if err != nil {
-		return nil, fmt.Errorf("fail to get session: %v", err)
+func (h *HSM) EndorseData(ctx context.Context, data []byte, params EndorseCertParams) ([]byte, []byte, error) {
+	if err := h.checkWritable("EndorseData"); err != nil {
+		return nil, nil, err
 	}
 
-	hsm := &HSM{
-		sessions: sq,
-	}
+	var asn1EcdsaPublicKey []byte
+	asn1Sig, err := withSession(ctx, h, "EndorseData", func(session *pk11.Session) ([]byte, error) {
+		// Get the PKCS#11 private key object.
+		privateKey, err := h.findSigningKey(session, params.KeyLabel, params.KeyID)
+		if err != nil {
+			return nil, err
+		}
 
-	session, release := hsm.sessions.getHandle()
-	defer release()
+		// Export the public key from the PKCS#11 private key object.
+		publicKeyHandle, err := privateKey.FindPublicKey()
+		if err != nil {
+			return nil, fmt.Errorf("failed to find public key on SE: %w", err)
+		}
+		publicKey, err := publicKeyHandle.ExportKey()
+		if err != nil {
+			return nil, fmt.Errorf("failed to export public key from SE: %w", err)
+		}
+		pub, ok := publicKey.(*ecdsa.PublicKey)
+		if !ok {
+			return nil, status.Errorf(codes.InvalidArgument, "EndorseData requires an ECDSA key, got %T", publicKey)
+		}
+		var ecdsaPubKey struct{ X, Y *big.Int }
+		ecdsaPubKey.X, ecdsaPubKey.Y = new(big.Int), new(big.Int)
+		ecdsaPubKey.X.Set(pub.X)
+		ecdsaPubKey.Y.Set(pub.Y)
+		asn1EcdsaPublicKey, err = asn1.Marshal(ecdsaPubKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal public key: %w", err)
+		}
 
-	hsm.SymmetricKeys = make(map[string][]byte)
-	for _, key := range cfg.SymmetricKeys {
-		id, err := getKeyIDByLabel(session, pk11.ClassSecretKey, key)
+		// Sign the hash of the data payload.
+		curve, hash, err := checkECDSACurve(privateKey, params.SignatureAlgorithm)
 		if err != nil {
-			return nil, fmt.Errorf("fail to find symmetric key ID: %q, error: %v", key, err)
+			return nil, err
 		}
-		hsm.SymmetricKeys[key] = id
+		return signECDSAWithKey(privateKey, curve, hash, data, !params.AllowHighS)
+	})
+	if err != nil {
+		return nil, nil, err
 	}
+	return asn1EcdsaPublicKey, asn1Sig, nil
+}
+
+// BatchSignError is returned by `SignBatch` when signing some of the items
+// failed.
+type BatchSignError struct {
+	// Errs contains the error of each item, or nil for items signed
+	// successfully.
+	Errs []error
+}
 
-	hsm.PrivateKeys = make(map[string][]byte)
-	for _, key := range cfg.PrivateKeys {
-		id, err := getKeyIDByLabel(session, pk11.ClassPrivateKey, key)
+func (e *BatchSignError) Error() string {
+	var failed []string
+	for i, err := range e.Errs {
 		if err != nil {
-			return nil, fmt.Errorf("fail to find private key ID: %q, error: %v", key, err)
+			failed = append(failed, fmt.Sprintf("item %d: %v", i, err))
 		}
-		hsm.PrivateKeys[key] = id
+	}
+	return fmt.Sprintf("failed to sign %d of %d items: %s", len(failed), len(e.Errs), strings.Join(failed, "; "))
+}
+
+// SignBatch signs each of the `items` with the ECDSA private key `keyLabel`
+// and returns their ASN.1 DER encoded signatures, in the same order.
+//
+// All items are signed within a single session checkout, and the key is only
+// looked up once, avoiding the per-item overhead of calling `EndorseData` in
+// a loop. The difference can be measured on the target HSM with
+// `TestSignBatchThroughput`, which signs 100 items both ways:
+//
+//	bazel test //src/spm/services:se_pk11_test --define gotags=loadtest \
+//	  --test_filter=TestSignBatchThroughput --test_output=all
+//
+// The hash of `alg` must match the curve of the key, and the signatures are
+// normalized to low-S form, as in `EndorseData`. Failed items have a nil
+// signature, and are reported in the returned `*BatchSignError`.
+func (h *HSM) SignBatch(ctx context.Context, keyLabel string, alg x509.SignatureAlgorithm, items [][]byte) ([][]byte, error) {
+	if err := h.checkWritable("SignBatch"); err != nil {
+		return nil, err
 	}
 
-	hsm.PublicKeys = make(map[string][]byte)
-	for _, key := range cfg.PublicKeys {
-		id, err := getKeyIDByLabel(session, pk11.ClassPublicKey, key)
+	return withSession(ctx, h, "SignBatch", func(session *pk11.Session) ([][]byte, error) {
+		key, err := h.findPrivateKey(session, keyLabel)
 		if err != nil {
-			return nil, fmt.Errorf("fail to find public key ID: %q, error: %v", key, err)
+			return nil, err
+		}
+		curve, hash, err := checkECDSACurve(key, alg)
+		if err != nil {
+			return nil, err
 		}
-		hsm.PublicKeys[key] = id
-	}
 
-	return hsm, nil
+		sigs := make([][]byte, len(items))
+		errs := make([]error, len(items))
+		failed := false
+		for i, item := range items {
+			sigs[i], errs[i] = signECDSAWithKey(key, curve, hash, item, true)
+			if errs[i] != nil {
+				failed = true
+			}
+		}
+		if failed {
+			return sigs, &BatchSignError{Errs: errs}
+		}
+		return sigs, nil
+	})
 }
 
-type CmdFunc func(*pk11.Session) error
+// ExportPublicKey exports the public key identified by `keyLabel` on the HSM.
+// The result is a *rsa.PublicKey or *ecdsa.PublicKey.
+func (h *HSM) ExportPublicKey(ctx context.Context, keyLabel string) (any, error) {
+	return withSession(ctx, h, "ExportPublicKey", func(session *pk11.Session) (any, error) {
+		keyID, err := getKeyIDByLabel(session, pk11.ClassPublicKey, keyLabel)
+		if err != nil {
+			return nil, fmt.Errorf("fail to find key with label: %q, error: %w", keyLabel, err)
+		}
+		key, err := session.FindPublicKey(keyID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find key object %q: %w", keyID, err)
+		}
+		pub, err := key.ExportKey()
+		if err != nil {
+			return nil, fmt.Errorf("failed to export public key: %w", err)
+		}
+		return pub, nil
+	})
+}
 
-// ExecuteCmd executes a command with a session handle in a thread safe way.
-func (h *HSM) ExecuteCmd(cmd CmdFunc) error {
-	session, release := h.sessions.getHandle()
-	defer release()
-	return cmd(session)
+// RSAParams selects an RSA key pair in `GenerateAndStoreKeyPair`.
+type RSAParams struct {
+	// ModBits is the size of the modulus in bits.
+	ModBits uint
+	// PubExp is the public exponent. Defaults to 65537 if zero.
+	PubExp uint
 }
 
-// VerifySession verifies that a session to the HSM for a given SKU is active
-func (h *HSM) VerifySession() error {
-	session, release := h.sessions.getHandle()
-	defer release()
+// Ed25519Params selects an Ed25519 key pair in `GenerateAndStoreKeyPair`.
+type Ed25519Params struct{}
 
-	kca, ok := h.PrivateKeys["KCAPriv"]
-	if !ok {
-		return fmt.Errorf("failed to find KCAPriv key UID")
-	}
+// ErrKeyAlreadyExists is returned by `GenerateAndStoreKeyPair` when a key
+// with the requested label is already stored on the HSM.
+var ErrKeyAlreadyExists = errors.New("key already exists")
 
-	_, err := session.FindPrivateKey(kca)
-	if err != nil {
-		return fmt.Errorf("failed to verify session: %v", err)
+// GenerateAndStoreKeyPair generates a key pair stored on the HSM as token
+// objects labeled `label`, and returns the DER encoded PKIX public key.
+// `keyType` is an `RSAParams`, an `elliptic.Curve` or an `Ed25519Params`.
+//
+// `opts` defaults to a non-extractable key if nil. Keys are always stored as
+// token objects, regardless of `opts.Token`. Fails with `ErrKeyAlreadyExists`
+// if a key pair labeled `label` already exists, rather than creating a
+// second key with the same label. Use `DeleteKeyPair` to remove the keys.
+func (h *HSM) GenerateAndStoreKeyPair(ctx context.Context, keyType any, label string, opts *pk11.KeyOptions) (pubDER []byte, err error) {
+	defer func() {
+		h.audit(AuditRecord{Op: "GenerateAndStoreKeyPair", KeyLabels: []string{label}, Err: err})
+	}()
+	if err := h.checkWritable("GenerateAndStoreKeyPair"); err != nil {
+		return nil, err
 	}
-	return nil
-}
-
-func (h *HSM) GenerateTokens(params []*TokenParams) ([]TokenResult, error) {
-	session, release := h.sessions.getHandle()
-	defer release()
-
-	Tokens := []TokenResult{}
-	for _, p := range params {
-		// Only support extracting random seeds using a wrapping key.
-		if p.Type != TokenTypeKeyGen && p.Wrap != WrappingMechanismNone {
-			return nil, fmt.Errorf("unsupported key type %v and wrap %v", p.Type, p.Wrap)
-		}
+	if label == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "key label is empty")
+	}
+	keyOpts := pk11.KeyOptions{}
+	if opts != nil {
+		keyOpts = *opts
+	}
+	keyOpts.Token = true
 
-		// Select the seed asset to use (High or Low security seed).
-		var seed pk11.SecretKey
-		var err error
-		switch p.Type {
-		case TokenTypeSecurityHi:
-			khs, ok := h.SymmetricKeys[p.SeedLabel]
-			if !ok {
-				return nil, fmt.Errorf("failed to find %q key UID", p.SeedLabel)
-			}
-			seed, err = session.FindSecretKey(khs)
+	// Serialize the label check with the key creation, so that concurrent
+	// calls cannot store two keys with the same label.
+	h.keyLabelMu.Lock()
+	defer h.keyLabelMu.Unlock()
+	return withSession(ctx, h, "GenerateAndStoreKeyPair", func(session *pk11.Session) ([]byte, error) {
+		for _, class := range []pk11.ClassAttribute{pk11.ClassPrivateKey, pk11.ClassPublicKey} {
+			exists, err := session.HasKeyWithLabel(class, label)
 			if err != nil {
-				return nil, fmt.Errorf("failed to get KHsks key object: %v", err)
+				return nil, fmt.Errorf("failed to look up key %q: %w", label, err)
 			}
-		case TokenTypeSecurityLo:
-			kls, ok := h.SymmetricKeys[p.SeedLabel]
-			if !ok {
-				return nil, fmt.Errorf("failed to find %q key UID", p.SeedLabel)
+			if exists {
+				return nil, fmt.Errorf("%w: %q", ErrKeyAlreadyExists, label)
 			}
-			seed, err = session.FindSecretKey(kls)
-			if err != nil {
-				return nil, fmt.Errorf("failed to get KLsks key object: %v", err)
-			}
-		case TokenTypeKeyGen:
-			seed, err = session.Generate(
-				256,
-				&pk11.KeyOptions{
-					Extractable: true,
-					Sensitive:   true,
-					Token:       false,
-				})
-			if err != nil {
-				return nil, fmt.Errorf("failed to generate random key: %v", err)
+		}
+
+		var kp pk11.KeyPair
+		var err error
+		switch kt := keyType.(type) {
+		case RSAParams:
+			pubExp := kt.PubExp
+			if pubExp == 0 {
+				pubExp = 65537
 			}
+			kp, err = session.GenerateRSA(kt.ModBits, pubExp, &keyOpts)
+		case elliptic.Curve:
+			kp, err = session.GenerateECDSA(kt, &keyOpts)
+		case Ed25519Params:
+			kp, err = session.GenerateEd25519(&keyOpts)
 		default:
-			return nil, fmt.Errorf("unsupported key type: %v", p.Type)
+			return nil, status.Errorf(codes.InvalidArgument, "unsupported key type: %T", keyType)
 		}
-
-		// Generate token from seed and extract.
-		rawData := append([]byte(p.Sku), []byte(p.Diversifier)...)
-		tBytes, err := seed.SignHMAC256(rawData)
 		if err != nil {
-			return nil, fmt.Errorf("failed to hash seed: %v", err)
+			return nil, fmt.Errorf("failed to generate key pair %q: %w", label, err)
 		}
 
-		// Truncate token if size is 128-bits (only valid value < 256 bits).
-		if p.SizeInBits == 128 {
-			tBytes = tBytes[:16]
+		pubDER, err := labelKeyPair(kp, label)
+		if err != nil {
+			// Do not leave unlabeled keys behind.
+			for _, o := range []interface{ Destroy() error }{kp.PrivateKey, kp.PublicKey} {
+				if derr := o.Destroy(); derr != nil {
+					log.Printf("Failed to destroy key pair %q: %v", label, derr)
+				}
+			}
+			return nil, err
 		}
+		return pubDER, nil
+	})
+}
 
-		if p.Op == TokenOpHashedOtLcToken {
-			// OpenTitan lifecycle tokens are stored in OTP in hashed form using the
-			// cSHAKE128 algorithm with the "LC_CTRL" customization string.
-			hasher := sha3.NewCShake128([]byte(""), []byte("LC_CTRL"))
-			hasher.Write(tBytes)
-			hasher.Read(tBytes)
-		}
+// labelKeyPair labels both keys of `kp` with `label`, and returns the DER
+// encoded PKIX public key.
+func labelKeyPair(kp pk11.KeyPair, label string) ([]byte, error) {
+	if err := kp.PrivateKey.SetLabel(label); err != nil {
+		return nil, fmt.Errorf("failed to label private key %q: %w", label, err)
+	}
+	if err := kp.PublicKey.SetLabel(label); err != nil {
+		return nil, fmt.Errorf("failed to label public key %q: %w", label, err)
+	}
+	pub, err := kp.PublicKey.ExportKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to export public key %q: %w", label, err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal public key %q: %w", label, err)
+	}
+	return der, nil
+}
 
-		wkey := []byte{}
-		if p.Wrap == WrappingMechanismRSAPCKS || p.Wrap == WrappingMechanismRSAOAEP {
-			wk, ok := h.PublicKeys[p.WrapKeyLabel]
-			if !ok {
-				return nil, fmt.Errorf("failed to find %q key UID", p.WrapKeyLabel)
-			}
-			wkObj, err := session.FindPublicKey(wk)
+// DeleteKeyPair destroys the private and public keys labeled `label`, e.g.
+// a key pair created by `GenerateAndStoreKeyPair`. Fails with
+// `ErrProtectedKey` if `label` is one of the long-lived keys listed in
+// `HSMConfig`, and with `codes.NotFound` if neither key exists.
+func (h *HSM) DeleteKeyPair(ctx context.Context, label string) error {
+	if err := h.checkWritable("DeleteKeyPair"); err != nil {
+		return err
+	}
+	if err := h.checkDeletable(label); err != nil {
+		return err
+	}
+	h.keyLabelMu.Lock()
+	defer h.keyLabelMu.Unlock()
+	return h.execute(ctx, "DeleteKeyPair", func(session *pk11.Session) error {
+		found := false
+		for _, class := range []pk11.ClassAttribute{pk11.ClassPrivateKey, pk11.ClassPublicKey} {
+			exists, err := session.HasKeyWithLabel(class, label)
 			if err != nil {
-				return nil, fmt.Errorf("failed to find %q key object: %v", p.WrapKeyLabel, err)
+				return fmt.Errorf("failed to look up key %q: %w", label, err)
 			}
-
-			var m pk11.GenSecretWrapMechanism
-			switch p.Wrap {
-			case WrappingMechanismRSAPCKS:
-				m = pk11.GenSecretWrapMechanismRsaPcks
-			case WrappingMechanismRSAOAEP:
-				m = pk11.GenSecretWrapMechanismRsaOaep
-			default:
-				return nil, fmt.Errorf("unsupported wrap mechanism: %v", p.Wrap)
+			if !exists {
+				continue
 			}
-			wkey, err = seed.Wrap(wkObj, m)
+			found = true
+			key, err := session.FindKeyByLabel(class, label)
 			if err != nil {
-				return nil, fmt.Errorf("failed to wrap seed: %v", err)
+				return fmt.Errorf("failed to find key %q: %w", label, err)
 			}
+			if err := key.Destroy(); err != nil {
+				return fmt.Errorf("failed to destroy key %q: %w", label, err)
+			}
+			h.keyIDs.invalidate(class, label)
+		}
+		if !found {
+			return status.Errorf(codes.NotFound, "key pair %q not found", label)
 		}
+		return nil
+	})
+}
 
-		Tokens = append(Tokens, TokenResult{
-			Token:       tBytes,
-			WrappedKey:  wkey,
-			Diversifier: p.Diversifier,
-		})
-	}
+// ErrProtectedKey is returned by `DeleteKeyByLabel` and `DeleteKeyPair` for
+// the long-lived keys listed in `HSMConfig`.
+var ErrProtectedKey = errors.New("key is protected")
 
-	return Tokens, nil
+// checkDeletable fails with `ErrProtectedKey` if `label` is one of the
+// long-lived keys listed in `HSMConfig.SymmetricKeys`,
+// `HSMConfig.PrivateKeys` or `HSMConfig.PublicKeys`.
+func (h *HSM) checkDeletable(label string) error {
+	_, symmetric := h.symmetricKeyID(label)
+	_, private := h.privateKeyID(label)
+	_, public := h.publicKeyID(label)
+	if symmetric || private || public {
+		return fmt.Errorf("%w: %q", ErrProtectedKey, label)
+	}
+	return nil
 }
 
-// OIDs for ECDSA signature algorithms corresponding to SHA-256, SHA-384 and
-// SHA-512.
-//
-// See https://datatracker.ietf.org/doc/html/rfc5758#section-3.1. The following
-// text is copied from the spec for reference:
-//
-// ecdsa-with-SHA256 OBJECT IDENTIFIER ::= { iso(1) member-body(2)
-//   us(840) ansi-X9-62(10045) signatures(4) ecdsa-with-SHA2(3) 2 }
+// DeleteKeyByLabel destroys the key of class `classAttr` labeled `label`,
+// e.g. to clean up after test runs. Fails with `ErrProtectedKey` if `label`
+// is one of the long-lived keys listed in `HSMConfig.SymmetricKeys`,
+// `HSMConfig.PrivateKeys` or `HSMConfig.PublicKeys`, and with
+// `codes.NotFound` if there is no such key.
+func (h *HSM) DeleteKeyByLabel(ctx context.Context, classAttr pk11.ClassAttribute, label string) error {
+	if err := h.checkWritable("DeleteKeyByLabel"); err != nil {
+		return err
+	}
+	if err := h.checkDeletable(label); err != nil {
+		return err
+	}
 
-// ecdsa-with-SHA384 OBJECT IDENTIFIER ::= { iso(1) member-body(2)
-//   us(840) ansi-X9-62(10045) signatures(4) ecdsa-with-SHA2(3) 3 }
+	h.keyLabelMu.Lock()
+	defer h.keyLabelMu.Unlock()
+	return h.execute(ctx, "DeleteKeyByLabel", func(session *pk11.Session) error {
+		exists, err := session.HasKeyWithLabel(classAttr, label)
+		if err != nil {
+			return fmt.Errorf("failed to look up key %q: %w", label, err)
+		}
+		if !exists {
+			return status.Errorf(codes.NotFound, "key %q not found", label)
+		}
+		keyID, err := getKeyIDByLabel(session, classAttr, label)
+		if err != nil {
+			return fmt.Errorf("fail to find key with label: %q, error: %w", label, err)
+		}
+		var key interface{ Destroy() error }
+		switch classAttr {
+		case pk11.ClassPrivateKey:
+			key, err = session.FindPrivateKey(keyID)
+		case pk11.ClassPublicKey:
+			key, err = session.FindPublicKey(keyID)
+		case pk11.ClassSecretKey:
+			key, err = session.FindSecretKey(keyID)
+		default:
+			return status.Errorf(codes.InvalidArgument, "unsupported key class")
+		}
+		if err != nil {
+			return fmt.Errorf("failed to find key object %q: %w", keyID, err)
+		}
+		if err := key.Destroy(); err != nil {
+			return fmt.Errorf("failed to destroy key %q: %w", label, err)
+		}
+		h.keyIDs.invalidate(classAttr, label)
+		return nil
+	})
+}
 
-// ecdsa-with-SHA512 OBJECT IDENTIFIER ::= { iso(1) member-body(2)
+// ECDHDerive derives an AES key inside the HSM from the ECDH shared secret of
+// the private key labeled `privateKeyLabel` and `peerPublicKey`, a DER
+// encoded SubjectPublicKeyInfo, and calls `use` with it, e.g. to wrap keys
+// with `WrapAESKWP`. See `pk11.PrivateKey.DeriveECDH`.
 //
-//	us(840) ansi-X9-62(10045) signatures(4) ecdsa-with-SHA2(3) 4 }
-var (
-	oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
-	oidECDSAWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}
-	oidECDSAWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 4}
-)
+// The derived key is bound to a pool session, so it is only valid during
+// `use`. It is a session object destroyed once `use` returns, unless
+// `opts.Token` is set, in which case it is stored on the HSM.
+func (h *HSM) ECDHDerive(ctx context.Context, privateKeyLabel string, peerPublicKey []byte, opts *pk11.KeyOptions, use func(pk11.SecretKey) error) error {
+	if err := h.checkWritable("ECDHDerive"); err != nil {
+		return err
+	}
+	pub, err := x509.ParsePKIXPublicKey(peerPublicKey)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "failed to parse peer public key: %v", err)
+	}
+	peer, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return status.Errorf(codes.InvalidArgument, "unsupported peer key type %T, expected EC public key", pub)
+	}
+	return h.execute(ctx, "ECDHDerive", func(session *pk11.Session) error {
+		priv, err := h.findPrivateKey(session, privateKeyLabel)
+		if err != nil {
+			return err
+		}
+		key, err := priv.DeriveECDH(peer, opts)
+		if err != nil {
+			return fmt.Errorf("failed to derive key with %q: %w", privateKeyLabel, err)
+		}
+		if opts == nil || !opts.Token {
+			defer func() {
+				if err := key.Destroy(); err != nil {
+					log.Printf("Failed to destroy derived key: %v", err)
+				}
+			}()
+		}
+		return use(key)
+	})
+}
 
-// oidFromSignatureAlgorithm returns the ASN.1 object identifier for the given
-// signature algorithm.
-func oidFromSignatureAlgorithm(alg x509.SignatureAlgorithm) (asn1.ObjectIdentifier, error) {
-	switch alg {
-	case x509.ECDSAWithSHA256:
-		return oidECDSAWithSHA256, nil
-	case x509.ECDSAWithSHA384:
-		return oidECDSAWithSHA384, nil
-	case x509.ECDSAWithSHA512:
-		return oidECDSAWithSHA512, nil
+// otLcTokenBits is the size of the OpenTitan lifecycle tokens hashed with
+// `hashLcToken`.
+const otLcTokenBits = 128
+
+// validateTokenParams checks the token size and wrapping mechanism of `p`,
+// returning `codes.InvalidArgument` if invalid. Raw tokens may be used as AES
+// keys, so their size must be 128, 192 or 256 bits. Hashed lifecycle tokens
+// must be `otLcTokenBits` wide. Seeds can only be wrapped with RSA, as
+// `TokenResult` has no field for the AES-GCM IV and only RSA wrapping keys
+// are validated.
+func validateTokenParams(p *TokenParams) error {
+	if _, err := pk11.HMACMechanism(tokenHash(p)); err != nil {
+		return status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	switch p.Wrap {
+	case WrappingMechanismNone, WrappingMechanismRSAPCKS, WrappingMechanismRSAOAEP:
+	case WrappingMechanismAESKWP, WrappingMechanismAESGCM:
+		return status.Errorf(codes.InvalidArgument, "AES wrapping mechanism %d is not supported for token seeds, use RSA-PKCS or RSA-OAEP", p.Wrap)
 	default:
-		return nil, fmt.Errorf("unsupported signature algorithm: %v", alg)
+		return status.Errorf(codes.InvalidArgument, "unknown wrapping mechanism %d", p.Wrap)
+	}
+	if p.Op == TokenOpHashedOtLcToken || p.Op == TokenOpHashedOtLcToken256 {
+		if p.SizeInBits != otLcTokenBits {
+			return status.Errorf(codes.InvalidArgument, "invalid lifecycle token size: %d bits, must be %d bits", p.SizeInBits, otLcTokenBits)
+		}
+		return nil
+	}
+	switch p.SizeInBits {
+	case 128, 192, 256:
+	default:
+		return status.Errorf(codes.InvalidArgument, "invalid token size: %d bits, must be 128, 192 or 256 bits", p.SizeInBits)
 	}
+	return nil
 }
 
-// hashFromSignatureAlgorithm returns the crypto.Hash for the given signature
-// algorithm.
-func hashFromSignatureAlgorithm(alg x509.SignatureAlgorithm) (crypto.Hash, error) {
-	switch alg {
-	case x509.ECDSAWithSHA256:
-		return crypto.SHA256, nil
-	case x509.ECDSAWithSHA384:
-		return crypto.SHA384, nil
-	case x509.ECDSAWithSHA512:
-		return crypto.SHA512, nil
-	default:
-		return 0, fmt.Errorf("unsupported signature algorithm: %v", alg)
+// hashLcToken hashes the lifecycle token `token` in place for operation `op`,
+// `TokenOpHashedOtLcToken` or `TokenOpHashedOtLcToken256`.
+//
+// OpenTitan lifecycle tokens are stored in OTP in hashed form using the
+// cSHAKE128 (or cSHAKE256) algorithm with the "LC_CTRL" customization string.
+func hashLcToken(op TokenOp, token []byte) {
+	var hasher sha3.ShakeHash
+	if op == TokenOpHashedOtLcToken256 {
+		hasher = sha3.NewCShake256([]byte(""), []byte("LC_CTRL"))
+	} else {
+		hasher = sha3.NewCShake128([]byte(""), []byte("LC_CTRL"))
 	}
+	hasher.Write(token)
+	hasher.Read(token)
 }
 
-func (h *HSM) EndorseCert(tbs []byte, params EndorseCertParams) ([]byte, error) {
-	session, release := h.sessions.getHandle()
-	defer release()
+// tokenDiversifier returns the diversifier deriving the token of `p`: the
+// encoded `p.DiversifierComponents` if set, or `p.Diversifier` otherwise.
+func tokenDiversifier(p *TokenParams) []byte {
+	if len(p.DiversifierComponents) > 0 {
+		return BuildDiversifier(p.DiversifierComponents)
+	}
+	return []byte(p.Diversifier)
+}
 
-	keyID, err := getKeyIDByLabel(session, pk11.ClassPrivateKey, params.KeyLabel)
-	if err != nil {
-		return nil, fmt.Errorf("fail to find key with label: %q, error: %v", params.KeyLabel, err)
+// BuildDiversifier encodes the diversifier `components` as a CBOR array of
+// byte strings (RFC 8949), so that no two lists of components share an
+// encoding. The encoding is deterministic: lengths use the shortest form.
+func BuildDiversifier(components [][]byte) []byte {
+	out := cborHead(nil, cborMajorArray, uint64(len(components)))
+	for _, c := range components {
+		out = cborHead(out, cborMajorBytes, uint64(len(c)))
+		out = append(out, c...)
 	}
+	return out
+}
 
-	key, err := session.FindPrivateKey(keyID)
-	if err != nil {
-		return nil, fmt.Errorf("failed to find key object %q: %v", keyID, err)
+// CBOR major types, see RFC 8949, section 3.1.
+const (
+	cborMajorBytes = 2
+	cborMajorArray = 4
+)
+
+// cborHead appends the CBOR head of an item of major type `major` with
+// argument `n` to `out`, using the shortest encoding of `n`.
+func cborHead(out []byte, major byte, n uint64) []byte {
+	major <<= 5
+	switch {
+	case n < 24:
+		return append(out, major|byte(n))
+	case n <= 0xff:
+		return append(out, major|24, byte(n))
+	case n <= 0xffff:
+		return append(out, major|25, byte(n>>8), byte(n))
+	case n <= 0xffffffff:
+		return append(out, major|26, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	default:
+		return append(out, major|27, byte(n>>56), byte(n>>48), byte(n>>40), byte(n>>32),
+			byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
 	}
+}
 
-	hash, err := hashFromSignatureAlgorithm(params.SignatureAlgorithm)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get hash from signature algorithm: %v", err)
+// tokenSeedLabel returns the label of the seed deriving the token of `p`, or
+// an empty string for `TokenTypeKeyGen` tokens. See `TokenParams.SeedLabel`.
+func tokenSeedLabel(p *TokenParams) string {
+	switch {
+	case p.Type == TokenTypeKeyGen:
+		return ""
+	case p.SeedLabel != "":
+		return p.SeedLabel
+	case p.Type == TokenTypeSecurityHi:
+		return HighSecSeedLabel
+	case p.Type == TokenTypeSecurityLo:
+		return LowSecSeedLabel
 	}
+	return ""
+}
 
-	rb, sb, err := key.SignECDSA(hash, tbs)
-	if err != nil {
-		return nil, fmt.Errorf("failed to sign: %v", err)
+// tokenHash returns the HMAC hash deriving the token of `p`.
+func tokenHash(p *TokenParams) crypto.Hash {
+	if p.HashAlgorithm == 0 {
+		return crypto.SHA256
 	}
+	return p.HashAlgorithm
+}
 
-	// Encode the signature as ASN.1 DER.
-	var sig struct{ R, S *big.Int }
-	sig.R, sig.S = new(big.Int), new(big.Int)
-	sig.R.SetBytes(rb)
-	sig.S.SetBytes(sb)
-	s, err := asn1.Marshal(sig)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal signature: %v", err)
+// checkTokenHashes checks that the HMAC mechanisms of the token hashes in
+// `params` are supported by the HSM slot. HMAC-SHA256 is assumed to be
+// supported.
+func checkTokenHashes(session *pk11.Session, params []*TokenParams) error {
+	var needed []uint
+	for _, p := range params {
+		mech, err := pk11.HMACMechanism(tokenHash(p))
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "%v", err)
+		}
+		if tokenHash(p) != crypto.SHA256 {
+			needed = append(needed, mech)
+		}
+	}
+	if len(needed) == 0 {
+		return nil
 	}
 
-	sigType, err := oidFromSignatureAlgorithm(params.SignatureAlgorithm)
+	mechs, err := session.Mechanisms()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get signature algorithm OID: %v", err)
+		return fmt.Errorf("failed to get slot mechanisms: %w", err)
 	}
-
-	certRaw := struct {
-		TBSCertificate     asn1.RawValue
-		SignatureAlgorithm pkix.AlgorithmIdentifier
-		SignatureValue     asn1.BitString
-	}{
-		TBSCertificate:     asn1.RawValue{FullBytes: tbs},
-		SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: sigType},
-		SignatureValue:     asn1.BitString{Bytes: s, BitLength: len(s) * 8},
+	supported := make(map[uint]bool, len(mechs))
+	for _, m := range mechs {
+		supported[m.Mechanism] = true
 	}
-	cert, err := asn1.Marshal(certRaw)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal certificate: %v", err)
+	for _, mech := range needed {
+		if !supported[mech] {
+			return status.Errorf(codes.FailedPrecondition, "HSM slot does not support %s, required by the token hash", pk11.MechanismName(mech))
+		}
 	}
-	return cert, nil
+	return nil
 }
 
-func (h *HSM) EndorseData(data []byte, params EndorseCertParams) ([]byte, []byte, error) {
-	session, release := h.sessions.getHandle()
-	defer release()
+// EncryptWithPublicKey encrypts `plaintext` with RSA-OAEP using the public key
+// identified by `keyLabel` on the HSM. `hash` is used for both the label
+// digest and MGF1.
+func (h *HSM) EncryptWithPublicKey(ctx context.Context, keyLabel string, plaintext []byte, hash crypto.Hash) ([]byte, error) {
+	return withSession(ctx, h, "EncryptWithPublicKey", func(session *pk11.Session) ([]byte, error) {
+		keyID, err := getKeyIDByLabel(session, pk11.ClassPublicKey, keyLabel)
+		if err != nil {
+			return nil, fmt.Errorf("fail to find key with label: %q, error: %w", keyLabel, err)
+		}
+		key, err := session.FindPublicKey(keyID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find key object %q: %w", keyID, err)
+		}
 
-	// Get the PKCS#11 private key object.
-	keyID, err := getKeyIDByLabel(session, pk11.ClassPrivateKey, params.KeyLabel)
-	if err != nil {
-		return nil, nil, fmt.Errorf("fail to find key with label: %q, error: %v", params.KeyLabel, err)
-	}
-	privateKey, err := session.FindPrivateKey(keyID)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to find private key object %q: %v", keyID, err)
-	}
+		ciphertext, err := key.EncryptRSAOAEP(hash, plaintext)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt: %w", err)
+		}
+		return ciphertext, nil
+	})
+}
 
-	// Export the public key from the PKCS#11 private key object.
-	publicKeyHandle, err := privateKey.FindPublicKey()
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to find public key on SE: %v", err)
-	}
-	publicKey, err := publicKeyHandle.ExportKey()
+// EncryptWithPublicKeyEC encrypts `plaintext` with ECIES using the EC public
+// key identified by `keyLabel` on the HSM. See `EncryptedPayload` for details
+// on the encryption scheme.
+//
+// The public key is exported from the HSM and the encryption is performed in
+// software, as it requires no secret key material held by the HSM.
+func (h *HSM) EncryptWithPublicKeyEC(ctx context.Context, keyLabel string, plaintext []byte) (EncryptedPayload, error) {
+	k, err := h.ExportPublicKey(ctx, keyLabel)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to export public key from SE: %v", err)
+		return EncryptedPayload{}, err
 	}
-	var ecdsaPubKey struct{ X, Y *big.Int }
-	ecdsaPubKey.X, ecdsaPubKey.Y = new(big.Int), new(big.Int)
-	ecdsaPubKey.X.Set(publicKey.(*ecdsa.PublicKey).X)
-	ecdsaPubKey.Y.Set(publicKey.(*ecdsa.PublicKey).Y)
-	asn1EcdsaPublicKey, err := asn1.Marshal(ecdsaPubKey)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to marshal public key: %v", err)
+	pub, ok := k.(*ecdsa.PublicKey)
+	if !ok {
+		return EncryptedPayload{}, fmt.Errorf("unsupported key type %T, expected EC public key", k)
 	}
+	return eciesEncrypt(pub, plaintext)
+}
 
-	// Hash the data payload.
-	hash, err := hashFromSignatureAlgorithm(params.SignatureAlgorithm)
+// eciesEncrypt encrypts `plaintext` to the `pub` public key. See
+// `EncryptedPayload` for details on the encryption scheme.
+func eciesEncrypt(pub *ecdsa.PublicKey, plaintext []byte) (EncryptedPayload, error) {
+	eph, err := ecdsa.GenerateKey(pub.Curve, rand.Reader)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to get hash from signature algorithm: %v", err)
+		return EncryptedPayload{}, fmt.Errorf("failed to generate ephemeral key: %w", err)
 	}
+	ephPub := elliptic.Marshal(pub.Curve, eph.X, eph.Y)
 
-	// Sign the hash of the data payload.
-	rb, sb, err := privateKey.SignECDSA(hash, data)
+	shared, _ := pub.Curve.ScalarMult(pub.X, pub.Y, eph.D.Bytes())
+	secret := make([]byte, (pub.Curve.Params().BitSize+7)/8)
+	shared.FillBytes(secret)
+
+	cek := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, ephPub), cek); err != nil {
+		return EncryptedPayload{}, fmt.Errorf("failed to derive encryption key: %w", err)
+	}
+	block, err := aes.NewCipher(cek)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to sign: %v", err)
+		return EncryptedPayload{}, fmt.Errorf("failed to create cipher: %w", err)
 	}
-
-	// Encode the signature as ASN.1 DER.
-	var sig struct{ R, S *big.Int }
-	sig.R, sig.S = new(big.Int), new(big.Int)
-	sig.R.SetBytes(rb)
-	sig.S.SetBytes(sb)
-	asn1Sig, err := asn1.Marshal(sig)
+	aead, err := cipher.NewGCM(block)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to marshal signature: %v", err)
+		return EncryptedPayload{}, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return EncryptedPayload{}, fmt.Errorf("failed to generate nonce: %w", err)
 	}
 
-	return asn1EcdsaPublicKey, asn1Sig, nil
+	return EncryptedPayload{
+		EphemeralPublicKey: ephPub,
+		Nonce:              nonce,
+		Ciphertext:         aead.Seal(nil, nonce, plaintext, nil),
+	}, nil
 }
@@ -0,0 +1,166 @@
+// Copyright lowRISC contributors (OpenTitan project).
+// Licensed under the Apache License, Version 2.0, see LICENSE for details.
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build loadtest
+
+// HSM load test used to verify provisioning throughput during factory floor
+// commissioning. Build with `--define gotags=loadtest` to enable.
+package se
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lowRISC/opentitan-provisioning/src/pk11"
+)
+
+// LoadTestOp is the HSM operation exercised by a load test.
+type LoadTestOp int
+
+const (
+	// LoadTestOpSign signs a payload with the ECDSA key `LoadTestOptions.KeyLabel`.
+	LoadTestOpSign LoadTestOp = iota
+	// LoadTestOpDerive derives a token from the seed `LoadTestOptions.KeyLabel`.
+	LoadTestOpDerive
+	// LoadTestOpRandom generates random bytes.
+	LoadTestOpRandom
+)
+
+// LoadTestOptions contains the parameters of `HSM.ConcurrentLoadTest`.
+type LoadTestOptions struct {
+	// DurationSeconds is the duration of the load test.
+	DurationSeconds int
+	// ConcurrentWorkers is the number of workers issuing operations in
+	// parallel. Workers beyond the number of HSM sessions wait for a session
+	// to become available, which is included in the measured latency.
+	ConcurrentWorkers int
+	// OperationType is the operation to run.
+	OperationType LoadTestOp
+	// KeyLabel is the signing key or seed label used by the sign and derive
+	// operations.
+	KeyLabel string
+}
+
+// LoadTestResult contains the throughput and latency measured by
+// `HSM.ConcurrentLoadTest`.
+type LoadTestResult struct {
+	// OpsPerSec is the number of successful operations per second.
+	OpsPerSec float64
+	// P50 and P99 are the latency percentiles of all operations.
+	P50, P99 time.Duration
+	// ErrorRate is the fraction of failed operations.
+	ErrorRate float64
+}
+
+// loadTestPayload is the message signed by the sign operation, matching the
+// size of a typical TBS certificate.
+var loadTestPayload = make([]byte, 512)
+
+// loadTestOp returns the function running a single `opts` operation.
+func (h *HSM) loadTestOp(opts LoadTestOptions) (func() error, error) {
+	switch opts.OperationType {
+	case LoadTestOpSign:
+		params := EndorseCertParams{
+			KeyLabel:           opts.KeyLabel,
+			SignatureAlgorithm: x509.ECDSAWithSHA256,
+		}
+		return func() error {
+			_, _, err := h.EndorseData(context.Background(), loadTestPayload, params)
+			return err
+		}, nil
+	case LoadTestOpDerive:
+		params := []*TokenParams{{
+			Diversifier: "loadtest",
+			Op:          TokenOpRaw,
+			Type:        TokenTypeSecurityHi,
+			SeedLabel:   opts.KeyLabel,
+			SizeInBits:  128,
+		}}
+		return func() error {
+			_, err := h.GenerateTokens(context.Background(), params)
+			return err
+		}, nil
+	case LoadTestOpRandom:
+		return func() error {
+			return h.ExecuteCmd(context.Background(), func(s *pk11.Session) error {
+				_, err := s.GenerateRandom(32)
+				return err
+			})
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported load test operation: %d", opts.OperationType)
+	}
+}
+
+// percentile returns the `p` percentile of the sorted `samples`.
+func percentile(samples []time.Duration, p float64) time.Duration {
+	if len(samples) == 0 {
+		return 0
+	}
+	i := int(p * float64(len(samples)-1))
+	return samples[i]
+}
+
+// ConcurrentLoadTest runs `opts.OperationType` continuously on
+// `opts.ConcurrentWorkers` workers for `opts.DurationSeconds`, or until `ctx`
+// is done, and reports the measured throughput and latency.
+func (h *HSM) ConcurrentLoadTest(ctx context.Context, opts LoadTestOptions) (*LoadTestResult, error) {
+	if opts.DurationSeconds <= 0 {
+		return nil, fmt.Errorf("invalid load test duration: %d", opts.DurationSeconds)
+	}
+	if opts.ConcurrentWorkers <= 0 {
+		return nil, fmt.Errorf("invalid number of load test workers: %d", opts.ConcurrentWorkers)
+	}
+	op, err := h.loadTestOp(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(opts.DurationSeconds)*time.Second)
+	defer cancel()
+
+	var (
+		mu        sync.Mutex
+		latencies []time.Duration
+		numErrors int
+		wg        sync.WaitGroup
+	)
+	start := time.Now()
+	for w := 0; w < opts.ConcurrentWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var local []time.Duration
+			localErrors := 0
+			for ctx.Err() == nil {
+				opStart := time.Now()
+				if err := op(); err != nil {
+					localErrors++
+				}
+				local = append(local, time.Since(opStart))
+			}
+			mu.Lock()
+			latencies = append(latencies, local...)
+			numErrors += localErrors
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	if len(latencies) == 0 {
+		return nil, fmt.Errorf("no operations completed")
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	return &LoadTestResult{
+		OpsPerSec: float64(len(latencies)-numErrors) / elapsed.Seconds(),
+		P50:       percentile(latencies, 0.50),
+		P99:       percentile(latencies, 0.99),
+		ErrorRate: float64(numErrors) / float64(len(latencies)),
+	}, nil
+}
@@ -0,0 +1,172 @@
+// Copyright lowRISC contributors (OpenTitan project).
+// Licensed under the Apache License, Version 2.0, see LICENSE for details.
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build loadtest
+
+package se
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/lowRISC/opentitan-provisioning/src/pk11"
+)
+
+func TestConcurrentLoadTest(t *testing.T) {
+	hsm, _, _ := MakeHSM(t)
+
+	res, err := hsm.ConcurrentLoadTest(context.Background(), LoadTestOptions{
+		DurationSeconds:   1,
+		ConcurrentWorkers: 4,
+		OperationType:     LoadTestOpRandom,
+	})
+	if err != nil {
+		t.Fatalf("ConcurrentLoadTest() failed: %v", err)
+	}
+	if res.OpsPerSec <= 0 {
+		t.Errorf("OpsPerSec = %v, expected a positive throughput", res.OpsPerSec)
+	}
+	if res.ErrorRate != 0 {
+		t.Errorf("ErrorRate = %v, want 0", res.ErrorRate)
+	}
+	if res.P50 > res.P99 {
+		t.Errorf("P50 %v is larger than P99 %v", res.P50, res.P99)
+	}
+
+	if _, err := hsm.ConcurrentLoadTest(context.Background(), LoadTestOptions{
+		DurationSeconds:   1,
+		ConcurrentWorkers: 1,
+		OperationType:     LoadTestOp(-1),
+	}); err == nil {
+		t.Error("expected ConcurrentLoadTest to reject an unsupported operation")
+	}
+}
+
+func TestSignBatchThroughput(t *testing.T) {
+	hsm, _, _ := MakeHSM(t)
+	kp, err := MintECDSAKeys(t, hsm)
+	if err != nil {
+		t.Fatalf("MintECDSAKeys() failed: %v", err)
+	}
+	_, release := hsm.sessions.getHandle()
+	if err := kp.PrivateKey.SetLabel("BatchKey"); err != nil {
+		t.Fatalf("SetLabel() failed: %v", err)
+	}
+	release()
+
+	const numItems = 100
+	items := make([][]byte, numItems)
+	for i := range items {
+		items[i] = []byte(fmt.Sprintf("firmware hash %d", i))
+	}
+	params := EndorseCertParams{
+		KeyLabel:           "BatchKey",
+		SignatureAlgorithm: x509.ECDSAWithSHA256,
+	}
+
+	start := time.Now()
+	for _, item := range items {
+		if _, _, err := hsm.EndorseData(context.Background(), item, params); err != nil {
+			t.Fatalf("EndorseData() failed: %v", err)
+		}
+	}
+	sequential := time.Since(start)
+
+	start = time.Now()
+	if _, err := hsm.SignBatch(context.Background(), params.KeyLabel, params.SignatureAlgorithm, items); err != nil {
+		t.Fatalf("SignBatch() failed: %v", err)
+	}
+	batch := time.Since(start)
+
+	t.Logf("%d items: sequential %v (%v/item), batch %v (%v/item)",
+		numItems, sequential, sequential/numItems, batch, batch/numItems)
+}
+
+func TestBatchEndorseCertThroughput(t *testing.T) {
+	hsm, _, _ := MakeHSM(t)
+	caCert, caKey := newCRLTestCA(t)
+	session, release := hsm.sessions.getHandle()
+	ca, err := session.ImportKey(caKey, &pk11.KeyOptions{Token: true})
+	if err != nil {
+		t.Fatalf("ImportKey() failed: %v", err)
+	}
+	if err := ca.SetLabel("KCAPriv"); err != nil {
+		t.Fatalf("SetLabel() failed: %v", err)
+	}
+	release()
+
+	const numCerts = 100
+	tbsList := newTestTBSList(t, caCert, caKey, time.Now(), numCerts)
+	params := EndorseCertParams{
+		KeyLabel:           "KCAPriv",
+		SignatureAlgorithm: x509.ECDSAWithSHA256,
+	}
+
+	start := time.Now()
+	for _, tbs := range tbsList {
+		if _, err := hsm.EndorseCert(context.Background(), tbs, params); err != nil {
+			t.Fatalf("EndorseCert() failed: %v", err)
+		}
+	}
+	sequential := time.Since(start)
+
+	start = time.Now()
+	if _, err := hsm.BatchEndorseCert(context.Background(), tbsList, params); err != nil {
+		t.Fatalf("BatchEndorseCert() failed: %v", err)
+	}
+	batch := time.Since(start)
+
+	t.Logf("%d certificates: sequential %v (%v/cert), batch %v (%v/cert)",
+		numCerts, sequential, sequential/numCerts, batch, batch/numCerts)
+}
+
+func TestEndorseCertsThroughput(t *testing.T) {
+	hsm, _, _ := MakeHSM(t)
+	caCert, caKey := newCRLTestCA(t)
+	session, release := hsm.sessions.getHandle()
+	ca, err := session.ImportKey(caKey, &pk11.KeyOptions{Token: true})
+	if err != nil {
+		t.Fatalf("ImportKey() failed: %v", err)
+	}
+	if err := ca.SetLabel("KCAPriv"); err != nil {
+		t.Fatalf("SetLabel() failed: %v", err)
+	}
+	release()
+
+	// Devices have three certificates: UDS, CDI_0 and CDI_1.
+	const numDevices, certsPerDevice = 100, 3
+	params := EndorseCertParams{
+		KeyLabel:           "KCAPriv",
+		SignatureAlgorithm: x509.ECDSAWithSHA256,
+	}
+	reqs := make([]EndorseCertParamsWithTBS, certsPerDevice)
+	for i, tbs := range newTestTBSList(t, caCert, caKey, time.Now(), certsPerDevice) {
+		reqs[i] = EndorseCertParamsWithTBS{EndorseCertParams: params, TBS: tbs}
+	}
+
+	start := time.Now()
+	for d := 0; d < numDevices; d++ {
+		for _, r := range reqs {
+			if _, err := hsm.EndorseCert(context.Background(), r.TBS, r.EndorseCertParams); err != nil {
+				t.Fatalf("EndorseCert() failed: %v", err)
+			}
+		}
+	}
+	sequential := time.Since(start)
+
+	start = time.Now()
+	for d := 0; d < numDevices; d++ {
+		if _, err := hsm.EndorseCerts(context.Background(), reqs, true); err != nil {
+			t.Fatalf("EndorseCerts() failed: %v", err)
+		}
+	}
+	batch := time.Since(start)
+
+	const numCerts = numDevices * certsPerDevice
+	t.Logf("%d devices of %d certificates: sequential %v (%v/cert), batch %v (%v/cert)",
+		numDevices, certsPerDevice, sequential, sequential/numCerts, batch, batch/numCerts)
+}
@@ -6,21 +6,41 @@ package se
 
 import (
 	"bytes"
+	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/asn1"
 	"encoding/hex"
 	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"math/big"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/bazelbuild/rules_go/go/tools/bazel"
+	"github.com/miekg/pkcs11"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/ocsp"
 	"golang.org/x/crypto/sha3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"github.com/lowRISC/opentitan-provisioning/src/pk11"
 	ts "github.com/lowRISC/opentitan-provisioning/src/pk11/test_support"
@@ -93,21 +113,28 @@ func MakeHSM(t *testing.T) (*HSM, []byte, []byte) {
 	err = sessions.insert(s)
 	ts.Check(t, err)
 
-	return &HSM{
-			SymmetricKeys: map[string][]byte{
-				"HighSecKdfSeed": hsksUID,
-				"LowSecKdfSeed":  lsksUID,
-			},
-			PublicKeys: map[string][]byte{
-				"TokenWrappingKey": twpPubUID,
-			},
-			PrivateKeys: map[string][]byte{
-				"TokenWrappingKey": twpPrivUID,
-			},
-			sessions: sessions,
+	// The HSM does not own the test module, so closing it only closes the
+	// test session.
+	hsm := &HSM{
+		SymmetricKeys: map[string][]byte{
+			"HighSecKdfSeed": hsksUID,
+			"LowSecKdfSeed":  lsksUID,
+		},
+		PublicKeys: map[string][]byte{
+			"TokenWrappingKey": twpPubUID,
 		},
-		hsSeed,
-		lsSeed
+		PrivateKeys: map[string][]byte{
+			"TokenWrappingKey": twpPrivUID,
+		},
+		minWrappingKeyBits: defaultMinWrappingKeyBits,
+		sessions:           sessions,
+	}
+	t.Cleanup(func() {
+		if err := hsm.Close(); err != nil {
+			t.Errorf("Close() failed: %v", err)
+		}
+	})
+	return hsm, hsSeed, lsSeed
 }
 
 func TestGenerateSymmKeys(t *testing.T) {
@@ -150,7 +177,7 @@ func TestGenerateSymmKeys(t *testing.T) {
 	}
 
 	// Generate the actual tokens (using the HSM).
-	res, err := hsm.GenerateTokens(params)
+	res, err := hsm.GenerateTokens(context.Background(), params)
 	ts.Check(t, err)
 	tokens := make([][]byte, len(res))
 	for i, r := range res {
@@ -185,6 +212,414 @@ func TestGenerateSymmKeys(t *testing.T) {
 	}
 }
 
+func TestGenerateTokensSeedLabel(t *testing.T) {
+	hsm, hsSeed, lsSeed := MakeHSM(t)
+
+	for _, tc := range []struct {
+		name string
+		p    TokenParams
+		seed []byte
+	}{
+		{"default high security seed", TokenParams{Type: TokenTypeSecurityHi}, hsSeed},
+		{"default low security seed", TokenParams{Type: TokenTypeSecurityLo}, lsSeed},
+		{"named seed", TokenParams{Type: TokenTypeSecurityHi, SeedLabel: "LowSecKdfSeed"}, lsSeed},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := tc.p
+			p.SizeInBits = 128
+			p.Sku = "test sku"
+			p.Diversifier = "test"
+			res, err := hsm.GenerateTokens(context.Background(), []*TokenParams{&p})
+			ts.Check(t, err)
+
+			mac := hmac.New(sha256.New, tc.seed)
+			mac.Write([]byte(p.Sku + p.Diversifier))
+			if want := mac.Sum(nil)[:p.SizeInBits/8]; !bytes.Equal(res[0].Token, want) {
+				t.Errorf("GenerateTokens() = %x, want %x", res[0].Token, want)
+			}
+		})
+	}
+
+	_, err := hsm.GenerateTokens(context.Background(), []*TokenParams{
+		{Type: TokenTypeSecurityHi, SeedLabel: "ProductFamilySeed", SizeInBits: 128},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("GenerateTokens() = %v with an unknown seed, want code %v", err, codes.InvalidArgument)
+	}
+}
+
+func TestTokenSeedLabel(t *testing.T) {
+	for _, tc := range []struct {
+		p    TokenParams
+		want string
+	}{
+		{TokenParams{Type: TokenTypeSecurityHi}, HighSecSeedLabel},
+		{TokenParams{Type: TokenTypeSecurityLo}, LowSecSeedLabel},
+		{TokenParams{Type: TokenTypeSecurityLo, SeedLabel: "FamilySeed"}, "FamilySeed"},
+		{TokenParams{Type: TokenTypeKeyGen, SeedLabel: "FamilySeed"}, ""},
+	} {
+		if got := tokenSeedLabel(&tc.p); got != tc.want {
+			t.Errorf("tokenSeedLabel(%+v) = %q, want %q", tc.p, got, tc.want)
+		}
+	}
+}
+
+func TestGenerateTokensHashAlgorithm(t *testing.T) {
+	hsm, _, lsSeed := MakeHSM(t)
+
+	tests := []struct {
+		hash crypto.Hash
+		size uint
+	}{
+		{0, 256},
+		{crypto.SHA256, 128},
+		{crypto.SHA256, 256},
+		{crypto.SHA384, 128},
+		{crypto.SHA384, 256},
+		{crypto.SHA512, 128},
+		{crypto.SHA512, 256},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%v-%d", tt.hash, tt.size), func(t *testing.T) {
+			p := &TokenParams{
+				SeedLabel:     "LowSecKdfSeed",
+				Type:          TokenTypeSecurityLo,
+				Op:            TokenOpRaw,
+				SizeInBits:    tt.size,
+				Sku:           "test sku",
+				Diversifier:   "test_unlock",
+				Wrap:          WrappingMechanismNone,
+				HashAlgorithm: tt.hash,
+			}
+			res, err := hsm.GenerateTokens(context.Background(), []*TokenParams{p})
+			ts.Check(t, err)
+			if got, want := len(res[0].Token), int(tt.size/8); got != want {
+				t.Fatalf("token length = %d, want %d", got, want)
+			}
+
+			hash := tt.hash
+			if hash == 0 {
+				hash = crypto.SHA256
+			}
+			mac := hmac.New(hash.New, lsSeed)
+			mac.Write([]byte(p.Sku + p.Diversifier))
+			if want := mac.Sum(nil)[:tt.size/8]; !bytes.Equal(res[0].Token, want) {
+				t.Errorf("token = %x, want %x", res[0].Token, want)
+			}
+		})
+	}
+
+	p := &TokenParams{
+		SeedLabel:     "LowSecKdfSeed",
+		Type:          TokenTypeSecurityLo,
+		SizeInBits:    128,
+		HashAlgorithm: crypto.SHA1,
+	}
+	_, err := hsm.GenerateTokens(context.Background(), []*TokenParams{p})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("GenerateTokens() with SHA-1 = %v, want InvalidArgument", err)
+	}
+}
+
+func TestGenerateTokensDiversifierComponents(t *testing.T) {
+	hsm, _, lsSeed := MakeHSM(t)
+
+	// token generates a token diversified by `components`.
+	token := func(components ...string) []byte {
+		t.Helper()
+		p := &TokenParams{
+			SeedLabel:   "LowSecKdfSeed",
+			Type:        TokenTypeSecurityLo,
+			Op:          TokenOpRaw,
+			SizeInBits:  256,
+			Sku:         "test sku",
+			Diversifier: "ignored",
+			Wrap:        WrappingMechanismNone,
+		}
+		for _, c := range components {
+			p.DiversifierComponents = append(p.DiversifierComponents, []byte(c))
+		}
+		res, err := hsm.GenerateTokens(context.Background(), []*TokenParams{p})
+		ts.Check(t, err)
+
+		mac := hmac.New(sha256.New, lsSeed)
+		mac.Write([]byte(p.Sku))
+		mac.Write(BuildDiversifier(p.DiversifierComponents))
+		if want := mac.Sum(nil); !bytes.Equal(res[0].Token, want) {
+			t.Errorf("token = %x, want %x", res[0].Token, want)
+		}
+		return res[0].Token
+	}
+
+	base := token("rev-b", "lot-0042", "2024-05-01")
+	for _, components := range [][]string{
+		{"rev-c", "lot-0042", "2024-05-01"},
+		{"rev-b", "lot-0043", "2024-05-01"},
+		{"rev-b", "lot-0042", "2024-05-02"},
+		// The component boundaries are part of the diversifier.
+		{"rev-blot-0042", "", "2024-05-01"},
+	} {
+		if bytes.Equal(token(components...), base) {
+			t.Errorf("diversifier components %q derive the same token as the base components", components)
+		}
+	}
+}
+
+func TestBuildDiversifier(t *testing.T) {
+	// The encoding is part of the token derivation, so it must never change.
+	for _, tc := range []struct {
+		components [][]byte
+		want       string
+	}{
+		{nil, "80"},
+		{[][]byte{{}}, "8140"},
+		{[][]byte{[]byte("rev-b"), []byte("lot")}, "82457265762d62436c6f74"},
+		{[][]byte{bytes.Repeat([]byte{0xaa}, 24)}, "815818" + strings.Repeat("aa", 24)},
+		{[][]byte{bytes.Repeat([]byte{0xbb}, 256)}, "81590100" + strings.Repeat("bb", 256)},
+	} {
+		if got := hex.EncodeToString(BuildDiversifier(tc.components)); got != tc.want {
+			t.Errorf("BuildDiversifier(%x) = %s, want %s", tc.components, got, tc.want)
+		}
+	}
+
+	// 24 components need a one byte length argument.
+	components := make([][]byte, 24)
+	if got := hex.EncodeToString(BuildDiversifier(components)[:2]); got != "9818" {
+		t.Errorf("BuildDiversifier() of 24 components starts with %s, want 9818", got)
+	}
+}
+
+func TestGenerateAndStoreKeyPair(t *testing.T) {
+	hsm, _, _ := MakeHSM(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		keyType any
+		want    any
+	}{
+		{"RSA", RSAParams{ModBits: 2048}, &rsa.PublicKey{}},
+		{"ECDSA", elliptic.P256(), &ecdsa.PublicKey{}},
+		{"Ed25519", Ed25519Params{}, ed25519.PublicKey{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			label := "StoredKey" + tt.name
+			der, err := hsm.GenerateAndStoreKeyPair(ctx, tt.keyType, label, nil)
+			ts.Check(t, err)
+			pub, err := x509.ParsePKIXPublicKey(der)
+			ts.Check(t, err)
+			if fmt.Sprintf("%T", pub) != fmt.Sprintf("%T", tt.want) {
+				t.Errorf("GenerateAndStoreKeyPair() returned a %T, want %T", pub, tt.want)
+			}
+
+			session, release := hsm.sessions.getHandle()
+			priv, err := session.FindKeyByLabel(pk11.ClassPrivateKey, label)
+			ts.Check(t, err)
+			extractable, err := priv.Bool(pkcs11.CKA_EXTRACTABLE)
+			ts.Check(t, err)
+			release()
+			if extractable {
+				t.Error("stored private key is extractable")
+			}
+
+			// Creating the key again fails without replacing it.
+			if _, err := hsm.GenerateAndStoreKeyPair(ctx, tt.keyType, label, nil); !errors.Is(err, ErrKeyAlreadyExists) {
+				t.Errorf("GenerateAndStoreKeyPair() = %v for an existing key, want %v", err, ErrKeyAlreadyExists)
+			}
+			got, err := hsm.ExportPublicKey(ctx, label)
+			ts.Check(t, err)
+			gotDER, err := x509.MarshalPKIXPublicKey(got)
+			ts.Check(t, err)
+			if !bytes.Equal(gotDER, der) {
+				t.Error("stored public key was replaced")
+			}
+
+			// The key can be created again once deleted.
+			ts.Check(t, hsm.DeleteKeyPair(ctx, label))
+			if err := hsm.DeleteKeyPair(ctx, label); status.Code(err) != codes.NotFound {
+				t.Errorf("DeleteKeyPair() = %v for a deleted key, want code %v", err, codes.NotFound)
+			}
+			_, err = hsm.GenerateAndStoreKeyPair(ctx, tt.keyType, label, nil)
+			ts.Check(t, err)
+		})
+	}
+
+	if _, err := hsm.GenerateAndStoreKeyPair(ctx, "P-256", "StoredKeyBadType", nil); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("GenerateAndStoreKeyPair() = %v for an unsupported key type, want code %v", err, codes.InvalidArgument)
+	}
+}
+
+func TestDeleteKeyByLabel(t *testing.T) {
+	hsm, _, _ := MakeHSM(t)
+	ctx := context.Background()
+
+	// hasKey reports whether a key of class `class` is labeled `label`.
+	hasKey := func(class pk11.ClassAttribute, label string) bool {
+		t.Helper()
+		session, release := hsm.sessions.getHandle()
+		defer release()
+		exists, err := session.HasKeyWithLabel(class, label)
+		ts.Check(t, err)
+		return exists
+	}
+
+	const label = "DeletedKey"
+	_, err := hsm.GenerateAndStoreKeyPair(ctx, elliptic.P256(), label, nil)
+	ts.Check(t, err)
+	ts.Check(t, hsm.DeleteKeyByLabel(ctx, pk11.ClassPrivateKey, label))
+	if hasKey(pk11.ClassPrivateKey, label) {
+		t.Error("private key still exists after DeleteKeyByLabel()")
+	}
+	if !hasKey(pk11.ClassPublicKey, label) {
+		t.Error("public key was deleted along with the private key")
+	}
+	ts.Check(t, hsm.DeleteKeyByLabel(ctx, pk11.ClassPublicKey, label))
+	if hasKey(pk11.ClassPublicKey, label) {
+		t.Error("public key still exists after DeleteKeyByLabel()")
+	}
+	if err := hsm.DeleteKeyByLabel(ctx, pk11.ClassPrivateKey, label); status.Code(err) != codes.NotFound {
+		t.Errorf("DeleteKeyByLabel() = %v for a deleted key, want code %v", err, codes.NotFound)
+	}
+
+	// The key can be created again once deleted.
+	_, err = hsm.GenerateAndStoreKeyPair(ctx, elliptic.P256(), label, nil)
+	ts.Check(t, err)
+	ts.Check(t, hsm.DeleteKeyPair(ctx, label))
+
+	// The long-lived keys of the HSM cannot be deleted.
+	for _, tc := range []struct {
+		class pk11.ClassAttribute
+		label string
+	}{
+		{pk11.ClassSecretKey, "HighSecKdfSeed"},
+		{pk11.ClassPrivateKey, "TokenWrappingKey"},
+		{pk11.ClassPublicKey, "TokenWrappingKey"},
+	} {
+		if err := hsm.DeleteKeyByLabel(ctx, tc.class, tc.label); !errors.Is(err, ErrProtectedKey) {
+			t.Errorf("DeleteKeyByLabel(%q) = %v, want %v", tc.label, err, ErrProtectedKey)
+		}
+		if !hasKey(tc.class, tc.label) {
+			t.Errorf("protected key %q was deleted", tc.label)
+		}
+	}
+	if err := hsm.DeleteKeyPair(ctx, "TokenWrappingKey"); !errors.Is(err, ErrProtectedKey) {
+		t.Errorf("DeleteKeyPair(%q) = %v, want %v", "TokenWrappingKey", err, ErrProtectedKey)
+	}
+	for _, class := range []pk11.ClassAttribute{pk11.ClassPrivateKey, pk11.ClassPublicKey} {
+		if !hasKey(class, "TokenWrappingKey") {
+			t.Errorf("protected key %q was deleted by DeleteKeyPair()", "TokenWrappingKey")
+		}
+	}
+}
+
+func TestECDHDerive(t *testing.T) {
+	hsm, _, _ := MakeHSM(t)
+	ctx := context.Background()
+
+	const label = "ECDHKey"
+	der, err := hsm.GenerateAndStoreKeyPair(ctx, elliptic.P256(), label, &pk11.KeyOptions{Derive: true})
+	ts.Check(t, err)
+	defer hsm.DeleteKeyPair(ctx, label)
+	pub, err := x509.ParsePKIXPublicKey(der)
+	ts.Check(t, err)
+	hsmPub := pub.(*ecdsa.PublicKey)
+
+	peer, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ts.Check(t, err)
+	peerDER, err := x509.MarshalPKIXPublicKey(&peer.PublicKey)
+	ts.Check(t, err)
+
+	var got []byte
+	err = hsm.ECDHDerive(ctx, label, peerDER, &pk11.KeyOptions{Extractable: true}, func(k pk11.SecretKey) error {
+		key, err := k.ExportKey()
+		if err != nil {
+			return err
+		}
+		got = key.(pk11.AESKey)
+		return nil
+	})
+	ts.Check(t, err)
+
+	x, _ := elliptic.P256().ScalarMult(hsmPub.X, hsmPub.Y, peer.D.Bytes())
+	if want := x.FillBytes(make([]byte, 32)); !bytes.Equal(got, want) {
+		t.Errorf("ECDHDerive() derived %x, want %x", got, want)
+	}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	ts.Check(t, err)
+	rsaDER, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	ts.Check(t, err)
+	for name, peerKey := range map[string][]byte{"RSA": rsaDER, "garbage": []byte("garbage")} {
+		err := hsm.ECDHDerive(ctx, label, peerKey, nil, func(pk11.SecretKey) error { return nil })
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("ECDHDerive() = %v with %s peer key, want code %v", err, name, codes.InvalidArgument)
+		}
+	}
+}
+
+func TestValidateTokenParams(t *testing.T) {
+	tests := []struct {
+		name string
+		p    TokenParams
+		ok   bool
+	}{
+		{"raw 128", TokenParams{Op: TokenOpRaw, SizeInBits: 128}, true},
+		{"raw 192", TokenParams{Op: TokenOpRaw, SizeInBits: 192}, true},
+		{"raw 256", TokenParams{Op: TokenOpRaw, SizeInBits: 256}, true},
+		{"raw 256 sha512", TokenParams{Op: TokenOpRaw, SizeInBits: 256, HashAlgorithm: crypto.SHA512}, true},
+		{"raw 0", TokenParams{Op: TokenOpRaw, SizeInBits: 0}, false},
+		{"raw 64", TokenParams{Op: TokenOpRaw, SizeInBits: 64}, false},
+		{"raw 129", TokenParams{Op: TokenOpRaw, SizeInBits: 129}, false},
+		{"raw 384", TokenParams{Op: TokenOpRaw, SizeInBits: 384, HashAlgorithm: crypto.SHA384}, false},
+		{"raw sha1", TokenParams{Op: TokenOpRaw, SizeInBits: 128, HashAlgorithm: crypto.SHA1}, false},
+		{"lc 128", TokenParams{Op: TokenOpHashedOtLcToken, SizeInBits: 128}, true},
+		{"lc 192", TokenParams{Op: TokenOpHashedOtLcToken, SizeInBits: 192}, false},
+		{"lc 256", TokenParams{Op: TokenOpHashedOtLcToken, SizeInBits: 256}, false},
+		{"lc cshake256 128", TokenParams{Op: TokenOpHashedOtLcToken256, SizeInBits: 128}, true},
+		{"lc cshake256 256", TokenParams{Op: TokenOpHashedOtLcToken256, SizeInBits: 256}, false},
+		{"wrap rsa oaep", TokenParams{Op: TokenOpRaw, SizeInBits: 256, Wrap: WrappingMechanismRSAOAEP}, true},
+		{"wrap aes kwp", TokenParams{Op: TokenOpRaw, SizeInBits: 256, Wrap: WrappingMechanismAESKWP}, false},
+		{"wrap aes gcm", TokenParams{Op: TokenOpRaw, SizeInBits: 256, Wrap: WrappingMechanismAESGCM}, false},
+		{"wrap unknown", TokenParams{Op: TokenOpRaw, SizeInBits: 256, Wrap: WrappingMechanismAESGCM + 1}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateTokenParams(&tt.p)
+			if tt.ok {
+				if err != nil {
+					t.Errorf("validateTokenParams() = %v, want nil", err)
+				}
+				return
+			}
+			if status.Code(err) != codes.InvalidArgument {
+				t.Errorf("validateTokenParams() = %v, want code %v", err, codes.InvalidArgument)
+			}
+			if !strings.Contains(err.Error(), fmt.Sprint(tt.p.SizeInBits)) && tt.p.HashAlgorithm != crypto.SHA1 && tt.p.Wrap == WrappingMechanismNone {
+				t.Errorf("validateTokenParams() = %v, want the offending size %d", err, tt.p.SizeInBits)
+			}
+		})
+	}
+}
+
+func TestHashLcToken(t *testing.T) {
+	token := []byte("0123456789abcdef")
+	tests := []struct {
+		op   TokenOp
+		want string
+	}{
+		{TokenOpHashedOtLcToken, "454915dd1b88893f87f008ad086db59d"},
+		{TokenOpHashedOtLcToken256, "0a7a4095f454a97697d420ac905fb95f"},
+	}
+	for _, tt := range tests {
+		got := append([]byte(nil), token...)
+		hashLcToken(tt.op, got)
+		if hex.EncodeToString(got) != tt.want {
+			t.Errorf("hashLcToken(%v) = %x, want %s", tt.op, got, tt.want)
+		}
+	}
+}
+
 func TestGenerateSymmKeysWrap(t *testing.T) {
 	hsm, _, _ := MakeHSM(t)
 
@@ -203,7 +638,7 @@ func TestGenerateSymmKeysWrap(t *testing.T) {
 	}
 
 	// Generate the actual tokens (using the HSM).
-	res, err := hsm.GenerateTokens(params)
+	res, err := hsm.GenerateTokens(context.Background(), params)
 	ts.Check(t, err)
 	if len(res) != 1 {
 		t.Fatal("expected 1 token, got", len(res))
@@ -238,128 +673,3054 @@ func TestGenerateSymmKeysWrap(t *testing.T) {
 	if !bytes.Equal(r.Token, expected_token) {
 		t.Fatal("generate token failed")
 	}
-}
-
-// MintECDSAKeys generates a P256 ECDSA key pair to be used by various tests
-// below as the keys to a Certificate Authority (CA) or HSM identity.
-// It requires an initialized `hsm` instance.
-func MintECDSAKeys(t *testing.T, hsm *HSM) (pk11.KeyPair, error) {
-	session, release := hsm.sessions.getHandle()
-	defer release()
-	return session.GenerateECDSA(elliptic.P256(), &pk11.KeyOptions{Extractable: true})
-}
-
-func TestEndorseCert(t *testing.T) {
-	log.Printf("TestEndorseCert")
-	hsm, _, _ := MakeHSM(t)
-
-	const kcaPrivName = "kca_priv"
-
-	// The following nested function is required to avoid deadlocks when calling
-	// `hsm.sessions.getHandle()` in the `EndorseCert` function.
-	importCAKey := func() {
-		privateKeyDer := readFile(t, diceCAKeyPath)
-		privateKey, err := x509.ParsePKCS8PrivateKey(privateKeyDer)
-		ts.Check(t, err)
 
-		// Import the CA key into the HSM.
-		session, release := hsm.sessions.getHandle()
+	// Check that the wrapping key fingerprint matches the wrapping key.
+	expected_fp := func() []byte {
+		s, release := hsm.sessions.getHandle()
 		defer release()
 
-		// Cast the private key to an ECDSA private key to make sure the
-		// `ImportKey` function imports the key as an ECDSA key.
-		privateKey = privateKey.(*ecdsa.PrivateKey)
-		ca, err := session.ImportKey(privateKey, &pk11.KeyOptions{
-			Extractable: true,
-			Token:       true,
-		})
+		wk, err := s.FindPublicKey(hsm.PublicKeys["TokenWrappingKey"])
 		ts.Check(t, err)
-		err = ca.SetLabel(kcaPrivName)
+		wkPub, err := wk.ExportKey()
+		ts.Check(t, err)
+		der, err := x509.MarshalPKIXPublicKey(wkPub)
 		ts.Check(t, err)
+		fp := sha256.Sum256(der)
+		return fp[:]
+	}()
+	if !bytes.Equal(r.WrapKeyFingerprint, expected_fp) {
+		t.Errorf("WrapKeyFingerprint = %x, want %x", r.WrapKeyFingerprint, expected_fp)
 	}
+}
 
-	importCAKey()
-	caCertPEM := readFile(t, diceCACertPath)
-	caCertBlock, _ := pem.Decode(caCertPEM)
-	caCert, err := x509.ParseCertificate(caCertBlock.Bytes)
+// makeTransportWrapKeys adds the "TransportWrappingKey" AES and HMAC keys to
+// `hsm`, and returns an extractable secret key to wrap.
+func makeTransportWrapKeys(t *testing.T, hsm *HSM) pk11.SecretKey {
+	t.Helper()
+	session, release := hsm.sessions.getHandle()
+	wk, err := session.GenerateAES(256, nil)
+	ts.Check(t, err)
+	wkUID, err := wk.UID()
+	ts.Check(t, err)
+	mk, err := session.Generate(256, nil)
 	ts.Check(t, err)
+	mkUID, err := mk.UID()
+	ts.Check(t, err)
+	key, err := session.Generate(256, &pk11.KeyOptions{Extractable: true})
+	ts.Check(t, err)
+	release()
 
-	roots := x509.NewCertPool()
-	roots.AddCert(caCert)
+	hsm.SymmetricKeys["TransportWrappingKey"] = wkUID
+	hsm.SymmetricKeys["TransportWrappingKey-mac"] = mkUID
+	return key
+}
 
-	log.Printf("Reading TBS")
-	tbs := readFile(t, diceTBSPath)
+func TestWrapAndTimestamp(t *testing.T) {
+	hsm, _, _ := MakeHSM(t)
+	key := makeTransportWrapKeys(t, hsm)
 
-	log.Printf("Endorsing cert")
-	certDER, err := hsm.EndorseCert(tbs, EndorseCertParams{
-		KeyLabel:           kcaPrivName,
-		SignatureAlgorithm: x509.ECDSAWithSHA256,
-	})
+	wrapped, err := hsm.WrapAndTimestamp(context.Background(), key, "TransportWrappingKey")
 	ts.Check(t, err)
+	if len(wrapped.Nonce) != wrapNonceSize {
+		t.Errorf("len(Nonce) = %d, want %d", len(wrapped.Nonce), wrapNonceSize)
+	}
 
-	cert, err := x509.ParseCertificate(certDER)
+	var got []byte
+	var unwrapped pk11.SecretKey
+	err = hsm.UnwrapWithTimestampVerification(context.Background(), wrapped, time.Minute, func(k pk11.SecretKey) error {
+		unwrapped = k
+		var err error
+		got, err = k.SignHMAC256([]byte("data"))
+		return err
+	})
 	ts.Check(t, err)
 
-	// DICE extensions marked as critical end up in this list. We explicitly
-	// clear the list to get x509.Verify to pass.
-	cert.UnhandledCriticalExtensions = nil
-
-	_, err = cert.Verify(x509.VerifyOptions{
-		Roots: roots,
-	})
+	_, release := hsm.sessions.getHandle()
+	defer release()
+	want, err := key.SignHMAC256([]byte("data"))
 	ts.Check(t, err)
+	if !bytes.Equal(got, want) {
+		t.Error("unwrapped key does not match the original key")
+	}
+	if _, err := unwrapped.SignHMAC256([]byte("data")); err == nil {
+		t.Error("unwrapped key not destroyed after use")
+	}
 }
 
-func TestEndorseData(t *testing.T) {
-	log.Printf("TestEndorseData")
+func TestUnwrapWithTimestampVerificationRejects(t *testing.T) {
 	hsm, _, _ := MakeHSM(t)
+	key := makeTransportWrapKeys(t, hsm)
 
-	// Mint ECDSA keys on HSM.
-	identityKeyPair, err := MintECDSAKeys(t, hsm)
+	wrapped, err := hsm.WrapAndTimestamp(context.Background(), key, "TransportWrappingKey")
 	ts.Check(t, err)
 
-	_, release := hsm.sessions.getHandle()
-	// Add labels to key objects in the HSM.
-	const kIdPrivName = "kid_priv"
-	const kIdPubName = "kid_pub"
-	err = identityKeyPair.PrivateKey.SetLabel(kIdPrivName)
-	ts.Check(t, err)
-	err = identityKeyPair.PublicKey.SetLabel(kIdPubName)
-	ts.Check(t, err)
-	// Export public key from HSM.
-	idPublicKeyExported, err := identityKeyPair.PublicKey.ExportKey()
+	tests := []struct {
+		name   string
+		modify func(w *WrappedKeyWithTimestamp)
+		maxAge time.Duration
+	}{
+		{
+			name:   "expired",
+			modify: func(w *WrappedKeyWithTimestamp) {},
+			maxAge: -time.Second,
+		},
+		{
+			name:   "timestamp_modified",
+			modify: func(w *WrappedKeyWithTimestamp) { w.Timestamp++ },
+			maxAge: time.Hour,
+		},
+		{
+			name:   "nonce_modified",
+			modify: func(w *WrappedKeyWithTimestamp) { w.Nonce[0] ^= 1 },
+			maxAge: time.Hour,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := wrapped
+			w.Nonce = append([]byte{}, wrapped.Nonce...)
+			tt.modify(&w)
+			err := hsm.UnwrapWithTimestampVerification(context.Background(), w, tt.maxAge, func(pk11.SecretKey) error {
+				t.Error("use called with a rejected wrapped key")
+				return nil
+			})
+			if status.Code(err) != codes.InvalidArgument {
+				t.Errorf("UnwrapWithTimestampVerification() = %v, want code %v", err, codes.InvalidArgument)
+			}
+		})
+	}
+}
+
+func TestCheckWrappedKeyLen(t *testing.T) {
+	wk, err := rsa.GenerateKey(rand.Reader, 2048)
 	ts.Check(t, err)
-	idPublicKey := idPublicKeyExported.(*ecdsa.PublicKey)
-	release()
 
-	log.Printf("Reading data")
-	data := readFile(t, diceTBSPath)
+	tests := []struct {
+		name    string
+		wrapped []byte
+		mech    WrappingMechanism
+		key     any
+		expCode codes.Code
+	}{
+		{
+			name:    "ok pkcs",
+			wrapped: make([]byte, wk.PublicKey.Size()),
+			mech:    WrappingMechanismRSAPCKS,
+			key:     &wk.PublicKey,
+			expCode: codes.OK,
+		},
+		{
+			name:    "ok oaep",
+			wrapped: make([]byte, wk.PublicKey.Size()),
+			mech:    WrappingMechanismRSAOAEP,
+			key:     &wk.PublicKey,
+			expCode: codes.OK,
+		},
+		{
+			name:    "truncated",
+			wrapped: make([]byte, wk.PublicKey.Size()-1),
+			mech:    WrappingMechanismRSAOAEP,
+			key:     &wk.PublicKey,
+			expCode: codes.Internal,
+		},
+		{
+			name:    "empty",
+			wrapped: []byte{},
+			mech:    WrappingMechanismRSAPCKS,
+			key:     &wk.PublicKey,
+			expCode: codes.Internal,
+		},
+		{
+			name:    "wrong key type",
+			wrapped: make([]byte, wk.PublicKey.Size()),
+			mech:    WrappingMechanismRSAPCKS,
+			key:     []byte("not a key"),
+			expCode: codes.Internal,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkWrappedKeyLen(tt.wrapped, tt.mech, tt.key)
+			if got := status.Code(err); got != tt.expCode {
+				t.Errorf("checkWrappedKeyLen() code = %v, want %v (err: %v)", got, tt.expCode, err)
+			}
+		})
+	}
+}
 
-	// Perform data signature operation.
-	log.Printf("Endorsing data")
-	asn1PubKey, asn1Sig, err := hsm.EndorseData(data, EndorseCertParams{
-		KeyLabel:           kIdPrivName,
-		SignatureAlgorithm: x509.ECDSAWithSHA256,
-	})
+func TestCheckValidity(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	ts.Check(t, err)
 
-	// Check public keys match.
-	var pubKey struct{ X, Y *big.Int }
-	_, err = asn1.Unmarshal(asn1PubKey, &pubKey)
-	if pubKey.X.Cmp(idPublicKey.X) != 0 {
-		t.Fatal("pubkey (X) exported does not match one in HSM")
+	const skew = 5 * time.Minute
+	// X.509 times have a resolution of one second.
+	now := time.Now().UTC().Truncate(time.Second)
+
+	tests := []struct {
+		name      string
+		notBefore time.Time
+		notAfter  time.Time
+		expCode   codes.Code
+	}{
+		{
+			name:      "now",
+			notBefore: now,
+			notAfter:  now.Add(time.Hour),
+			expCode:   codes.OK,
+		},
+		{
+			name:      "future at skew limit",
+			notBefore: now.Add(skew),
+			notAfter:  now.Add(time.Hour),
+			expCode:   codes.OK,
+		},
+		{
+			name:      "future beyond skew limit",
+			notBefore: now.Add(skew + time.Second),
+			notAfter:  now.Add(time.Hour),
+			expCode:   codes.InvalidArgument,
+		},
+		{
+			name:      "backdated at skew limit",
+			notBefore: now.Add(-skew),
+			notAfter:  now.Add(time.Hour),
+			expCode:   codes.OK,
+		},
+		{
+			name:      "backdated beyond skew limit",
+			notBefore: now.Add(-skew - time.Second),
+			notAfter:  now.Add(time.Hour),
+			expCode:   codes.InvalidArgument,
+		},
+		{
+			name:      "expired",
+			notBefore: now,
+			notAfter:  now,
+			expCode:   codes.InvalidArgument,
+		},
 	}
-	if pubKey.Y.Cmp(idPublicKey.Y) != 0 {
-		t.Fatal("pubkey (Y) exported does not match one in HSM")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			template := &x509.Certificate{
+				SerialNumber: big.NewInt(1),
+				Subject:      pkix.Name{CommonName: "Test Device"},
+				NotBefore:    tt.notBefore,
+				NotAfter:     tt.notAfter,
+			}
+			der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+			ts.Check(t, err)
+			cert, err := x509.ParseCertificate(der)
+			ts.Check(t, err)
+
+			err = checkValidity(cert.RawTBSCertificate, now, skew)
+			if got := status.Code(err); got != tt.expCode {
+				t.Errorf("checkValidity() code = %v, want %v (err: %v)", got, tt.expCode, err)
+			}
+		})
 	}
 
-	// Verify signatures.
-	log.Printf("Verifying data signature")
-	dataHash := sha256.Sum256(data)
-	var sig struct{ R, S *big.Int }
-	_, err = asn1.Unmarshal(asn1Sig, &sig)
-	verfied := ecdsa.Verify(idPublicKey, dataHash[:], sig.R, sig.S)
-	if !verfied {
-		t.Errorf("signature failed to verify")
+	if err := checkValidity([]byte("not a certificate"), now, skew); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("checkValidity() code = %v, want %v (err: %v)", status.Code(err), codes.InvalidArgument, err)
+	}
+}
+
+func TestValidateWrappingKey(t *testing.T) {
+	s := ts.GetSession(t)
+	ts.Check(t, s.Login(pk11.NormalUser, ts.UserPin))
+
+	tests := []struct {
+		name    string
+		bits    uint
+		opts    pk11.KeyOptions
+		wantErr string
+	}{
+		{
+			name: "ok",
+			bits: 3072,
+			opts: pk11.KeyOptions{Token: true, Wrapping: true},
+		},
+		{
+			name:    "weak key",
+			bits:    2048,
+			opts:    pk11.KeyOptions{Token: true, Wrapping: true},
+			wantErr: "too weak",
+		},
+		{
+			name:    "missing wrap attribute",
+			bits:    3072,
+			opts:    pk11.KeyOptions{Token: true, Encryption: true},
+			wantErr: "wrap attribute",
+		},
+		{
+			name:    "session object",
+			bits:    3072,
+			opts:    pk11.KeyOptions{Wrapping: true},
+			wantErr: "token object",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kp, err := s.GenerateRSA(tt.bits, 0x010001, &tt.opts)
+			ts.Check(t, err)
+			err = validateWrappingKey(kp.PublicKey, defaultMinWrappingKeyBits)
+			if tt.wantErr == "" {
+				ts.Check(t, err)
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validateWrappingKey() = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGetRandomInt(t *testing.T) {
+	hsm, _, _ := MakeHSM(t)
+
+	const (
+		numBuckets = 10
+		numSamples = 10000
+		// Chi-squared critical value for 9 degrees of freedom at p = 0.001.
+		chiSquaredCritical = 27.877
+	)
+	min := big.NewInt(100)
+	max := big.NewInt(100 + numBuckets)
+
+	var counts [numBuckets]int
+	for i := 0; i < numSamples; i++ {
+		n, err := hsm.GetRandomInt(context.Background(), min, max)
+		ts.Check(t, err)
+		if n.Cmp(min) < 0 || n.Cmp(max) >= 0 {
+			t.Fatalf("GetRandomInt() = %v, want value in [%v, %v)", n, min, max)
+		}
+		counts[n.Int64()-min.Int64()]++
+	}
+
+	expected := float64(numSamples) / numBuckets
+	chiSquared := 0.0
+	for _, c := range counts {
+		d := float64(c) - expected
+		chiSquared += d * d / expected
+	}
+	if chiSquared > chiSquaredCritical {
+		t.Errorf("distribution is not uniform: chi-squared = %f, counts = %v", chiSquared, counts)
+	}
+}
+
+func TestBulkGenerateCertSerials(t *testing.T) {
+	hsm, _, _ := MakeHSM(t)
+
+	const n = 100
+	serials, err := hsm.BulkGenerateCertSerials(context.Background(), n)
+	ts.Check(t, err)
+	if len(serials) != n {
+		t.Fatalf("BulkGenerateCertSerials() returned %d serial numbers, want %d", len(serials), n)
+	}
+	seen := make(map[string]bool)
+	for _, sn := range serials {
+		der, err := asn1.Marshal(sn)
+		ts.Check(t, err)
+		// Tag, length and exactly certSerialSize content bytes.
+		if len(der) != certSerialSize+2 {
+			t.Errorf("serial number %x encodes to %d bytes, want %d", sn, len(der), certSerialSize+2)
+		}
+		if seen[sn.String()] {
+			t.Errorf("duplicate serial number %x", sn)
+		}
+		seen[sn.String()] = true
+	}
+}
+
+func TestGetRandomIntInvalidRange(t *testing.T) {
+	hsm, _, _ := MakeHSM(t)
+
+	if _, err := hsm.GetRandomInt(context.Background(), big.NewInt(10), big.NewInt(10)); err == nil {
+		t.Error("expected error for empty range")
+	}
+	n, err := hsm.GetRandomInt(context.Background(), big.NewInt(7), big.NewInt(8))
+	ts.Check(t, err)
+	if n.Int64() != 7 {
+		t.Errorf("GetRandomInt() = %v, want 7", n)
+	}
+}
+
+func TestVerifyRequiredMechanisms(t *testing.T) {
+	hsm, _, _ := MakeHSM(t)
+
+	mechs, err := hsm.GetSlotMechanisms(context.Background())
+	ts.Check(t, err)
+	if len(mechs) == 0 {
+		t.Fatal("GetSlotMechanisms() returned no mechanisms")
+	}
+
+	ts.Check(t, hsm.VerifyRequiredMechanisms(context.Background(), []uint{pkcs11.CKM_ECDSA, pkcs11.CKM_AES_GCM}))
+
+	// All unsupported mechanisms must be reported at once.
+	err = hsm.VerifyRequiredMechanisms(context.Background(), []uint{pkcs11.CKM_ECDSA, 0x80000001, 0x80000002})
+	if err == nil {
+		t.Fatal("expected VerifyRequiredMechanisms to fail")
+	}
+	for _, name := range []string{"0x80000001", "0x80000002"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("error %q does not list missing mechanism %s", err, name)
+		}
+	}
+	if strings.Contains(err.Error(), "CKM_ECDSA") {
+		t.Errorf("error %q lists supported mechanism CKM_ECDSA", err)
+	}
+}
+
+func TestDeepHealthCheck(t *testing.T) {
+	const numSessions = 4
+	sessions := newSessionQueue(numSessions)
+	open, _, err := newSessionOpener(ts.Plugin(), ts.UserPin, ts.GetSlot(t), false)
+	ts.Check(t, err)
+	sessions.open = open
+	unhealthy := map[*pk11.Session]bool{}
+	for i := 0; i < numSessions; i++ {
+		s := ts.GetSession(t)
+		ts.Check(t, s.Login(pk11.NormalUser, ts.UserPin))
+		ts.Check(t, sessions.insert(s))
+		// Flag the second and last sessions as unhealthy.
+		if i == 1 || i == numSessions-1 {
+			unhealthy[s] = true
+		}
+	}
+
+	hsm := &HSM{
+		sessions: sessions,
+		healthProbe: func(s *pk11.Session) error {
+			if unhealthy[s] {
+				return errors.New("probe failed")
+			}
+			return defaultHealthProbe(s)
+		},
+	}
+
+	report, err := hsm.DeepHealthCheck(context.Background())
+	ts.Check(t, err)
+	if report.NumHealthy != numSessions-2 {
+		t.Errorf("NumHealthy = %d, want %d", report.NumHealthy, numSessions-2)
+	}
+	for _, sh := range report.Sessions {
+		wantHealthy := sh.Index != 1 && sh.Index != numSessions-1
+		if sh.Healthy != wantHealthy {
+			t.Errorf("session %d: Healthy = %t, want %t (err: %v)", sh.Index, sh.Healthy, wantHealthy, sh.Err)
+		}
+	}
+
+	// The healthy sessions must be returned to the pool, and the unhealthy
+	// ones replaced.
+	if got := len(sessions.s); got != numSessions {
+		t.Errorf("sessions in pool = %d, want %d", got, numSessions)
+	}
+	for i := 0; i < numSessions; i++ {
+		s := <-sessions.s
+		if unhealthy[s] {
+			t.Error("unhealthy session was returned to the pool")
+		}
+		s.Close()
+	}
+}
+
+// flakyOpener returns a session opener failing while `fail` is set.
+func flakyOpener(t *testing.T, fail *atomic.Bool) sessionOpener {
+	t.Helper()
+	open, _, err := newSessionOpener(ts.Plugin(), ts.UserPin, ts.GetSlot(t), false)
+	ts.Check(t, err)
+	return func() (*pk11.Session, error) {
+		if fail.Load() {
+			return nil, errors.New("simulated HSM network failure")
+		}
+		return open()
+	}
+}
+
+func TestOpenSessionsDegraded(t *testing.T) {
+	ts.GetSession(t)
+	backfillInterval := sessionBackfillInterval
+	sessionBackfillInterval = 10 * time.Millisecond
+	defer func() { sessionBackfillInterval = backfillInterval }()
+
+	var fail atomic.Bool
+	open := flakyOpener(t, &fail)
+	calls := 0
+	sq, err := openSessions(func() (*pk11.Session, error) {
+		// Start failing after the first two sessions, until cleared below.
+		if calls++; calls == 3 {
+			fail.Store(true)
+		}
+		return open()
+	}, RetryPolicy{}, 4, 2, 4)
+	ts.Check(t, err)
+	hsm := &HSM{sessions: sq}
+
+	report, err := hsm.DeepHealthCheck(context.Background())
+	ts.Check(t, err)
+	if !report.Degraded || len(report.Sessions) != 2 {
+		t.Errorf("DeepHealthCheck() = degraded %v with %d sessions, want degraded with 2", report.Degraded, len(report.Sessions))
+	}
+
+	// The missing sessions are opened once the HSM is reachable again.
+	fail.Store(false)
+	deadline := time.Now().Add(5 * time.Second)
+	for sq.pending.Load() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	report, err = hsm.DeepHealthCheck(context.Background())
+	ts.Check(t, err)
+	if report.Degraded || report.NumHealthy != 4 {
+		t.Errorf("DeepHealthCheck() = degraded %v with %d healthy sessions, want 4 healthy", report.Degraded, report.NumHealthy)
+	}
+}
+
+func TestGetHandleContext(t *testing.T) {
+	q := newSessionQueue(1)
+	if err := q.insert(nil); err != nil {
+		t.Fatalf("insert() failed: %v", err)
+	}
+
+	_, release, err := q.getHandleContext(context.Background(), sessionClassShort)
+	if err != nil {
+		t.Fatalf("getHandleContext() failed: %v", err)
+	}
+
+	// The queue is empty until the session is released.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, timedOut, err := q.getHandleContext(ctx, sessionClassShort)
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("getHandleContext() = %v, want code %v", err, codes.DeadlineExceeded)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("getHandleContext() = %v, want %v", err, context.DeadlineExceeded)
+	}
+	// Releasing after a timeout is a no-op.
+	timedOut()
+
+	// The queue wait timeout applies without a context deadline.
+	q.waitTimeout = 10 * time.Millisecond
+	if _, _, err := q.getHandleContext(context.Background(), sessionClassShort); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("getHandleContext() = %v, want %v", err, context.DeadlineExceeded)
+	}
+	q.waitTimeout = 0
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := q.getHandleContext(ctx, sessionClassShort); status.Code(err) != codes.Canceled {
+		t.Errorf("getHandleContext() = %v, want code %v", err, codes.Canceled)
+	}
+
+	// Releasing twice returns the session to the queue only once.
+	release()
+	release()
+	if n := len(q.s); n != 1 {
+		t.Errorf("queue holds %d sessions, want 1", n)
+	}
+	if _, _, err := q.getHandleContext(context.Background(), sessionClassShort); err != nil {
+		t.Errorf("getHandleContext() after release failed: %v", err)
+	}
+}
+
+func TestSessionKeepalive(t *testing.T) {
+	const numSessions = 3
+	q := newSessionQueue(numSessions)
+	for i := 0; i < numSessions; i++ {
+		if err := q.insert(nil); err != nil {
+			t.Fatalf("insert() failed: %v", err)
+		}
+	}
+	var probes int
+	probe := func(*pk11.Session) error {
+		probes++
+		return nil
+	}
+
+	// One session is in use and is not probed.
+	_, release := q.getHandle()
+	q.keepaliveRound(probe)
+	if probes != numSessions-1 {
+		t.Errorf("keepalive probed %d sessions, want %d", probes, numSessions-1)
+	}
+	release()
+	if n := len(q.s); n != numSessions {
+		t.Errorf("queue holds %d sessions after keepalive, want %d", n, numSessions)
+	}
+
+	// The round is skipped while requests wait for a session.
+	probes = 0
+	q.waiters.Add(1)
+	q.keepaliveRound(probe)
+	q.waiters.Add(-1)
+	if probes != 0 {
+		t.Errorf("keepalive probed %d sessions under pressure, want 0", probes)
+	}
+}
+
+func TestReservedSessions(t *testing.T) {
+	const numSessions, reserved, numBulk = 3, 1, 5
+	q := newSessionQueue(numSessions)
+	q.reserved = reserved
+	for i := 0; i < numSessions; i++ {
+		if err := q.insert(nil); err != nil {
+			t.Fatalf("insert() failed: %v", err)
+		}
+	}
+	hsm := &HSM{sessions: q}
+
+	// Start more bulk operations than sessions, all blocking until done.
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < numBulk; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := hsm.execute(context.Background(), "GenerateTokens", func(*pk11.Session) error {
+				<-done
+				return nil
+			})
+			if err != nil {
+				t.Errorf("bulk operation failed: %v", err)
+			}
+		}()
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for q.bulkInUse.Load() < numSessions-reserved {
+		if time.Now().After(deadline) {
+			t.Fatal("bulk operations did not start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// The endorsement uses the reserved session instead of queuing behind
+	// the bulk operations.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := hsm.execute(ctx, "EndorseCert", func(*pk11.Session) error { return nil }); err != nil {
+		t.Errorf("EndorseCert with bulk operations in flight failed: %v", err)
+	}
+	if n := q.bulkInUse.Load(); n != numSessions-reserved {
+		t.Errorf("bulk operations hold %d sessions, want %d", n, numSessions-reserved)
+	}
+	if n := len(q.s); n != reserved {
+		t.Errorf("queue holds %d idle sessions, want the %d reserved ones", n, reserved)
+	}
+
+	close(done)
+	wg.Wait()
+	if n := q.bulkInUse.Load(); n != 0 {
+		t.Errorf("bulk operations hold %d sessions after completion, want 0", n)
+	}
+	if n := len(q.s); n != numSessions {
+		t.Errorf("queue holds %d sessions after completion, want %d", n, numSessions)
+	}
+}
+
+func TestReadWriteSessions(t *testing.T) {
+	newQueue := func(n int) *sessionQueue {
+		q := newSessionQueue(n)
+		for i := 0; i < n; i++ {
+			if err := q.insert(nil); err != nil {
+				t.Fatalf("insert() failed: %v", err)
+			}
+		}
+		return q
+	}
+	ro, rw := newQueue(2), newQueue(1)
+	hsm := &HSM{sessions: ro, rwSessions: rw}
+
+	// Read-only operations never consume the read-write session.
+	err := hsm.execute(context.Background(), "EndorseCert", func(*pk11.Session) error {
+		if n := len(ro.s); n != 1 {
+			t.Errorf("read-only queue holds %d idle sessions during EndorseCert, want 1", n)
+		}
+		if n := len(rw.s); n != 1 {
+			t.Errorf("read-write queue holds %d idle sessions during EndorseCert, want 1", n)
+		}
+		return nil
+	})
+	ts.Check(t, err)
+
+	err = hsm.ExecuteCmd(context.Background(), func(*pk11.Session) error {
+		if n := len(ro.s); n != 2 {
+			t.Errorf("read-only queue holds %d idle sessions during ExecuteCmd, want 2", n)
+		}
+		if n := len(rw.s); n != 0 {
+			t.Errorf("read-write queue holds %d idle sessions during ExecuteCmd, want 0", n)
+		}
+		return nil
+	})
+	ts.Check(t, err)
+
+	// Without read-write sessions, all operations use the same pool.
+	hsm.rwSessions = nil
+	if q := hsm.queue("ExecuteCmd"); q != ro {
+		t.Error("ExecuteCmd does not use the only session pool")
+	}
+}
+
+// reopenSessions makes the session pool of `hsm` open replacement sessions on
+// the test token and returns a pointer to the number of sessions opened.
+func reopenSessions(t *testing.T, hsm *HSM) *int {
+	opened := 0
+	hsm.sessions.open = func() (*pk11.Session, error) {
+		opened++
+		s := ts.GetSession(t)
+		return s, s.Login(pk11.NormalUser, ts.UserPin)
+	}
+	return &opened
+}
+
+func TestResizeSessions(t *testing.T) {
+	q := newResizableSessionQueue(1, 4)
+	s := ts.GetSession(t)
+	ts.Check(t, s.Login(pk11.NormalUser, ts.UserPin))
+	ts.Check(t, q.insert(s))
+	hsm := &HSM{sessions: q}
+	opened := reopenSessions(t, hsm)
+
+	checkStats := func(want PoolStats) {
+		t.Helper()
+		got := hsm.PoolStats()
+		got = PoolStats{Total: got.Total, InUse: got.InUse, Available: got.Available, Retiring: got.Retiring}
+		if got != want {
+			t.Errorf("PoolStats() = %+v, want %+v", got, want)
+		}
+	}
+
+	ts.Check(t, hsm.ResizeSessions(3))
+	checkStats(PoolStats{Total: 3, Available: 3})
+	if *opened != 2 {
+		t.Errorf("opened %d sessions, want 2", *opened)
+	}
+	for _, n := range []int{0, 5} {
+		if err := hsm.ResizeSessions(n); err == nil {
+			t.Errorf("ResizeSessions(%d) succeeded, want error", n)
+		}
+	}
+
+	// Sessions in use are retired when returned.
+	_, release1 := q.getHandle()
+	_, release2 := q.getHandle()
+	ts.Check(t, hsm.ResizeSessions(1))
+	checkStats(PoolStats{Total: 1, InUse: 2, Retiring: 1})
+
+	// Growing keeps retiring sessions before opening new ones.
+	ts.Check(t, hsm.ResizeSessions(2))
+	checkStats(PoolStats{Total: 2, InUse: 2})
+	ts.Check(t, hsm.ResizeSessions(1))
+	release1()
+	checkStats(PoolStats{Total: 1, InUse: 1})
+	release2()
+	checkStats(PoolStats{Total: 1, Available: 1})
+	if *opened != 2 {
+		t.Errorf("opened %d sessions, want 2", *opened)
+	}
+
+	// Concurrent resizes are serialized.
+	var wg sync.WaitGroup
+	for n := 1; n <= 4; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			if err := hsm.ResizeSessions(n); err != nil {
+				t.Errorf("ResizeSessions(%d) failed: %v", n, err)
+			}
+		}(n)
+	}
+	wg.Wait()
+	if stats := hsm.PoolStats(); stats.Total != stats.Available || stats.Total != len(q.s) {
+		t.Errorf("PoolStats() = %+v, want all %d sessions available", stats, len(q.s))
+	}
+}
+
+func TestExecuteCmdReplacesLostSession(t *testing.T) {
+	hsm, _, _ := MakeHSM(t)
+	opened := reopenSessions(t, hsm)
+
+	// Simulate an HSM restart by closing the session under the first
+	// attempt. The command is retried with the replacement session.
+	attempts := 0
+	err := hsm.ExecuteCmd(context.Background(), func(s *pk11.Session) error {
+		attempts++
+		if attempts == 1 {
+			ts.Check(t, s.Close())
+		}
+		return s.Ping()
+	})
+	ts.Check(t, err)
+	if attempts != 2 {
+		t.Errorf("command ran %d times, want 2", attempts)
+	}
+	if *opened != 1 {
+		t.Errorf("opened %d replacement sessions, want 1", *opened)
+	}
+	if got := hsm.PoolStats().Total; got != 1 {
+		t.Errorf("PoolStats().Total = %d, want 1", got)
+	}
+}
+
+func TestLostSessionRecovery(t *testing.T) {
+	hsm, _, _ := MakeHSM(t)
+	opened := reopenSessions(t, hsm)
+
+	// Close the pooled session out from under the pool.
+	s, release := hsm.sessions.getHandle()
+	ts.Check(t, s.Close())
+	release()
+
+	// The entry point recovers even though the PKCS#11 error is not wrapped.
+	_, err := hsm.GetRandomInt(context.Background(), big.NewInt(0), big.NewInt(100))
+	ts.Check(t, err)
+	if *opened != 1 {
+		t.Errorf("opened %d replacement sessions, want 1", *opened)
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	transient := pk11.Error{Raw: pkcs11.CKR_FUNCTION_FAILED}
+	p := RetryPolicy{
+		MaxAttempts:    4,
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     300 * time.Millisecond,
+	}
+	for _, tc := range []struct {
+		attempt  int
+		min, max time.Duration
+	}{
+		{1, 50 * time.Millisecond, 100 * time.Millisecond},
+		{2, 100 * time.Millisecond, 200 * time.Millisecond},
+		// Capped by MaxBackoff.
+		{3, 150 * time.Millisecond, 300 * time.Millisecond},
+	} {
+		d, ok := p.backoff(tc.attempt, 0, fmt.Errorf("failed to sign: %w", transient))
+		if !ok || d < tc.min || d > tc.max {
+			t.Errorf("backoff(%d) = %v, %t, want a delay in [%v, %v]", tc.attempt, d, ok, tc.min, tc.max)
+		}
+	}
+
+	for _, tc := range []struct {
+		name    string
+		policy  RetryPolicy
+		attempt int
+		elapsed time.Duration
+		err     error
+	}{
+		{"success", p, 1, 0, nil},
+		{"max attempts", p, 4, 0, transient},
+		{"disabled", RetryPolicy{}, 1, 0, transient},
+		{"max elapsed", RetryPolicy{MaxAttempts: 4, MaxElapsed: time.Second}, 1, time.Second, transient},
+		{"not retryable", p, 1, 0, pk11.Error{Raw: pkcs11.CKR_PIN_INCORRECT}},
+		{"not a PKCS#11 error", p, 1, 0, errors.New("failed")},
+		{"not listed", RetryPolicy{MaxAttempts: 4, RetryableErrors: []uint{0x80000001}}, 1, 0, transient},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if d, ok := tc.policy.backoff(tc.attempt, tc.elapsed, tc.err); ok {
+				t.Errorf("backoff() = %v, true, want no retry", d)
+			}
+		})
+	}
+}
+
+func TestExecuteCmdRetriesTransientErrors(t *testing.T) {
+	hsm, _, _ := MakeHSM(t)
+	hsm.config.Retry = RetryPolicy{
+		MaxAttempts:     4,
+		InitialBackoff:  time.Millisecond,
+		RetryableErrors: []uint{pkcs11.CKR_FUNCTION_FAILED},
+	}
+
+	// failing returns a command failing `n` times with `code`.
+	failing := func(n int, code pkcs11.Error) (CmdFunc, *int) {
+		attempts := 0
+		return func(s *pk11.Session) error {
+			attempts++
+			if attempts <= n {
+				return fmt.Errorf("failed to sign: %w", pk11.Error{Raw: code})
+			}
+			return s.Ping()
+		}, &attempts
+	}
+
+	cmd, attempts := failing(3, pkcs11.CKR_FUNCTION_FAILED)
+	ts.Check(t, hsm.ExecuteCmd(context.Background(), cmd))
+	if *attempts != 4 {
+		t.Errorf("command ran %d times, want 4", *attempts)
+	}
+
+	cmd, attempts = failing(4, pkcs11.CKR_FUNCTION_FAILED)
+	if err := hsm.ExecuteCmd(context.Background(), cmd); err == nil {
+		t.Error("ExecuteCmd() succeeded after exhausting the retries, want error")
+	}
+	if *attempts != 4 {
+		t.Errorf("command ran %d times, want 4", *attempts)
+	}
+
+	cmd, attempts = failing(1, pkcs11.CKR_PIN_INCORRECT)
+	if err := hsm.ExecuteCmd(context.Background(), cmd); err == nil {
+		t.Error("ExecuteCmd() succeeded after a non-retryable error, want error")
+	}
+	if *attempts != 1 {
+		t.Errorf("command ran %d times, want 1", *attempts)
+	}
+}
+
+func TestSessionHealthCheck(t *testing.T) {
+	hsm, _, _ := MakeHSM(t)
+	opened := reopenSessions(t, hsm)
+	q := hsm.sessions
+
+	// Close the idle session out from under the pool, as a dropped HSM
+	// connection would.
+	s, release := q.getHandle()
+	ts.Check(t, s.Close())
+	release()
+
+	open := q.open
+	reopened := make(chan struct{}, 1)
+	q.open = func() (*pk11.Session, error) {
+		defer func() { reopened <- struct{}{} }()
+		return open()
+	}
+	done := make(chan struct{})
+	go func() {
+		q.healthCheck(time.Millisecond)
+		close(done)
+	}()
+	select {
+	case <-reopened:
+	case <-time.After(10 * time.Second):
+		t.Error("lost session was not replaced")
+	}
+	q.close()
+	<-done
+	if *opened != 1 {
+		t.Fatalf("opened %d replacement sessions, want 1", *opened)
+	}
+
+	// The replacement session is usable without a failed operation.
+	replacement := <-q.s
+	ts.Check(t, replacement.Ping())
+}
+
+func TestClose(t *testing.T) {
+	hsm, _, _ := MakeHSM(t)
+
+	// Close waits for the session in use until the timeout.
+	hsm.config.CloseTimeout = 10 * time.Millisecond
+	s, release := hsm.sessions.getHandle()
+	ts.Check(t, hsm.Close())
+
+	// The session in use was not closed.
+	ts.Check(t, s.Ping())
+
+	// No sessions are handed out after Close.
+	if _, _, err := hsm.sessions.getHandleContext(context.Background(), sessionClassShort); status.Code(err) != codes.Unavailable {
+		t.Errorf("getHandleContext() after Close() = %v, want code %v", err, codes.Unavailable)
+	}
+	if err := hsm.ExecuteCmd(context.Background(), func(*pk11.Session) error { return nil }); status.Code(err) != codes.Unavailable {
+		t.Errorf("ExecuteCmd() after Close() = %v, want code %v", err, codes.Unavailable)
+	}
+
+	// The session is closed when returned.
+	release()
+	if n := len(hsm.sessions.s); n != 0 {
+		t.Errorf("queue holds %d sessions after Close(), want 0", n)
+	}
+	if err := s.Ping(); err == nil {
+		t.Errorf("Ping() on a closed session succeeded")
+	}
+	if got := hsm.PoolStats().Total; got != 0 {
+		t.Errorf("PoolStats().Total = %d after Close(), want 0", got)
+	}
+
+	// Closing again does not wait for the closed sessions.
+	hsm.config.CloseTimeout = 0
+	start := time.Now()
+	ts.Check(t, hsm.Close())
+	if elapsed := time.Since(start); elapsed >= defaultCloseTimeout {
+		t.Errorf("second Close() took %v", elapsed)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	s := ts.GetSession(t)
+	ts.Check(t, s.Login(pk11.NormalUser, ts.UserPin))
+	kp, err := s.GenerateRSA(3072, 0x010001, &pk11.KeyOptions{Token: true})
+	ts.Check(t, err)
+	ts.Check(t, kp.PrivateKey.SetLabel("ReconnectKey"))
+
+	hsm, err := NewHSM(HSMConfig{
+		SOPath:      ts.Plugin(),
+		SlotID:      ts.GetSlot(t),
+		HSMPassword: ts.UserPin,
+		NumSessions: 1,
+		PrivateKeys: []string{"ReconnectKey"},
+	})
+	ts.Check(t, err)
+	sessions := hsm.sessions
+
+	// A failed reconnection keeps the current sessions.
+	hsm.config.HSMPassword = "wrong password"
+	if err := hsm.Reconnect(); err == nil {
+		t.Fatal("Reconnect() with a wrong password succeeded, want error")
+	}
+	if hsm.sessions != sessions {
+		t.Error("failed Reconnect() replaced the session pool")
+	}
+	ts.Check(t, hsm.ExecuteCmd(context.Background(), func(s *pk11.Session) error { return s.Ping() }))
+
+	hsm.config.HSMPassword = ts.UserPin
+	ts.Check(t, hsm.Reconnect())
+	if hsm.sessions == sessions {
+		t.Error("Reconnect() did not replace the session pool")
+	}
+	if !sessions.closing.Load() {
+		t.Error("Reconnect() did not close the replaced session pool")
+	}
+	if _, ok := hsm.privateKeyID("ReconnectKey"); !ok {
+		t.Error("Reconnect() did not resolve the private keys")
+	}
+	ts.Check(t, hsm.ExecuteCmd(context.Background(), func(s *pk11.Session) error { return s.Ping() }))
+}
+
+func TestReconnectConcurrentExecuteCmd(t *testing.T) {
+	newQueue := func(n int) *sessionQueue {
+		q := newSessionQueue(n)
+		for i := 0; i < n; i++ {
+			if err := q.insert(nil); err != nil {
+				t.Fatalf("insert() failed: %v", err)
+			}
+		}
+		return q
+	}
+	hsm := &HSM{sessions: newQueue(2), rwSessions: newQueue(1)}
+
+	// Operations waiting for a session of a replaced pool are served by the
+	// new pool. Run with -race to check for data races.
+	var wg sync.WaitGroup
+	errs := make(chan error, 16*100)
+	for w := 0; w < 16; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				errs <- hsm.ExecuteCmd(context.Background(), func(*pk11.Session) error { return nil })
+			}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		old, err := hsm.swap(&HSM{
+			SymmetricKeys: map[string][]byte{"Seed": {byte(i)}},
+			sessions:      newQueue(2),
+			rwSessions:    newQueue(1),
+		})
+		ts.Check(t, err)
+		// The pools hold nil sessions, which cannot be drained.
+		for _, q := range old {
+			q.close()
+		}
+		if _, ok := hsm.symmetricKeyID("Seed"); !ok {
+			t.Error("swap() did not replace the symmetric keys")
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("ExecuteCmd() during Reconnect() failed: %v", err)
+		}
+	}
+
+	// The HSM cannot be reconnected once closed.
+	hsm.mu.Lock()
+	hsm.closed = true
+	hsm.mu.Unlock()
+	if _, err := hsm.swap(&HSM{}); err != errSessionPoolClosed {
+		t.Errorf("swap() after Close() = %v, want %v", err, errSessionPoolClosed)
+	}
+	if err := hsm.Reconnect(); status.Code(err) != codes.Unavailable {
+		t.Errorf("Reconnect() after Close() = %v, want code %v", err, codes.Unavailable)
+	}
+}
+
+func TestSessionQueueCloseWakesWaiters(t *testing.T) {
+	q := newSessionQueue(1)
+	if err := q.insert(nil); err != nil {
+		t.Fatalf("insert() failed: %v", err)
+	}
+	_, release := q.getHandle()
+	defer release()
+
+	errs := make(chan error)
+	go func() {
+		_, _, err := q.getHandleContext(context.Background(), sessionClassShort)
+		errs <- err
+	}()
+	for q.waiters.Load() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if !q.close() {
+		t.Fatal("close() = false, want true")
+	}
+	if err := <-errs; err != errSessionPoolClosed {
+		t.Errorf("getHandleContext() = %v, want %v", err, errSessionPoolClosed)
+	}
+	if q.close() {
+		t.Error("second close() = true, want false")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("getHandle() on a closed queue did not panic")
+		}
+	}()
+	q.getHandle()
+}
+
+func TestSessionQueueConcurrentAccess(t *testing.T) {
+	const numSessions = 4
+	q := newSessionQueue(numSessions)
+	for i := 0; i < numSessions; i++ {
+		if err := q.insert(nil); err != nil {
+			t.Fatalf("insert() failed: %v", err)
+		}
+	}
+	if err := q.insert(nil); err == nil {
+		t.Errorf("insert() on a full queue succeeded, want error")
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 32; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				_, release := q.getHandle()
+				release()
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatal("session queue deadlocked")
+	}
+	if n := len(q.s); n != numSessions {
+		t.Errorf("queue holds %d sessions, want %d", n, numSessions)
+	}
+}
+
+// poolStatsCounts returns the stats of `hsm` without the durations, which
+// are not deterministic.
+func poolStatsCounts(hsm *HSM) PoolStats {
+	stats := hsm.PoolStats()
+	stats.WaitTime, stats.HoldTime = 0, 0
+	return stats
+}
+
+func TestPoolStats(t *testing.T) {
+	q := newSessionQueue(2)
+	for i := 0; i < 2; i++ {
+		if err := q.insert(nil); err != nil {
+			t.Fatalf("insert() failed: %v", err)
+		}
+	}
+	hsm := &HSM{sessions: q}
+
+	want := PoolStats{Total: 2, Available: 2}
+	if got := poolStatsCounts(hsm); got != want {
+		t.Errorf("PoolStats() = %+v, want %+v", got, want)
+	}
+
+	_, release1 := q.getHandle()
+	_, release2 := q.getHandle()
+	want = PoolStats{Total: 2, InUse: 2, HighWaterMark: 2, Checkouts: 2}
+	if got := poolStatsCounts(hsm); got != want {
+		t.Errorf("PoolStats() = %+v, want %+v", got, want)
+	}
+
+	// A request on the exhausted pool is counted as a wait.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	q.getHandleContext(ctx, sessionClassShort)
+	release1()
+	release2()
+	want = PoolStats{Total: 2, Available: 2, HighWaterMark: 2, Waits: 1, Checkouts: 2}
+	if got := poolStatsCounts(hsm); got != want {
+		t.Errorf("PoolStats() = %+v, want %+v", got, want)
+	}
+	if got := hsm.PoolStats().WaitTime; got < 10*time.Millisecond {
+		t.Errorf("PoolStats().WaitTime = %v, want at least 10ms", got)
+	}
+}
+
+func TestPoolStatsWaiters(t *testing.T) {
+	q := newSessionQueue(1)
+	if err := q.insert(nil); err != nil {
+		t.Fatalf("insert() failed: %v", err)
+	}
+	hsm := &HSM{sessions: q}
+
+	_, release := q.getHandle()
+	acquired := make(chan struct{})
+	go func() {
+		_, release := q.getHandle()
+		release()
+		close(acquired)
+	}()
+	for hsm.PoolStats().Waiters != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	release()
+	<-acquired
+	if got := hsm.PoolStats().Waiters; got != 0 {
+		t.Errorf("PoolStats().Waiters = %d, want 0", got)
+	}
+}
+
+func TestPoolStatsConcurrentGenerateRandom(t *testing.T) {
+	hsm, _, _ := MakeHSM(t)
+
+	const numCalls = 16
+	var wg sync.WaitGroup
+	for i := 0; i < numCalls; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := hsm.ExecuteCmd(context.Background(), func(s *pk11.Session) error {
+				_, err := s.GenerateRandom(32)
+				return err
+			})
+			if err != nil {
+				t.Errorf("GenerateRandom failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	stats := hsm.PoolStats()
+	if stats.Checkouts != numCalls {
+		t.Errorf("Checkouts = %d, want %d", stats.Checkouts, numCalls)
+	}
+	if stats.InUse != 0 || stats.Waiters != 0 {
+		t.Errorf("InUse = %d, Waiters = %d, want 0 after all calls returned", stats.InUse, stats.Waiters)
+	}
+	if stats.Available != stats.Total {
+		t.Errorf("Available = %d, want %d", stats.Available, stats.Total)
+	}
+	if stats.Waits >= numCalls {
+		t.Errorf("Waits = %d, want less than %d", stats.Waits, numCalls)
+	}
+	if stats.HoldTime <= 0 {
+		t.Errorf("HoldTime = %v, want positive", stats.HoldTime)
+	}
+}
+
+func TestOpenSessionsLazy(t *testing.T) {
+	// The background sessions open once `unblock` is closed.
+	unblock := make(chan struct{})
+	var calls atomic.Int32
+	open := func() (*pk11.Session, error) {
+		if calls.Add(1) > 1 {
+			<-unblock
+		}
+		return nil, nil
+	}
+	sq, err := openSessionsLazy(open, RetryPolicy{}, 4, 4)
+	ts.Check(t, err)
+	hsm := &HSM{sessions: sq}
+
+	if hsm.Ready() {
+		t.Error("Ready() = true before the background sessions are open")
+	}
+	// The initial session is usable right away.
+	_, release := sq.getHandle()
+	release()
+
+	close(unblock)
+	deadline := time.Now().Add(5 * time.Second)
+	for !hsm.Ready() {
+		if time.Now().After(deadline) {
+			t.Fatal("session pool did not warm up")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := len(sq.s); n != 4 {
+		t.Errorf("queue holds %d sessions, want 4", n)
+	}
+
+	if _, err := openSessionsLazy(func() (*pk11.Session, error) {
+		return nil, errors.New("unreachable")
+	}, RetryPolicy{}, 4, 4); err == nil {
+		t.Error("openSessionsLazy() succeeded without an initial session, want error")
+	}
+}
+
+func TestOpenSessionsBelowMinimum(t *testing.T) {
+	ts.GetSession(t)
+	var fail atomic.Bool
+	open := flakyOpener(t, &fail)
+	calls := 0
+	var opened []*pk11.Session
+	_, err := openSessions(func() (*pk11.Session, error) {
+		if calls++; calls > 1 {
+			fail.Store(true)
+		}
+		s, err := open()
+		if err == nil {
+			opened = append(opened, s)
+		}
+		return s, err
+	}, RetryPolicy{}, 4, 2, 4)
+	if err == nil {
+		t.Fatal("expected openSessions to fail below the minimum session count")
+	}
+	for _, s := range opened {
+		if s.Ping() == nil {
+			t.Error("openSessions leaked a session opened before failing")
+		}
+	}
+}
+
+func TestOpenWithRetry(t *testing.T) {
+	retry := RetryPolicy{
+		MaxAttempts:     3,
+		InitialBackoff:  time.Millisecond,
+		RetryableErrors: []uint{pkcs11.CKR_FUNCTION_FAILED},
+	}
+	// failing returns an opener failing `n` times with `code`.
+	failing := func(n int, code pkcs11.Error) (sessionOpener, *int) {
+		attempts := 0
+		return func() (*pk11.Session, error) {
+			attempts++
+			if attempts <= n {
+				return nil, fmt.Errorf("fail to login into the HSM slot 0: %w", pk11.Error{Raw: code})
+			}
+			return nil, nil
+		}, &attempts
+	}
+
+	tests := []struct {
+		name         string
+		failures     int
+		code         pkcs11.Error
+		wantErr      bool
+		wantAttempts int
+	}{
+		{"transient", 2, pkcs11.CKR_FUNCTION_FAILED, false, 3},
+		{"retries exhausted", 3, pkcs11.CKR_FUNCTION_FAILED, true, 3},
+		{"permanent", 1, pkcs11.CKR_PIN_INCORRECT, true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			open, attempts := failing(tt.failures, tt.code)
+			if _, err := openWithRetry(open, retry); (err != nil) != tt.wantErr {
+				t.Errorf("openWithRetry() = %v, want error %v", err, tt.wantErr)
+			}
+			if *attempts != tt.wantAttempts {
+				t.Errorf("opener called %d times, want %d", *attempts, tt.wantAttempts)
+			}
+		})
+	}
+
+	// Without a retry policy, sessions are opened once.
+	open, attempts := failing(1, pkcs11.CKR_FUNCTION_FAILED)
+	if _, err := openWithRetry(open, RetryPolicy{}); err == nil || *attempts != 1 {
+		t.Errorf("openWithRetry() = %v after %d attempts, want error after 1", err, *attempts)
+	}
+}
+
+func TestDeepHealthCheckTimeout(t *testing.T) {
+	hsm, _, _ := MakeHSM(t)
+
+	// Hold the only session so the health check cannot acquire it.
+	_, release := hsm.sessions.getHandle()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := hsm.DeepHealthCheck(ctx); err == nil {
+		t.Error("expected DeepHealthCheck to time out")
+	}
+	release()
+
+	report, err := hsm.DeepHealthCheck(context.Background())
+	ts.Check(t, err)
+	if report.NumHealthy != 1 {
+		t.Errorf("NumHealthy = %d, want 1", report.NumHealthy)
+	}
+
+	// A probe outlasting the deadline fails the check, and the session is
+	// returned to the pool once the probe completes.
+	unblock := make(chan struct{})
+	hsm.healthProbe = func(s *pk11.Session) error {
+		<-unblock
+		return defaultHealthProbe(s)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := hsm.DeepHealthCheck(ctx); status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("DeepHealthCheck() = %v with a blocked probe, want code %v", err, codes.DeadlineExceeded)
+	}
+	close(unblock)
+	_, release = hsm.sessions.getHandle()
+	release()
+}
+
+func TestEncryptWithPublicKey(t *testing.T) {
+	hsm, _, _ := MakeHSM(t)
+
+	session, release := hsm.sessions.getHandle()
+	kp, err := session.GenerateRSA(2048, 0x010001, &pk11.KeyOptions{Encryption: true})
+	ts.Check(t, err)
+	ts.Check(t, kp.PublicKey.SetLabel("PeerKey"))
+	release()
+
+	msg := []byte("session key")
+	ciphertext, err := hsm.EncryptWithPublicKey(context.Background(), "PeerKey", msg, crypto.SHA256)
+	ts.Check(t, err)
+
+	_, release = hsm.sessions.getHandle()
+	defer release()
+	plaintext, err := kp.PrivateKey.DecryptRSAOAEP(crypto.SHA256, ciphertext)
+	ts.Check(t, err)
+	if !bytes.Equal(plaintext, msg) {
+		t.Errorf("decrypted = %x, want %x", plaintext, msg)
+	}
+}
+
+func TestEncryptWithPublicKeyEC(t *testing.T) {
+	hsm, _, _ := MakeHSM(t)
+
+	session, release := hsm.sessions.getHandle()
+	kp, err := session.GenerateECDSA(elliptic.P256(), &pk11.KeyOptions{Extractable: true})
+	ts.Check(t, err)
+	ts.Check(t, kp.PublicKey.SetLabel("PeerKey"))
+	k, err := kp.PrivateKey.ExportKey()
+	ts.Check(t, err)
+	release()
+	priv := k.(*ecdsa.PrivateKey)
+
+	msg := []byte("session key")
+	payload, err := hsm.EncryptWithPublicKeyEC(context.Background(), "PeerKey", msg)
+	ts.Check(t, err)
+
+	// Decrypt the payload in software.
+	x, y := elliptic.Unmarshal(priv.Curve, payload.EphemeralPublicKey)
+	if x == nil {
+		t.Fatal("failed to parse ephemeral public key")
+	}
+	shared, _ := priv.Curve.ScalarMult(x, y, priv.D.Bytes())
+	secret := make([]byte, 32)
+	shared.FillBytes(secret)
+	cek := make([]byte, 32)
+	_, err = io.ReadFull(hkdf.New(sha256.New, secret, nil, payload.EphemeralPublicKey), cek)
+	ts.Check(t, err)
+	block, err := aes.NewCipher(cek)
+	ts.Check(t, err)
+	aead, err := cipher.NewGCM(block)
+	ts.Check(t, err)
+	plaintext, err := aead.Open(nil, payload.Nonce, payload.Ciphertext, nil)
+	ts.Check(t, err)
+	if !bytes.Equal(plaintext, msg) {
+		t.Errorf("decrypted = %x, want %x", plaintext, msg)
+	}
+
+	if _, err := hsm.EncryptWithPublicKeyEC(context.Background(), "TokenWrappingKey", msg); err == nil {
+		t.Error("expected error when using an RSA key")
+	}
+}
+
+func TestNewHSMReadOnly(t *testing.T) {
+	// Provision a token wrapping key as Crypto User, then log out.
+	s := ts.GetSession(t)
+	ts.Check(t, s.Login(pk11.NormalUser, ts.UserPin))
+	kp, err := s.GenerateRSA(3072, 0x010001, &pk11.KeyOptions{
+		Token:      true,
+		Wrapping:   true,
+		Encryption: true,
+	})
+	ts.Check(t, err)
+	ts.Check(t, kp.PublicKey.SetLabel("TokenWrappingKey"))
+	ts.Check(t, kp.PrivateKey.SetLabel("TokenWrappingKey"))
+	s.Logout()
+
+	cfg := HSMConfig{
+		SOPath:       ts.Plugin(),
+		SlotID:       ts.GetSlot(t),
+		NumSessions:  1,
+		PublicKeys:   []string{"TokenWrappingKey"},
+		WrappingKeys: []string{"TokenWrappingKey"},
+	}
+	hsm, err := NewHSMReadOnly(cfg)
+	ts.Check(t, err)
+
+	// Read paths work without the Crypto User PIN.
+	pub, err := hsm.ExportPublicKey(context.Background(), "TokenWrappingKey")
+	ts.Check(t, err)
+	if _, ok := pub.(*rsa.PublicKey); !ok {
+		t.Errorf("ExportPublicKey() returned %T, want *rsa.PublicKey", pub)
+	}
+	_, err = hsm.EncryptWithPublicKey(context.Background(), "TokenWrappingKey", []byte("data"), crypto.SHA256)
+	ts.Check(t, err)
+	_, err = hsm.GetRandomInt(context.Background(), big.NewInt(0), big.NewInt(100))
+	ts.Check(t, err)
+
+	// Mutating paths are rejected.
+	params := EndorseCertParams{
+		KeyLabel:           "TokenWrappingKey",
+		SignatureAlgorithm: x509.ECDSAWithSHA256,
+	}
+	mutating := map[string]func() error{
+		"GenerateTokens": func() error {
+			_, err := hsm.GenerateTokens(context.Background(), []*TokenParams{{Type: TokenTypeKeyGen, SizeInBits: 128}})
+			return err
+		},
+		"EndorseCert": func() error {
+			_, err := hsm.EndorseCert(context.Background(), []byte("tbs"), params)
+			return err
+		},
+		"SignCRL": func() error {
+			_, err := hsm.SignCRL(context.Background(), []byte("tbs"), params)
+			return err
+		},
+		"EndorseData": func() error {
+			_, _, err := hsm.EndorseData(context.Background(), []byte("data"), params)
+			return err
+		},
+	}
+	for name, op := range mutating {
+		if err := op(); status.Code(err) != codes.PermissionDenied {
+			t.Errorf("%s: got err %v, want code %v", name, err, codes.PermissionDenied)
+		}
+	}
+
+	// Private keys are not accessible in read-only mode.
+	cfg.PrivateKeys = []string{"TokenWrappingKey"}
+	if _, err := NewHSMReadOnly(cfg); err == nil {
+		t.Error("expected NewHSMReadOnly to reject private keys")
+	}
+}
+
+func TestNewHSMMissingKeys(t *testing.T) {
+	s := ts.GetSession(t)
+	ts.Check(t, s.Login(pk11.NormalUser, ts.UserPin))
+	kp, err := s.GenerateRSA(3072, 0x010001, &pk11.KeyOptions{Token: true})
+	ts.Check(t, err)
+	ts.Check(t, kp.PublicKey.SetLabel("PresentKey"))
+
+	_, err = NewHSM(HSMConfig{
+		SOPath:        ts.Plugin(),
+		SlotID:        ts.GetSlot(t),
+		HSMPassword:   ts.UserPin,
+		NumSessions:   1,
+		SymmetricKeys: []string{"MissingSymm0", "MissingSymm1"},
+		PrivateKeys:   []string{"MissingPriv"},
+		PublicKeys:    []string{"PresentKey", "MissingPub"},
+	})
+	if err == nil {
+		t.Fatal("expected NewHSM to fail")
+	}
+	for _, label := range []string{"MissingSymm0", "MissingSymm1", "MissingPriv", "MissingPub"} {
+		if !strings.Contains(err.Error(), label) {
+			t.Errorf("error %q does not list missing key %q", err, label)
+		}
+	}
+	if strings.Contains(err.Error(), "PresentKey") {
+		t.Errorf("error %q lists present key %q", err, "PresentKey")
+	}
+}
+
+// MintECDSAKeys generates a P256 ECDSA key pair to be used by various tests
+// below as the keys to a Certificate Authority (CA) or HSM identity.
+// It requires an initialized `hsm` instance.
+func MintECDSAKeys(t *testing.T, hsm *HSM) (pk11.KeyPair, error) {
+	session, release := hsm.sessions.getHandle()
+	defer release()
+	return session.GenerateECDSA(elliptic.P256(), &pk11.KeyOptions{Extractable: true})
+}
+
+func TestEndorseCert(t *testing.T) {
+	log.Printf("TestEndorseCert")
+	hsm, _, _ := MakeHSM(t)
+
+	const kcaPrivName = "kca_priv"
+
+	// The following nested function is required to avoid deadlocks when calling
+	// `hsm.sessions.getHandle()` in the `EndorseCert` function.
+	importCAKey := func() {
+		privateKeyDer := readFile(t, diceCAKeyPath)
+		privateKey, err := x509.ParsePKCS8PrivateKey(privateKeyDer)
+		ts.Check(t, err)
+
+		// Import the CA key into the HSM.
+		session, release := hsm.sessions.getHandle()
+		defer release()
+
+		// Cast the private key to an ECDSA private key to make sure the
+		// `ImportKey` function imports the key as an ECDSA key.
+		privateKey = privateKey.(*ecdsa.PrivateKey)
+		ca, err := session.ImportKey(privateKey, &pk11.KeyOptions{
+			Extractable: true,
+			Token:       true,
+		})
+		ts.Check(t, err)
+		err = ca.SetLabel(kcaPrivName)
+		ts.Check(t, err)
+	}
+
+	importCAKey()
+	caCertPEM := readFile(t, diceCACertPath)
+	caCertBlock, _ := pem.Decode(caCertPEM)
+	caCert, err := x509.ParseCertificate(caCertBlock.Bytes)
+	ts.Check(t, err)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+
+	log.Printf("Reading TBS")
+	tbs := readFile(t, diceTBSPath)
+
+	log.Printf("Endorsing cert")
+	certDER, err := hsm.EndorseCert(context.Background(), tbs, EndorseCertParams{
+		KeyLabel:           kcaPrivName,
+		SignatureAlgorithm: x509.ECDSAWithSHA256,
+	})
+	ts.Check(t, err)
+
+	cert, err := x509.ParseCertificate(certDER)
+	ts.Check(t, err)
+
+	// DICE extensions marked as critical end up in this list. We explicitly
+	// clear the list to get x509.Verify to pass.
+	cert.UnhandledCriticalExtensions = nil
+
+	_, err = cert.Verify(x509.VerifyOptions{
+		Roots: roots,
+	})
+	ts.Check(t, err)
+}
+
+func TestEndorseCertRSA(t *testing.T) {
+	hsm, _, _ := MakeHSM(t)
+
+	const caPrivName = "rsa_ca_priv"
+
+	// Create an RSA CA with a key imported into the HSM.
+	caKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	ts.Check(t, err)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "RSA Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	ts.Check(t, err)
+	caCert, err := x509.ParseCertificate(caDER)
+	ts.Check(t, err)
+
+	func() {
+		session, release := hsm.sessions.getHandle()
+		defer release()
+		ca, err := session.ImportKey(caKey, &pk11.KeyOptions{Token: true})
+		ts.Check(t, err)
+		ts.Check(t, ca.SetLabel(caPrivName))
+	}()
+
+	deviceKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ts.Check(t, err)
+	for _, alg := range []x509.SignatureAlgorithm{
+		x509.SHA256WithRSA,
+		x509.SHA384WithRSA,
+		x509.SHA512WithRSA,
+		x509.SHA256WithRSAPSS,
+		x509.SHA384WithRSAPSS,
+		x509.SHA512WithRSAPSS,
+	} {
+		t.Run(alg.String(), func(t *testing.T) {
+			// Build the TBS certificate. The software signature is discarded.
+			tmpl := &x509.Certificate{
+				SerialNumber:       big.NewInt(2),
+				Subject:            pkix.Name{CommonName: "device"},
+				NotBefore:          time.Now(),
+				NotAfter:           time.Now().Add(time.Hour),
+				SignatureAlgorithm: alg,
+			}
+			swDER, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, &deviceKey.PublicKey, caKey)
+			ts.Check(t, err)
+			swCert, err := x509.ParseCertificate(swDER)
+			ts.Check(t, err)
+
+			certDER, err := hsm.EndorseCert(context.Background(), swCert.RawTBSCertificate, EndorseCertParams{
+				KeyLabel:           caPrivName,
+				SignatureAlgorithm: alg,
+			})
+			ts.Check(t, err)
+
+			cert, err := x509.ParseCertificate(certDER)
+			ts.Check(t, err)
+			if cert.SignatureAlgorithm != alg {
+				t.Errorf("SignatureAlgorithm = %v, want %v", cert.SignatureAlgorithm, alg)
+			}
+			ts.Check(t, cert.CheckSignatureFrom(caCert))
+		})
+	}
+
+	// The signature algorithm must match the key type.
+	_, err = hsm.EndorseCert(context.Background(), caCert.RawTBSCertificate, EndorseCertParams{
+		KeyLabel:           caPrivName,
+		SignatureAlgorithm: x509.ECDSAWithSHA256,
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("EndorseCert() with an ECDSA algorithm and RSA key = %v, want code %v", err, codes.InvalidArgument)
+	}
+}
+
+func TestEndorseCertECDSACurves(t *testing.T) {
+	hsm, _, _ := MakeHSM(t)
+
+	deviceKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ts.Check(t, err)
+	for _, tc := range []struct {
+		curve    elliptic.Curve
+		alg      x509.SignatureAlgorithm
+		mismatch x509.SignatureAlgorithm
+	}{
+		{elliptic.P384(), x509.ECDSAWithSHA384, x509.ECDSAWithSHA256},
+		{elliptic.P521(), x509.ECDSAWithSHA512, x509.ECDSAWithSHA384},
+	} {
+		t.Run(tc.curve.Params().Name, func(t *testing.T) {
+			caPrivName := "ca_priv_" + tc.curve.Params().Name
+
+			// Create a CA with a key imported into the HSM.
+			caKey, err := ecdsa.GenerateKey(tc.curve, rand.Reader)
+			ts.Check(t, err)
+			caTmpl := &x509.Certificate{
+				SerialNumber:          big.NewInt(1),
+				Subject:               pkix.Name{CommonName: "ECDSA Test CA"},
+				NotBefore:             time.Now().Add(-time.Hour),
+				NotAfter:              time.Now().Add(time.Hour),
+				KeyUsage:              x509.KeyUsageCertSign,
+				BasicConstraintsValid: true,
+				IsCA:                  true,
+			}
+			caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+			ts.Check(t, err)
+			caCert, err := x509.ParseCertificate(caDER)
+			ts.Check(t, err)
+			func() {
+				session, release := hsm.sessions.getHandle()
+				defer release()
+				ca, err := session.ImportKey(caKey, &pk11.KeyOptions{Token: true})
+				ts.Check(t, err)
+				ts.Check(t, ca.SetLabel(caPrivName))
+			}()
+
+			// Build the TBS certificate. The software signature is discarded.
+			tmpl := &x509.Certificate{
+				SerialNumber:       big.NewInt(2),
+				Subject:            pkix.Name{CommonName: "device"},
+				NotBefore:          time.Now(),
+				NotAfter:           time.Now().Add(time.Hour),
+				SignatureAlgorithm: tc.alg,
+			}
+			swDER, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, &deviceKey.PublicKey, caKey)
+			ts.Check(t, err)
+			swCert, err := x509.ParseCertificate(swDER)
+			ts.Check(t, err)
+
+			certDER, err := hsm.EndorseCert(context.Background(), swCert.RawTBSCertificate, EndorseCertParams{
+				KeyLabel:           caPrivName,
+				SignatureAlgorithm: tc.alg,
+			})
+			ts.Check(t, err)
+			cert, err := x509.ParseCertificate(certDER)
+			ts.Check(t, err)
+			if cert.SignatureAlgorithm != tc.alg {
+				t.Errorf("SignatureAlgorithm = %v, want %v", cert.SignatureAlgorithm, tc.alg)
+			}
+			ts.Check(t, cert.CheckSignatureFrom(caCert))
+
+			// The hash must match the curve of the key.
+			_, err = hsm.EndorseCert(context.Background(), swCert.RawTBSCertificate, EndorseCertParams{
+				KeyLabel:           caPrivName,
+				SignatureAlgorithm: tc.mismatch,
+			})
+			if status.Code(err) != codes.InvalidArgument {
+				t.Errorf("EndorseCert() with %v = %v, want code %v", tc.mismatch, err, codes.InvalidArgument)
+			}
+		})
+	}
+}
+
+func TestEndorseCertLowS(t *testing.T) {
+	hsm, _, _ := MakeHSM(t)
+	ctx := context.Background()
+	const caPrivName = "ca_priv_low_s"
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ts.Check(t, err)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Low-S Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	ts.Check(t, err)
+	caCert, err := x509.ParseCertificate(caDER)
+	ts.Check(t, err)
+	func() {
+		session, release := hsm.sessions.getHandle()
+		defer release()
+		ca, err := session.ImportKey(caKey, &pk11.KeyOptions{Token: true})
+		ts.Check(t, err)
+		ts.Check(t, ca.SetLabel(caPrivName))
+	}()
+
+	tmpl := &x509.Certificate{
+		SerialNumber:       big.NewInt(2),
+		Subject:            pkix.Name{CommonName: "device"},
+		NotBefore:          time.Now(),
+		NotAfter:           time.Now().Add(time.Hour),
+		SignatureAlgorithm: x509.ECDSAWithSHA256,
+	}
+	swDER, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, &caKey.PublicKey, caKey)
+	ts.Check(t, err)
+	swCert, err := x509.ParseCertificate(swDER)
+	ts.Check(t, err)
+
+	halfN := new(big.Int).Rsh(elliptic.P256().Params().N, 1)
+	// endorse endorses the TBS certificate and reports whether its signature
+	// is high-S.
+	endorse := func(allowHighS bool) bool {
+		t.Helper()
+		certDER, err := hsm.EndorseCert(ctx, swCert.RawTBSCertificate, EndorseCertParams{
+			KeyLabel:           caPrivName,
+			SignatureAlgorithm: x509.ECDSAWithSHA256,
+			AllowHighS:         allowHighS,
+		})
+		ts.Check(t, err)
+		cert, err := x509.ParseCertificate(certDER)
+		ts.Check(t, err)
+		ts.Check(t, cert.CheckSignatureFrom(caCert))
+		var sig struct{ R, S *big.Int }
+		_, err = asn1.Unmarshal(cert.Signature, &sig)
+		ts.Check(t, err)
+		return sig.S.Cmp(halfN) > 0
+	}
+
+	// Half of the signatures are high-S, so one is expected well within the
+	// attempts.
+	const attempts = 64
+	highS := false
+	for i := 0; i < attempts && !highS; i++ {
+		highS = endorse(true)
+	}
+	if !highS {
+		t.Fatalf("no high-S signature in %d attempts with AllowHighS", attempts)
+	}
+	for i := 0; i < attempts; i++ {
+		if endorse(false) {
+			t.Fatal("EndorseCert() returned a high-S signature")
+		}
+	}
+}
+
+func TestEndorseCertVerify(t *testing.T) {
+	hsm, _, _ := MakeHSM(t)
+	ctx := context.Background()
+
+	const caLabel = "verify_ca"
+	_, err := hsm.GenerateAndStoreKeyPair(ctx, elliptic.P256(), caLabel, nil)
+	ts.Check(t, err)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ts.Check(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:       big.NewInt(2),
+		Subject:            pkix.Name{CommonName: "device"},
+		NotBefore:          time.Now(),
+		NotAfter:           time.Now().Add(time.Hour),
+		SignatureAlgorithm: x509.ECDSAWithSHA256,
+	}
+	swDER, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	ts.Check(t, err)
+	swCert, err := x509.ParseCertificate(swDER)
+	ts.Check(t, err)
+	params := EndorseCertParams{KeyLabel: caLabel, SignatureAlgorithm: x509.ECDSAWithSHA256}
+
+	_, err = hsm.EndorseCert(ctx, swCert.RawTBSCertificate, params)
+	ts.Check(t, err)
+
+	truncated := swCert.RawTBSCertificate[:len(swCert.RawTBSCertificate)/2]
+	if _, err := hsm.EndorseCert(ctx, truncated, params); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("EndorseCert() = %v for a truncated TBS certificate, want code %v", err, codes.InvalidArgument)
+	}
+	var batchErr *BatchEndorseError
+	if _, err := hsm.BatchEndorseCert(ctx, [][]byte{swCert.RawTBSCertificate, truncated}, params); !errors.As(err, &batchErr) || batchErr.Index != 1 {
+		t.Errorf("BatchEndorseCert() = %v, want a *BatchEndorseError for certificate 1", err)
+	}
+
+	// The checks are skipped on request.
+	params.SkipVerify = true
+	hsm.config.TBSChecks = TBSChecks{SkipStructure: true, SkipSignatureAlgorithm: true, SkipValidity: true}
+	if _, err := hsm.EndorseCert(ctx, truncated, params); err != nil {
+		t.Errorf("EndorseCert() = %v for a truncated TBS certificate with SkipVerify, want success", err)
+	}
+}
+
+func TestVerifyEndorsedCert(t *testing.T) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ts.Check(t, err)
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ts.Check(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:       big.NewInt(1),
+		Subject:            pkix.Name{CommonName: "device"},
+		NotBefore:          time.Now(),
+		NotAfter:           time.Now().Add(time.Hour),
+		SignatureAlgorithm: x509.ECDSAWithSHA256,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &caKey.PublicKey, caKey)
+	ts.Check(t, err)
+
+	// Re-assemble the certificate around a truncated TBS certificate.
+	var cert struct {
+		TBS                asn1.RawValue
+		SignatureAlgorithm asn1.RawValue
+		SignatureValue     asn1.BitString
+	}
+	_, err = asn1.Unmarshal(der, &cert)
+	ts.Check(t, err)
+	cert.TBS = asn1.RawValue{FullBytes: cert.TBS.FullBytes[:len(cert.TBS.FullBytes)-8]}
+	truncated, err := asn1.Marshal(cert)
+	ts.Check(t, err)
+
+	for _, tc := range []struct {
+		name string
+		pub  crypto.PublicKey
+		der  []byte
+		alg  x509.SignatureAlgorithm
+		ok   bool
+	}{
+		{"valid", &caKey.PublicKey, der, x509.ECDSAWithSHA256, true},
+		{"no verification key", nil, der, x509.ECDSAWithSHA256, true},
+		{"wrong key", &otherKey.PublicKey, der, x509.ECDSAWithSHA256, false},
+		{"algorithm mismatch", &caKey.PublicKey, der, x509.ECDSAWithSHA384, false},
+		{"truncated", &caKey.PublicKey, truncated, x509.ECDSAWithSHA256, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := verifyEndorsedCert(tc.pub, tc.der, tc.alg)
+			if tc.ok {
+				ts.Check(t, err)
+				return
+			}
+			if status.Code(err) != codes.InvalidArgument {
+				t.Errorf("verifyEndorsedCert() = %v, want code %v", err, codes.InvalidArgument)
+			}
+		})
+	}
+}
+
+func TestCheckTBS(t *testing.T) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ts.Check(t, err)
+	caTmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Test CA", Organization: []string{"lowRISC"}},
+	}
+	// newTBS returns a TBS certificate issued by the test CA, valid from
+	// `notBefore` to `notAfter`.
+	newTBS := func(notBefore, notAfter time.Time) []byte {
+		tmpl := &x509.Certificate{
+			SerialNumber:       big.NewInt(2),
+			Subject:            pkix.Name{CommonName: "device"},
+			NotBefore:          notBefore,
+			NotAfter:           notAfter,
+			SignatureAlgorithm: x509.ECDSAWithSHA256,
+			ExtraExtensions: []pkix.Extension{
+				{Id: asn1.ObjectIdentifier{2, 23, 133, 5, 4, 1}, Value: []byte{0x30, 0x00}},
+			},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, caTmpl, &caKey.PublicKey, caKey)
+		ts.Check(t, err)
+		cert, err := x509.ParseCertificate(der)
+		ts.Check(t, err)
+		return cert.RawTBSCertificate
+	}
+	now := time.Now()
+	tbs := newTBS(now, now.Add(time.Hour))
+	expired := newTBS(now, now.Add(-time.Hour))
+	trailing := append(append([]byte{}, tbs...), 0x05, 0x00)
+	const issuer = "CN=Test CA,O=lowRISC"
+
+	for _, tc := range []struct {
+		name   string
+		tbs    []byte
+		alg    x509.SignatureAlgorithm
+		issuer string
+		checks TBSChecks
+		ok     bool
+	}{
+		{"valid", tbs, x509.ECDSAWithSHA256, issuer, TBSChecks{}, true},
+		{"no issuer configured", tbs, x509.ECDSAWithSHA256, "", TBSChecks{}, true},
+		{"not a certificate", []byte("arbitrary data"), x509.ECDSAWithSHA256, "", TBSChecks{}, false},
+		{"truncated", tbs[:len(tbs)/2], x509.ECDSAWithSHA256, "", TBSChecks{}, false},
+		{"trailing data", trailing, x509.ECDSAWithSHA256, "", TBSChecks{}, false},
+		{"trailing data allowed", trailing, x509.ECDSAWithSHA256, "", TBSChecks{SkipStructure: true}, true},
+		{"algorithm mismatch", tbs, x509.ECDSAWithSHA384, "", TBSChecks{}, false},
+		{"algorithm mismatch allowed", tbs, x509.ECDSAWithSHA384, "", TBSChecks{SkipSignatureAlgorithm: true}, true},
+		{"invalid validity", expired, x509.ECDSAWithSHA256, "", TBSChecks{}, false},
+		{"invalid validity allowed", expired, x509.ECDSAWithSHA256, "", TBSChecks{SkipValidity: true}, true},
+		{"issuer mismatch", tbs, x509.ECDSAWithSHA256, "CN=Other CA", TBSChecks{}, false},
+		{"issuer mismatch allowed", tbs, x509.ECDSAWithSHA256, "CN=Other CA", TBSChecks{SkipIssuer: true}, true},
+		{"all checks disabled", []byte("arbitrary data"), x509.ECDSAWithSHA256, issuer,
+			TBSChecks{SkipStructure: true, SkipSignatureAlgorithm: true, SkipValidity: true, SkipIssuer: true}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkTBS(tc.tbs, tc.alg, tc.issuer, tc.checks)
+			if tc.ok {
+				ts.Check(t, err)
+				return
+			}
+			if status.Code(err) != codes.InvalidArgument {
+				t.Errorf("checkTBS() = %v, want code %v", err, codes.InvalidArgument)
+			}
+		})
+	}
+}
+
+func TestECDSAHashMatchesCurve(t *testing.T) {
+	for _, tc := range []struct {
+		curve elliptic.Curve
+		hash  crypto.Hash
+		want  bool
+	}{
+		{elliptic.P256(), crypto.SHA256, true},
+		{elliptic.P256(), crypto.SHA3_256, true},
+		{elliptic.P256(), crypto.SHA384, false},
+		{elliptic.P384(), crypto.SHA384, true},
+		{elliptic.P384(), crypto.SHA3_384, true},
+		{elliptic.P384(), crypto.SHA256, false},
+		{elliptic.P521(), crypto.SHA512, true},
+		{elliptic.P521(), crypto.SHA384, false},
+		{elliptic.P224(), crypto.SHA224, false},
+	} {
+		if got := ecdsaHashMatchesCurve(tc.curve, tc.hash); got != tc.want {
+			t.Errorf("ecdsaHashMatchesCurve(%s, %v) = %v, want %v", tc.curve.Params().Name, tc.hash, got, tc.want)
+		}
+	}
+}
+
+func TestEndorseCertEd25519(t *testing.T) {
+	hsm, _, _ := MakeHSM(t)
+
+	const caPrivName = "ed25519_ca_priv"
+
+	// Generate the CA key pair in the HSM.
+	var caPub ed25519.PublicKey
+	func() {
+		session, release := hsm.sessions.getHandle()
+		defer release()
+		kp, err := session.GenerateEd25519(&pk11.KeyOptions{Token: true})
+		ts.Check(t, err)
+		ts.Check(t, kp.PrivateKey.SetLabel(caPrivName))
+		pub, err := kp.PublicKey.ExportKey()
+		ts.Check(t, err)
+		caPub = pub.(ed25519.PublicKey)
+	}()
+	params := EndorseCertParams{
+		KeyLabel:           caPrivName,
+		SignatureAlgorithm: x509.PureEd25519,
+	}
+
+	// Build the self-signed CA certificate. The software signature is
+	// discarded and replaced by the HSM signature.
+	_, swKey, err := ed25519.GenerateKey(rand.Reader)
+	ts.Check(t, err)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Ed25519 Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	swCADER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, caPub, swKey)
+	ts.Check(t, err)
+	swCACert, err := x509.ParseCertificate(swCADER)
+	ts.Check(t, err)
+	caDER, err := hsm.EndorseCert(context.Background(), swCACert.RawTBSCertificate, params)
+	ts.Check(t, err)
+	caCert, err := x509.ParseCertificate(caDER)
+	ts.Check(t, err)
+
+	// Endorse a device certificate with the CA.
+	deviceKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ts.Check(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:       big.NewInt(2),
+		Subject:            pkix.Name{CommonName: "device"},
+		NotBefore:          time.Now(),
+		NotAfter:           time.Now().Add(time.Hour),
+		SignatureAlgorithm: x509.PureEd25519,
+	}
+	swDER, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, &deviceKey.PublicKey, swKey)
+	ts.Check(t, err)
+	swCert, err := x509.ParseCertificate(swDER)
+	ts.Check(t, err)
+
+	certDER, err := hsm.EndorseCert(context.Background(), swCert.RawTBSCertificate, params)
+	ts.Check(t, err)
+
+	var signed struct {
+		TBS                asn1.RawValue
+		SignatureAlgorithm pkix.AlgorithmIdentifier
+		SignatureValue     asn1.BitString
+	}
+	_, err = asn1.Unmarshal(certDER, &signed)
+	ts.Check(t, err)
+	if !signed.SignatureAlgorithm.Algorithm.Equal(asn1.ObjectIdentifier{1, 3, 101, 112}) {
+		t.Errorf("signatureAlgorithm = %v, want id-EdDSA", signed.SignatureAlgorithm.Algorithm)
+	}
+	if len(signed.SignatureAlgorithm.Parameters.FullBytes) != 0 {
+		t.Errorf("signatureAlgorithm parameters = %x, want absent", signed.SignatureAlgorithm.Parameters.FullBytes)
+	}
+	if !ed25519.Verify(caPub, swCert.RawTBSCertificate, signed.SignatureValue.Bytes) {
+		t.Error("ed25519.Verify() failed")
+	}
+
+	cert, err := x509.ParseCertificate(certDER)
+	ts.Check(t, err)
+	if cert.SignatureAlgorithm != x509.PureEd25519 {
+		t.Errorf("SignatureAlgorithm = %v, want %v", cert.SignatureAlgorithm, x509.PureEd25519)
+	}
+	ts.Check(t, cert.CheckSignatureFrom(caCert))
+}
+
+func TestSignatureAlgorithmIdentifier(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	ts.Check(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ts.Check(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	ts.Check(t, err)
+
+	for _, tc := range []struct {
+		alg x509.SignatureAlgorithm
+		key crypto.Signer
+	}{
+		{x509.ECDSAWithSHA256, ecKey},
+		{x509.ECDSAWithSHA384, ecKey},
+		{x509.SHA256WithRSA, rsaKey},
+		{x509.SHA384WithRSA, rsaKey},
+		{x509.SHA512WithRSA, rsaKey},
+		{x509.SHA256WithRSAPSS, rsaKey},
+		{x509.SHA384WithRSAPSS, rsaKey},
+		{x509.SHA512WithRSAPSS, rsaKey},
+		{x509.PureEd25519, edKey},
+	} {
+		t.Run(tc.alg.String(), func(t *testing.T) {
+			// The identifier must match the one emitted by crypto/x509.
+			tmpl := &x509.Certificate{
+				SerialNumber:       big.NewInt(1),
+				NotBefore:          time.Now(),
+				NotAfter:           time.Now().Add(time.Hour),
+				SignatureAlgorithm: tc.alg,
+			}
+			der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, tc.key.Public(), tc.key)
+			ts.Check(t, err)
+			var cert struct {
+				TBS                asn1.RawValue
+				SignatureAlgorithm asn1.RawValue
+				SignatureValue     asn1.BitString
+			}
+			_, err = asn1.Unmarshal(der, &cert)
+			ts.Check(t, err)
+
+			id, err := signatureAlgorithmIdentifier(tc.alg)
+			ts.Check(t, err)
+			got, err := asn1.Marshal(id)
+			ts.Check(t, err)
+			if !bytes.Equal(got, cert.SignatureAlgorithm.FullBytes) {
+				t.Errorf("signatureAlgorithmIdentifier() = %x, want %x", got, cert.SignatureAlgorithm.FullBytes)
+			}
+		})
+	}
+}
+
+func TestSHA3ECDSASignatureAlgorithms(t *testing.T) {
+	for _, tc := range []struct {
+		alg  x509.SignatureAlgorithm
+		hash crypto.Hash
+		oid  string
+	}{
+		{ECDSAWithSHA3_256, crypto.SHA3_256, "2.16.840.1.101.3.4.3.10"},
+		{ECDSAWithSHA3_384, crypto.SHA3_384, "2.16.840.1.101.3.4.3.11"},
+		{ECDSAWithSHA3_512, crypto.SHA3_512, "2.16.840.1.101.3.4.3.12"},
+	} {
+		t.Run(tc.oid, func(t *testing.T) {
+			hash, err := hashFromSignatureAlgorithm(tc.alg)
+			ts.Check(t, err)
+			if hash != tc.hash {
+				t.Errorf("hashFromSignatureAlgorithm() = %v, want %v", hash, tc.hash)
+			}
+			if !hash.Available() {
+				t.Errorf("hash %v is not linked in", hash)
+			}
+			id, err := signatureAlgorithmIdentifier(tc.alg)
+			ts.Check(t, err)
+			if got := id.Algorithm.String(); got != tc.oid {
+				t.Errorf("signatureAlgorithmIdentifier() OID = %s, want %s", got, tc.oid)
+			}
+			if len(id.Parameters.FullBytes) != 0 {
+				t.Errorf("signatureAlgorithmIdentifier() parameters = %x, want absent", id.Parameters.FullBytes)
+			}
+		})
+	}
+
+	// Other algorithms are still rejected.
+	if _, err := hashFromSignatureAlgorithm(x509.MD5WithRSA); err == nil {
+		t.Error("hashFromSignatureAlgorithm(MD5WithRSA) succeeded, want error")
+	}
+	if _, err := oidFromSignatureAlgorithm(x509.MD5WithRSA); err == nil {
+		t.Error("oidFromSignatureAlgorithm(MD5WithRSA) succeeded, want error")
+	}
+}
+
+func TestSignCRL(t *testing.T) {
+	hsm, _, _ := MakeHSM(t)
+
+	const caPrivName = "crl_ca_priv"
+
+	// Create a CA with a key imported into the HSM.
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ts.Check(t, err)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "CRL Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	ts.Check(t, err)
+	caCert, err := x509.ParseCertificate(caDER)
+	ts.Check(t, err)
+
+	func() {
+		session, release := hsm.sessions.getHandle()
+		defer release()
+		ca, err := session.ImportKey(caKey, &pk11.KeyOptions{Token: true})
+		ts.Check(t, err)
+		ts.Check(t, ca.SetLabel(caPrivName))
+	}()
+
+	// Build the TBSCertList. The software signature is discarded.
+	crlTmpl := &x509.RevocationList{
+		SignatureAlgorithm: x509.ECDSAWithSHA256,
+		Number:             big.NewInt(7),
+		ThisUpdate:         time.Now(),
+		NextUpdate:         time.Now().Add(time.Hour),
+		RevokedCertificates: []pkix.RevokedCertificate{
+			{SerialNumber: big.NewInt(42), RevocationTime: time.Now()},
+		},
+	}
+	swCRL, err := x509.CreateRevocationList(rand.Reader, crlTmpl, caCert, caKey)
+	ts.Check(t, err)
+	parsed, err := x509.ParseRevocationList(swCRL)
+	ts.Check(t, err)
+
+	crlDER, err := hsm.SignCRL(context.Background(), parsed.RawTBSRevocationList, EndorseCertParams{
+		KeyLabel:           caPrivName,
+		SignatureAlgorithm: x509.ECDSAWithSHA256,
+	})
+	ts.Check(t, err)
+
+	crl, err := x509.ParseRevocationList(crlDER)
+	ts.Check(t, err)
+	ts.Check(t, crl.CheckSignatureFrom(caCert))
+	if len(crl.RevokedCertificates) != 1 || crl.RevokedCertificates[0].SerialNumber.Int64() != 42 {
+		t.Errorf("unexpected revoked certificates: %v", crl.RevokedCertificates)
+	}
+}
+
+// newCRLTestCA returns a self-signed ECDSA CA certificate allowed to sign CRLs,
+// and its private key.
+func newCRLTestCA(t *testing.T) (*x509.Certificate, *ecdsa.PrivateKey) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ts.Check(t, err)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "CRL Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		SubjectKeyId:          []byte{1, 2, 3, 4},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	ts.Check(t, err)
+	caCert, err := x509.ParseCertificate(caDER)
+	ts.Check(t, err)
+	return caCert, caKey
+}
+
+// isRevoked returns true if `cert` is listed in `crl`.
+func isRevoked(crl *x509.RevocationList, cert *x509.Certificate) bool {
+	for _, rc := range crl.RevokedCertificates {
+		if rc.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func TestNewTBSCertList(t *testing.T) {
+	caCert, caKey := newCRLTestCA(t)
+	thisUpdate := time.Now().Truncate(time.Second)
+	nextUpdate := thisUpdate.Add(24 * time.Hour)
+	revoked := []pkix.RevokedCertificate{{SerialNumber: big.NewInt(42), RevocationTime: thisUpdate}}
+
+	alg, err := crlSignatureAlgorithm(caCert)
+	ts.Check(t, err)
+	if alg != x509.ECDSAWithSHA256 {
+		t.Errorf("crlSignatureAlgorithm() = %v, want %v", alg, x509.ECDSAWithSHA256)
+	}
+	tbs, err := newTBSCertList(caCert, alg, revoked, thisUpdate, nextUpdate)
+	ts.Check(t, err)
+
+	// Sign the TBSCertList in software.
+	digest := sha256.Sum256(tbs)
+	sig, err := ecdsa.SignASN1(rand.Reader, caKey, digest[:])
+	ts.Check(t, err)
+	sigAlg, err := signatureAlgorithmIdentifier(alg)
+	ts.Check(t, err)
+	der, err := asn1.Marshal(struct {
+		TBS                asn1.RawValue
+		SignatureAlgorithm pkix.AlgorithmIdentifier
+		SignatureValue     asn1.BitString
+	}{
+		TBS:                asn1.RawValue{FullBytes: tbs},
+		SignatureAlgorithm: sigAlg,
+		SignatureValue:     asn1.BitString{Bytes: sig, BitLength: len(sig) * 8},
+	})
+	ts.Check(t, err)
+
+	crl, err := x509.ParseRevocationList(der)
+	ts.Check(t, err)
+	ts.Check(t, crl.CheckSignatureFrom(caCert))
+	if !bytes.Equal(crl.AuthorityKeyId, caCert.SubjectKeyId) {
+		t.Errorf("AuthorityKeyId = %x, want %x", crl.AuthorityKeyId, caCert.SubjectKeyId)
+	}
+	if crl.Number.Int64() != thisUpdate.Unix() {
+		t.Errorf("Number = %v, want %d", crl.Number, thisUpdate.Unix())
+	}
+	if !crl.ThisUpdate.Equal(thisUpdate) || !crl.NextUpdate.Equal(nextUpdate) {
+		t.Errorf("ThisUpdate, NextUpdate = %v, %v, want %v, %v", crl.ThisUpdate, crl.NextUpdate, thisUpdate, nextUpdate)
+	}
+	if len(crl.RevokedCertificates) != 1 || crl.RevokedCertificates[0].SerialNumber.Int64() != 42 {
+		t.Errorf("unexpected revoked certificates: %v", crl.RevokedCertificates)
+	}
+
+	noCRLSign := *caCert
+	noCRLSign.KeyUsage = x509.KeyUsageCertSign
+	noSKID := *caCert
+	noSKID.SubjectKeyId = nil
+	for _, tc := range []struct {
+		name       string
+		caCert     *x509.Certificate
+		nextUpdate time.Time
+	}{
+		{"no_crl_sign", &noCRLSign, nextUpdate},
+		{"no_subject_key_id", &noSKID, nextUpdate},
+		{"next_update_before_this_update", caCert, thisUpdate.Add(-time.Hour)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := newTBSCertList(tc.caCert, alg, revoked, thisUpdate, tc.nextUpdate); err == nil {
+				t.Error("newTBSCertList() succeeded, want error")
+			}
+		})
+	}
+}
+
+func TestCheckTBSCertList(t *testing.T) {
+	caCert, caKey := newCRLTestCA(t)
+	crlDER, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		SignatureAlgorithm: x509.ECDSAWithSHA256,
+		Number:             big.NewInt(7),
+		ThisUpdate:         time.Now(),
+		NextUpdate:         time.Now().Add(time.Hour),
+		RevokedCertificates: []pkix.RevokedCertificate{
+			{SerialNumber: big.NewInt(42), RevocationTime: time.Now()},
+		},
+	}, caCert, caKey)
+	ts.Check(t, err)
+	crl, err := x509.ParseRevocationList(crlDER)
+	ts.Check(t, err)
+
+	if err := checkTBSCertList(crl.RawTBSRevocationList, x509.ECDSAWithSHA256); err != nil {
+		t.Errorf("checkTBSCertList() failed: %v", err)
+	}
+	for _, tc := range []struct {
+		name string
+		tbs  []byte
+		alg  x509.SignatureAlgorithm
+	}{
+		{"algorithm_mismatch", crl.RawTBSRevocationList, x509.ECDSAWithSHA384},
+		{"tbs_certificate", caCert.RawTBSCertificate, x509.ECDSAWithSHA256},
+		{"trailing_data", append(append([]byte{}, crl.RawTBSRevocationList...), 0), x509.ECDSAWithSHA256},
+		{"garbage", []byte("tbs"), x509.ECDSAWithSHA256},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := checkTBSCertList(tc.tbs, tc.alg); status.Code(err) != codes.InvalidArgument {
+				t.Errorf("checkTBSCertList() = %v, want code %v", err, codes.InvalidArgument)
+			}
+		})
+	}
+}
+
+func TestGenerateCRL(t *testing.T) {
+	hsm, _, _ := MakeHSM(t)
+
+	caCert, caKey := newCRLTestCA(t)
+	func() {
+		session, release := hsm.sessions.getHandle()
+		defer release()
+		ca, err := session.ImportKey(caKey, &pk11.KeyOptions{Token: true})
+		ts.Check(t, err)
+		ts.Check(t, ca.SetLabel("KCAPriv"))
+	}()
+
+	// Issue a leaf certificate, valid until revoked.
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ts.Check(t, err)
+	leafTmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1234),
+		Subject:      pkix.Name{CommonName: "device"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTmpl, caCert, &leafKey.PublicKey, caKey)
+	ts.Check(t, err)
+	leaf, err := x509.ParseCertificate(leafDER)
+	ts.Check(t, err)
+	ts.Check(t, leaf.CheckSignatureFrom(caCert))
+
+	now := time.Now()
+	crlDER, err := hsm.GenerateCRL(context.Background(), caCert, []pkix.RevokedCertificate{
+		{SerialNumber: leaf.SerialNumber, RevocationTime: now},
+	}, now, now.Add(24*time.Hour))
+	ts.Check(t, err)
+
+	crl, err := x509.ParseRevocationList(crlDER)
+	ts.Check(t, err)
+	ts.Check(t, crl.CheckSignatureFrom(caCert))
+	if crl.SignatureAlgorithm != x509.ECDSAWithSHA256 {
+		t.Errorf("SignatureAlgorithm = %v, want %v", crl.SignatureAlgorithm, x509.ECDSAWithSHA256)
+	}
+	if !bytes.Equal(crl.AuthorityKeyId, caCert.SubjectKeyId) {
+		t.Errorf("AuthorityKeyId = %x, want %x", crl.AuthorityKeyId, caCert.SubjectKeyId)
+	}
+	if !isRevoked(crl, leaf) {
+		t.Error("leaf certificate is not revoked by the CRL")
+	}
+}
+
+// newTestTBSList returns `n` DER encoded TBS certificates issued by `caCert`,
+// valid from `notBefore` for an hour.
+func newTestTBSList(t *testing.T, caCert *x509.Certificate, caKey *ecdsa.PrivateKey, notBefore time.Time, n int) [][]byte {
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ts.Check(t, err)
+	tbsList := make([][]byte, n)
+	for i := range tbsList {
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(int64(i + 1)),
+			Subject:      pkix.Name{CommonName: fmt.Sprintf("device %d", i)},
+			NotBefore:    notBefore,
+			NotAfter:     notBefore.Add(time.Hour),
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, &leafKey.PublicKey, caKey)
+		ts.Check(t, err)
+		cert, err := x509.ParseCertificate(der)
+		ts.Check(t, err)
+		tbsList[i] = cert.RawTBSCertificate
+	}
+	return tbsList
+}
+
+func TestBatchEndorseCert(t *testing.T) {
+	hsm, _, _ := MakeHSM(t)
+
+	caCert, caKey := newCRLTestCA(t)
+	func() {
+		session, release := hsm.sessions.getHandle()
+		defer release()
+		ca, err := session.ImportKey(caKey, &pk11.KeyOptions{Token: true})
+		ts.Check(t, err)
+		ts.Check(t, ca.SetLabel("KCAPriv"))
+	}()
+	params := EndorseCertParams{
+		KeyLabel:           "KCAPriv",
+		SignatureAlgorithm: x509.ECDSAWithSHA256,
+	}
+
+	tbsList := newTestTBSList(t, caCert, caKey, time.Now(), 3)
+	certs, err := hsm.BatchEndorseCert(context.Background(), tbsList, params)
+	ts.Check(t, err)
+	if len(certs) != len(tbsList) {
+		t.Fatalf("BatchEndorseCert() returned %d certificates, want %d", len(certs), len(tbsList))
+	}
+	for i, der := range certs {
+		cert, err := x509.ParseCertificate(der)
+		ts.Check(t, err)
+		if !bytes.Equal(cert.RawTBSCertificate, tbsList[i]) {
+			t.Errorf("certificate %d does not match its TBS certificate", i)
+		}
+		ts.Check(t, cert.CheckSignatureFrom(caCert))
+	}
+
+	// A certificate failing validation fails the whole batch with its index.
+	hsm.maxClockSkew = time.Minute
+	future := newTestTBSList(t, caCert, caKey, time.Now().Add(time.Hour), 1)[0]
+	_, err = hsm.BatchEndorseCert(context.Background(), [][]byte{tbsList[0], future}, params)
+	var batchErr *BatchEndorseError
+	if !errors.As(err, &batchErr) || batchErr.Index != 1 {
+		t.Errorf("BatchEndorseCert() = %v, want a *BatchEndorseError for certificate 1", err)
+	}
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("BatchEndorseCert() = %v, want code %v", err, codes.InvalidArgument)
+	}
+	hsm.maxClockSkew = 0
+
+	// A signing failure returns the certificates endorsed so far.
+	certs, err = hsm.BatchEndorseCert(context.Background(), tbsList, EndorseCertParams{
+		KeyLabel:           "KCAPriv",
+		SignatureAlgorithm: x509.PureEd25519,
+	})
+	if !errors.As(err, &batchErr) || batchErr.Index != 0 {
+		t.Errorf("BatchEndorseCert() = %v, want a *BatchEndorseError for certificate 0", err)
+	}
+	if len(certs) != 0 {
+		t.Errorf("BatchEndorseCert() returned %d certificates, want 0", len(certs))
+	}
+}
+
+func TestEndorseCerts(t *testing.T) {
+	hsm, _, _ := MakeHSM(t)
+
+	caCert, caKey := newCRLTestCA(t)
+	func() {
+		session, release := hsm.sessions.getHandle()
+		defer release()
+		ca, err := session.ImportKey(caKey, &pk11.KeyOptions{Token: true})
+		ts.Check(t, err)
+		ts.Check(t, ca.SetLabel("KCAPriv"))
+	}()
+	params := EndorseCertParams{
+		KeyLabel:           "KCAPriv",
+		SignatureAlgorithm: x509.ECDSAWithSHA256,
+	}
+
+	// The second certificate requests an algorithm the TBS certificate does
+	// not declare.
+	tbsList := newTestTBSList(t, caCert, caKey, time.Now(), 3)
+	reqs := make([]EndorseCertParamsWithTBS, len(tbsList))
+	for i, tbs := range tbsList {
+		reqs[i] = EndorseCertParamsWithTBS{EndorseCertParams: params, TBS: tbs}
+	}
+	reqs[1].SignatureAlgorithm = x509.ECDSAWithSHA384
+
+	results, err := hsm.EndorseCerts(context.Background(), reqs, false)
+	ts.Check(t, err)
+	if len(results) != len(reqs) {
+		t.Fatalf("EndorseCerts() returned %d results, want %d", len(results), len(reqs))
+	}
+	for i, r := range results {
+		if i == 1 {
+			if status.Code(r.Err) != codes.InvalidArgument || r.Cert != nil {
+				t.Errorf("EndorseCerts() result 1 = %x, %v, want code %v", r.Cert, r.Err, codes.InvalidArgument)
+			}
+			continue
+		}
+		ts.Check(t, r.Err)
+		cert, err := x509.ParseCertificate(r.Cert)
+		ts.Check(t, err)
+		if !bytes.Equal(cert.RawTBSCertificate, tbsList[i]) {
+			t.Errorf("certificate %d does not match its TBS certificate", i)
+		}
+		ts.Check(t, cert.CheckSignatureFrom(caCert))
+	}
+
+	// Fail fast stops at the failed certificate.
+	results, err = hsm.EndorseCerts(context.Background(), reqs, true)
+	var batchErr *BatchEndorseError
+	if !errors.As(err, &batchErr) || batchErr.Index != 1 {
+		t.Errorf("EndorseCerts() = %v, want a *BatchEndorseError for certificate 1", err)
+	}
+	if len(results) != 1 {
+		t.Errorf("EndorseCerts() returned %d results, want 1", len(results))
+	}
+}
+
+func TestEndorseCertKeyIDCache(t *testing.T) {
+	hsm, _, _ := MakeHSM(t)
+	importCA := func() (*x509.Certificate, []byte) {
+		caCert, caKey := newCRLTestCA(t)
+		session, release := hsm.sessions.getHandle()
+		defer release()
+		ca, err := session.ImportKey(caKey, &pk11.KeyOptions{Token: true})
+		ts.Check(t, err)
+		ts.Check(t, ca.SetLabel("KCAPriv"))
+		return caCert, newTestTBSList(t, caCert, caKey, time.Now(), 1)[0]
+	}
+	params := EndorseCertParams{
+		KeyLabel:           "KCAPriv",
+		SignatureAlgorithm: x509.ECDSAWithSHA256,
+	}
+
+	caCert, tbs := importCA()
+	for i := 0; i < 3; i++ {
+		certDER, err := hsm.EndorseCert(context.Background(), tbs, params)
+		ts.Check(t, err)
+		cert, err := x509.ParseCertificate(certDER)
+		ts.Check(t, err)
+		ts.Check(t, cert.CheckSignatureFrom(caCert))
+	}
+	if got := hsm.keyIDs.lookups.Load(); got != 1 {
+		t.Errorf("got %d key label lookups for 3 endorsements, want 1", got)
+	}
+
+	// Replace the key behind the back of the HSM. The stale UID is dropped
+	// and the label looked up again.
+	func() {
+		session, release := hsm.sessions.getHandle()
+		defer release()
+		key, err := session.FindKeyByLabel(pk11.ClassPrivateKey, "KCAPriv")
+		ts.Check(t, err)
+		ts.Check(t, key.Destroy())
+	}()
+	caCert, tbs = importCA()
+	certDER, err := hsm.EndorseCert(context.Background(), tbs, params)
+	ts.Check(t, err)
+	cert, err := x509.ParseCertificate(certDER)
+	ts.Check(t, err)
+	ts.Check(t, cert.CheckSignatureFrom(caCert))
+}
+
+func TestEndorseCertKeyID(t *testing.T) {
+	hsm, _, _ := MakeHSM(t)
+
+	// Import two generations of the CA key sharing a label.
+	var caCerts []*x509.Certificate
+	var keyIDs [][]byte
+	var tbs []byte
+	for i := 0; i < 2; i++ {
+		caCert, caKey := newCRLTestCA(t)
+		func() {
+			session, release := hsm.sessions.getHandle()
+			defer release()
+			ca, err := session.ImportKey(caKey, &pk11.KeyOptions{Token: true})
+			ts.Check(t, err)
+			ts.Check(t, ca.SetLabel("KCAPriv"))
+			id, err := ca.UID()
+			ts.Check(t, err)
+			keyIDs = append(keyIDs, id)
+		}()
+		caCerts = append(caCerts, caCert)
+		tbs = newTestTBSList(t, caCert, caKey, time.Now(), 1)[0]
+	}
+
+	ctx := context.Background()
+	_, err := hsm.EndorseCert(ctx, tbs, EndorseCertParams{
+		KeyLabel:           "KCAPriv",
+		SignatureAlgorithm: x509.ECDSAWithSHA256,
+	})
+	if !errors.Is(err, ErrAmbiguousKeyLabel) {
+		t.Errorf("EndorseCert() = %v with an ambiguous label, want %v", err, ErrAmbiguousKeyLabel)
+	}
+
+	for _, label := range []string{"", "KCAPriv"} {
+		certDER, err := hsm.EndorseCert(ctx, tbs, EndorseCertParams{
+			KeyLabel:           label,
+			KeyID:              keyIDs[1],
+			SignatureAlgorithm: x509.ECDSAWithSHA256,
+		})
+		ts.Check(t, err)
+		cert, err := x509.ParseCertificate(certDER)
+		ts.Check(t, err)
+		ts.Check(t, cert.CheckSignatureFrom(caCerts[1]))
+	}
+
+	for _, tc := range []struct {
+		name    string
+		label   string
+		keyID   []byte
+		expCode codes.Code
+	}{
+		{"label_mismatch", "Other", keyIDs[1], codes.InvalidArgument},
+		{"unknown_id", "", []byte("unknown"), codes.NotFound},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := hsm.EndorseCert(ctx, tbs, EndorseCertParams{
+				KeyLabel:           tc.label,
+				KeyID:              tc.keyID,
+				SignatureAlgorithm: x509.ECDSAWithSHA256,
+			})
+			if status.Code(err) != tc.expCode {
+				t.Errorf("EndorseCert() = %v, want code %v", err, tc.expCode)
+			}
+		})
+	}
+}
+
+func TestKeyLabelBySKU(t *testing.T) {
+	hsm := &HSM{config: HSMConfig{CAKeys: map[string]string{"sku-a": "KCAPrivA"}}}
+	for _, tc := range []struct {
+		name   string
+		params EndorseCertParams
+		want   string
+	}{
+		{"key label", EndorseCertParams{KeyLabel: "KCAPriv"}, "KCAPriv"},
+		{"sku", EndorseCertParams{KeyLabel: "KCAPriv", SKU: "sku-a"}, "KCAPrivA"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := hsm.keyLabel(tc.params)
+			ts.Check(t, err)
+			if got != tc.want {
+				t.Errorf("keyLabel() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+
+	// Unknown SKUs do not fall back to the key label.
+	params := EndorseCertParams{KeyLabel: "KCAPriv", SKU: "sku-b"}
+	if _, err := hsm.EndorseCert(context.Background(), nil, params); status.Code(err) != codes.NotFound {
+		t.Errorf("EndorseCert() = %v, want code %v", err, codes.NotFound)
+	}
+	if _, err := hsm.BatchEndorseCert(context.Background(), nil, params); status.Code(err) != codes.NotFound {
+		t.Errorf("BatchEndorseCert() = %v, want code %v", err, codes.NotFound)
+	}
+}
+
+// newTestCSR returns a DER encoded CSR for a new P-256 key.
+func newTestCSR(t *testing.T) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ts.Check(t, err)
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: "device"},
+		DNSNames: []string{"device.example.com"},
+	}, key)
+	ts.Check(t, err)
+	return csr
+}
+
+func TestEndorseCSRRejectsInvalidRequests(t *testing.T) {
+	caCert, _ := newCRLTestCA(t)
+	hsm := &HSM{}
+	csr := newTestCSR(t)
+	tampered := append([]byte(nil), csr...)
+	tampered[len(tampered)-1] ^= 1
+	valid := EndorseCSRParams{
+		EndorseCertParams: EndorseCertParams{KeyLabel: "KCAPriv", SignatureAlgorithm: x509.ECDSAWithSHA256},
+		Issuer:            caCert,
+		SerialNumber:      big.NewInt(1),
+		NotBefore:         time.Now(),
+		NotAfter:          time.Now().Add(time.Hour),
+	}
+	for _, tc := range []struct {
+		name   string
+		csr    []byte
+		modify func(*EndorseCSRParams)
+	}{
+		{"malformed", []byte{0x30, 0x00}, func(*EndorseCSRParams) {}},
+		{"bad signature", tampered, func(*EndorseCSRParams) {}},
+		{"no issuer", csr, func(p *EndorseCSRParams) { p.Issuer = nil }},
+		{"zero serial", csr, func(p *EndorseCSRParams) { p.SerialNumber = big.NewInt(0) }},
+		{"long serial", csr, func(p *EndorseCSRParams) { p.SerialNumber = new(big.Int).Lsh(big.NewInt(1), 8*certSerialSize-1) }},
+		{"long allocated serial", csr, func(p *EndorseCSRParams) {
+			p.SerialNumber = nil
+			p.NextSerial = func(context.Context) (*big.Int, error) {
+				return new(big.Int).Lsh(big.NewInt(1), 8*certSerialSize), nil
+			}
+		}},
+		{"empty validity", csr, func(p *EndorseCSRParams) { p.NotAfter = p.NotBefore }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			params := valid
+			tc.modify(&params)
+			if _, err := hsm.EndorseCSR(context.Background(), tc.csr, params); status.Code(err) != codes.InvalidArgument {
+				t.Errorf("EndorseCSR() = %v, want code %v", err, codes.InvalidArgument)
+			}
+		})
+	}
+}
+
+func TestEndorseCSR(t *testing.T) {
+	hsm, _, _ := MakeHSM(t)
+
+	caCert, caKey := newCRLTestCA(t)
+	func() {
+		session, release := hsm.sessions.getHandle()
+		defer release()
+		ca, err := session.ImportKey(caKey, &pk11.KeyOptions{Token: true})
+		ts.Check(t, err)
+		ts.Check(t, ca.SetLabel("KCAPriv"))
+	}()
+
+	csrDER := newTestCSR(t)
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	ts.Check(t, err)
+	notBefore := time.Now().Truncate(time.Second)
+	params := EndorseCSRParams{
+		EndorseCertParams: EndorseCertParams{KeyLabel: "KCAPriv", SignatureAlgorithm: x509.ECDSAWithSHA256},
+		Issuer:            caCert,
+		SerialNumber:      big.NewInt(4321),
+		NotBefore:         notBefore,
+		NotAfter:          notBefore.Add(24 * time.Hour),
+	}
+	der, err := hsm.EndorseCSR(context.Background(), csrDER, params)
+	ts.Check(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	ts.Check(t, err)
+	ts.Check(t, cert.CheckSignatureFrom(caCert))
+	if !bytes.Equal(cert.RawSubjectPublicKeyInfo, csr.RawSubjectPublicKeyInfo) {
+		t.Error("certificate public key does not match the CSR")
+	}
+	if cert.Subject.String() != csr.Subject.String() {
+		t.Errorf("Subject = %v, want %v", cert.Subject, csr.Subject)
+	}
+	if cert.SerialNumber.Cmp(params.SerialNumber) != 0 {
+		t.Errorf("SerialNumber = %v, want %v", cert.SerialNumber, params.SerialNumber)
+	}
+	if !cert.NotBefore.Equal(params.NotBefore) || !cert.NotAfter.Equal(params.NotAfter) {
+		t.Errorf("validity = [%v, %v], want [%v, %v]", cert.NotBefore, cert.NotAfter, params.NotBefore, params.NotAfter)
+	}
+	if len(cert.DNSNames) != 1 || cert.DNSNames[0] != "device.example.com" {
+		t.Errorf("DNSNames = %v, want the CSR DNS names", cert.DNSNames)
+	}
+
+	// The serial number is generated by the HSM if unset.
+	params.SerialNumber = nil
+	der, err = hsm.EndorseCSR(context.Background(), csrDER, params)
+	ts.Check(t, err)
+	cert, err = x509.ParseCertificate(der)
+	ts.Check(t, err)
+	ts.Check(t, validateCertSerial(cert.SerialNumber))
+	if n := len(cert.SerialNumber.Bytes()); n != certSerialSize {
+		t.Errorf("generated serial number is %d bytes long, want %d", n, certSerialSize)
+	}
+}
+
+func TestCertSerial(t *testing.T) {
+	for _, fill := range []byte{0x00, 0xff} {
+		sn := certSerial(bytes.Repeat([]byte{fill}, certSerialSize))
+		if err := validateCertSerial(sn); err != nil {
+			t.Errorf("validateCertSerial(certSerial(%#x...)) = %v", fill, err)
+		}
+		der, err := asn1.Marshal(sn)
+		ts.Check(t, err)
+		// Tag and length bytes precede the value.
+		if n := len(der) - 2; n != certSerialSize {
+			t.Errorf("certSerial(%#x...) encodes to %d bytes, want %d", fill, n, certSerialSize)
+		}
+	}
+
+	max := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 8*certSerialSize-1), big.NewInt(1))
+	for _, tc := range []struct {
+		sn    *big.Int
+		valid bool
+	}{
+		{big.NewInt(1), true},
+		{max, true},
+		{new(big.Int).Add(max, big.NewInt(1)), false},
+		{big.NewInt(0), false},
+		{big.NewInt(-1), false},
+	} {
+		if err := validateCertSerial(tc.sn); (err == nil) != tc.valid {
+			t.Errorf("validateCertSerial(%x) = %v, want valid = %v", tc.sn, err, tc.valid)
+		}
+	}
+}
+
+func TestSignOCSPResponse(t *testing.T) {
+	hsm, _, _ := MakeHSM(t)
+
+	caCert, caKey := newCRLTestCA(t)
+	func() {
+		session, release := hsm.sessions.getHandle()
+		defer release()
+		ca, err := session.ImportKey(caKey, &pk11.KeyOptions{Token: true})
+		ts.Check(t, err)
+		ts.Check(t, ca.SetLabel("KCAPriv"))
+	}()
+
+	now := time.Now().Truncate(time.Second)
+	template := &ocsp.Response{
+		Status:           ocsp.Revoked,
+		SerialNumber:     big.NewInt(1234),
+		ThisUpdate:       now,
+		NextUpdate:       now.Add(time.Hour),
+		RevokedAt:        now.Add(-time.Minute),
+		RevocationReason: ocsp.KeyCompromise,
+	}
+	der, err := hsm.SignOCSPResponse(context.Background(), template, caCert, "")
+	ts.Check(t, err)
+
+	// ParseResponse validates the signature against `caCert`.
+	resp, err := ocsp.ParseResponse(der, caCert)
+	ts.Check(t, err)
+	if resp.Status != ocsp.Revoked {
+		t.Errorf("Status = %d, want %d", resp.Status, ocsp.Revoked)
+	}
+	if resp.SerialNumber.Cmp(template.SerialNumber) != 0 {
+		t.Errorf("SerialNumber = %v, want %v", resp.SerialNumber, template.SerialNumber)
+	}
+	if resp.RevocationReason != ocsp.KeyCompromise {
+		t.Errorf("RevocationReason = %d, want %d", resp.RevocationReason, ocsp.KeyCompromise)
+	}
+	if resp.SignatureAlgorithm != x509.ECDSAWithSHA256 {
+		t.Errorf("SignatureAlgorithm = %v, want %v", resp.SignatureAlgorithm, x509.ECDSAWithSHA256)
+	}
+	ts.Check(t, resp.CheckSignatureFrom(caCert))
+
+	if _, err := hsm.SignOCSPResponse(context.Background(), template, caCert, "missing"); err == nil {
+		t.Error("SignOCSPResponse() with an unknown key label succeeded, want error")
+	}
+}
+
+func TestEndorseData(t *testing.T) {
+	log.Printf("TestEndorseData")
+	hsm, _, _ := MakeHSM(t)
+
+	// Mint ECDSA keys on HSM.
+	identityKeyPair, err := MintECDSAKeys(t, hsm)
+	ts.Check(t, err)
+
+	_, release := hsm.sessions.getHandle()
+	// Add labels to key objects in the HSM.
+	const kIdPrivName = "kid_priv"
+	const kIdPubName = "kid_pub"
+	err = identityKeyPair.PrivateKey.SetLabel(kIdPrivName)
+	ts.Check(t, err)
+	err = identityKeyPair.PublicKey.SetLabel(kIdPubName)
+	ts.Check(t, err)
+	// Export public key from HSM.
+	idPublicKeyExported, err := identityKeyPair.PublicKey.ExportKey()
+	ts.Check(t, err)
+	idPublicKey := idPublicKeyExported.(*ecdsa.PublicKey)
+	release()
+
+	log.Printf("Reading data")
+	data := readFile(t, diceTBSPath)
+
+	// Perform data signature operation.
+	log.Printf("Endorsing data")
+	asn1PubKey, asn1Sig, err := hsm.EndorseData(context.Background(), data, EndorseCertParams{
+		KeyLabel:           kIdPrivName,
+		SignatureAlgorithm: x509.ECDSAWithSHA256,
+	})
+	ts.Check(t, err)
+
+	// Check public keys match.
+	var pubKey struct{ X, Y *big.Int }
+	_, err = asn1.Unmarshal(asn1PubKey, &pubKey)
+	if pubKey.X.Cmp(idPublicKey.X) != 0 {
+		t.Fatal("pubkey (X) exported does not match one in HSM")
+	}
+	if pubKey.Y.Cmp(idPublicKey.Y) != 0 {
+		t.Fatal("pubkey (Y) exported does not match one in HSM")
+	}
+
+	// Verify signatures.
+	log.Printf("Verifying data signature")
+	dataHash := sha256.Sum256(data)
+	var sig struct{ R, S *big.Int }
+	_, err = asn1.Unmarshal(asn1Sig, &sig)
+	verfied := ecdsa.Verify(idPublicKey, dataHash[:], sig.R, sig.S)
+	if !verfied {
+		t.Errorf("signature failed to verify")
+	}
+}
+
+func TestEndorseDataNonECDSAKey(t *testing.T) {
+	hsm, _, _ := MakeHSM(t)
+	session, release := hsm.sessions.getHandle()
+	kp, err := session.GenerateRSA(2048, 0x010001, &pk11.KeyOptions{})
+	ts.Check(t, err)
+	ts.Check(t, kp.PrivateKey.SetLabel("RSADataKey"))
+	release()
+
+	_, _, err = hsm.EndorseData(context.Background(), []byte("data"), EndorseCertParams{
+		KeyLabel:           "RSADataKey",
+		SignatureAlgorithm: x509.ECDSAWithSHA256,
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("EndorseData() with an RSA key: got err %v, want code %v", err, codes.InvalidArgument)
+	}
+}
+
+func TestSignBatch(t *testing.T) {
+	hsm, _, _ := MakeHSM(t)
+	kp, err := MintECDSAKeys(t, hsm)
+	ts.Check(t, err)
+	_, release := hsm.sessions.getHandle()
+	ts.Check(t, kp.PrivateKey.SetLabel("BatchKey"))
+	pub, err := kp.PublicKey.ExportKey()
+	ts.Check(t, err)
+	release()
+
+	items := [][]byte{[]byte("item0"), []byte("item1"), {}}
+	sigs, err := hsm.SignBatch(context.Background(), "BatchKey", x509.ECDSAWithSHA256, items)
+	ts.Check(t, err)
+	if len(sigs) != len(items) {
+		t.Fatalf("got %d signatures, want %d", len(sigs), len(items))
+	}
+	halfN := new(big.Int).Rsh(elliptic.P256().Params().N, 1)
+	for i, item := range items {
+		h := sha256.Sum256(item)
+		if !ecdsa.VerifyASN1(pub.(*ecdsa.PublicKey), h[:], sigs[i]) {
+			t.Errorf("signature of item %d failed to verify", i)
+		}
+		var sig struct{ R, S *big.Int }
+		_, err = asn1.Unmarshal(sigs[i], &sig)
+		ts.Check(t, err)
+		if sig.S.Cmp(halfN) > 0 {
+			t.Errorf("signature of item %d is not in low-S form", i)
+		}
+	}
+
+	// The SHA-384 hash does not match the P-256 key.
+	if _, err := hsm.SignBatch(context.Background(), "BatchKey", x509.ECDSAWithSHA384, items); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("SignBatch() with mismatched hash: got err %v, want code %v", err, codes.InvalidArgument)
+	}
+
+	if _, err := hsm.SignBatch(context.Background(), "MissingKey", x509.ECDSAWithSHA256, items); err == nil {
+		t.Error("SignBatch() with missing key succeeded, want error")
+	}
+}
+
+func TestBatchSignError(t *testing.T) {
+	err := &BatchSignError{Errs: []error{nil, errors.New("boom"), nil}}
+	want := "failed to sign 1 of 3 items: item 1: boom"
+	if err.Error() != want {
+		t.Errorf("Error() = %q, want %q", err.Error(), want)
 	}
 }
@@ -0,0 +1,138 @@
+// Copyright lowRISC contributors (OpenTitan project).
+// Licensed under the Apache License, Version 2.0, see LICENSE for details.
+// SPDX-License-Identifier: Apache-2.0
+
+package se
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/big"
+	"sync"
+)
+
+// serialGenerator generates `n` certificate serial numbers. See
+// `HSM.BulkGenerateCertSerials`.
+type serialGenerator func(ctx context.Context, n int) ([]*big.Int, error)
+
+// SerialPool is a pool of pre-generated certificate serial numbers. It
+// amortizes the cost of an HSM session checkout across many certificates.
+//
+// The pool is refilled in the background when it drops below its low-water
+// mark. Call `Close` to stop the refill goroutine.
+type SerialPool struct {
+	// gen generates the serial numbers added to the pool.
+	gen serialGenerator
+
+	// serials holds the available serial numbers.
+	serials chan *big.Int
+
+	// lowWater is the number of serial numbers below which a refill is
+	// triggered.
+	lowWater int
+
+	// refill signals the refill goroutine. Buffered so that a pending
+	// request is not lost while a refill is in progress.
+	refill chan struct{}
+
+	// done is closed by `Close`.
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewSerialPool creates a pool holding up to `size` serial numbers generated
+// by `h`. The pool is refilled when fewer than `lowWater` serial numbers are
+// available.
+func NewSerialPool(h *HSM, size, lowWater int) (*SerialPool, error) {
+	return newSerialPool(h.BulkGenerateCertSerials, size, lowWater)
+}
+
+// newSerialPool creates a pool of serial numbers generated by `gen`. See
+// `NewSerialPool`.
+func newSerialPool(gen serialGenerator, size, lowWater int) (*SerialPool, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("invalid serial pool size: %d", size)
+	}
+	if lowWater < 0 || lowWater >= size {
+		return nil, fmt.Errorf("invalid serial pool low-water mark %d, must be in [0, %d)", lowWater, size)
+	}
+	p := &SerialPool{
+		gen:      gen,
+		serials:  make(chan *big.Int, size),
+		lowWater: lowWater,
+		refill:   make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	go p.run()
+	p.requestRefill()
+	return p, nil
+}
+
+// Next returns a serial number from the pool, waiting for a refill if the
+// pool is empty. Fails if `ctx` is done first.
+func (p *SerialPool) Next(ctx context.Context) (*big.Int, error) {
+	select {
+	case sn := <-p.serials:
+		if len(p.serials) < p.lowWater {
+			p.requestRefill()
+		}
+		return sn, nil
+	default:
+	}
+
+	p.requestRefill()
+	select {
+	case sn := <-p.serials:
+		return sn, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("no certificate serial number available: %w", ctx.Err())
+	}
+}
+
+// Available returns the number of serial numbers in the pool.
+func (p *SerialPool) Available() int {
+	return len(p.serials)
+}
+
+// Close stops the refill goroutine. Serial numbers left in the pool can still
+// be retrieved with `Next`.
+func (p *SerialPool) Close() {
+	p.closeOnce.Do(func() { close(p.done) })
+}
+
+// requestRefill wakes up the refill goroutine without blocking.
+func (p *SerialPool) requestRefill() {
+	select {
+	case p.refill <- struct{}{}:
+	default:
+	}
+}
+
+// run tops up the pool every time a refill is requested, until `Close` is
+// called.
+func (p *SerialPool) run() {
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-p.refill:
+		}
+		n := cap(p.serials) - len(p.serials)
+		if n == 0 {
+			continue
+		}
+		serials, err := p.gen(context.Background(), n)
+		if err != nil {
+			log.Printf("Failed to refill certificate serial number pool: %v", err)
+			continue
+		}
+		for _, sn := range serials {
+			select {
+			case p.serials <- sn:
+			default:
+				// Only `run` adds to the pool, so it cannot be full.
+			}
+		}
+	}
+}
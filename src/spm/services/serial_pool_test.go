@@ -0,0 +1,127 @@
+// Copyright lowRISC contributors (OpenTitan project).
+// Licensed under the Apache License, Version 2.0, see LICENSE for details.
+// SPDX-License-Identifier: Apache-2.0
+
+package se
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingGenerator returns sequential serial numbers and counts its calls.
+type countingGenerator struct {
+	next  atomic.Int64
+	calls atomic.Int32
+}
+
+func (g *countingGenerator) generate(ctx context.Context, n int) ([]*big.Int, error) {
+	g.calls.Add(1)
+	serials := make([]*big.Int, n)
+	for i := range serials {
+		serials[i] = big.NewInt(g.next.Add(1))
+	}
+	return serials, nil
+}
+
+// waitFor polls `cond` until it holds or the test times out.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSerialPoolUnique(t *testing.T) {
+	gen := &countingGenerator{}
+	p, err := newSerialPool(gen.generate, 16, 4)
+	if err != nil {
+		t.Fatalf("newSerialPool() failed: %v", err)
+	}
+	defer p.Close()
+
+	seen := make(map[int64]bool)
+	for i := 0; i < 1000; i++ {
+		sn, err := p.Next(context.Background())
+		if err != nil {
+			t.Fatalf("Next() failed: %v", err)
+		}
+		if seen[sn.Int64()] {
+			t.Fatalf("Next() returned duplicate serial number %v", sn)
+		}
+		seen[sn.Int64()] = true
+	}
+	// Serial numbers are generated in batches, not one at a time.
+	if calls := gen.calls.Load(); calls >= 1000 {
+		t.Errorf("generator called %d times for 1000 serial numbers", calls)
+	}
+}
+
+func TestSerialPoolRefill(t *testing.T) {
+	gen := &countingGenerator{}
+	p, err := newSerialPool(gen.generate, 10, 5)
+	if err != nil {
+		t.Fatalf("newSerialPool() failed: %v", err)
+	}
+	defer p.Close()
+
+	waitFor(t, func() bool { return p.Available() == 10 })
+	calls := gen.calls.Load()
+
+	// Draining down to the low-water mark does not trigger a refill.
+	for i := 0; i < 5; i++ {
+		if _, err := p.Next(context.Background()); err != nil {
+			t.Fatalf("Next() failed: %v", err)
+		}
+	}
+	if got := gen.calls.Load(); got != calls {
+		t.Errorf("generator called %d times above the low-water mark, want %d", got, calls)
+	}
+
+	// Dropping below the low-water mark tops up the pool.
+	if _, err := p.Next(context.Background()); err != nil {
+		t.Fatalf("Next() failed: %v", err)
+	}
+	waitFor(t, func() bool { return p.Available() == 10 })
+	if got := gen.calls.Load(); got != calls+1 {
+		t.Errorf("generator called %d times, want %d", got, calls+1)
+	}
+}
+
+func TestSerialPoolNextTimeout(t *testing.T) {
+	gen := func(ctx context.Context, n int) ([]*big.Int, error) {
+		return nil, errors.New("HSM unavailable")
+	}
+	p, err := newSerialPool(gen, 10, 5)
+	if err != nil {
+		t.Fatalf("newSerialPool() failed: %v", err)
+	}
+	defer p.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := p.Next(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Next() = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestNewSerialPoolInvalidParams(t *testing.T) {
+	gen := (&countingGenerator{}).generate
+	for _, tc := range []struct{ size, lowWater int }{
+		{0, 0},
+		{10, -1},
+		{10, 10},
+	} {
+		if _, err := newSerialPool(gen, tc.size, tc.lowWater); err == nil {
+			t.Errorf("newSerialPool(%d, %d) succeeded, want error", tc.size, tc.lowWater)
+		}
+	}
+}
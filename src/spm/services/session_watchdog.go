@@ -0,0 +1,182 @@
+// Copyright lowRISC contributors (OpenTitan project).
+// Licensed under the Apache License, Version 2.0, see LICENSE for details.
+// SPDX-License-Identifier: Apache-2.0
+
+package se
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lowRISC/opentitan-provisioning/src/pk11"
+)
+
+// checkout is a session checked out of the pool, as tracked by
+// `sessionWatchdog`.
+type checkout struct {
+	session *pk11.Session
+	// acquired is the checkout time.
+	acquired time.Time
+	// caller is the call site that checked out the session.
+	caller string
+	// release returns the session to the pool.
+	release func()
+	// warned is set once the held-too-long warning was logged.
+	warned bool
+}
+
+// sessionWatchdog detects sessions held longer than expected, which usually
+// indicates a leaked release function or a hung HSM operation. See
+// `HSMConfig.SessionHoldWarning` and `HSMConfig.SessionHoldLimit`.
+type sessionWatchdog struct {
+	// warnAfter is the hold time after which a warning is logged. Disabled
+	// if zero.
+	warnAfter time.Duration
+
+	// reclaimAfter is the hold time after which the session is forcibly
+	// returned to the pool. Disabled if zero.
+	reclaimAfter time.Duration
+
+	// mu guards held and the warned flag of its entries.
+	mu sync.Mutex
+
+	// held contains the sessions currently checked out.
+	held map[*checkout]struct{}
+
+	// abandoned counts the sessions held longer than warnAfter.
+	abandoned atomic.Int64
+
+	// reclaimed counts the sessions forcibly returned to the pool.
+	reclaimed atomic.Int64
+}
+
+// newSessionWatchdog creates a watchdog warning about sessions held longer
+// than `warnAfter` and reclaiming sessions held longer than `reclaimAfter`.
+// Either threshold is disabled if zero.
+func newSessionWatchdog(warnAfter, reclaimAfter time.Duration) *sessionWatchdog {
+	return &sessionWatchdog{
+		warnAfter:    warnAfter,
+		reclaimAfter: reclaimAfter,
+		held:         make(map[*checkout]struct{}),
+	}
+}
+
+// track starts watching checkout `c`.
+func (w *sessionWatchdog) track(c *checkout) {
+	w.mu.Lock()
+	w.held[c] = struct{}{}
+	w.mu.Unlock()
+}
+
+// untrack stops watching checkout `c`.
+func (w *sessionWatchdog) untrack(c *checkout) {
+	w.mu.Lock()
+	delete(w.held, c)
+	w.mu.Unlock()
+}
+
+// untrackSession stops watching the checkout of session `s`, which is
+// discarded without being released. See `sessionQueue.replace`.
+func (w *sessionWatchdog) untrackSession(s *pk11.Session) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for c := range w.held {
+		if c.session == s {
+			delete(w.held, c)
+			return
+		}
+	}
+}
+
+// interval returns the period at which `run` checks the held sessions.
+func (w *sessionWatchdog) interval() time.Duration {
+	d := w.warnAfter
+	if d == 0 || (w.reclaimAfter > 0 && w.reclaimAfter < d) {
+		d = w.reclaimAfter
+	}
+	return d / 2
+}
+
+// run checks the held sessions periodically until `done` is closed.
+func (w *sessionWatchdog) run(done <-chan struct{}) {
+	t := time.NewTicker(w.interval())
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-t.C:
+			w.check(now)
+		}
+	}
+}
+
+// check logs a warning for every session held longer than `warnAfter` at
+// time `now`, and reclaims the sessions held longer than `reclaimAfter`.
+func (w *sessionWatchdog) check(now time.Time) {
+	var reclaim []*checkout
+	w.mu.Lock()
+	for c := range w.held {
+		held := now.Sub(c.acquired)
+		if w.warnAfter > 0 && held >= w.warnAfter && !c.warned {
+			c.warned = true
+			w.abandoned.Add(1)
+			log.Printf("HSM session held for %v, checked out at %s", held.Round(time.Millisecond), c.caller)
+		}
+		if w.reclaimAfter > 0 && held >= w.reclaimAfter {
+			reclaim = append(reclaim, c)
+		}
+	}
+	w.mu.Unlock()
+
+	// The release functions untrack the checkout, so they are called without
+	// holding the lock.
+	for _, c := range reclaim {
+		log.Printf("Reclaiming HSM session held for %v, checked out at %s", now.Sub(c.acquired).Round(time.Millisecond), c.caller)
+		w.reclaimed.Add(1)
+		c.release()
+	}
+}
+
+// sessionPoolFrames identifies the session pool functions skipped by
+// `callSite`.
+var sessionPoolFrames = []string{
+	".(*sessionQueue).",
+	".withSession[",
+	".trySession[",
+	".(*HSM).execute",
+	".(*HSM).ExecuteCmd",
+}
+
+// callSite returns the location of the first caller of the session pool
+// functions, formatted as "function (file:line)".
+func callSite() string {
+	pc := make([]uintptr, 16)
+	n := runtime.Callers(2, pc)
+	frames := runtime.CallersFrames(pc[:n])
+	for {
+		f, more := frames.Next()
+		if !isSessionPoolFrame(f.Function) {
+			return fmt.Sprintf("%s (%s:%d)", f.Function, f.File, f.Line)
+		}
+		if !more {
+			return "unknown"
+		}
+	}
+}
+
+// isSessionPoolFrame reports whether `function` is one of the
+// `sessionPoolFrames`.
+func isSessionPoolFrame(function string) bool {
+	for _, p := range sessionPoolFrames {
+		if strings.Contains(function, p) {
+			return true
+		}
+	}
+	return false
+}
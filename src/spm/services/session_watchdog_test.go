@@ -0,0 +1,112 @@
+// Copyright lowRISC contributors (OpenTitan project).
+// Licensed under the Apache License, Version 2.0, see LICENSE for details.
+// SPDX-License-Identifier: Apache-2.0
+
+package se
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// newWatchedQueue returns a queue of one idle nil session watched by `w`.
+func newWatchedQueue(t *testing.T, w *sessionWatchdog) *sessionQueue {
+	t.Helper()
+	q := newSessionQueue(1)
+	q.watchdog = w
+	if err := q.insert(nil); err != nil {
+		t.Fatalf("insert() failed: %v", err)
+	}
+	return q
+}
+
+// heldCheckouts returns the checkouts tracked by `w`.
+func heldCheckouts(w *sessionWatchdog) []*checkout {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var held []*checkout
+	for c := range w.held {
+		held = append(held, c)
+	}
+	return held
+}
+
+func TestSessionWatchdogWarning(t *testing.T) {
+	w := newSessionWatchdog(time.Minute, 0)
+	q := newWatchedQueue(t, w)
+	hsm := &HSM{sessions: q}
+
+	_, release := q.getHandle()
+	held := heldCheckouts(w)
+	if len(held) != 1 {
+		t.Fatalf("watchdog tracks %d sessions, want 1", len(held))
+	}
+	if !strings.Contains(held[0].caller, "TestSessionWatchdogWarning") {
+		t.Errorf("checkout caller = %q, want the test function", held[0].caller)
+	}
+
+	w.check(time.Now())
+	if got := hsm.PoolStats().Abandoned; got != 0 {
+		t.Errorf("PoolStats().Abandoned = %d before the warning threshold, want 0", got)
+	}
+	// The warning is only issued once per checkout.
+	w.check(time.Now().Add(2 * time.Minute))
+	w.check(time.Now().Add(3 * time.Minute))
+	if got := hsm.PoolStats().Abandoned; got != 1 {
+		t.Errorf("PoolStats().Abandoned = %d, want 1", got)
+	}
+	if n := len(q.s); n != 0 {
+		t.Errorf("queue holds %d sessions, want the session to remain checked out", n)
+	}
+
+	release()
+	if n := len(heldCheckouts(w)); n != 0 {
+		t.Errorf("watchdog tracks %d sessions after release, want 0", n)
+	}
+}
+
+func TestSessionWatchdogReclaim(t *testing.T) {
+	w := newSessionWatchdog(0, time.Minute)
+	q := newWatchedQueue(t, w)
+	hsm := &HSM{sessions: q}
+
+	_, release := q.getHandle()
+	w.check(time.Now().Add(2 * time.Minute))
+	if n := len(q.s); n != 1 {
+		t.Fatalf("queue holds %d sessions after reclaim, want 1", n)
+	}
+	if got := hsm.PoolStats().Reclaimed; got != 1 {
+		t.Errorf("PoolStats().Reclaimed = %d, want 1", got)
+	}
+	if n := len(heldCheckouts(w)); n != 0 {
+		t.Errorf("watchdog tracks %d sessions after reclaim, want 0", n)
+	}
+
+	// Releasing a reclaimed session must not return it twice.
+	release()
+	if n := len(q.s); n != 1 {
+		t.Errorf("queue holds %d sessions after late release, want 1", n)
+	}
+}
+
+func TestSessionWatchdogRun(t *testing.T) {
+	w := newSessionWatchdog(0, 10*time.Millisecond)
+	q := newWatchedQueue(t, w)
+	done := make(chan struct{})
+	go func() {
+		w.run(q.closed)
+		close(done)
+	}()
+
+	q.getHandle()
+	deadline := time.Now().Add(10 * time.Second)
+	for w.reclaimed.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("leaked session was not reclaimed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	q.close()
+	<-done
+}
@@ -6,7 +6,10 @@
 package skucfg
 
 import (
+	"errors"
 	"fmt"
+	"strings"
+	"time"
 )
 
 // AttrName is an attribute name.
@@ -31,14 +34,89 @@ const (
 )
 
 type Config struct {
-	Sku           string            `yaml:"sku"`
-	SlotID        int               `yaml:"slotId"`
-	NumSessions   int               `yaml:"numSessions"`
+	Sku    string `yaml:"sku"`
+	SlotID int    `yaml:"slotId"`
+	// TokenLabel selects the HSM token by label. Takes precedence over
+	// SlotID if set.
+	TokenLabel  string `yaml:"tokenLabel"`
+	NumSessions int    `yaml:"numSessions"`
+	// FailoverSlotIDs are slots holding replicas of the SlotID partition,
+	// used when SlotID is unreachable.
+	FailoverSlotIDs []int `yaml:"failoverSlotIds"`
+	// MinSessions is the minimum number of HSM sessions required to start.
+	// Defaults to NumSessions if unset.
+	MinSessions int `yaml:"minSessions"`
+	// MaxSessions is the largest number of HSM sessions the pool can be
+	// resized to at runtime. Defaults to NumSessions if unset.
+	MaxSessions   int               `yaml:"maxSessions"`
 	SymmetricKeys []SymmetricKey    `yaml:"symmetricKeys"`
 	PrivateKeys   []PrivateKey      `yaml:"privateKeys"`
 	PublicKeys    []PublicKey       `yaml:"publicKeys"`
 	Certs         []Certificate     `yaml:"certs"`
 	Attributes    map[string]string `yaml:"attributes"`
+	// IssuanceWindows restricts token generation and certificate endorsement
+	// to the given time ranges. Operations are allowed at any time if empty.
+	IssuanceWindows []IssuanceWindow `yaml:"issuanceWindows"`
+	// MaxClockSkew is the tolerance applied to the NotBefore field of
+	// endorsed certificates, e.g. "5m". NotBefore is not checked if unset.
+	MaxClockSkew time.Duration `yaml:"maxClockSkew"`
+	// SessionWaitTimeout bounds the time a request waits for a free HSM
+	// session, e.g. "5s". Requests wait until their deadline if unset.
+	SessionWaitTimeout time.Duration `yaml:"sessionWaitTimeout"`
+	// SessionHoldWarning logs the call site of HSM sessions held longer
+	// than the given time, e.g. "30s". Disabled if unset.
+	SessionHoldWarning time.Duration `yaml:"sessionHoldWarning"`
+	// SessionHoldLimit forcibly returns HSM sessions held longer than the
+	// given time to the pool. Development only. Disabled if unset.
+	SessionHoldLimit time.Duration `yaml:"sessionHoldLimit"`
+	// SessionHealthCheckInterval is the period at which idle HSM sessions
+	// are checked and lost ones reopened, e.g. "1m". Disabled if unset.
+	SessionHealthCheckInterval time.Duration `yaml:"sessionHealthCheckInterval"`
+	// SessionKeepaliveInterval is the period at which idle HSM sessions are
+	// kept alive with a cheap operation, e.g. "5m". Should be shorter than
+	// the idle timeout of the HSM. Disabled if unset.
+	SessionKeepaliveInterval time.Duration `yaml:"sessionKeepaliveInterval"`
+	// SessionOpenAttempts is the number of attempts to open each HSM
+	// session at startup when the HSM returns a transient error, e.g. 5.
+	// Not retried if unset.
+	SessionOpenAttempts int `yaml:"sessionOpenAttempts"`
+	// SessionOpenBackoff is the delay before the first session open retry,
+	// doubled on every retry, e.g. "500ms". Defaults to 50ms if unset.
+	SessionOpenBackoff time.Duration `yaml:"sessionOpenBackoff"`
+	// LazySessions opens a single HSM session at startup and the remaining
+	// sessions in the background.
+	LazySessions bool `yaml:"lazySessions"`
+	// ReadWriteSessions is the number of read-write HSM sessions opened for
+	// the operations creating or destroying token objects, in addition to
+	// NumSessions read-only sessions. All sessions are read-write if unset.
+	ReadWriteSessions int `yaml:"readWriteSessions"`
+	// ReservedSessions is the number of HSM sessions reserved for
+	// latency-sensitive operations such as certificate endorsement. Disabled
+	// if unset.
+	ReservedSessions int `yaml:"reservedSessions"`
+	// SkipCertVerification skips parsing and verifying the certificates
+	// endorsed by the HSM before returning them, for throughput-critical
+	// SKUs.
+	SkipCertVerification bool `yaml:"skipCertVerification"`
+	// ClientBudget limits the HSM usage of each client. Reloaded periodically
+	// by the SPM server, see `--budget_reload_interval`.
+	ClientBudget ClientBudget `yaml:"clientBudget"`
+}
+
+// ClientBudget is a per-client budget of HSM operations. Clients are
+// identified by the subject of their TLS client certificate, so budgets
+// require mTLS. Zero limits are not enforced.
+type ClientBudget struct {
+	// MaxRequests is the number of token generation and endorsement requests
+	// allowed per window.
+	MaxRequests int64 `yaml:"maxRequests"`
+	// MaxHSMTime is the cumulative time spent by the HSM on the client's
+	// requests allowed per window, e.g. "30s". Expensive operations such as
+	// RSA-4096 signatures consume more of the budget than ECDSA-P256 ones.
+	MaxHSMTime time.Duration `yaml:"maxHsmTime"`
+	// Window is the period after which budgets are replenished, e.g. "1m".
+	// Budgets are never replenished if unset.
+	Window time.Duration `yaml:"window"`
 }
 
 type SymmetricKey struct {
@@ -59,6 +137,127 @@ type Certificate struct {
 	Path string `yaml:"path"`
 }
 
+// IssuanceWindow is a recurring daily time range in which issuance is
+// allowed. A window with `End` before `Start` spans midnight.
+type IssuanceWindow struct {
+	// Days is the list of weekdays (e.g. "Mon") the window starts on. The
+	// window applies to every day if empty.
+	Days []string `yaml:"days"`
+	// Start is the local start time of the window in "15:04" format.
+	Start string `yaml:"start"`
+	// End is the local end time of the window in "15:04" format (exclusive).
+	End string `yaml:"end"`
+	// Timezone is the IANA time zone name used to interpret `Start` and `End`.
+	// Defaults to UTC.
+	Timezone string `yaml:"timezone"`
+}
+
+// ErrOutsideIssuanceWindow is returned when an operation is attempted outside
+// of the configured issuance windows.
+var ErrOutsideIssuanceWindow = errors.New("outside of issuance window")
+
+// parseTimeOfDay parses a "15:04" time of day into minutes past midnight.
+func parseTimeOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q: %v", s, err)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// contains returns true if `t` falls within the window.
+func (w IssuanceWindow) contains(t time.Time) (bool, error) {
+	loc := time.UTC
+	if w.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(w.Timezone); err != nil {
+			return false, fmt.Errorf("invalid timezone %q: %v", w.Timezone, err)
+		}
+	}
+	start, err := parseTimeOfDay(w.Start)
+	if err != nil {
+		return false, err
+	}
+	end, err := parseTimeOfDay(w.End)
+	if err != nil {
+		return false, err
+	}
+	for _, d := range w.Days {
+		if !isWeekday(d) {
+			return false, fmt.Errorf("invalid weekday %q", d)
+		}
+	}
+
+	// Wall clock time is used so that windows follow DST transitions.
+	local := t.In(loc)
+	now := local.Hour()*60 + local.Minute()
+	day := local.Weekday()
+	switch {
+	case start < end:
+		if now < start || now >= end {
+			return false, nil
+		}
+	case start > end:
+		// The window spans midnight; the early morning part belongs to the
+		// window started on the previous day.
+		if now < end {
+			day = (day + 6) % 7
+		} else if now < start {
+			return false, nil
+		}
+	default:
+		return false, fmt.Errorf("empty issuance window %s-%s", w.Start, w.End)
+	}
+
+	if len(w.Days) == 0 {
+		return true, nil
+	}
+	for _, d := range w.Days {
+		if strings.EqualFold(d, day.String()[:3]) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// isWeekday returns true if `d` is a three letter weekday abbreviation.
+func isWeekday(d string) bool {
+	for wd := time.Sunday; wd <= time.Saturday; wd++ {
+		if strings.EqualFold(d, wd.String()[:3]) {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateIssuanceWindows checks that all issuance windows are well formed.
+func (c *Config) ValidateIssuanceWindows() error {
+	for i, w := range c.IssuanceWindows {
+		if _, err := w.contains(time.Time{}); err != nil {
+			return fmt.Errorf("issuance window %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// CheckIssuanceWindow returns an error wrapping `ErrOutsideIssuanceWindow` if
+// `t` is not covered by any of the configured issuance windows.
+func (c *Config) CheckIssuanceWindow(t time.Time) error {
+	if len(c.IssuanceWindows) == 0 {
+		return nil
+	}
+	for i, w := range c.IssuanceWindows {
+		ok, err := w.contains(t)
+		if err != nil {
+			return fmt.Errorf("issuance window %d: %v", i, err)
+		}
+		if ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: sku %q, time %s, windows %+v", ErrOutsideIssuanceWindow, c.Sku, t.Format(time.RFC3339), c.IssuanceWindows)
+}
+
 type SkuAuth struct {
 	SkuAuth string   `yaml:"skuAuth"`
 	Methods []string `yaml:"methods"`
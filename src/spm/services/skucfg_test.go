@@ -0,0 +1,166 @@
+// Copyright lowRISC contributors (OpenTitan project).
+// Licensed under the Apache License, Version 2.0, see LICENSE for details.
+// SPDX-License-Identifier: Apache-2.0
+
+package skucfg
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func mustParse(t *testing.T, s string) time.Time {
+	t.Helper()
+	tm, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		t.Fatalf("failed to parse time %q: %v", s, err)
+	}
+	return tm
+}
+
+func TestCheckIssuanceWindow(t *testing.T) {
+	weekdays := IssuanceWindow{
+		Days:     []string{"Mon", "Tue", "Wed", "Thu", "Fri"},
+		Start:    "08:00",
+		End:      "18:00",
+		Timezone: "America/Los_Angeles",
+	}
+	overnight := IssuanceWindow{
+		Days:  []string{"Fri"},
+		Start: "22:00",
+		End:   "02:00",
+	}
+
+	tests := []struct {
+		name    string
+		windows []IssuanceWindow
+		time    string
+		ok      bool
+	}{
+		{
+			name: "no windows",
+			time: "2024-03-03T03:00:00Z",
+			ok:   true,
+		},
+		{
+			name:    "in window",
+			windows: []IssuanceWindow{weekdays},
+			// Monday 09:00 PST.
+			time: "2024-03-04T17:00:00Z",
+			ok:   true,
+		},
+		{
+			name:    "sunday",
+			windows: []IssuanceWindow{weekdays},
+			// Sunday 10:00 PST.
+			time: "2024-03-03T18:00:00Z",
+		},
+		{
+			name:    "after hours",
+			windows: []IssuanceWindow{weekdays},
+			// Monday 03:00 PST.
+			time: "2024-03-04T11:00:00Z",
+		},
+		{
+			name:    "end is exclusive",
+			windows: []IssuanceWindow{weekdays},
+			// Monday 18:00 PST.
+			time: "2024-03-05T02:00:00Z",
+		},
+		{
+			// 2024-03-11 is the first Monday after the DST switch, so 08:30
+			// PDT is 15:30 UTC. The same UTC time was 07:30 PST a week ago.
+			name:    "dst in window",
+			windows: []IssuanceWindow{weekdays},
+			time:    "2024-03-11T15:30:00Z",
+			ok:      true,
+		},
+		{
+			name:    "dst out of window",
+			windows: []IssuanceWindow{weekdays},
+			time:    "2024-03-04T15:30:00Z",
+		},
+		{
+			name:    "overnight before midnight",
+			windows: []IssuanceWindow{overnight},
+			// Friday 23:00 UTC.
+			time: "2024-03-08T23:00:00Z",
+			ok:   true,
+		},
+		{
+			name:    "overnight after midnight",
+			windows: []IssuanceWindow{overnight},
+			// Saturday 01:00 UTC, window started on Friday.
+			time: "2024-03-09T01:00:00Z",
+			ok:   true,
+		},
+		{
+			name:    "overnight wrong day",
+			windows: []IssuanceWindow{overnight},
+			// Saturday 23:00 UTC.
+			time: "2024-03-09T23:00:00Z",
+		},
+		{
+			name:    "any window matches",
+			windows: []IssuanceWindow{weekdays, overnight},
+			time:    "2024-03-09T01:00:00Z",
+			ok:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{Sku: "test", IssuanceWindows: tt.windows}
+			err := cfg.CheckIssuanceWindow(mustParse(t, tt.time))
+			if tt.ok {
+				if err != nil {
+					t.Errorf("CheckIssuanceWindow() = %v, want nil", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrOutsideIssuanceWindow) {
+				t.Errorf("CheckIssuanceWindow() = %v, want %v", err, ErrOutsideIssuanceWindow)
+			}
+		})
+	}
+}
+
+func TestValidateIssuanceWindows(t *testing.T) {
+	tests := []struct {
+		name   string
+		window IssuanceWindow
+		ok     bool
+	}{
+		{
+			name:   "ok",
+			window: IssuanceWindow{Start: "08:00", End: "17:00", Timezone: "Europe/London"},
+			ok:     true,
+		},
+		{
+			name:   "bad timezone",
+			window: IssuanceWindow{Start: "08:00", End: "17:00", Timezone: "Mars/Olympus"},
+		},
+		{
+			name:   "bad start",
+			window: IssuanceWindow{Start: "8am", End: "17:00"},
+		},
+		{
+			name:   "bad day",
+			window: IssuanceWindow{Days: []string{"Someday"}, Start: "08:00", End: "17:00"},
+		},
+		{
+			name:   "empty window",
+			window: IssuanceWindow{Start: "08:00", End: "08:00"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{IssuanceWindows: []IssuanceWindow{tt.window}}
+			if err := cfg.ValidateIssuanceWindows(); (err == nil) != tt.ok {
+				t.Errorf("expected ok=%t; got err=%v", tt.ok, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,268 @@
+// Copyright lowRISC contributors (OpenTitan project).
+// Licensed under the Apache License, Version 2.0, see LICENSE for details.
+// SPDX-License-Identifier: Apache-2.0
+
+package se
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/lowRISC/opentitan-provisioning/src/pk11"
+)
+
+// slotState tracks the reachability of an HSM slot.
+type slotState struct {
+	// id is the index of the slot token, as configured in `HSMConfig`.
+	id int
+
+	// tok is the token in the slot.
+	tok pk11.Token
+
+	// down is set while the slot is unreachable.
+	down atomic.Bool
+
+	// mu guards lastErr.
+	mu sync.Mutex
+
+	// lastErr is the error that marked the slot down.
+	lastErr error
+}
+
+// markDown records that the slot became unreachable because of `err`.
+func (s *slotState) markDown(err error) {
+	s.mu.Lock()
+	s.lastErr = err
+	s.mu.Unlock()
+	if !s.down.Swap(true) {
+		log.Printf("HSM slot %d is down: %v", s.id, err)
+	}
+}
+
+// markUp records that the slot is reachable.
+func (s *slotState) markUp() {
+	if s.down.Swap(false) {
+		log.Printf("HSM slot %d is back up", s.id)
+	}
+}
+
+// slotSet opens sessions on a set of slots holding replicated HSM
+// partitions, e.g. on redundant network HSMs. Sessions are distributed over
+// the reachable slots in a round-robin fashion.
+type slotSet struct {
+	slots []*slotState
+
+	// next is the index of the slot the next session is opened on.
+	next atomic.Uint32
+
+	// open opens and logs in a read-write session on a slot.
+	open func(*slotState) (*pk11.Session, error)
+
+	// openRO opens and logs in a read-only session on a slot. Defaults to
+	// `open` if nil.
+	openRO func(*slotState) (*pk11.Session, error)
+}
+
+// newSlotSet returns a `slotSet` for the tokens in the slots `slotIDs`. If
+// `tokenLabel` is set, the first slot is the one holding the token with that
+// label instead. Sessions are logged in as crypto user with `hsmPW` password,
+// unless `readOnly` is set. See `newSessionOpener`.
+func newSlotSet(soPath, hsmPW, tokenLabel string, slotIDs []int, readOnly bool) (*slotSet, *pk11.Mod, error) {
+	mod, err := pk11.Load(soPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("fail to load pk11: %w", err)
+	}
+	toks, err := mod.Tokens()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open tokens: %w", err)
+	}
+	if tokenLabel != "" {
+		labels := make([]string, len(toks))
+		for i, tok := range toks {
+			if labels[i], err = tok.Label(); err != nil {
+				return nil, nil, fmt.Errorf("failed to read token label: %w", err)
+			}
+		}
+		id, err := findTokenByLabel(labels, tokenLabel)
+		if err != nil {
+			return nil, nil, err
+		}
+		slotIDs = append([]int{id}, slotIDs[1:]...)
+	}
+	// open returns a function opening sessions with `openTok`, logged in as
+	// crypto user unless `readOnly` is set.
+	open := func(openTok func(pk11.Token) (*pk11.Session, error)) func(*slotState) (*pk11.Session, error) {
+		return func(slot *slotState) (*pk11.Session, error) {
+			s, err := openTok(slot.tok)
+			if err != nil {
+				return nil, fmt.Errorf("fail to open session to HSM slot %d: %w", slot.id, err)
+			}
+			if readOnly {
+				return s, nil
+			}
+			if err := s.Login(pk11.NormalUser, hsmPW); err != nil {
+				return nil, fmt.Errorf("fail to login into the HSM slot %d: %w", slot.id, err)
+			}
+			return s, nil
+		}
+	}
+	ss := &slotSet{
+		open:   open(pk11.Token.OpenSession),
+		openRO: open(pk11.Token.OpenReadOnlySession),
+	}
+	if readOnly {
+		ss.open = ss.openRO
+	}
+	for _, id := range slotIDs {
+		if id < 0 || id >= len(toks) {
+			return nil, nil, fmt.Errorf("fail to find slot number: %d", id)
+		}
+		ss.slots = append(ss.slots, &slotState{id: id, tok: toks[id]})
+	}
+	return ss, mod, nil
+}
+
+// findTokenByLabel returns the index of the token labeled `label` in the
+// token `labels`. Fails if no token or more than one token has that label.
+func findTokenByLabel(labels []string, label string) (int, error) {
+	found := -1
+	for i, l := range labels {
+		if l != label {
+			continue
+		}
+		if found >= 0 {
+			return 0, fmt.Errorf("token label %q is used by slots %d and %d", label, found, i)
+		}
+		found = i
+	}
+	if found < 0 {
+		return 0, fmt.Errorf("fail to find token with label %q, available labels: %q", label, labels)
+	}
+	return found, nil
+}
+
+// openSession opens a read-write session on the next reachable slot. Slots
+// marked down are only tried once all the others failed, so that a recovered
+// slot is detected when it is the last one left.
+func (ss *slotSet) openSession() (*pk11.Session, error) {
+	return ss.openWith(ss.open)
+}
+
+// openReadOnlySession is like `openSession`, but opens a read-only session,
+// which cannot create or destroy token objects.
+func (ss *slotSet) openReadOnlySession() (*pk11.Session, error) {
+	if ss.openRO == nil {
+		return ss.openSession()
+	}
+	return ss.openWith(ss.openRO)
+}
+
+// openWith opens a session with `open` on the next reachable slot. See
+// `openSession`.
+func (ss *slotSet) openWith(open func(*slotState) (*pk11.Session, error)) (*pk11.Session, error) {
+	n := len(ss.slots)
+	start := int(ss.next.Add(1)-1) % n
+	var errs []string
+	var lastErr error
+	for _, down := range []bool{false, true} {
+		for i := 0; i < n; i++ {
+			slot := ss.slots[(start+i)%n]
+			if slot.down.Load() != down {
+				continue
+			}
+			s, err := open(slot)
+			if err != nil {
+				if n > 1 {
+					slot.markDown(err)
+				}
+				lastErr = err
+				errs = append(errs, fmt.Sprintf("slot %d: %v", slot.id, err))
+				continue
+			}
+			slot.markUp()
+			return s, nil
+		}
+	}
+	if n == 1 {
+		return nil, lastErr
+	}
+	return nil, fmt.Errorf("failed to open a session on any HSM slot: %s", strings.Join(errs, "; "))
+}
+
+// markLost marks the slot of the lost session `s` down, so that its
+// replacement is opened on another slot.
+func (ss *slotSet) markLost(s *pk11.Session) {
+	if len(ss.slots) == 1 {
+		return
+	}
+	for _, slot := range ss.slots {
+		if slot.tok.Slot() == s.Token().Slot() {
+			slot.markDown(fmt.Errorf("session lost"))
+			return
+		}
+	}
+}
+
+// probe checks whether the slots marked down are reachable again by opening
+// a session on each of them.
+func (ss *slotSet) probe() {
+	for _, slot := range ss.slots {
+		if !slot.down.Load() {
+			continue
+		}
+		s, err := ss.open(slot)
+		if err != nil {
+			slot.markDown(err)
+			continue
+		}
+		if err := s.Close(); err != nil {
+			log.Printf("Failed to close HSM slot probe session: %v", err)
+		}
+		slot.markUp()
+	}
+}
+
+// maxSessions returns the number of sessions that can be opened on every
+// slot, as reported by the tokens. Returns zero if no token reports a limit.
+func (ss *slotSet) maxSessions() (int, error) {
+	max := 0
+	for _, slot := range ss.slots {
+		n, err := slot.tok.MaxSessions()
+		if err != nil {
+			return 0, err
+		}
+		if n > 0 && (max == 0 || int(n) < max) {
+			max = int(n)
+		}
+	}
+	return max, nil
+}
+
+// SlotHealth reports whether an HSM slot is serving sessions. See
+// `HSM.SlotHealth`.
+type SlotHealth struct {
+	// SlotID is the slot, as configured in `HSMConfig.SlotID` or
+	// `HSMConfig.FailoverSlotIDs`.
+	SlotID int
+	// Serving is set if new sessions are opened on the slot.
+	Serving bool
+	// Err is the error that marked the slot down. Nil while serving.
+	Err error
+}
+
+// health returns the state of each slot.
+func (ss *slotSet) health() []SlotHealth {
+	health := make([]SlotHealth, len(ss.slots))
+	for i, slot := range ss.slots {
+		health[i] = SlotHealth{SlotID: slot.id, Serving: !slot.down.Load()}
+		if !health[i].Serving {
+			slot.mu.Lock()
+			health[i].Err = slot.lastErr
+			slot.mu.Unlock()
+		}
+	}
+	return health
+}
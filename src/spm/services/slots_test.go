@@ -0,0 +1,131 @@
+// Copyright lowRISC contributors (OpenTitan project).
+// Licensed under the Apache License, Version 2.0, see LICENSE for details.
+// SPDX-License-Identifier: Apache-2.0
+
+package se
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/lowRISC/opentitan-provisioning/src/pk11"
+)
+
+// fakeSlots is a set of slots opening nil sessions, which fail to open on
+// the slots marked unreachable.
+type fakeSlots struct {
+	unreachable map[int]bool
+	opened      []int
+}
+
+func newFakeSlotSet(f *fakeSlots, ids ...int) *slotSet {
+	ss := &slotSet{
+		open: func(slot *slotState) (*pk11.Session, error) {
+			if f.unreachable[slot.id] {
+				return nil, fmt.Errorf("slot %d unreachable", slot.id)
+			}
+			f.opened = append(f.opened, slot.id)
+			return nil, nil
+		},
+	}
+	for _, id := range ids {
+		ss.slots = append(ss.slots, &slotState{id: id})
+	}
+	return ss
+}
+
+func TestSlotSetFailover(t *testing.T) {
+	f := &fakeSlots{unreachable: map[int]bool{}}
+	ss := newFakeSlotSet(f, 0, 1)
+
+	openN := func(n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			if _, err := ss.openSession(); err != nil {
+				t.Fatalf("openSession() failed: %v", err)
+			}
+		}
+	}
+
+	// Sessions are distributed over the slots.
+	openN(4)
+	if want := []int{0, 1, 0, 1}; !reflect.DeepEqual(f.opened, want) {
+		t.Errorf("opened sessions on slots %v, want %v", f.opened, want)
+	}
+
+	// Sessions are only opened on the reachable slot.
+	f.unreachable[1] = true
+	f.opened = nil
+	openN(4)
+	if want := []int{0, 0, 0, 0}; !reflect.DeepEqual(f.opened, want) {
+		t.Errorf("opened sessions on slots %v, want %v", f.opened, want)
+	}
+	health := ss.health()
+	if len(health) != 2 || !health[0].Serving || health[1].Serving || health[1].Err == nil {
+		t.Errorf("health() = %+v, want slot 0 serving and slot 1 down", health)
+	}
+
+	// A slot marked down is tried again once the others fail.
+	f.unreachable[0], f.unreachable[1] = true, false
+	f.opened = nil
+	openN(1)
+	if want := []int{1}; !reflect.DeepEqual(f.opened, want) {
+		t.Errorf("opened sessions on slots %v, want %v", f.opened, want)
+	}
+	if health := ss.health(); health[0].Serving || !health[1].Serving || health[1].Err != nil {
+		t.Errorf("health() = %+v, want slot 0 down and slot 1 serving", health)
+	}
+
+	// Opening a session fails when all slots are unreachable.
+	f.unreachable[0], f.unreachable[1] = true, true
+	_, err := ss.openSession()
+	if err == nil || !strings.Contains(err.Error(), "slot 0") || !strings.Contains(err.Error(), "slot 1") {
+		t.Errorf("openSession() = %v, want errors of both slots", err)
+	}
+}
+
+func TestSlotSetSingleSlot(t *testing.T) {
+	openErr := errors.New("unreachable")
+	ss := &slotSet{
+		slots: []*slotState{{id: 3}},
+		open: func(*slotState) (*pk11.Session, error) {
+			return nil, openErr
+		},
+	}
+	// The error is returned as is, and a single slot is never marked down.
+	if _, err := ss.openSession(); err != openErr {
+		t.Errorf("openSession() = %v, want %v", err, openErr)
+	}
+	if health := ss.health(); !health[0].Serving {
+		t.Errorf("health() = %+v, want the slot serving", health)
+	}
+}
+
+func TestFindTokenByLabel(t *testing.T) {
+	labels := []string{"spm-a", "spm-b", "spm-a", "spm-c"}
+
+	if got, err := findTokenByLabel(labels, "spm-c"); err != nil || got != 3 {
+		t.Errorf("findTokenByLabel(%q) = %d, %v, want 3, nil", "spm-c", got, err)
+	}
+
+	_, err := findTokenByLabel(labels, "missing")
+	if err == nil {
+		t.Fatalf("findTokenByLabel(%q) succeeded, want not found error", "missing")
+	}
+	for _, l := range []string{"spm-a", "spm-b", "spm-c"} {
+		if !strings.Contains(err.Error(), l) {
+			t.Errorf("not found error %q does not list available label %q", err, l)
+		}
+	}
+
+	_, err = findTokenByLabel(labels, "spm-a")
+	if err == nil {
+		t.Fatalf("findTokenByLabel(%q) succeeded, want duplicate label error", "spm-a")
+	}
+	if !strings.Contains(err.Error(), "slots 0 and 2") {
+		t.Errorf("duplicate label error %q does not name the slots", err)
+	}
+}
@@ -8,11 +8,15 @@ package spm
 import (
 	"context"
 	"crypto/x509"
+	"errors"
+	"expvar"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"strings"
 	"sync"
+	"time"
 
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -45,6 +49,23 @@ type Options struct {
 
 	// File contains the full file path of the HSM's password
 	HsmPWFile string
+
+	// HSMCallTimeout bounds the time a request waits for an HSM session. Zero
+	// means no limit beyond the request deadline.
+	HSMCallTimeout time.Duration
+
+	// AuditLogger records the HSM certificate endorsement and key generation
+	// operations of all SKUs. Disabled if nil.
+	AuditLogger se.AuditLogger
+
+	// NewSE creates the SE of each SKU. Defaults to `se.NewHSM` if nil.
+	// Tests running without an HSM may use `se.NewFakeHSM` instead.
+	NewSE func(se.HSMConfig) (se.SE, error)
+
+	// BudgetReloadInterval is the period at which the client budgets of the
+	// initialized SKUs are reloaded from their configuration files. Budgets
+	// are never reloaded if zero.
+	BudgetReloadInterval time.Duration
 }
 
 // server is the server object.
@@ -59,6 +80,15 @@ type server struct {
 	// hsmPasswordFile holds the full file path of the HSM's password
 	hsmPasswordFile string
 
+	// hsmCallTimeout bounds the time a request waits for an HSM session.
+	hsmCallTimeout time.Duration
+
+	// auditLogger records the HSM operations. Optional.
+	auditLogger se.AuditLogger
+
+	// newSE creates the SE of each SKU.
+	newSE func(se.HSMConfig) (se.SE, error)
+
 	// skus contains SKU specific configuration only visible to the SPM
 	// server.
 	skus map[string]*skuState
@@ -68,6 +98,10 @@ type server struct {
 
 	// muSKU is a mutex use to arbitrate SKU initialization access.
 	muSKU sync.RWMutex
+
+	// stopReload stops the periodic reload of the client budgets. Nil if
+	// budgets are not reloaded.
+	stopReload chan struct{}
 }
 
 type skuState struct {
@@ -81,8 +115,22 @@ type skuState struct {
 
 	// Instance of HSM.
 	seHandle se.SE
+
+	// budgets tracks the HSM usage of each client.
+	budgets *clientBudgets
+}
+
+// seHealth is implemented by the SEs reporting their health, such as
+// `se.HSM`.
+type seHealth interface {
+	Ready() bool
+	SlotHealth() []se.SlotHealth
 }
 
+// hsmMetrics holds the HSM metrics of each SKU, indexed by SKU name.
+// Published through expvar.
+var hsmMetrics = expvar.NewMap("spm_hsm")
+
 const (
 	EKCertSerialNumberSize int  = 10
 	TokenSize              int  = 16
@@ -98,8 +146,15 @@ func generateSessionToken(n int) (string, error) {
 	return token.Generate(n)
 }
 
+// Server is the SPM gRPC server. Closing it closes the HSMs of the
+// initialized SKUs on shutdown.
+type Server interface {
+	pbs.SpmServiceServer
+	io.Closer
+}
+
 // NewSpmServer returns an implementation of the SPM gRPC server.
-func NewSpmServer(opts Options) (pbs.SpmServiceServer, error) {
+func NewSpmServer(opts Options) (Server, error) {
 	if _, err := os.Stat(opts.SPMConfigDir); os.IsNotExist(err) {
 		return nil, fmt.Errorf("config directory does not exist: %q, error: %v", opts.SPMConfigDir, err)
 	}
@@ -112,15 +167,72 @@ func NewSpmServer(opts Options) (pbs.SpmServiceServer, error) {
 
 	session_token.NewSessionTokenInstance()
 
-	return &server{
+	newSE := opts.NewSE
+	if newSE == nil {
+		newSE = func(cfg se.HSMConfig) (se.SE, error) {
+			return se.NewHSM(cfg)
+		}
+	}
+	s := &server{
 		configDir:       opts.SPMConfigDir,
 		hsmSOLibPath:    opts.HSMSOLibPath,
 		hsmPasswordFile: opts.HsmPWFile,
+		hsmCallTimeout:  opts.HSMCallTimeout,
+		auditLogger:     opts.AuditLogger,
+		newSE:           newSE,
 		skus:            make(map[string]*skuState),
 		authCfg: &skucfg.Auth{
 			SkuAuthCfgList: config.SkuAuthCfgList,
 		},
-	}, nil
+	}
+	if opts.BudgetReloadInterval > 0 {
+		s.stopReload = make(chan struct{})
+		go s.reloadBudgetsEvery(opts.BudgetReloadInterval, s.stopReload)
+	}
+	return s, nil
+}
+
+// Close closes the HSM of every initialized SKU. The server must not be used
+// afterwards.
+func (s *server) Close() error {
+	if s.stopReload != nil {
+		close(s.stopReload)
+	}
+
+	s.muSKU.Lock()
+	defer s.muSKU.Unlock()
+
+	var errs []string
+	for name, sku := range s.skus {
+		if err := sku.seHandle.Close(); err != nil {
+			errs = append(errs, fmt.Sprintf("sku %q: %v", name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to close HSMs: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// hsmContext returns a context bounding a single HSM call issued on behalf of
+// the request with context `ctx`.
+func (s *server) hsmContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.hsmCallTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, s.hsmCallTimeout)
+}
+
+// hsmError returns the gRPC error reported to clients for a failed HSM call.
+// Timeouts and cancellations waiting for an HSM session, and requests failing
+// because the HSM is shutting down, are returned as is; all other errors are
+// reported as `codes.Internal`.
+func hsmError(err error, format string, a ...any) error {
+	switch status.Code(err) {
+	case codes.DeadlineExceeded, codes.Canceled, codes.Unavailable:
+		return err
+	}
+	return status.Errorf(codes.Internal, format, a...)
 }
 
 func (s *server) initSku(sku string) (string, error) {
@@ -192,6 +304,10 @@ func (s *server) DeriveTokens(ctx context.Context, request *pbp.DeriveTokensRequ
 		return nil, status.Errorf(codes.NotFound, "unable to find sku %q. Try calling InitSession first", request.Sku)
 	}
 
+	if err := checkIssuanceWindow(sku.config); err != nil {
+		return nil, err
+	}
+
 	sLabelHi, err := sku.config.GetAttribute(skucfg.AttrNameSeedSecHi)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "could not fetch seed label %q: %v", skucfg.AttrNameSeedSecHi, err)
@@ -270,9 +386,19 @@ func (s *server) DeriveTokens(ctx context.Context, request *pbp.DeriveTokensRequ
 	}
 
 	// Generate the symmetric keys.
-	res, err := sku.seHandle.GenerateTokens(keygenParams)
+	var res []se.TokenResult
+	err = sku.budgets.run(ctx, func(ctx context.Context) error {
+		var err error
+		hsmCtx, cancel := s.hsmContext(ctx)
+		defer cancel()
+		res, err = sku.seHandle.GenerateTokens(hsmCtx, keygenParams)
+		if err != nil {
+			return hsmError(err, "could not generate symmetric key: %s", err)
+		}
+		return nil
+	})
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "could not generate symmetric key: %s", err)
+		return nil, err
 	}
 
 	tokens := make([]*pbp.Token, len(res))
@@ -288,6 +414,20 @@ func (s *server) DeriveTokens(ctx context.Context, request *pbp.DeriveTokensRequ
 	}, nil
 }
 
+// checkIssuanceWindow verifies that the current time is within the issuance
+// windows configured for the SKU.
+func checkIssuanceWindow(cfg *skucfg.Config) error {
+	now := time.Now()
+	if err := cfg.CheckIssuanceWindow(now); err != nil {
+		log.Printf("Rejected request for sku %q at %s: %v", cfg.Sku, now.Format(time.RFC3339), err)
+		if errors.Is(err, skucfg.ErrOutsideIssuanceWindow) {
+			return status.Errorf(codes.FailedPrecondition, "%v", err)
+		}
+		return status.Errorf(codes.Internal, "unable to check issuance window: %v", err)
+	}
+	return nil
+}
+
 // ecdsaSignatureAlgorithmFromHashType returns the x509.SignatureAlgorithm
 // corresponding to the given pbcommon.HashType.
 func ecdsaSignatureAlgorithmFromHashType(h pbcommon.HashType) x509.SignatureAlgorithm {
@@ -298,6 +438,12 @@ func ecdsaSignatureAlgorithmFromHashType(h pbcommon.HashType) x509.SignatureAlgo
 		return x509.ECDSAWithSHA384
 	case pbcommon.HashType_HASH_TYPE_SHA512:
 		return x509.ECDSAWithSHA512
+	case pbcommon.HashType_HASH_TYPE_SHA3_256:
+		return se.ECDSAWithSHA3_256
+	case pbcommon.HashType_HASH_TYPE_SHA3_384:
+		return se.ECDSAWithSHA3_384
+	case pbcommon.HashType_HASH_TYPE_SHA3_512:
+		return se.ECDSAWithSHA3_512
 	default:
 		return x509.UnknownSignatureAlgorithm
 	}
@@ -318,26 +464,47 @@ func (s *server) EndorseCerts(ctx context.Context, request *pbp.EndorseCertsRequ
 		return nil, status.Errorf(codes.NotFound, "unable to find sku %q. Try calling InitSession first", request.Sku)
 	}
 
+	if err := checkIssuanceWindow(sku.config); err != nil {
+		return nil, err
+	}
+
 	var certs []*pbc.Certificate
-	for _, bundle := range request.Bundles {
-		keyLabel, err := sku.config.GetUnsafeAttribute(bundle.KeyParams.KeyLabel)
-		if err != nil {
-			return nil, status.Errorf(codes.Internal, "unable to find key label %q in SKU configuration: %v", bundle.KeyParams.KeyLabel, err)
-		}
-		switch key := bundle.KeyParams.Key.(type) {
-		case *pbc.SigningKeyParams_EcdsaParams:
-			params := se.EndorseCertParams{
-				KeyLabel:           keyLabel,
-				SignatureAlgorithm: ecdsaSignatureAlgorithmFromHashType(key.EcdsaParams.HashType),
-			}
-			cert, err := sku.seHandle.EndorseCert(bundle.Tbs, params)
+	err := sku.budgets.run(ctx, func(ctx context.Context) error {
+		reqs := make([]se.EndorseCertParamsWithTBS, 0, len(request.Bundles))
+		for _, bundle := range request.Bundles {
+			keyLabel, err := sku.config.GetUnsafeAttribute(bundle.KeyParams.KeyLabel)
 			if err != nil {
-				return nil, status.Errorf(codes.Internal, "could not endorse cert: %v", err)
+				return status.Errorf(codes.Internal, "unable to find key label %q in SKU configuration: %v", bundle.KeyParams.KeyLabel, err)
+			}
+			switch key := bundle.KeyParams.Key.(type) {
+			case *pbc.SigningKeyParams_EcdsaParams:
+				reqs = append(reqs, se.EndorseCertParamsWithTBS{
+					EndorseCertParams: se.EndorseCertParams{
+						KeyLabel:           keyLabel,
+						SignatureAlgorithm: ecdsaSignatureAlgorithmFromHashType(key.EcdsaParams.HashType),
+						SkipVerify:         sku.config.SkipCertVerification,
+					},
+					TBS: bundle.Tbs,
+				})
+			default:
+				return status.Errorf(codes.Unimplemented, "unsupported key format")
 			}
-			certs = append(certs, &pbc.Certificate{Blob: cert})
-		default:
-			return nil, status.Errorf(codes.Unimplemented, "unsupported key format")
 		}
+
+		// Endorse all the certificates with a single HSM session.
+		hsmCtx, cancel := s.hsmContext(ctx)
+		results, err := sku.seHandle.EndorseCerts(hsmCtx, reqs, true)
+		cancel()
+		if err != nil {
+			return hsmError(err, "could not endorse cert: %v", err)
+		}
+		for _, r := range results {
+			certs = append(certs, &pbc.Certificate{Blob: r.Cert})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 	return &pbp.EndorseCertsResponse{
 		Certs: certs,
@@ -355,6 +522,10 @@ func (s *server) EndorseData(ctx context.Context, request *pbs.EndorseDataReques
 		return nil, status.Errorf(codes.NotFound, "unable to find sku %q. Try calling InitSession first", request.Sku)
 	}
 
+	if err := checkIssuanceWindow(sku.config); err != nil {
+		return nil, err
+	}
+
 	// Retrieve signing key label.
 	keyLabel, err := sku.config.GetUnsafeAttribute(request.KeyParams.KeyLabel)
 	if err != nil {
@@ -369,9 +540,18 @@ func (s *server) EndorseData(ctx context.Context, request *pbs.EndorseDataReques
 			KeyLabel:           keyLabel,
 			SignatureAlgorithm: ecdsaSignatureAlgorithmFromHashType(key.EcdsaParams.HashType),
 		}
-		asn1Pubkey, asn1Sig, err = sku.seHandle.EndorseData(request.Data, params)
+		err = sku.budgets.run(ctx, func(ctx context.Context) error {
+			var err error
+			hsmCtx, cancel := s.hsmContext(ctx)
+			defer cancel()
+			asn1Pubkey, asn1Sig, err = sku.seHandle.EndorseData(hsmCtx, request.Data, params)
+			if err != nil {
+				return hsmError(err, "could not endorse data payload: %v", err)
+			}
+			return nil
+		})
 		if err != nil {
-			return nil, status.Errorf(codes.Internal, "could not endorse data payload: %v", err)
+			return nil, err
 		}
 	default:
 		return nil, status.Errorf(codes.Unimplemented, "unsupported key format")
@@ -384,18 +564,22 @@ func (s *server) EndorseData(ctx context.Context, request *pbs.EndorseDataReques
 }
 
 func (s *server) initializeSKU(skuName string) error {
+	s.muSKU.RLock()
+	_, ok := s.skus[skuName]
+	s.muSKU.RUnlock()
+	if ok {
+		return nil
+	}
+
 	s.muSKU.Lock()
 	defer s.muSKU.Unlock()
 	if _, ok := s.skus[skuName]; ok {
 		return nil
 	}
 
-	configFilename := "sku_" + skuName + ".yml"
-
-	var cfg skucfg.Config
-	err := utils.LoadConfig(s.configDir, configFilename, &cfg)
+	cfg, err := s.loadSkuConfig(skuName)
 	if err != nil {
-		return fmt.Errorf("could not load config: %v", err)
+		return err
 	}
 
 	var hsmPassword string
@@ -433,20 +617,63 @@ func (s *server) initializeSKU(skuName string) error {
 		pubKeys[i] = key.Name
 	}
 
-	log.Printf("Initializing HSM: %v", cfg)
+	// The wrapping key, if any, must satisfy the wrapping key policy enforced
+	// by the HSM.
+	var wrapKeys []string
+	if wkl, ok := cfg.Attributes[string(skucfg.AttrNameWrappingKeyLabel)]; ok {
+		wrapKeys = append(wrapKeys, wkl)
+	}
+
+	log.Printf("Initializing HSM: %v", *cfg)
+	metricsVars := new(expvar.Map).Init()
+	hsmMetrics.Set(skuName, metricsVars)
 	// Create new instance of HSM.
-	seHandle, err := se.NewHSM(se.HSMConfig{
-		SOPath:        s.hsmSOLibPath,
-		SlotID:        cfg.SlotID,
-		HSMPassword:   hsmPassword,
-		NumSessions:   cfg.NumSessions,
-		SymmetricKeys: akeys,
-		PrivateKeys:   pkeys,
-		PublicKeys:    pubKeys,
+	seHandle, err := s.newSE(se.HSMConfig{
+		SOPath:                     s.hsmSOLibPath,
+		SlotID:                     cfg.SlotID,
+		TokenLabel:                 cfg.TokenLabel,
+		FailoverSlotIDs:            cfg.FailoverSlotIDs,
+		HSMPassword:                hsmPassword,
+		NumSessions:                cfg.NumSessions,
+		MinSessions:                cfg.MinSessions,
+		MaxSessions:                cfg.MaxSessions,
+		LazySessions:               cfg.LazySessions,
+		ReadWriteSessions:          cfg.ReadWriteSessions,
+		ReservedSessions:           cfg.ReservedSessions,
+		SymmetricKeys:              akeys,
+		PrivateKeys:                pkeys,
+		PublicKeys:                 pubKeys,
+		WrappingKeys:               wrapKeys,
+		MaxClockSkew:               cfg.MaxClockSkew,
+		SessionWaitTimeout:         cfg.SessionWaitTimeout,
+		SessionHoldWarning:         cfg.SessionHoldWarning,
+		SessionHoldLimit:           cfg.SessionHoldLimit,
+		SessionHealthCheckInterval: cfg.SessionHealthCheckInterval,
+		SessionKeepaliveInterval:   cfg.SessionKeepaliveInterval,
+		Metrics:                    se.NewExpvarMetrics(metricsVars),
+		Audit:                      s.auditLogger,
+		OpenRetry: se.RetryPolicy{
+			MaxAttempts:    cfg.SessionOpenAttempts,
+			InitialBackoff: cfg.SessionOpenBackoff,
+		},
 	})
 	if err != nil {
 		return fmt.Errorf("fail to create an instance of HSM: %v", err)
 	}
+	if h, ok := seHandle.(seHealth); ok {
+		// Publish whether all HSM sessions are open, for health checks.
+		metricsVars.Set("ready", expvar.Func(func() any {
+			return h.Ready()
+		}))
+		// Publish the slots currently serving sessions, indexed by slot ID.
+		metricsVars.Set("slots_serving", expvar.Func(func() any {
+			serving := make(map[string]bool)
+			for _, slot := range h.SlotHealth() {
+				serving[fmt.Sprint(slot.SlotID)] = slot.Serving
+			}
+			return serving
+		}))
+	}
 
 	// Load all certificates referenced in the SKU configuration.
 	certs := make(map[string]*x509.Certificate)
@@ -459,9 +686,62 @@ func (s *server) initializeSKU(skuName string) error {
 	}
 
 	s.skus[skuName] = &skuState{
-		config:   &cfg,
+		config:   cfg,
 		certs:    certs,
 		seHandle: seHandle,
+		budgets:  newClientBudgets(cfg.ClientBudget),
 	}
 	return nil
 }
+
+// reloadBudgetsEvery reloads the client budgets every `interval` until `stop`
+// is closed. See `reloadBudgets`.
+func (s *server) reloadBudgetsEvery(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			s.reloadBudgets()
+		}
+	}
+}
+
+// reloadBudgets reloads the client budgets of the initialized SKUs from their
+// configuration files. Client budgets are the only settings reloaded for an
+// initialized SKU. A SKU keeps its current budgets if its configuration fails
+// to load.
+func (s *server) reloadBudgets() {
+	s.muSKU.RLock()
+	skus := make(map[string]*skuState, len(s.skus))
+	for name, sku := range s.skus {
+		skus[name] = sku
+	}
+	s.muSKU.RUnlock()
+
+	for name, sku := range skus {
+		cfg, err := s.loadSkuConfig(name)
+		if err != nil {
+			log.Printf("Failed to reload the client budgets of sku %q, keeping the current ones: %v", name, err)
+			continue
+		}
+		sku.budgets.setLimits(cfg.ClientBudget)
+	}
+}
+
+// loadSkuConfig loads and validates the configuration file of `skuName`.
+func (s *server) loadSkuConfig(skuName string) (*skucfg.Config, error) {
+	configFilename := "sku_" + skuName + ".yml"
+
+	var cfg skucfg.Config
+	err := utils.LoadConfig(s.configDir, configFilename, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("could not load config: %v", err)
+	}
+	if err := cfg.ValidateIssuanceWindows(); err != nil {
+		return nil, fmt.Errorf("invalid config: %v", err)
+	}
+	return &cfg, nil
+}
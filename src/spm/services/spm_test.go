@@ -0,0 +1,161 @@
+// Copyright lowRISC contributors (OpenTitan project).
+// Licensed under the Apache License, Version 2.0, see LICENSE for details.
+// SPDX-License-Identifier: Apache-2.0
+
+package spm
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/lowRISC/opentitan-provisioning/src/spm/services/se"
+	"github.com/lowRISC/opentitan-provisioning/src/spm/services/skucfg"
+
+	pbp "github.com/lowRISC/opentitan-provisioning/src/pa/proto/pa_go_pb"
+	pbc "github.com/lowRISC/opentitan-provisioning/src/proto/crypto/cert_go_pb"
+	pbcommon "github.com/lowRISC/opentitan-provisioning/src/proto/crypto/common_go_pb"
+	pbe "github.com/lowRISC/opentitan-provisioning/src/proto/crypto/ecdsa_go_pb"
+)
+
+func TestHSMError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want codes.Code
+	}{
+		{"deadline", status.Error(codes.DeadlineExceeded, "no HSM session available"), codes.DeadlineExceeded},
+		{"canceled", status.Error(codes.Canceled, "no HSM session available"), codes.Canceled},
+		{"closed", status.Error(codes.Unavailable, "HSM session pool is closed"), codes.Unavailable},
+		{"other", fmt.Errorf("sign failed"), codes.Internal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := status.Code(hsmError(tt.err, "could not sign: %v", tt.err)); got != tt.want {
+				t.Errorf("hsmError() code = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEndorseCertsFakeHSM(t *testing.T) {
+	hsm, err := se.NewFakeHSM(se.HSMConfig{PrivateKeys: []string{"KCAPriv"}})
+	if err != nil {
+		t.Fatalf("NewFakeHSM() failed: %v", err)
+	}
+	s := &server{
+		skus: map[string]*skuState{
+			"sival": {
+				config: &skucfg.Config{
+					Attributes: map[string]string{"DiceKeyLabel": "KCAPriv"},
+				},
+				seHandle: hsm,
+				budgets:  newClientBudgets(skucfg.ClientBudget{}),
+			},
+		},
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber:       big.NewInt(1),
+		Subject:            pkix.Name{CommonName: "device"},
+		NotBefore:          time.Now(),
+		NotAfter:           time.Now().Add(time.Hour),
+		SignatureAlgorithm: x509.ECDSAWithSHA256,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	swCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+
+	resp, err := s.EndorseCerts(context.Background(), &pbp.EndorseCertsRequest{
+		Sku: "sival",
+		Bundles: []*pbp.EndorseCertBundle{{
+			KeyParams: &pbc.SigningKeyParams{
+				KeyLabel: "DiceKeyLabel",
+				Key: &pbc.SigningKeyParams_EcdsaParams{
+					EcdsaParams: &pbe.EcdsaParams{HashType: pbcommon.HashType_HASH_TYPE_SHA256},
+				},
+			},
+			Tbs: swCert.RawTBSCertificate,
+		}},
+	})
+	if err != nil {
+		t.Fatalf("EndorseCerts() failed: %v", err)
+	}
+	if len(resp.Certs) != 1 {
+		t.Fatalf("EndorseCerts() returned %d certificates, want 1", len(resp.Certs))
+	}
+	cert, err := x509.ParseCertificate(resp.Certs[0].Blob)
+	if err != nil {
+		t.Fatalf("failed to parse endorsed certificate: %v", err)
+	}
+	pub, err := hsm.ExportPublicKey(context.Background(), "KCAPriv")
+	if err != nil {
+		t.Fatalf("ExportPublicKey() failed: %v", err)
+	}
+	if err := (&x509.Certificate{PublicKey: pub}).CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature); err != nil {
+		t.Errorf("endorsed certificate does not verify: %v", err)
+	}
+}
+
+func TestReloadBudgets(t *testing.T) {
+	dir := t.TempDir()
+	writeConfig := func(data string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, "sku_sival.yml"), []byte(data), 0o644); err != nil {
+			t.Fatalf("failed to write config: %v", err)
+		}
+	}
+	budgets := newClientBudgets(skucfg.ClientBudget{MaxRequests: 1})
+	s := &server{
+		configDir: dir,
+		skus: map[string]*skuState{
+			"sival": {
+				config:  &skucfg.Config{},
+				budgets: budgets,
+			},
+		},
+	}
+
+	writeConfig("clientBudget:\n  maxRequests: 5\n")
+	s.reloadBudgets()
+	if got := budgets.limits.MaxRequests; got != 5 {
+		t.Errorf("MaxRequests after reload = %d, want 5", got)
+	}
+
+	// An invalid configuration keeps the last good budgets.
+	writeConfig("clientBudget: [")
+	s.reloadBudgets()
+	if got := budgets.limits.MaxRequests; got != 5 {
+		t.Errorf("MaxRequests after failed reload = %d, want 5", got)
+	}
+
+	// Initializing an already initialized SKU does not reload its config.
+	writeConfig("clientBudget:\n  maxRequests: 7\n")
+	if err := s.initializeSKU("sival"); err != nil {
+		t.Fatalf("initializeSKU() failed: %v", err)
+	}
+	if got := budgets.limits.MaxRequests; got != 5 {
+		t.Errorf("MaxRequests after initializeSKU() = %d, want 5", got)
+	}
+}
@@ -8,12 +8,18 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"google.golang.org/grpc"
 
 	pbs "github.com/lowRISC/opentitan-provisioning/src/spm/proto/spm_go_pb"
+	"github.com/lowRISC/opentitan-provisioning/src/spm/services/se"
 	"github.com/lowRISC/opentitan-provisioning/src/spm/services/spm"
 	"github.com/lowRISC/opentitan-provisioning/src/transport/grpconn"
 	"github.com/lowRISC/opentitan-provisioning/src/utils"
@@ -30,34 +36,79 @@ var (
 	spmAuthConfig = flag.String("spm_auth_config", "", "File path to the SPM Auth configuration file. Relative to the SPM configuration directory.")
 	spmConfigDir  = flag.String("spm_config_dir", "", "Path to the configuration directory.")
 	version       = flag.Bool("version", false, "Print version information and exit")
+	hsmTimeout    = flag.Duration("hsm_call_timeout", 0, "Maximum time a request waits for an HSM session; zero waits for the request deadline")
+	auditLog      = flag.Bool("audit_log", false, "Log an audit record of every HSM certificate endorsement and key generation; optional")
+	budgetReload  = flag.Duration("budget_reload_interval", time.Minute, "Period at which the client budgets are reloaded from the SKU configuration files; zero disables reloading")
+	stopTimeout   = flag.Duration("shutdown_timeout", 30*time.Second, "Time given to in-flight RPCs to complete on shutdown before they are cancelled")
+
+	keepaliveTime        = flag.Duration("grpc_keepalive_time", grpconn.DefaultServerConfig().KeepaliveTime, "Idle time after which the server pings clients")
+	keepaliveTimeout     = flag.Duration("grpc_keepalive_timeout", grpconn.DefaultServerConfig().KeepaliveTimeout, "Time to wait for a keepalive ping ack before closing the connection")
+	minPingInterval      = flag.Duration("grpc_min_ping_interval", grpconn.DefaultServerConfig().MinPingInterval, "Minimum interval allowed between client keepalive pings")
+	maxConcurrentStreams = flag.Uint("grpc_max_concurrent_streams", uint(grpconn.DefaultServerConfig().MaxConcurrentStreams), "Maximum number of concurrent streams per connection; zero is unlimited")
+	maxConnectionAge     = flag.Duration("grpc_max_connection_age", grpconn.DefaultServerConfig().MaxConnectionAge, "Maximum connection lifetime; zero is unlimited")
+	maxConnectionGrace   = flag.Duration("grpc_max_connection_age_grace", grpconn.DefaultServerConfig().MaxConnectionAgeGrace, "Time given to in-flight RPCs after the maximum connection age is reached")
 )
 
-func startSPMServer() (*grpc.Server, error) {
+// startSPMServer returns the SPM gRPC server and a closer releasing the HSM
+// resources held by the SPM service.
+func startSPMServer() (*grpc.Server, io.Closer, error) {
 	opts := []grpc.ServerOption{}
 	if *enableTLS {
 		credentials, err := grpconn.LoadServerCredentials(*caRootCerts, *serviceCert, *serviceKey)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		opts = append(opts, grpc.Creds(credentials))
 		opts = append(opts, grpc.UnaryInterceptor(grpconn.CheckEndpointInterceptor))
 	}
 
+	var auditLogger se.AuditLogger
+	if *auditLog {
+		auditLogger = se.NewLogAuditLogger(nil)
+	}
+
 	spmServer, err := spm.NewSpmServer(spm.Options{
-		HSMSOLibPath:      *hsmSOPath,
-		SPMAuthConfigFile: *spmAuthConfig,
-		SPMConfigDir:      *spmConfigDir,
-		HsmPWFile:         *hsmPWFile,
+		HSMSOLibPath:         *hsmSOPath,
+		SPMAuthConfigFile:    *spmAuthConfig,
+		SPMConfigDir:         *spmConfigDir,
+		HsmPWFile:            *hsmPWFile,
+		HSMCallTimeout:       *hsmTimeout,
+		AuditLogger:          auditLogger,
+		BudgetReloadInterval: *budgetReload,
 	})
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	// Create a new gRPC server.
-	server := grpc.NewServer(opts...)
+	server := grpconn.NewServer(grpconn.ServerConfig{
+		KeepaliveTime:         *keepaliveTime,
+		KeepaliveTimeout:      *keepaliveTimeout,
+		MinPingInterval:       *minPingInterval,
+		MaxConcurrentStreams:  uint32(*maxConcurrentStreams),
+		MaxConnectionAge:      *maxConnectionAge,
+		MaxConnectionAgeGrace: *maxConnectionGrace,
+	}, opts...)
 	// Register the RegisterSpmServiceServer with the gRPC server.
 	pbs.RegisterSpmServiceServer(server, spmServer)
-	return server, nil
+	return server, spmServer, nil
+}
+
+// stopServer stops `server` gracefully, waiting for the in-flight RPCs to
+// complete. The remaining RPCs are cancelled after `timeout`, so that a stuck
+// HSM call does not block the shutdown.
+func stopServer(server *grpc.Server, timeout time.Duration) {
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(timeout):
+		log.Printf("In-flight RPCs did not complete within %v, stopping SPM server", timeout)
+		server.Stop()
+	}
 }
 
 func main() {
@@ -77,14 +128,33 @@ func main() {
 	}
 
 	// Start the SPM gRPC server.
-	server, err := startSPMServer()
+	server, spmCloser, err := startSPMServer()
 	if err != nil {
 		log.Fatalf("failed to start SPM server: %v", err)
 	}
 	log.Printf("SPM server is now listening on port: %d", *port)
 
+	// Stop accepting RPCs on SIGTERM, so that in-flight requests complete
+	// before the HSM sessions are closed.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+	stopped := make(chan struct{})
+	go func() {
+		sig := <-sigs
+		log.Printf("Received %v, shutting down SPM server", sig)
+		stopServer(server, *stopTimeout)
+		close(stopped)
+	}()
+
 	// Block and serve incoming RPCs on the listener.
 	if err := server.Serve(listener); err != nil {
 		log.Fatalf("SPM server failed to start: %v", err)
 	}
+	// Serve returns as soon as the shutdown starts, wait for the in-flight
+	// RPCs.
+	<-stopped
+	if err := spmCloser.Close(); err != nil {
+		log.Fatalf("failed to close SPM server: %v", err)
+	}
+	log.Printf("SPM server stopped")
 }
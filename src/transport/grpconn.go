@@ -12,16 +12,94 @@ import (
 	"fmt"
 	"net"
 	"strings"
+	"time"
 
 	"github.com/lowRISC/opentitan-provisioning/src/utils"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/peer"
 )
 
-// loadCertPool returns a certificate pool initialized with the CA certificates
+// ServerConfig contains the connection management parameters of a gRPC
+// server. Use `DefaultServerConfig` to get a configuration with sane defaults.
+//
+// Interaction with load balancers: L4 load balancers balance connections, not
+// requests, so long-lived station connections pin their load to a single
+// server instance. `MaxConnectionAge` forces clients to reconnect periodically,
+// which lets the load balancer spread connections across new instances.
+// `KeepaliveTime` must be shorter than the idle timeout of any load balancer or
+// NAT between clients and the server, otherwise idle connections are silently
+// dropped. Clients must not ping more often than `MinPingInterval`, or the
+// server closes the connection with a GOAWAY "too_many_pings" error.
+type ServerConfig struct {
+	// KeepaliveTime is the idle time after which the server pings the client
+	// to check if the connection is still alive.
+	KeepaliveTime time.Duration
+
+	// KeepaliveTimeout is the time the server waits for a ping ack before
+	// closing the connection.
+	KeepaliveTimeout time.Duration
+
+	// MinPingInterval is the minimum interval allowed between client pings.
+	MinPingInterval time.Duration
+
+	// MaxConcurrentStreams is the maximum number of concurrent streams per
+	// client connection. Unlimited if set to zero.
+	MaxConcurrentStreams uint32
+
+	// MaxConnectionAge is the maximum lifetime of a connection. Unlimited if
+	// set to zero.
+	MaxConnectionAge time.Duration
+
+	// MaxConnectionAgeGrace is the time given to in-flight RPCs to complete
+	// after `MaxConnectionAge` is reached.
+	MaxConnectionAgeGrace time.Duration
+}
+
+// DefaultServerConfig returns the default gRPC server connection parameters.
+func DefaultServerConfig() ServerConfig {
+	return ServerConfig{
+		KeepaliveTime:         2 * time.Minute,
+		KeepaliveTimeout:      20 * time.Second,
+		MinPingInterval:       30 * time.Second,
+		MaxConcurrentStreams:  1000,
+		MaxConnectionAge:      30 * time.Minute,
+		MaxConnectionAgeGrace: time.Minute,
+	}
+}
+
+// ServerOptions returns the gRPC server options implementing the `c`
+// configuration.
+func (c ServerConfig) ServerOptions() []grpc.ServerOption {
+	opts := []grpc.ServerOption{
+		grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:                  c.KeepaliveTime,
+			Timeout:               c.KeepaliveTimeout,
+			MaxConnectionAge:      c.MaxConnectionAge,
+			MaxConnectionAgeGrace: c.MaxConnectionAgeGrace,
+		}),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime: c.MinPingInterval,
+			// Stations may keep connections open between provisioning runs.
+			PermitWithoutStream: true,
+		}),
+	}
+	if c.MaxConcurrentStreams > 0 {
+		opts = append(opts, grpc.MaxConcurrentStreams(c.MaxConcurrentStreams))
+	}
+	return opts
+}
+
+// NewServer creates a gRPC server configured with the connection parameters
+// in `cfg`, followed by any additional `opts`.
+func NewServer(cfg ServerConfig, opts ...grpc.ServerOption) *grpc.Server {
+	return grpc.NewServer(append(cfg.ServerOptions(), opts...)...)
+}
+
+// LoadCertPool returns a certificate pool initialized with the CA certificates
 // included in the `rootFilename` PEM file path.
-func loadCertPool(rootsFilename string) (*x509.CertPool, error) {
+func LoadCertPool(rootsFilename string) (*x509.CertPool, error) {
 	roots, err := utils.ReadFile(rootsFilename)
 	if err != nil {
 		return nil, err
@@ -38,7 +116,7 @@ func loadCertPool(rootsFilename string) (*x509.CertPool, error) {
 // `rootsFilename` should point to the client CA root certificates in PEM
 // format.
 func LoadServerCredentials(rootsFilename, certFilename, keyFilename string) (credentials.TransportCredentials, error) {
-	certPool, err := loadCertPool(rootsFilename)
+	certPool, err := LoadCertPool(rootsFilename)
 	if err != nil {
 		return nil, err
 	}
@@ -60,7 +138,7 @@ func LoadServerCredentials(rootsFilename, certFilename, keyFilename string) (cre
 // `rootsFilename` should point to the server CA root certificates in PEM
 // format.
 func LoadClientCredentials(rootsFilename, certFilename, keyFilename string) (credentials.TransportCredentials, error) {
-	certPool, err := loadCertPool(rootsFilename)
+	certPool, err := LoadCertPool(rootsFilename)
 	if err != nil {
 		return nil, err
 	}
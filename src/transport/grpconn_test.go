@@ -0,0 +1,55 @@
+// Copyright lowRISC contributors (OpenTitan project).
+// Licensed under the Apache License, Version 2.0, see LICENSE for details.
+// SPDX-License-Identifier: Apache-2.0
+
+package grpconn
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestNewServerMaxConnectionAge(t *testing.T) {
+	cfg := DefaultServerConfig()
+	cfg.MaxConnectionAge = 100 * time.Millisecond
+	cfg.MaxConnectionAgeGrace = 100 * time.Millisecond
+
+	listener := bufconn.Listen(1024 * 1024)
+	server := NewServer(cfg)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, "", grpc.WithInsecure(), grpc.WithBlock(),
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+			return listener.Dial()
+		}))
+	if err != nil {
+		t.Fatalf("failed to connect to test server: %v", err)
+	}
+	defer conn.Close()
+
+	// The server closes the connection once it exceeds its maximum age,
+	// which moves the client out of the READY state.
+	if !conn.WaitForStateChange(ctx, connectivity.Ready) {
+		t.Fatalf("connection still %v after %v, expected MaxConnectionAge to close it", conn.GetState(), 5*time.Second)
+	}
+}
+
+func TestServerOptions(t *testing.T) {
+	cfg := DefaultServerConfig()
+	if got := len(cfg.ServerOptions()); got != 3 {
+		t.Errorf("ServerOptions() returned %d options, want 3", got)
+	}
+	cfg.MaxConcurrentStreams = 0
+	if got := len(cfg.ServerOptions()); got != 2 {
+		t.Errorf("ServerOptions() with unlimited streams returned %d options, want 2", got)
+	}
+}